@@ -0,0 +1,34 @@
+package api
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestLogger attaches a logger carrying the request ID, method, route, client IP and,
+// when tracing is enabled, the trace ID to the request context, so the log lines of the
+// handlers and services can be correlated. It must run after the RequestID and tracing middlewares.
+func RequestLogger() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			lc := logger.With().
+				Str("request_id", c.Response().Header().Get(echo.HeaderXRequestID)).
+				Str("method", req.Method).
+				Str("route", c.Path()).
+				Str("remote_ip", c.RealIP())
+			if sc := trace.SpanContextFromContext(req.Context()); sc.IsValid() {
+				lc = lc.Str("trace_id", sc.TraceID().String())
+			}
+			c.SetRequest(req.WithContext(logger.WithContext(req.Context(), lc.Logger())))
+			return next(c)
+		}
+	}
+}
+
+// reqLogger returns the logger of the request, see RequestLogger.
+func reqLogger(c echo.Context) *zerolog.Logger {
+	return logger.Ctx(c.Request().Context())
+}
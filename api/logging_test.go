@@ -0,0 +1,55 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger.InitWithOptions(logger.LevelDebug, &buf, logger.Options{Format: logger.FormatJSON, Redaction: logger.DefaultRedaction()})
+	t.Cleanup(func() { logger.InitWithWriter(logger.LevelInfo, &bytes.Buffer{}) })
+
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.Use(RequestLogger())
+	h := handler{svc: service.NewMessageService(nil, nil, "")}
+	e.POST("/api/client/fetch_messages", h.fetchMessages)
+
+	body := `{"username":"alice","password":"hunter2","last_id":""}`
+	req := httptest.NewRequest(http.MethodPost, "/api/client/fetch_messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	buf.Reset()
+	e.ServeHTTP(rec, req)
+	requestID := rec.Header().Get(echo.HeaderXRequestID)
+	require.NotEmpty(t, requestID)
+
+	// Every line of the request, the service ones included, carries its fields.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.NotEmpty(t, lines)
+	var sawService bool
+	for _, l := range lines {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(l), &entry), l)
+		assert.Equal(t, requestID, entry["request_id"], l)
+		assert.Equal(t, "/api/client/fetch_messages", entry["route"], l)
+		if entry["message"] == "fetch messages request received" {
+			sawService = true
+			assert.Equal(t, "alice", entry["user"])
+		}
+	}
+	assert.True(t, sawService)
+	assert.NotContains(t, buf.String(), "hunter2")
+}
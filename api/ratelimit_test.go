@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/ratelimit"
+	"github.com/nethesis/matrix2acrobits/service"
+	"github.com/nethesis/matrix2acrobits/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fetchWithoutPassword(e *echo.Echo, username, remoteAddr string, host ...string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.FetchMessagesRequest{Username: username})
+	req := httptest.NewRequest(http.MethodPost, "/api/client/fetch_messages", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = remoteAddr
+	if len(host) > 0 {
+		req.Host = host[0]
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func fetchWithPassword(e *echo.Echo, username, password, remoteAddr string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.FetchMessagesRequest{Username: username, Password: password})
+	req := httptest.NewRequest(http.MethodPost, "/api/client/fetch_messages", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestClientEndpoints_BruteForceLockout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(backend.Close)
+
+	tn := newTestTenant(t, "acme", nil, "")
+	cfg := service.ConfigFromEnv("")
+	cfg.ExtAuthURL = backend.URL
+	svc, err := service.NewMessageServiceWithConfig(nil, tn.PushTokenDB, cfg)
+	require.NoError(t, err)
+	tn.MessageService = svc
+	tn.Guard = ratelimit.NewGuard(
+		ratelimit.Config{LockoutThreshold: 2, LockoutBase: time.Minute},
+		ratelimit.Config{LockoutThreshold: 10},
+	)
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{tn})
+
+	// Requests refused before reaching the auth backend do not count.
+	for range 3 {
+		assert.Equal(t, http.StatusUnauthorized, fetchWithoutPassword(e, "201", "192.0.2.1:1000").Code)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, fetchWithPassword(e, "201", "guess1", "192.0.2.1:1000").Code)
+	assert.Equal(t, http.StatusUnauthorized, fetchWithPassword(e, " 201", "guess2", "192.0.2.1:1000").Code)
+
+	// The username is locked out at the client IP sending the failures only.
+	rec := fetchWithPassword(e, "201", "guess3", "192.0.2.1:1000")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusUnauthorized, fetchWithPassword(e, "201", "guess3", "192.0.2.2:1000").Code)
+
+	// Other usernames are not affected.
+	assert.Equal(t, http.StatusUnauthorized, fetchWithPassword(e, "202", "guess1", "192.0.2.1:1000").Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/internal/rate_limits", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set(adminTokenHeader, tn.AdminToken)
+	statsRec := httptest.NewRecorder()
+	e.ServeHTTP(statsRec, req)
+	require.Equal(t, http.StatusOK, statsRec.Code)
+
+	var stats ratelimit.GuardStats
+	require.NoError(t, json.Unmarshal(statsRec.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(4), stats.User.AuthFailures)
+	assert.Equal(t, uint64(1), stats.User.Lockouts)
+	assert.Equal(t, uint64(1), stats.User.LockedOut)
+	assert.Equal(t, 1, stats.User.LockedKeys)
+}
+
+func TestClientEndpoints_RateLimitPerIP(t *testing.T) {
+	tn := newTestTenant(t, "acme", nil, "")
+	tn.Guard = ratelimit.NewGuard(ratelimit.Config{}, ratelimit.Config{RPS: 0.001, Burst: 1})
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{tn})
+
+	assert.Equal(t, http.StatusUnauthorized, fetchWithoutPassword(e, "201", "192.0.2.1:1000").Code)
+
+	rec := fetchWithoutPassword(e, "202", "192.0.2.1:1000")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusUnauthorized, fetchWithoutPassword(e, "202", "192.0.2.2:1000").Code)
+}
+
+func TestClientEndpoints_AuthBackendDownDoesNotLockOut(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+
+	tn := newTestTenant(t, "acme", nil, "")
+	cfg := service.ConfigFromEnv("")
+	cfg.ExtAuthURL = backend.URL
+	svc, err := service.NewMessageServiceWithConfig(nil, tn.PushTokenDB, cfg)
+	require.NoError(t, err)
+	tn.MessageService = svc
+	tn.Guard = ratelimit.NewGuard(
+		ratelimit.Config{LockoutThreshold: 2, LockoutBase: time.Minute},
+		ratelimit.Config{LockoutThreshold: 10},
+	)
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{tn})
+
+	for range 3 {
+		body, _ := json.Marshal(models.FetchMessagesRequest{Username: "201", Password: "s3cret"})
+		req := httptest.NewRequest(http.MethodPost, "/api/client/fetch_messages", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.1:1000"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	}
+	assert.Zero(t, tn.Guard.Stats().User.AuthFailures)
+}
@@ -1,99 +1,366 @@
 package api
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/health"
 	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/metrics"
 	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/ratelimit"
 	"github.com/nethesis/matrix2acrobits/service"
+	"github.com/nethesis/matrix2acrobits/tenant"
+	"maunium.net/go/mautrix/event"
 )
 
 const adminTokenHeader = "X-Super-Admin-Token"
 
+// router is the subset of *echo.Echo and *echo.Group used to register endpoints.
+type router interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	PUT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
 // RegisterRoutes wires API endpoints to Echo handlers.
 func RegisterRoutes(e *echo.Echo, svc *service.MessageService, pushSvc *service.PushService, adminToken string, pushTokenDB interface{}) {
 	h := handler{svc: svc, pushSvc: pushSvc, adminToken: adminToken, pushTokenDB: pushTokenDB}
-	e.POST("/api/client/send_message", h.sendMessage)
-	e.POST("/api/client/fetch_messages", h.fetchMessages)
-	e.POST("/api/client/push_token_report", h.pushTokenReport)
-	e.GET("/api/internal/push_tokens", h.getPushTokens)
-	e.DELETE("/api/internal/push_tokens", h.resetPushTokens)
+	e.GET("/health", liveness)
+	e.GET("/health/live", liveness)
+	e.GET("/metrics", metricsHandler, metricsAccess(metricsSourcesFromEnv()))
+	h.register(e)
+}
+
+// RegisterTenantRoutes wires the API endpoints of every tenant.
+// A tenant with hosts is served only on those Host headers, optionally below its path prefix;
+// a tenant with only a path prefix is served below that prefix on any host;
+// a tenant with neither is served at the root.
+func RegisterTenantRoutes(e *echo.Echo, tenants []*tenant.Tenant) {
+	e.GET("/health", liveness)
+	e.GET("/health/live", liveness)
+	e.GET("/health/ready", readiness(tenants))
+	// The metrics of every tenant are served only by the default router, never on a tenant host.
+	e.GET("/metrics", metricsHandler, metricsAccess(metricsSourcesFromEnv()))
+
+	// Echo replaces the router of a host each time Host is called, so tenants sharing a host
+	// below different path prefixes register on the same group.
+	hostGroups := make(map[string]*echo.Group)
+	hostTenants := make(map[string][]*tenant.Tenant)
+	for _, t := range tenants {
+		for _, host := range t.Hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if hostGroups[host] == nil {
+				hostGroups[host] = e.Host(host)
+			}
+			hostTenants[host] = append(hostTenants[host], t)
+		}
+	}
+	for host, hg := range hostGroups {
+		// Host routers do not fall back to the default router, so health must be registered again.
+		hg.GET("/health", liveness)
+		hg.GET("/health/live", liveness)
+		hg.GET("/health/ready", readiness(hostTenants[host]))
+	}
+
+	// Handlers of the tenants served at the root of any host ("") or of a host, with a flag set
+	// when one of them is selected by path prefix and needs the push gateway dispatcher.
+	scopeHandlers := make(map[string][]handler)
+	scopePrefixed := make(map[string]bool)
+	for _, t := range tenants {
+		h := handler{
+			svc:         t.MessageService,
+			pushSvc:     t.PushService,
+			adminToken:  t.AdminToken,
+			hsToken:     t.HsToken,
+			pushTokenDB: t.PushTokenDB,
+			guard:       t.Guard,
+			metrics:     metrics.Tenant(t.Name),
+		}
+		if len(t.Hosts) == 0 {
+			if t.PathPrefix != "" {
+				g := e.Group(t.PathPrefix)
+				g.GET("/health/ready", readiness([]*tenant.Tenant{t}))
+				h.register(g)
+			} else {
+				h.register(e)
+			}
+			scopeHandlers[""] = append(scopeHandlers[""], h)
+			scopePrefixed[""] = scopePrefixed[""] || t.PathPrefix != ""
+			continue
+		}
+		for _, host := range t.Hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			hg := hostGroups[host]
+			if t.PathPrefix == "" {
+				h.register(hg)
+			} else {
+				g := hg.Group(t.PathPrefix)
+				g.GET("/health/ready", readiness([]*tenant.Tenant{t}))
+				h.register(g)
+			}
+			scopeHandlers[host] = append(scopeHandlers[host], h)
+			scopePrefixed[host] = scopePrefixed[host] || t.PathPrefix != ""
+		}
+		logger.Debug().Str("tenant", t.Name).Strs("hosts", t.Hosts).Str("path_prefix", t.PathPrefix).Msg("tenant routes registered")
+	}
+
+	// Registered last, the dispatcher replaces the push gateway of a tenant served at the root.
+	for scope, handlers := range scopeHandlers {
+		if !scopePrefixed[scope] {
+			continue
+		}
+		if scope == "" {
+			e.POST("/_matrix/push/v1/notify", pushDispatcher(handlers))
+		} else {
+			hostGroups[scope].POST("/_matrix/push/v1/notify", pushDispatcher(handlers))
+		}
+	}
+}
+
+func (h handler) register(r router) {
+	r.POST("/api/client/send_message", h.sendMessage)
+	r.POST("/api/client/fetch_messages", h.fetchMessages)
+	r.POST("/api/client/mark_read", h.markRead)
+	r.POST("/api/client/push_token_report", h.pushTokenReport)
+	r.GET("/api/client/media/:server/:mediaId", h.media)
+	r.GET("/api/internal/push_tokens", h.getPushTokens)
+	r.DELETE("/api/internal/push_tokens", h.resetPushTokens)
+	r.GET("/api/internal/rate_limits", h.getRateLimitStats)
+	r.GET("/api/internal/quiet_hours", h.listQuietHours)
+	r.PUT("/api/internal/quiet_hours", h.setQuietHours)
+	r.DELETE("/api/internal/quiet_hours/:user", h.deleteQuietHours)
 
 	// Matrix Push Gateway API
-	e.POST("/_matrix/push/v1/notify", h.matrixPushNotify)
+	r.POST("/_matrix/push/v1/notify", h.matrixPushNotify)
 	// Matrix Application Service transactions (push events to AS)
-	e.PUT("/_matrix/app/v1/transactions/:txnId", h.matrixAppTransaction)
+	r.PUT("/_matrix/app/v1/transactions/:txnId", h.matrixAppTransaction)
+}
+
+// liveness is the liveness probe: it only proves the process serves requests.
+func liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readiness returns the readiness probe of tenants: 200 while no critical dependency check
+// fails, 503 otherwise. Check names are prefixed with the tenant name. The probe is public, so
+// it answers only with the status of each check; the errors of the failing ones are logged.
+func readiness(tenants []*tenant.Tenant) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reports := make(map[string]health.Report, len(tenants))
+		for _, t := range tenants {
+			if t.Health != nil {
+				reports[t.Name] = t.Health.Report(c.Request().Context())
+			}
+		}
+		report := health.Merge(reports)
+		for name, res := range report.Checks {
+			if res.Status != health.StatusOK {
+				logger.Warn().Str("endpoint", "readiness").Str("check", name).Bool("critical", res.Critical).Str("error", res.Error).Msg("readiness check failing")
+			}
+		}
+		if !report.Ready() {
+			logger.Warn().Str("endpoint", "readiness").Str("status", report.Status).Msg("readiness check failed")
+			return c.JSON(http.StatusServiceUnavailable, report.Summary())
+		}
+		return c.JSON(http.StatusOK, report.Summary())
+	}
+}
+
+var metricsHandler = echo.WrapHandler(metrics.Handler())
+
+// metricsSourcesFromEnv returns the addresses of METRICS_ALLOWED_SOURCES. An invalid list is
+// logged and ignored, leaving the metrics to localhost.
+func metricsSourcesFromEnv() []netip.Prefix {
+	sources, err := service.ParseSources(os.Getenv("METRICS_ALLOWED_SOURCES"))
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid METRICS_ALLOWED_SOURCES, metrics only available from localhost")
+		return nil
+	}
+	return sources
+}
+
+// metricsAccess serves the metrics only to localhost and to sources: they reveal the tenants,
+// their traffic and their errors.
+func metricsAccess(sources []netip.Prefix) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			addr, err := netip.ParseAddr(c.RealIP())
+			if err == nil {
+				addr = addr.Unmap()
+				if addr.IsLoopback() {
+					return next(c)
+				}
+				for _, p := range sources {
+					if p.Contains(addr) {
+						return next(c)
+					}
+				}
+			}
+			logger.Warn().Str("endpoint", "metrics").Str("ip", c.RealIP()).Msg("metrics request from a source not allowed")
+			return echo.NewHTTPError(http.StatusForbidden, "metrics only available from localhost or METRICS_ALLOWED_SOURCES")
+		}
+	}
+}
+
+// observeClientRequest records the duration and outcome of a client API request; it is deferred
+// with a pointer to the handler's result so the final error is seen.
+func (h handler) observeClientRequest(endpoint string, start time.Time, err *error) {
+	h.metrics.ObserveClientRequest(endpoint, requestOutcome(*err), start)
+}
+
+func requestOutcome(err error) string {
+	if err == nil {
+		return metrics.OutcomeOK
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		switch he.Code {
+		case http.StatusBadRequest:
+			return "bad_request"
+		case http.StatusUnauthorized:
+			return "unauthorized"
+		case http.StatusNotFound:
+			return "not_found"
+		case http.StatusTooManyRequests:
+			return "rate_limited"
+		}
+	}
+	return metrics.OutcomeError
 }
 
 type handler struct {
 	svc         *service.MessageService
 	pushSvc     *service.PushService
 	adminToken  string
+	hsToken     string
 	pushTokenDB interface{}
+	guard       *ratelimit.Guard
+	metrics     metrics.Tenant
 }
 
-func (h handler) sendMessage(c echo.Context) error {
+func (h handler) sendMessage(c echo.Context) (err error) {
+	defer h.observeClientRequest("send_message", time.Now(), &err)
+
 	var req models.SendMessageRequest
 	if err := c.Bind(&req); err != nil {
-		logger.Warn().Str("endpoint", "send_message").Err(err).Msg("invalid request payload")
+		reqLogger(c).Warn().Str("endpoint", "send_message").Err(err).Msg("invalid request payload")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
 
-	logger.Debug().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Msg("processing send message request")
-	logger.Debug().Str("endpoint", "send_message").Str("raw_from", req.From).Str("raw_to", req.To).Msg("raw identifiers for recipient resolution")
+	logger.AddStr(c.Request().Context(), "user", req.From)
+	if err := h.checkRateLimit(c, "send_message", req.From); err != nil {
+		return err
+	}
+
+	reqLogger(c).Debug().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Msg("processing send message request")
+	reqLogger(c).Debug().Str("endpoint", "send_message").Str("raw_from", req.From).Str("raw_to", req.To).Msg("raw identifiers for recipient resolution")
 
 	resp, err := h.svc.SendMessage(c.Request().Context(), &req)
+	h.recordAuthResult(c, req.From, err)
 	if err != nil {
-		logger.Error().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Err(err).Msg("failed to send message")
+		reqLogger(c).Error().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Err(err).Msg("failed to send message")
 		// Add extra context to help debugging recipient resolution
-		logger.Debug().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Msg("send_message handler returning error to client; check mapping store and AS configuration")
-		return mapServiceError(err)
+		reqLogger(c).Debug().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Msg("send_message handler returning error to client; check mapping store and AS configuration")
+		return mapServiceError(c, err)
 	}
 
-	logger.Info().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Str("message_id", resp.ID).Msg("message sent successfully")
+	reqLogger(c).Info().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Str("message_id", resp.ID).Msg("message sent successfully")
 	return c.JSON(http.StatusOK, resp)
 }
 
-func (h handler) fetchMessages(c echo.Context) error {
+func (h handler) fetchMessages(c echo.Context) (err error) {
+	defer h.observeClientRequest("fetch_messages", time.Now(), &err)
+
 	var req models.FetchMessagesRequest
 	if err := c.Bind(&req); err != nil {
-		logger.Warn().Str("endpoint", "fetch_messages").Err(err).Msg("invalid request payload")
+		reqLogger(c).Warn().Str("endpoint", "fetch_messages").Err(err).Msg("invalid request payload")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
 
-	logger.Debug().Str("endpoint", "fetch_messages").Str("username", req.Username).Str("last_id", req.LastID).Msg("processing fetch messages request")
+	logger.AddStr(c.Request().Context(), "user", req.Username)
+	if err := h.checkRateLimit(c, "fetch_messages", req.Username); err != nil {
+		return err
+	}
+
+	reqLogger(c).Debug().Str("endpoint", "fetch_messages").Str("username", req.Username).Str("last_id", req.LastID).Msg("processing fetch messages request")
 
 	resp, err := h.svc.FetchMessages(c.Request().Context(), &req)
+	h.recordAuthResult(c, req.Username, err)
 	if err != nil {
-		logger.Error().Str("endpoint", "fetch_messages").Str("username", req.Username).Err(err).Msg("failed to fetch messages")
-		return mapServiceError(err)
+		reqLogger(c).Error().Str("endpoint", "fetch_messages").Str("username", req.Username).Err(err).Msg("failed to fetch messages")
+		return mapServiceError(c, err)
 	}
 
-	logger.Info().Str("endpoint", "fetch_messages").Str("username", req.Username).Int("received", len(resp.ReceivedSMSs)).Int("sent", len(resp.SentSMSs)).Msg("messages fetched successfully")
+	reqLogger(c).Info().Str("endpoint", "fetch_messages").Str("username", req.Username).Int("received", len(resp.ReceivedSMSs)).Int("sent", len(resp.SentSMSs)).Msg("messages fetched successfully")
 	return c.JSON(http.StatusOK, resp)
 }
 
-func (h handler) pushTokenReport(c echo.Context) error {
+func (h handler) markRead(c echo.Context) (err error) {
+	defer h.observeClientRequest("mark_read", time.Now(), &err)
+
+	var req models.MarkReadRequest
+	if err := c.Bind(&req); err != nil {
+		reqLogger(c).Warn().Str("endpoint", "mark_read").Err(err).Msg("invalid request payload")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+
+	logger.AddStr(c.Request().Context(), "user", req.Username)
+	if err := h.checkRateLimit(c, "mark_read", req.Username); err != nil {
+		return err
+	}
+
+	reqLogger(c).Debug().Str("endpoint", "mark_read").Str("username", req.Username).Str("sms_id", req.SMSID).Msg("processing mark read request")
+
+	err = h.svc.MarkRead(c.Request().Context(), &req)
+	h.recordAuthResult(c, req.Username, err)
+	if err != nil {
+		reqLogger(c).Error().Str("endpoint", "mark_read").Str("username", req.Username).Err(err).Msg("failed to mark message as read")
+		return mapServiceError(c, err)
+	}
+
+	reqLogger(c).Info().Str("endpoint", "mark_read").Str("username", req.Username).Str("sms_id", req.SMSID).Msg("message marked as read")
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h handler) pushTokenReport(c echo.Context) (err error) {
+	defer h.observeClientRequest("push_token_report", time.Now(), &err)
+
 	var req models.PushTokenReportRequest
 	if err := c.Bind(&req); err != nil {
-		logger.Warn().Str("endpoint", "push_token_report").Err(err).Msg("invalid request payload")
+		reqLogger(c).Warn().Str("endpoint", "push_token_report").Err(err).Msg("invalid request payload")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
 
-	logger.Debug().Str("endpoint", "push_token_report").Str("selector", req.Selector).Msg("processing push token report")
+	logger.AddStr(c.Request().Context(), "user", req.UserName)
+	if err := h.checkRateLimit(c, "push_token_report", req.UserName); err != nil {
+		return err
+	}
+
+	reqLogger(c).Debug().Str("endpoint", "push_token_report").Str("selector", req.Selector).Msg("processing push token report")
 
 	resp, err := h.svc.ReportPushToken(c.Request().Context(), &req)
+	h.recordAuthResult(c, req.UserName, err)
 	if err != nil {
-		logger.Error().Str("endpoint", "push_token_report").Str("selector", req.Selector).Err(err).Msg("failed to report push token")
-		return mapServiceError(err)
+		reqLogger(c).Error().Str("endpoint", "push_token_report").Str("selector", req.Selector).Err(err).Msg("failed to report push token")
+		return mapServiceError(c, err)
 	}
 
-	logger.Info().Str("endpoint", "push_token_report").Str("selector", req.Selector).Msg("push token reported successfully")
+	reqLogger(c).Info().Str("endpoint", "push_token_report").Str("selector", req.Selector).Msg("push token reported successfully")
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -102,21 +369,21 @@ func (h handler) getPushTokens(c echo.Context) error {
 		return err
 	}
 
-	logger.Debug().Str("endpoint", "get_push_tokens").Msg("fetching all push tokens")
+	reqLogger(c).Debug().Str("endpoint", "get_push_tokens").Msg("fetching all push tokens")
 
 	db, ok := h.pushTokenDB.(*db.Database)
 	if !ok {
-		logger.Error().Str("endpoint", "get_push_tokens").Msg("push token database not available")
+		reqLogger(c).Error().Str("endpoint", "get_push_tokens").Msg("push token database not available")
 		return echo.NewHTTPError(http.StatusInternalServerError, "push token database not available")
 	}
 
 	tokens, err := db.ListPushTokens()
 	if err != nil {
-		logger.Error().Str("endpoint", "get_push_tokens").Err(err).Msg("failed to list push tokens")
+		reqLogger(c).Error().Str("endpoint", "get_push_tokens").Err(err).Msg("failed to list push tokens")
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	logger.Info().Str("endpoint", "get_push_tokens").Int("count", len(tokens)).Msg("push tokens listed successfully")
+	reqLogger(c).Info().Str("endpoint", "get_push_tokens").Int("count", len(tokens)).Msg("push tokens listed successfully")
 	return c.JSON(http.StatusOK, tokens)
 }
 
@@ -125,23 +392,163 @@ func (h handler) resetPushTokens(c echo.Context) error {
 		return err
 	}
 
-	logger.Debug().Str("endpoint", "reset_push_tokens").Msg("resetting push tokens database")
+	reqLogger(c).Debug().Str("endpoint", "reset_push_tokens").Msg("resetting push tokens database")
 
 	db, ok := h.pushTokenDB.(*db.Database)
 	if !ok {
-		logger.Error().Str("endpoint", "reset_push_tokens").Msg("push token database not available")
+		reqLogger(c).Error().Str("endpoint", "reset_push_tokens").Msg("push token database not available")
 		return echo.NewHTTPError(http.StatusInternalServerError, "push token database not available")
 	}
 
 	if err := db.ResetPushTokens(); err != nil {
-		logger.Error().Str("endpoint", "reset_push_tokens").Err(err).Msg("failed to reset push tokens")
+		reqLogger(c).Error().Str("endpoint", "reset_push_tokens").Err(err).Msg("failed to reset push tokens")
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	logger.Info().Str("endpoint", "reset_push_tokens").Msg("push tokens database reset successfully")
+	reqLogger(c).Info().Str("endpoint", "reset_push_tokens").Msg("push tokens database reset successfully")
 	return c.JSON(http.StatusOK, map[string]string{"status": "reset"})
 }
 
+func (h handler) listQuietHours(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+
+	schedules, err := h.pushSvc.ListQuietHours()
+	if err != nil {
+		reqLogger(c).Error().Str("endpoint", "list_quiet_hours").Err(err).Msg("failed to list quiet hours")
+		return mapServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+func (h handler) setQuietHours(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+
+	var req db.QuietHours
+	if err := c.Bind(&req); err != nil {
+		reqLogger(c).Warn().Str("endpoint", "set_quiet_hours").Err(err).Msg("invalid request payload")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+
+	schedule, err := h.pushSvc.SetQuietHours(req)
+	if err != nil {
+		reqLogger(c).Warn().Str("endpoint", "set_quiet_hours").Str("user", req.User).Err(err).Msg("failed to set quiet hours")
+		return mapServiceError(c, err)
+	}
+
+	reqLogger(c).Info().Str("endpoint", "set_quiet_hours").Str("user", schedule.User).Msg("quiet hours set successfully")
+	return c.JSON(http.StatusOK, schedule)
+}
+
+func (h handler) deleteQuietHours(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+
+	user := c.Param("user")
+	if err := h.pushSvc.DeleteQuietHours(user); err != nil {
+		reqLogger(c).Warn().Str("endpoint", "delete_quiet_hours").Str("user", user).Err(err).Msg("failed to delete quiet hours")
+		return mapServiceError(c, err)
+	}
+
+	reqLogger(c).Info().Str("endpoint", "delete_quiet_hours").Str("user", user).Msg("quiet hours deleted successfully")
+	return c.NoContent(http.StatusNoContent)
+}
+
+// media serves Matrix media, such as stickers, to clients that cannot authenticate to the homeserver.
+// Only URLs signed by the service when the message was fetched are served.
+func (h handler) media(c echo.Context) (err error) {
+	defer h.observeClientRequest("media", time.Now(), &err)
+
+	resp, err := h.svc.OpenMedia(c.Request().Context(), c.Param("server"), c.Param("mediaId"), c.QueryParam("sig"))
+	if err != nil {
+		reqLogger(c).Debug().Str("endpoint", "media").Err(err).Msg("media not served")
+		return mapServiceError(c, err)
+	}
+	defer resp.Body.Close()
+
+	header := c.Response().Header()
+	for _, key := range []string{echo.HeaderContentLength, echo.HeaderContentDisposition} {
+		if v := resp.Header.Get(key); v != "" {
+			header.Set(key, v)
+		}
+	}
+	// Media IDs are immutable
+	header.Set("Cache-Control", "private, max-age=86400, immutable")
+	contentType := resp.Header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	// Media are uploaded by any Matrix user: browsers must neither guess their type nor run them
+	// in the origin of the proxy, and only images are shown inline.
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	header.Set(echo.HeaderContentSecurityPolicy, "sandbox")
+	if !inlineMedia(contentType) {
+		header.Set(echo.HeaderContentDisposition, attachmentDisposition(header.Get(echo.HeaderContentDisposition)))
+	}
+	return c.Stream(http.StatusOK, contentType, resp.Body)
+}
+
+// inlineMedia reports whether media of contentType may be shown inline: raster images only,
+// since SVG images can carry scripts.
+func inlineMedia(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml"
+}
+
+// attachmentDisposition turns the Content-Disposition of the homeserver into an attachment,
+// keeping the file name.
+func attachmentDisposition(disposition string) string {
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil || params["filename"] == "" {
+		return "attachment"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": params["filename"]})
+}
+
+func (h handler) getRateLimitStats(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h.guard.Stats())
+}
+
+// checkRateLimit rejects the request with 429 and a Retry-After header when the
+// username or the client IP is rate limited or locked out.
+func (h handler) checkRateLimit(c echo.Context, endpoint, username string) error {
+	ok, wait := h.guard.Allow(rateLimitKey(username), c.RealIP())
+	if ok {
+		return nil
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	reqLogger(c).Warn().Str("endpoint", endpoint).Str("username", username).Str("ip", c.RealIP()).Int("retry_after", retryAfter).Msg("request rate limited")
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many requests")
+}
+
+// recordAuthResult feeds the outcome of a client request into the brute-force protection.
+// Only the credentials rejected by the auth backend count; other errors, including the requests
+// refused before reaching the backend, neither lock out nor reset the username.
+func (h handler) recordAuthResult(c echo.Context, username string, err error) {
+	switch {
+	case err == nil:
+		h.guard.Success(rateLimitKey(username), c.RealIP())
+	case errors.Is(err, service.ErrInvalidCredentials):
+		h.guard.Failure(rateLimitKey(username), c.RealIP())
+	}
+}
+
+// rateLimitKey normalizes a username so that case and whitespace variants share one bucket.
+func rateLimitKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
 func (h handler) ensureAdminAccess(c echo.Context) error {
 	if h.adminToken == "" {
 		return echo.NewHTTPError(http.StatusInternalServerError, "admin token not configured")
@@ -156,13 +563,28 @@ func (h handler) ensureAdminAccess(c echo.Context) error {
 	return nil
 }
 
-func mapServiceError(err error) error {
+// mapServiceError maps the errors of the services to HTTP errors. When the homeserver is rate
+// limiting or unavailable the client gets 429 or 503, with a Retry-After header when known.
+func mapServiceError(c echo.Context, err error) error {
 	switch {
+	case errors.Is(err, service.ErrAuthUnavailable), errors.Is(err, service.ErrHomeserverToken):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, matrix.ErrRateLimited), errors.Is(err, matrix.ErrUnavailable):
+		if wait := matrix.RetryAfter(err); wait > 0 {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		if errors.Is(err, matrix.ErrRateLimited) {
+			return echo.NewHTTPError(http.StatusTooManyRequests, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
 	case errors.Is(err, service.ErrAuthentication):
 		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
-	case errors.Is(err, service.ErrInvalidRecipient):
+	case errors.Is(err, service.ErrRecipientBlocked):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	case errors.Is(err, service.ErrInvalidRecipient), errors.Is(err, service.ErrInvalidEdit), errors.Is(err, service.ErrInvalidContent),
+		errors.Is(err, service.ErrInvalidReceipt), errors.Is(err, service.ErrInvalidQuietHours):
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-	case errors.Is(err, service.ErrMappingNotFound):
+	case errors.Is(err, service.ErrMappingNotFound), errors.Is(err, service.ErrMediaNotFound), errors.Is(err, service.ErrQuietHoursNotFound):
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	default:
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -185,39 +607,106 @@ func (h handler) isLocalhost(ip string) bool {
 func (h handler) matrixPushNotify(c echo.Context) error {
 	var req models.MatrixPushNotifyRequest
 	if err := c.Bind(&req); err != nil {
-		logger.Warn().Str("endpoint", "matrix_push_notify").Err(err).Msg("invalid request payload")
+		reqLogger(c).Warn().Str("endpoint", "matrix_push_notify").Err(err).Msg("invalid request payload")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
+	return h.pushNotify(c, &req)
+}
+
+// pushDispatcher serves the push gateway at the root for the tenants of a host, or of any host,
+// when some of them are selected by path prefix: the spec fixes the path of pusher URLs, so they
+// cannot carry the prefix. A notification goes to the tenant owning its pushkeys; unknown
+// pushkeys are rejected, as a single tenant does.
+func pushDispatcher(handlers []handler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req models.MatrixPushNotifyRequest
+		if err := c.Bind(&req); err != nil {
+			reqLogger(c).Warn().Str("endpoint", "matrix_push_notify").Err(err).Msg("invalid request payload")
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+		}
+		for _, h := range handlers {
+			if h.pushSvc == nil {
+				continue
+			}
+			for _, device := range req.Notification.Devices {
+				if h.pushSvc.OwnsPushkey(device.Pushkey) {
+					return h.pushNotify(c, &req)
+				}
+			}
+		}
+		rejected := make([]string, 0, len(req.Notification.Devices))
+		for _, device := range req.Notification.Devices {
+			rejected = append(rejected, device.Pushkey)
+		}
+		reqLogger(c).Warn().Str("endpoint", "matrix_push_notify").Int("rejected_count", len(rejected)).Msg("push notification for pushkeys of no tenant")
+		return c.JSON(http.StatusOK, models.MatrixPushNotifyResponse{Rejected: rejected})
+	}
+}
 
-	logger.Debug().Str("endpoint", "matrix_push_notify").Int("device_count", len(req.Notification.Devices)).Str("event_id", req.Notification.EventID).Msg("processing matrix push notification")
+// pushNotify authorizes and delivers a push gateway notification of the tenant of h.
+func (h handler) pushNotify(c echo.Context, req *models.MatrixPushNotifyRequest) error {
+	reqLogger(c).Debug().Str("endpoint", "matrix_push_notify").Int("device_count", len(req.Notification.Devices)).Str("event_id", req.Notification.EventID).Msg("processing matrix push notification")
 
 	if h.pushSvc == nil {
-		logger.Error().Str("endpoint", "matrix_push_notify").Msg("push service not initialized")
+		reqLogger(c).Error().Str("endpoint", "matrix_push_notify").Msg("push service not initialized")
 		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
 	}
 
-	resp, err := h.pushSvc.HandleMatrixPushNotification(c.Request().Context(), &req)
+	if err := h.pushSvc.AuthorizeNotify(c.Request().Context(), c.RealIP(), c.QueryParam(service.PushGatewaySecretParam), req); err != nil {
+		if errors.Is(err, service.ErrPushGatewayUnauthorized) {
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
+		reqLogger(c).Error().Str("endpoint", "matrix_push_notify").Err(err).Msg("failed to authorize matrix push notification")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	resp, err := h.pushSvc.HandleMatrixPushNotification(c.Request().Context(), req)
 	if err != nil {
-		logger.Error().Str("endpoint", "matrix_push_notify").Err(err).Msg("failed to handle matrix push notification")
+		reqLogger(c).Error().Str("endpoint", "matrix_push_notify").Err(err).Msg("failed to handle matrix push notification")
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	logger.Info().Str("endpoint", "matrix_push_notify").Int("rejected_count", len(resp.Rejected)).Msg("matrix push notification processed")
+	reqLogger(c).Info().Str("endpoint", "matrix_push_notify").Int("rejected_count", len(resp.Rejected)).Msg("matrix push notification processed")
 	return c.JSON(http.StatusOK, resp)
 }
 
 // matrixAppTransaction handles incoming Application Service transactions from homeservers.
-// It logs the received payload for debugging and returns HTTP 200 as required by the spec.
+// It checks the hs_token of the homeserver, logs the received payload for debugging, passes the
+// events to the message service, which follows the upgrades of direct rooms, and returns HTTP 200
+// as required by the spec. Without a configured hs_token transactions are acknowledged and ignored.
 func (h handler) matrixAppTransaction(c echo.Context) error {
 	txnId := c.Param("txnId")
+	if h.hsToken == "" {
+		reqLogger(c).Debug().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Msg("hs_token not configured, application service transaction ignored")
+		return c.NoContent(http.StatusOK)
+	}
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok || token == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "missing hs_token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.hsToken)) != 1 {
+		reqLogger(c).Warn().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Str("ip", c.RealIP()).Msg("invalid hs_token")
+		return echo.NewHTTPError(http.StatusForbidden, "invalid hs_token")
+	}
+
 	// Read raw body
 	bodyBytes, err := io.ReadAll(c.Request().Body)
 	if err != nil {
-		logger.Error().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Err(err).Msg("failed to read request body")
+		reqLogger(c).Error().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Err(err).Msg("failed to read request body")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
 
-	logger.Debug().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Str("payload", string(bodyBytes)).Msg("received application service transaction")
+	reqLogger(c).Debug().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Interface("payload", json.RawMessage(bodyBytes)).Msg("received application service transaction")
+
+	var txn struct {
+		Events []*event.Event `json:"events"`
+	}
+	if err := json.Unmarshal(bodyBytes, &txn); err != nil {
+		// The homeserver retries rejected transactions forever: acknowledge what cannot be decoded
+		reqLogger(c).Warn().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Err(err).Msg("cannot decode application service transaction")
+	} else if h.svc != nil {
+		h.svc.HandleAppServiceTransaction(c.Request().Context(), txnId, txn.Events)
+	}
 
 	// As per spec, simply acknowledge with 200 OK.
 	return c.NoContent(http.StatusOK)
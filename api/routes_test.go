@@ -3,17 +3,22 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/matrix"
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/nethesis/matrix2acrobits/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestIsLocalhost(t *testing.T) {
@@ -40,6 +45,35 @@ func TestIsLocalhost(t *testing.T) {
 	}
 }
 
+func TestMarkRead(t *testing.T) {
+	e := echo.New()
+	svc := service.NewMessageService(nil, nil, "")
+	h := handler{svc: svc, adminToken: "test"}
+
+	t.Run("missing message", func(t *testing.T) {
+		body, _ := json.Marshal(models.MarkReadRequest{Username: "@alice:example.com", StreamID: "!room:example.com"})
+		req := httptest.NewRequest(http.MethodPost, "/api/client/mark_read", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		c := e.NewContext(req, httptest.NewRecorder())
+
+		err := h.markRead(c)
+		var httpErr *echo.HTTPError
+		require.ErrorAs(t, err, &httpErr)
+		assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/client/mark_read", bytes.NewBufferString("invalid json"))
+		req.Header.Set("Content-Type", "application/json")
+		c := e.NewContext(req, httptest.NewRecorder())
+
+		err := h.markRead(c)
+		var httpErr *echo.HTTPError
+		require.ErrorAs(t, err, &httpErr)
+		assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+	})
+}
+
 func TestPushTokenReport(t *testing.T) {
 	e := echo.New()
 	svc := service.NewMessageService(nil, nil, "")
@@ -380,3 +414,166 @@ func TestResetPushTokens(t *testing.T) {
 		assert.Equal(t, http.StatusInternalServerError, echoErr.Code)
 	})
 }
+
+func TestMatrixPushNotifyAuthorization(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+	require.NoError(t, pushTokenDB.SavePushToken("sel", "pushkey", "app", "", ""))
+	require.NoError(t, pushTokenDB.SetGatewaySecret("sel", "s3cret"))
+
+	e := echo.New()
+	RegisterRoutes(e, nil, service.NewPushService(pushTokenDB), "admin", pushTokenDB)
+
+	notify := func(target string) int {
+		body, _ := json.Marshal(models.MatrixPushNotifyRequest{
+			Notification: models.MatrixNotification{Devices: []models.MatrixDevice{{Pushkey: "unknown"}, {Pushkey: "pushkey"}}},
+		})
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "203.0.113.1:4000"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, notify("/_matrix/push/v1/notify"))
+	assert.Equal(t, http.StatusUnauthorized, notify("/_matrix/push/v1/notify?secret=wrong"))
+}
+
+func TestMedia(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v1/media/download/example.com/sticker":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+			return
+		case "/_matrix/client/v1/media/download/example.com/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Disposition", `inline; filename="page.html"`)
+			w.Write([]byte("<script>alert(1)</script>"))
+			return
+		case "/_matrix/client/v1/media/download/example.com/drawing":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte("<svg/>"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+	}))
+	defer homeserver.Close()
+
+	client, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+	svc, err := service.NewMessageServiceWithConfig(client, nil, service.Config{ProxyURL: "https://proxy.example.com"})
+	require.NoError(t, err)
+	e := echo.New()
+	RegisterRoutes(e, svc, nil, "", nil)
+
+	sig := client.SignMedia(id.ContentURI{Homeserver: "example.com", FileID: "sticker"})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/client/media/example.com/sticker?sig="+sig, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "png", rec.Body.String())
+	assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "sandbox", rec.Header().Get("Content-Security-Policy"))
+	assert.Empty(t, rec.Header().Get("Content-Disposition"), "images are shown inline")
+
+	// Other media are downloaded, never rendered in the origin of the proxy
+	for file, disposition := range map[string]string{"page": `attachment; filename=page.html`, "drawing": "attachment"} {
+		sig := client.SignMedia(id.ContentURI{Homeserver: "example.com", FileID: file})
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/client/media/example.com/"+file+"?sig="+sig, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, file)
+		assert.Equal(t, disposition, rec.Header().Get("Content-Disposition"), file)
+		assert.Equal(t, "sandbox", rec.Header().Get("Content-Security-Policy"), file)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/client/media/example.com/sticker?sig=forged", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestQuietHours(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+
+	e := echo.New()
+	h := handler{pushSvc: service.NewPushService(pushTokenDB), adminToken: "test-admin-token"}
+	newContext := func(method, target, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-Super-Admin-Token", "test-admin-token")
+		req.RemoteAddr = "127.0.0.1:12345"
+		rec := httptest.NewRecorder()
+		return e.NewContext(req, rec), rec
+	}
+
+	c, rec := newContext(http.MethodPut, "/api/internal/quiet_hours", `{"user":"201","start":"22:00","end":"07:00","timezone":"Europe/Rome","days":["mon","tue"]}`)
+	require.NoError(t, h.setQuietHours(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	c, rec = newContext(http.MethodPut, "/api/internal/quiet_hours", `{"user":"202","start":"7pm","end":"07:00"}`)
+	err = h.setQuietHours(c)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	c, rec = newContext(http.MethodGet, "/api/internal/quiet_hours", "")
+	require.NoError(t, h.listQuietHours(c))
+	var schedules []db.QuietHours
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &schedules))
+	require.Len(t, schedules, 1)
+	assert.Equal(t, "201", schedules[0].User)
+	assert.Equal(t, []string{"mon", "tue"}, schedules[0].Days)
+
+	c, rec = newContext(http.MethodDelete, "/api/internal/quiet_hours/201", "")
+	c.SetParamNames("user")
+	c.SetParamValues("201")
+	require.NoError(t, h.deleteQuietHours(c))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	c, _ = newContext(http.MethodDelete, "/api/internal/quiet_hours/201", "")
+	c.SetParamNames("user")
+	c.SetParamValues("201")
+	err = h.deleteQuietHours(c)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, err.(*echo.HTTPError).Code)
+
+	// The endpoints require the admin token
+	c, _ = newContext(http.MethodGet, "/api/internal/quiet_hours", "")
+	c.Request().Header.Del("X-Super-Admin-Token")
+	assert.Error(t, h.listQuietHours(c))
+}
+
+func TestMapServiceError(t *testing.T) {
+	e := echo.New()
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"rate limited", fmt.Errorf("send message: %w", &matrix.UnavailableError{RateLimited: true, RetryAfter: 1500 * time.Millisecond, Err: errors.New("M_LIMIT_EXCEEDED")}), http.StatusTooManyRequests, "2"},
+		{"unavailable", fmt.Errorf("sync messages: %w", &matrix.UnavailableError{Err: errors.New("HTTP 502")}), http.StatusServiceUnavailable, ""},
+		{"circuit open", &matrix.UnavailableError{RetryAfter: 30 * time.Second, Err: errors.New("circuit breaker open")}, http.StatusServiceUnavailable, "30"},
+		{"media unavailable", fmt.Errorf("%w: %w", service.ErrMediaNotFound, &matrix.UnavailableError{Err: errors.New("HTTP 503")}), http.StatusServiceUnavailable, ""},
+		{"as_token rejected", fmt.Errorf("send message: %w: M_UNKNOWN_TOKEN", service.ErrHomeserverToken), http.StatusServiceUnavailable, ""},
+		{"credentials rejected", service.ErrInvalidCredentials, http.StatusUnauthorized, ""},
+		{"not found", service.ErrMappingNotFound, http.StatusNotFound, ""},
+		{"blocked", service.ErrRecipientBlocked, http.StatusForbidden, ""},
+		{"other", errors.New("boom"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, mapServiceError(c, tt.err), &httpErr)
+			assert.Equal(t, tt.status, httpErr.Code)
+			assert.Equal(t, tt.retryAfter, rec.Header().Get("Retry-After"))
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/health"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/service"
+	"github.com/nethesis/matrix2acrobits/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTenant(t *testing.T, name string, hosts []string, prefix string) *tenant.Tenant {
+	t.Helper()
+	pushTokenDB, err := db.NewDatabase(filepath.Join(t.TempDir(), name+".db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { pushTokenDB.Close() })
+
+	require.NoError(t, pushTokenDB.SavePushToken("selector-"+name, "token-"+name, "app", "", ""))
+
+	return &tenant.Tenant{
+		Name:           name,
+		Hosts:          hosts,
+		PathPrefix:     prefix,
+		AdminToken:     "admin-" + name,
+		MessageService: service.NewMessageService(nil, pushTokenDB, ""),
+		PushService:    service.NewPushService(pushTokenDB),
+		PushTokenDB:    pushTokenDB,
+	}
+}
+
+func listTokens(t *testing.T, e *echo.Echo, host, path, adminToken string) (int, []*db.PushToken) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set(adminTokenHeader, adminToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var tokens []*db.PushToken
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+	}
+	return rec.Code, tokens
+}
+
+func TestRegisterTenantRoutes_Isolation(t *testing.T) {
+	acme := newTestTenant(t, "acme", []string{"acme.example.com"}, "")
+	globex := newTestTenant(t, "globex", nil, "/globex")
+	initech := newTestTenant(t, "initech", []string{"shared.example.com"}, "/initech")
+
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{acme, globex, initech})
+
+	t.Run("routes by host header", func(t *testing.T) {
+		code, tokens := listTokens(t, e, "acme.example.com", "/api/internal/push_tokens", "admin-acme")
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "selector-acme", tokens[0].Selector)
+	})
+
+	t.Run("routes by path prefix on any host", func(t *testing.T) {
+		code, tokens := listTokens(t, e, "proxy.example.com", "/globex/api/internal/push_tokens", "admin-globex")
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "selector-globex", tokens[0].Selector)
+	})
+
+	t.Run("routes by host and path prefix", func(t *testing.T) {
+		code, tokens := listTokens(t, e, "shared.example.com", "/initech/api/internal/push_tokens", "admin-initech")
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "selector-initech", tokens[0].Selector)
+	})
+
+	t.Run("admin token of another tenant is rejected", func(t *testing.T) {
+		code, _ := listTokens(t, e, "acme.example.com", "/api/internal/push_tokens", "admin-globex")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("host tenant is not reachable through other hosts", func(t *testing.T) {
+		code, _ := listTokens(t, e, "proxy.example.com", "/api/internal/push_tokens", "admin-acme")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("prefix tenant is not reachable through host tenants", func(t *testing.T) {
+		code, _ := listTokens(t, e, "acme.example.com", "/globex/api/internal/push_tokens", "admin-globex")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("health is served on every host", func(t *testing.T) {
+		for _, host := range []string{"acme.example.com", "shared.example.com", "proxy.example.com"} {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.Host = host
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code, host)
+		}
+	})
+}
+
+func TestRegisterTenantRoutes_SharedHost(t *testing.T) {
+	initech := newTestTenant(t, "initech", []string{"shared.example.com"}, "/initech")
+	hooli := newTestTenant(t, "hooli", []string{"Shared.example.com"}, "/hooli")
+
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{initech, hooli})
+
+	for _, tt := range []*tenant.Tenant{initech, hooli} {
+		code, tokens := listTokens(t, e, "shared.example.com", tt.PathPrefix+"/api/internal/push_tokens", tt.AdminToken)
+		require.Equal(t, http.StatusOK, code, tt.Name)
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "selector-"+tt.Name, tokens[0].Selector)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Host = "shared.example.com"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestRegisterTenantRoutes_PushGateway(t *testing.T) {
+	globex := newTestTenant(t, "globex", nil, "/globex")
+	initech := newTestTenant(t, "initech", nil, "/initech")
+	require.NoError(t, globex.PushTokenDB.SetGatewaySecret("selector-globex", "globex-secret"))
+	require.NoError(t, initech.PushTokenDB.SetGatewaySecret("selector-initech", "initech-secret"))
+
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{globex, initech})
+
+	// Counts-only notifications without counts deliver nothing, so no push reaches PNM
+	notify := func(target, pushkey string) (int, models.MatrixPushNotifyResponse) {
+		body, _ := json.Marshal(models.MatrixPushNotifyRequest{
+			Notification: models.MatrixNotification{Devices: []models.MatrixDevice{{Pushkey: pushkey}}},
+		})
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "203.0.113.1:4000"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var resp models.MatrixPushNotifyResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	// Pusher URLs have no prefix: the tenant is the one owning the pushkey
+	code, resp := notify("/_matrix/push/v1/notify?secret=initech-secret", "token-initech")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Rejected)
+	code, _ = notify("/_matrix/push/v1/notify?secret=initech-secret", "token-globex")
+	assert.Equal(t, http.StatusUnauthorized, code, "checked against the secret of globex")
+	code, _ = notify("/_matrix/push/v1/notify?secret=globex-secret", "token-globex")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, resp = notify("/_matrix/push/v1/notify", "unknown")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"unknown"}, resp.Rejected)
+
+	// Pushers registered with the prefix keep working
+	code, _ = notify("/globex/_matrix/push/v1/notify?secret=globex-secret", "token-globex")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestRegisterTenantRoutes_Metrics(t *testing.T) {
+	t.Setenv("METRICS_ALLOWED_SOURCES", "198.51.100.0/24")
+	acme := newTestTenant(t, "acme", []string{"acme.example.com"}, "")
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{acme})
+
+	// A client request without password is recorded as unauthorized.
+	assert.Equal(t, http.StatusUnauthorized, fetchWithoutPassword(e, "201", "192.0.2.1:1000", "acme.example.com").Code)
+
+	scrape := func(host, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Host = host
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := scrape("other.example.com", "127.0.0.1:9000")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `matrix2acrobits_client_request_duration_seconds_count{endpoint="fetch_messages",outcome="unauthorized",tenant="acme"}`)
+	assert.Equal(t, http.StatusOK, scrape("other.example.com", "198.51.100.7:9000").Code)
+
+	// Other sources are refused.
+	assert.Equal(t, http.StatusForbidden, scrape("other.example.com", "192.0.2.1:1000").Code)
+
+	// Tenant hosts do not expose the metrics of the other tenants.
+	assert.Equal(t, http.StatusNotFound, scrape("acme.example.com", "127.0.0.1:9000").Code)
+}
+
+func TestRegisterTenantRoutes_Readiness(t *testing.T) {
+	failing := errors.New("homeserver unreachable")
+	acme := newTestTenant(t, "acme", []string{"acme.example.com"}, "")
+	acme.Health = health.NewChecker(0, time.Second,
+		health.Check{Name: "matrix", Critical: true, Run: func(ctx context.Context) error { return nil }},
+		health.Check{Name: "pnm", Run: func(ctx context.Context) error { return failing }},
+	)
+	globex := newTestTenant(t, "globex", nil, "/globex")
+	globex.Health = health.NewChecker(0, time.Second,
+		health.Check{Name: "matrix", Critical: true, Run: func(ctx context.Context) error { return failing }},
+	)
+	e := echo.New()
+	RegisterTenantRoutes(e, []*tenant.Tenant{acme, globex})
+
+	get := func(host, path string) (int, health.Summary) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var report health.Summary
+		if rec.Code == http.StatusOK || rec.Code == http.StatusServiceUnavailable {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+			assert.NotContains(t, rec.Body.String(), failing.Error(), "check errors are only logged")
+		}
+		return rec.Code, report
+	}
+
+	code, report := get("acme.example.com", "/health/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusDegraded, report.Status)
+	assert.Equal(t, health.StatusFail, report.Checks["acme/pnm"])
+	assert.Equal(t, health.StatusOK, report.Checks["acme/matrix"])
+	assert.NotContains(t, report.Checks, "globex/matrix")
+
+	code, report = get("other.example.com", "/globex/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFail, report.Status)
+
+	// The root aggregates every tenant.
+	code, report = get("other.example.com", "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Len(t, report.Checks, 3)
+
+	for _, host := range []string{"acme.example.com", "other.example.com"} {
+		code, _ = get(host, "/health/live")
+		assert.Equal(t, http.StatusOK, code, host)
+	}
+}
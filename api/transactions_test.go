@@ -13,7 +13,7 @@ import (
 func TestMatrixAppTransaction(t *testing.T) {
 	e := echo.New()
 
-	// Minimal valid-ish transaction body (we don't parse it, only log)
+	// Minimal valid-ish transaction body
 	payload := `{"events":[], "other": "value"}`
 	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn123", strings.NewReader(payload))
 	req.Header.Set("Content-Type", "application/json")
@@ -29,3 +29,49 @@ func TestMatrixAppTransaction(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, rec.Code)
 }
+
+func TestMatrixAppTransaction_InvalidPayload(t *testing.T) {
+	e := echo.New()
+
+	// Undecodable transactions are acknowledged too, otherwise the homeserver retries them forever
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn124", strings.NewReader(`{"events":"nope"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	c := e.NewContext(req, rec)
+	c.SetParamNames("txnId")
+	c.SetParamValues("txn124")
+
+	h := handler{}
+	err := h.matrixAppTransaction(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestMatrixAppTransaction_HsToken(t *testing.T) {
+	h := handler{hsToken: "hs-secret"}
+	transaction := func(authorization string) int {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn125", strings.NewReader(`{"events":[]}`))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("txnId")
+		c.SetParamValues("txn125")
+		if err := h.matrixAppTransaction(c); err != nil {
+			var he *echo.HTTPError
+			if assert.ErrorAs(t, err, &he) {
+				return he.Code
+			}
+		}
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, transaction("Bearer hs-secret"))
+	assert.Equal(t, http.StatusUnauthorized, transaction(""))
+	assert.Equal(t, http.StatusUnauthorized, transaction("hs-secret"))
+	assert.Equal(t, http.StatusForbidden, transaction("Bearer as-secret"))
+}
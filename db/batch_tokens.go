@@ -0,0 +1,78 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// SaveBatchTokens stores the Matrix sync batch token of each user, replacing the previous ones.
+// Users missing from tokens keep their stored token.
+func (d *Database) SaveBatchTokens(tokens map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO batch_tokens (user_id, token, updated_at) VALUES (?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET token = excluded.token, updated_at = excluded.updated_at;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare batch token insert: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	for userID, token := range tokens {
+		if _, err := stmt.Exec(userID, token, now); err != nil {
+			return fmt.Errorf("failed to save batch token: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit batch tokens: %w", err)
+	}
+
+	logger.Debug().Int("count", len(tokens)).Msg("batch tokens saved")
+	return nil
+}
+
+// LoadBatchTokens returns the stored sync batch tokens keyed by Matrix user ID.
+func (d *Database) LoadBatchTokens() (map[string]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT user_id, token FROM batch_tokens;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query batch tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]string)
+	for rows.Next() {
+		var userID, token string
+		if err := rows.Scan(&userID, &token); err != nil {
+			return nil, fmt.Errorf("failed to scan batch token: %w", err)
+		}
+		tokens[userID] = token
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating batch tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// DeleteBatchToken removes the stored sync batch token of a user.
+func (d *Database) DeleteBatchToken(userID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.db.Exec(`DELETE FROM batch_tokens WHERE user_id = ?;`, userID); err != nil {
+		return fmt.Errorf("failed to delete batch token: %w", err)
+	}
+	return nil
+}
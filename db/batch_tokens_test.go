@@ -0,0 +1,36 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchTokens(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+
+	tokens, err := db.LoadBatchTokens()
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+
+	require.NoError(t, db.SaveBatchTokens(map[string]string{"@alice:example.com": "s1", "@bob:example.com": "s2"}))
+	require.NoError(t, db.SaveBatchTokens(map[string]string{"@alice:example.com": "s3"}))
+	require.NoError(t, db.DeleteBatchToken("@bob:example.com"))
+	require.NoError(t, db.Close())
+
+	// Tokens survive a restart.
+	db, err = NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	tokens, err = db.LoadBatchTokens()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"@alice:example.com": "s3"}, tokens)
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Status of an outbound message, see OutboundMessage.
+const (
+	OutboundQueued = "queued"
+	OutboundSent   = "sent"
+	OutboundFailed = "failed"
+	// OutboundNotified is a failed message whose sender was handed the failure notice.
+	OutboundNotified = "notified"
+)
+
+// OutboundMessage is a message accepted from a client while the homeserver was unavailable.
+// ID is the provisional message_id returned to the client; once sent, EventID is the Matrix event.
+type OutboundMessage struct {
+	ID     string
+	UserID string
+	// Request is the JSON send_message request, without password.
+	Request     string
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	EventID     string
+	LastError   string
+	CreatedAt   time.Time
+}
+
+const outboundColumns = `id, user_id, request, status, attempts, next_attempt, event_id, last_error, created_at`
+
+// EnqueueOutboundMessage stores a new queued message. It reports false, storing nothing, when a
+// message with the same ID is already stored.
+func (d *Database) EnqueueOutboundMessage(m OutboundMessage) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`
+	INSERT INTO outbound_messages (`+outboundColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO NOTHING;`,
+		m.ID, m.UserID, m.Request, OutboundQueued, m.Attempts, m.NextAttempt.UTC(), "", "", m.CreatedAt.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to enqueue outbound message: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to enqueue outbound message: %w", err)
+	}
+	return n > 0, nil
+}
+
+// GetOutboundMessage returns the outbound message with the given ID, or nil when there is none.
+func (d *Database) GetOutboundMessage(id string) (*OutboundMessage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	m, err := scanOutboundMessage(d.db.QueryRow(`SELECT `+outboundColumns+` FROM outbound_messages WHERE id = ?;`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get outbound message: %w", err)
+	}
+	return m, nil
+}
+
+// DueOutboundMessages returns up to limit queued messages whose next attempt is due, oldest first.
+func (d *Database) DueOutboundMessages(now time.Time, limit int) ([]*OutboundMessage, error) {
+	return d.queryOutboundMessages(`SELECT `+outboundColumns+` FROM outbound_messages
+	WHERE status = ? AND next_attempt <= ? ORDER BY created_at, rowid LIMIT ?;`, OutboundQueued, now.UTC(), limit)
+}
+
+// QueuedOutboundMessages returns the messages of userID still queued, oldest first.
+func (d *Database) QueuedOutboundMessages(userID string) ([]*OutboundMessage, error) {
+	return d.queryOutboundMessages(`SELECT `+outboundColumns+` FROM outbound_messages
+	WHERE user_id = ? AND status = ? ORDER BY created_at, rowid;`, userID, OutboundQueued)
+}
+
+// SettledOutboundMessages returns the messages of userID that were sent, failed or notified, oldest first.
+func (d *Database) SettledOutboundMessages(userID string) ([]*OutboundMessage, error) {
+	return d.queryOutboundMessages(`SELECT `+outboundColumns+` FROM outbound_messages
+	WHERE user_id = ? AND status != ? ORDER BY created_at;`, userID, OutboundQueued)
+}
+
+// CountOutboundMessages returns the number of messages still queued.
+func (d *Database) CountOutboundMessages() (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var n int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM outbound_messages WHERE status = ?;`, OutboundQueued).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count outbound messages: %w", err)
+	}
+	return n, nil
+}
+
+// UpdateOutboundMessage stores the delivery state of m: status, attempts, next attempt, event and error.
+func (d *Database) UpdateOutboundMessage(m *OutboundMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE outbound_messages SET status = ?, attempts = ?, next_attempt = ?, event_id = ?, last_error = ? WHERE id = ?;`,
+		m.Status, m.Attempts, m.NextAttempt.UTC(), m.EventID, m.LastError, m.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update outbound message: %w", err)
+	}
+	return nil
+}
+
+// DeleteOutboundMessage removes the outbound message with the given ID.
+func (d *Database) DeleteOutboundMessage(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.db.Exec(`DELETE FROM outbound_messages WHERE id = ?;`, id); err != nil {
+		return fmt.Errorf("failed to delete outbound message: %w", err)
+	}
+	return nil
+}
+
+// PruneOutboundMessages removes the messages sent, failed or notified that were queued before the
+// given time, and returns how many.
+func (d *Database) PruneOutboundMessages(before time.Time) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM outbound_messages WHERE status != ? AND created_at < ?;`, OutboundQueued, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune outbound messages: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+func (d *Database) queryOutboundMessages(query string, args ...any) ([]*OutboundMessage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbound messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*OutboundMessage
+	for rows.Next() {
+		m, err := scanOutboundMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbound message: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating outbound messages: %w", err)
+	}
+	return messages, nil
+}
+
+func scanOutboundMessage(row interface{ Scan(...any) error }) (*OutboundMessage, error) {
+	var m OutboundMessage
+	if err := row.Scan(&m.ID, &m.UserID, &m.Request, &m.Status, &m.Attempts, &m.NextAttempt, &m.EventID, &m.LastError, &m.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
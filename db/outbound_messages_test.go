@@ -0,0 +1,68 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboundMessages(t *testing.T) {
+	db, err := NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	for i, id := range []string{"m1", "m2"} {
+		created, err := db.EnqueueOutboundMessage(OutboundMessage{
+			ID: id, UserID: "@alice:example.com", Request: `{"body":"hi"}`,
+			NextAttempt: now.Add(time.Duration(i) * time.Minute), CreatedAt: now.Add(time.Duration(i) * time.Second),
+		})
+		require.NoError(t, err)
+		assert.True(t, created)
+	}
+	created, err := db.EnqueueOutboundMessage(OutboundMessage{ID: "m1", UserID: "@alice:example.com", Request: "{}"})
+	require.NoError(t, err)
+	assert.False(t, created, "a message is queued once")
+
+	count, err := db.CountOutboundMessages()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	due, err := db.DueOutboundMessages(now.Add(time.Second), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, "m1", due[0].ID)
+	assert.Equal(t, OutboundQueued, due[0].Status)
+	assert.Equal(t, `{"body":"hi"}`, due[0].Request)
+
+	due[0].Status, due[0].EventID, due[0].Attempts = OutboundSent, "$event", 2
+	require.NoError(t, db.UpdateOutboundMessage(due[0]))
+	m, err := db.GetOutboundMessage("m1")
+	require.NoError(t, err)
+	assert.Equal(t, "$event", m.EventID)
+	assert.Equal(t, 2, m.Attempts)
+
+	queued, err := db.QueuedOutboundMessages("@alice:example.com")
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	assert.Equal(t, "m2", queued[0].ID)
+	queued, err = db.QueuedOutboundMessages("@bob:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, queued)
+
+	settled, err := db.SettledOutboundMessages("@alice:example.com")
+	require.NoError(t, err)
+	require.Len(t, settled, 1)
+	assert.Equal(t, "m1", settled[0].ID)
+
+	// Queued messages are never pruned
+	n, err := db.PruneOutboundMessages(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	require.NoError(t, db.DeleteOutboundMessage("m2"))
+	m, err = db.GetOutboundMessage("m2")
+	require.NoError(t, err)
+	assert.Nil(t, m)
+}
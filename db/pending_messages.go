@@ -0,0 +1,68 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// SavePendingMessages stores the messages of each user not yet delivered by fetch_messages,
+// encoded by the caller, replacing all the stored ones.
+func (d *Database) SavePendingMessages(pending map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM pending_messages;`); err != nil {
+		return fmt.Errorf("failed to clear pending messages: %w", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO pending_messages (user_id, messages, updated_at) VALUES (?, ?, ?);`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare pending messages insert: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	for userID, messages := range pending {
+		if _, err := stmt.Exec(userID, messages, now); err != nil {
+			return fmt.Errorf("failed to save pending messages: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit pending messages: %w", err)
+	}
+
+	logger.Debug().Int("count", len(pending)).Msg("pending messages saved")
+	return nil
+}
+
+// LoadPendingMessages returns the stored pending messages keyed by Matrix user ID.
+func (d *Database) LoadPendingMessages() (map[string]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT user_id, messages FROM pending_messages;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending messages: %w", err)
+	}
+	defer rows.Close()
+
+	pending := make(map[string]string)
+	for rows.Next() {
+		var userID, messages string
+		if err := rows.Scan(&userID, &messages); err != nil {
+			return nil, fmt.Errorf("failed to scan pending messages: %w", err)
+		}
+		pending[userID] = messages
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pending messages: %w", err)
+	}
+	return pending, nil
+}
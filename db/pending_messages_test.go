@@ -0,0 +1,35 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingMessages(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+
+	pending, err := db.LoadPendingMessages()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	require.NoError(t, db.SavePendingMessages(map[string]string{"@alice:example.com": "[1]", "@bob:example.com": "[2]"}))
+	// Users missing from a save no longer have pending messages
+	require.NoError(t, db.SavePendingMessages(map[string]string{"@alice:example.com": "[3]"}))
+	require.NoError(t, db.Close())
+
+	db, err = NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	pending, err = db.LoadPendingMessages()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"@alice:example.com": "[3]"}, pending)
+}
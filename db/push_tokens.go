@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sync"
@@ -18,8 +19,16 @@ type PushToken struct {
 	AppIDMsgs  string
 	TokenCalls string
 	AppIDCalls string
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	// UserName is the Acrobits username that reported the token, used to find its quiet hours.
+	UserName string
+	// Platform ("ios", "android") and Language (e.g. "it") are reported by the client with the token;
+	// they choose the push verb and the language of the texts the proxy writes.
+	Platform string
+	Language string
+	// GatewaySecret authenticates push gateway requests for this token's pusher; never serialized.
+	GatewaySecret string `json:"-"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 // Database manages push token persistence using SQLite.
@@ -70,6 +79,84 @@ func (d *Database) createSchema() error {
 	if err != nil {
 		return fmt.Errorf("failed to create push_tokens table: %w", err)
 	}
+	if err := d.addColumnIfMissing("push_tokens", "gateway_secret", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("push_tokens", "username", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("push_tokens", "platform", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("push_tokens", "language", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// health_check holds a single row rewritten by Check to prove the database is writable.
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS health_check (id INTEGER PRIMARY KEY, checked_at DATETIME);`); err != nil {
+		return fmt.Errorf("failed to create health_check table: %w", err)
+	}
+
+	// batch_tokens keeps the sync position of each user across restarts, see SaveBatchTokens.
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS batch_tokens (user_id TEXT PRIMARY KEY, token TEXT NOT NULL, updated_at DATETIME);`); err != nil {
+		return fmt.Errorf("failed to create batch_tokens table: %w", err)
+	}
+
+	// pending_messages keeps the messages fetched from Matrix beyond the fetch_messages page size,
+	// see SavePendingMessages.
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS pending_messages (user_id TEXT PRIMARY KEY, messages TEXT NOT NULL, updated_at DATETIME);`); err != nil {
+		return fmt.Errorf("failed to create pending_messages table: %w", err)
+	}
+
+	// sent_messages maps the transaction ID of each message sent by a client to its Matrix event,
+	// see SaveSentMessage.
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS sent_messages (txn_id TEXT PRIMARY KEY, event_id TEXT NOT NULL, created_at DATETIME);`); err != nil {
+		return fmt.Errorf("failed to create sent_messages table: %w", err)
+	}
+
+	// outbound_messages queues the messages accepted while the homeserver was unavailable,
+	// see EnqueueOutboundMessage.
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS outbound_messages (id TEXT PRIMARY KEY, user_id TEXT NOT NULL, request TEXT NOT NULL, status TEXT NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, next_attempt DATETIME, event_id TEXT NOT NULL DEFAULT '', last_error TEXT NOT NULL DEFAULT '', created_at DATETIME);`); err != nil {
+		return fmt.Errorf("failed to create outbound_messages table: %w", err)
+	}
+
+	// quiet_hours keeps the do-not-disturb schedule of each user, see SaveQuietHours.
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS quiet_hours (user_name TEXT PRIMARY KEY, start_time TEXT NOT NULL, end_time TEXT NOT NULL, timezone TEXT NOT NULL DEFAULT '', days TEXT NOT NULL DEFAULT '', updated_at DATETIME);`); err != nil {
+		return fmt.Errorf("failed to create quiet_hours table: %w", err)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of the schema.
+func (d *Database) addColumnIfMissing(table, column, definition string) error {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("failed to inspect %s table: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	logger.Info().Str("table", table).Str("column", column).Msg("database schema migrated")
 	return nil
 }
 
@@ -107,13 +194,13 @@ func (d *Database) GetPushToken(selector string) (*PushToken, error) {
 
 	var pt PushToken
 	query := `
-	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at
+	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, username, platform, language, gateway_secret, created_at, updated_at
 	FROM push_tokens
 	WHERE selector = ?;
 	`
 
 	err := d.db.QueryRow(query, selector).Scan(
-		&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt,
+		&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.UserName, &pt.Platform, &pt.Language, &pt.GatewaySecret, &pt.CreatedAt, &pt.UpdatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -133,13 +220,13 @@ func (d *Database) GetPushTokenByPushkey(pushkey string) (*PushToken, error) {
 
 	var pt PushToken
 	query := `
-	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at
+	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, username, platform, language, gateway_secret, created_at, updated_at
 	FROM push_tokens
 	WHERE token_msgs = ? OR token_calls = ?;
 	`
 
 	err := d.db.QueryRow(query, pushkey, pushkey).Scan(
-		&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt,
+		&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.UserName, &pt.Platform, &pt.Language, &pt.GatewaySecret, &pt.CreatedAt, &pt.UpdatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -151,6 +238,51 @@ func (d *Database) GetPushTokenByPushkey(pushkey string) (*PushToken, error) {
 	return &pt, nil
 }
 
+// SetGatewaySecret stores the push gateway secret of the token identified by selector.
+func (d *Database) SetGatewaySecret(selector, secret string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`UPDATE push_tokens SET gateway_secret = ? WHERE selector = ?;`, secret, selector)
+	if err != nil {
+		return fmt.Errorf("failed to set gateway secret: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to set gateway secret: selector %q not found", selector)
+	}
+	return nil
+}
+
+// SetPushTokenUser stores the Acrobits username of the token identified by selector.
+func (d *Database) SetPushTokenUser(selector, userName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`UPDATE push_tokens SET username = ? WHERE selector = ?;`, userName, selector)
+	if err != nil {
+		return fmt.Errorf("failed to set push token user: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to set push token user: selector %q not found", selector)
+	}
+	return nil
+}
+
+// SetPushTokenDevice stores the platform and language reported with the token identified by selector.
+func (d *Database) SetPushTokenDevice(selector, platform, language string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`UPDATE push_tokens SET platform = ?, language = ? WHERE selector = ?;`, platform, language, selector)
+	if err != nil {
+		return fmt.Errorf("failed to set push token device: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to set push token device: selector %q not found", selector)
+	}
+	return nil
+}
+
 // DeletePushToken removes a push token by selector.
 func (d *Database) DeletePushToken(selector string) error {
 	d.mu.Lock()
@@ -172,7 +304,7 @@ func (d *Database) ListPushTokens() ([]*PushToken, error) {
 	defer d.mu.RUnlock()
 
 	query := `
-	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at
+	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, username, platform, language, gateway_secret, created_at, updated_at
 	FROM push_tokens
 	ORDER BY updated_at DESC;
 	`
@@ -186,7 +318,7 @@ func (d *Database) ListPushTokens() ([]*PushToken, error) {
 	var tokens []*PushToken
 	for rows.Next() {
 		var pt PushToken
-		if err := rows.Scan(&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt); err != nil {
+		if err := rows.Scan(&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.UserName, &pt.Platform, &pt.Language, &pt.GatewaySecret, &pt.CreatedAt, &pt.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan push token: %w", err)
 		}
 		tokens = append(tokens, &pt)
@@ -219,8 +351,25 @@ func (d *Database) ResetPushTokens() error {
 	return nil
 }
 
-// Close closes the database connection.
+// Check verifies that the database answers and accepts writes.
+func (d *Database) Check(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	if _, err := d.db.ExecContext(ctx, `INSERT OR REPLACE INTO health_check (id, checked_at) VALUES (1, ?);`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database connection, waiting for the operation in progress, if any.
 func (d *Database) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.db != nil {
 		return d.db.Close()
 	}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"os"
 	"testing"
 	"time"
@@ -166,3 +168,109 @@ func TestListPushTokensEmpty(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, tokens, 0)
 }
+
+func TestGatewaySecret(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("selector1", "token1", "app1", "", ""))
+	require.NoError(t, db.SetGatewaySecret("selector1", "s3cret"))
+
+	// Re-reporting the token must keep the secret.
+	require.NoError(t, db.SavePushToken("selector1", "token1", "app1", "", ""))
+	pt, err := db.GetPushTokenByPushkey("token1")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", pt.GatewaySecret)
+
+	assert.Error(t, db.SetGatewaySecret("missing", "s3cret"))
+}
+
+func TestMigrateGatewaySecretColumn(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	// Create the table as older versions did, without gateway_secret.
+	raw, err := sql.Open("sqlite", tmpFile.Name())
+	require.NoError(t, err)
+	_, err = raw.Exec(`CREATE TABLE push_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		selector TEXT NOT NULL UNIQUE,
+		token_msgs TEXT,
+		appid_msgs TEXT,
+		token_calls TEXT,
+		appid_calls TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO push_tokens (selector, token_msgs, appid_msgs, token_calls, appid_calls) VALUES ('old', 'oldtoken', 'app', '', '');`)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	pt, err := db.GetPushToken("old")
+	require.NoError(t, err)
+	require.NotNil(t, pt)
+	assert.Empty(t, pt.GatewaySecret)
+	require.NoError(t, db.SetGatewaySecret("old", "s3cret"))
+
+	// Opening again must not try to add the column twice.
+	db2, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	db2.Close()
+}
+
+func TestCheck(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+
+	assert.NoError(t, db.Check(context.Background()))
+
+	require.NoError(t, db.Close())
+	assert.Error(t, db.Check(context.Background()))
+}
+
+func TestSetPushTokenUser(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("sel", "tok", "app", "", ""))
+	require.NoError(t, db.SetPushTokenUser("sel", "201"))
+	token, err := db.GetPushTokenByPushkey("tok")
+	require.NoError(t, err)
+	assert.Equal(t, "201", token.UserName)
+
+	assert.Error(t, db.SetPushTokenUser("missing", "201"))
+}
+
+func TestSetPushTokenDevice(t *testing.T) {
+	db, err := NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("sel", "tok", "app", "", ""))
+	require.NoError(t, db.SetPushTokenDevice("sel", "android", "it"))
+	token, err := db.GetPushTokenByPushkey("tok")
+	require.NoError(t, err)
+	assert.Equal(t, "android", token.Platform)
+	assert.Equal(t, "it", token.Language)
+
+	assert.Error(t, db.SetPushTokenDevice("missing", "ios", ""))
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// QuietHours is the do-not-disturb schedule of a user, identified by its Acrobits username.
+// Start and End are "15:04" times in Timezone (UTC when empty); a schedule ending before it starts
+// spans midnight. Days are the weekdays ("mon" to "sun") the schedule starts on; empty means every day.
+type QuietHours struct {
+	User      string    `json:"user"`
+	Start     string    `json:"start"`
+	End       string    `json:"end"`
+	Timezone  string    `json:"timezone,omitempty"`
+	Days      []string  `json:"days,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SaveQuietHours stores the schedule of q.User, replacing the previous one.
+func (d *Database) SaveQuietHours(q QuietHours) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query := `
+	INSERT INTO quiet_hours (user_name, start_time, end_time, timezone, days, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(user_name) DO UPDATE SET
+		start_time = excluded.start_time,
+		end_time = excluded.end_time,
+		timezone = excluded.timezone,
+		days = excluded.days,
+		updated_at = excluded.updated_at;
+	`
+	if _, err := d.db.Exec(query, q.User, q.Start, q.End, q.Timezone, strings.Join(q.Days, ","), time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save quiet hours: %w", err)
+	}
+	logger.Debug().Str("user", q.User).Msg("quiet hours saved")
+	return nil
+}
+
+// GetQuietHours returns the schedule of user, or nil when it has none.
+func (d *Database) GetQuietHours(user string) (*QuietHours, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	row := d.db.QueryRow(`SELECT user_name, start_time, end_time, timezone, days, updated_at FROM quiet_hours WHERE user_name = ?;`, user)
+	q, err := scanQuietHours(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quiet hours: %w", err)
+	}
+	return q, nil
+}
+
+// ListQuietHours returns all the stored schedules, ordered by user.
+func (d *Database) ListQuietHours() ([]*QuietHours, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT user_name, start_time, end_time, timezone, days, updated_at FROM quiet_hours ORDER BY user_name;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quiet hours: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := []*QuietHours{}
+	for rows.Next() {
+		q, err := scanQuietHours(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan quiet hours: %w", err)
+		}
+		schedules = append(schedules, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating quiet hours: %w", err)
+	}
+	return schedules, nil
+}
+
+// DeleteQuietHours removes the schedule of user, reporting whether it had one.
+func (d *Database) DeleteQuietHours(user string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM quiet_hours WHERE user_name = ?;`, user)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete quiet hours: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	logger.Debug().Str("user", user).Msg("quiet hours deleted")
+	return n > 0, nil
+}
+
+func scanQuietHours(row interface{ Scan(...any) error }) (*QuietHours, error) {
+	var q QuietHours
+	var days string
+	if err := row.Scan(&q.User, &q.Start, &q.End, &q.Timezone, &days, &q.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if days != "" {
+		q.Days = strings.Split(days, ",")
+	}
+	return &q, nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuietHours(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	q, err := db.GetQuietHours("201")
+	require.NoError(t, err)
+	assert.Nil(t, q)
+
+	require.NoError(t, db.SaveQuietHours(QuietHours{User: "201", Start: "22:00", End: "07:00", Timezone: "Europe/Rome", Days: []string{"mon", "tue"}}))
+	require.NoError(t, db.SaveQuietHours(QuietHours{User: "202", Start: "12:00", End: "13:00"}))
+	// Saving again replaces the schedule
+	require.NoError(t, db.SaveQuietHours(QuietHours{User: "201", Start: "23:00", End: "07:00", Timezone: "Europe/Rome"}))
+
+	q, err = db.GetQuietHours("201")
+	require.NoError(t, err)
+	require.NotNil(t, q)
+	assert.Equal(t, "23:00", q.Start)
+	assert.Equal(t, "07:00", q.End)
+	assert.Equal(t, "Europe/Rome", q.Timezone)
+	assert.Empty(t, q.Days)
+
+	all, err := db.ListQuietHours()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "202", all[1].User)
+
+	deleted, err := db.DeleteQuietHours("201")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = db.DeleteQuietHours("201")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SaveSentMessage records the Matrix event sent for the transaction txnID, so a retried send
+// returns it instead of sending again.
+func (d *Database) SaveSentMessage(txnID, eventID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+	INSERT INTO sent_messages (txn_id, event_id, created_at) VALUES (?, ?, ?)
+	ON CONFLICT(txn_id) DO UPDATE SET event_id = excluded.event_id;`, txnID, eventID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save sent message: %w", err)
+	}
+	return nil
+}
+
+// GetSentMessage returns the Matrix event sent for txnID, or an empty string when there is none.
+func (d *Database) GetSentMessage(txnID string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var eventID string
+	err := d.db.QueryRow(`SELECT event_id FROM sent_messages WHERE txn_id = ?;`, txnID).Scan(&eventID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get sent message: %w", err)
+	}
+	return eventID, nil
+}
+
+// PruneSentMessages forgets the transactions recorded before the given time and returns how many.
+func (d *Database) PruneSentMessages(before time.Time) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM sent_messages WHERE created_at < ?;`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune sent messages: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
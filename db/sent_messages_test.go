@@ -0,0 +1,35 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSentMessages(t *testing.T) {
+	db, err := NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	defer db.Close()
+
+	eventID, err := db.GetSentMessage("txn1")
+	require.NoError(t, err)
+	assert.Empty(t, eventID)
+
+	require.NoError(t, db.SaveSentMessage("txn1", "$event1"))
+	require.NoError(t, db.SaveSentMessage("txn2", "$event2"))
+	eventID, err = db.GetSentMessage("txn1")
+	require.NoError(t, err)
+	assert.Equal(t, "$event1", eventID)
+
+	n, err := db.PruneSentMessages(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	n, err = db.PruneSentMessages(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	eventID, err = db.GetSentMessage("txn2")
+	require.NoError(t, err)
+	assert.Empty(t, eventID)
+}
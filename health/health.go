@@ -0,0 +1,196 @@
+// Package health runs dependency checks for the readiness endpoint and caches their results.
+package health
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status values of a check and of a whole report.
+const (
+	StatusOK = "ok"
+	// StatusDegraded means only non-critical checks failed; the proxy is still ready.
+	StatusDegraded = "degraded"
+	StatusFail     = "fail"
+)
+
+const (
+	defaultCacheTTL = 10 * time.Second
+	defaultTimeout  = 5 * time.Second
+)
+
+// Check is a single dependency check. A failing critical check makes the proxy not ready.
+type Check struct {
+	Name     string
+	Critical bool
+	Run      func(ctx context.Context) error
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the outcome of all checks of a Checker.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Ready reports whether no critical check failed.
+func (r Report) Ready() bool {
+	return r.Status != StatusFail
+}
+
+// Summary is the public view of a Report: the status of each check, without the errors that
+// may reveal internal addresses or configuration.
+type Summary struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Summary returns the public view of r.
+func (r Report) Summary() Summary {
+	summary := Summary{Status: r.Status, Checks: make(map[string]string, len(r.Checks))}
+	for name, res := range r.Checks {
+		summary.Checks[name] = res.Status
+	}
+	return summary
+}
+
+// Checker runs its checks concurrently and caches the report for a TTL,
+// so frequent probes do not hammer the dependencies.
+type Checker struct {
+	checks  []Check
+	ttl     time.Duration
+	timeout time.Duration
+	now     func() time.Time
+
+	mu       sync.Mutex
+	last     Report
+	lastTime time.Time
+
+	draining atomic.Bool
+}
+
+// NewChecker creates a Checker. ttl is how long a report is reused and timeout bounds each check.
+func NewChecker(ttl, timeout time.Duration, checks ...Check) *Checker {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Checker{checks: checks, ttl: ttl, timeout: timeout, now: time.Now}
+}
+
+// NewCheckerFromEnv creates a Checker configured by HEALTH_CACHE_SECONDS (default 10, 0 disables caching)
+// and HEALTH_CHECK_TIMEOUT_SECONDS (default 5).
+func NewCheckerFromEnv(checks ...Check) *Checker {
+	ttl := defaultCacheTTL
+	if v := os.Getenv("HEALTH_CACHE_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			ttl = time.Duration(parsed) * time.Second
+		}
+	}
+	timeout := defaultTimeout
+	if v := os.Getenv("HEALTH_CHECK_TIMEOUT_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			timeout = time.Duration(parsed) * time.Second
+		}
+	}
+	return NewChecker(ttl, timeout, checks...)
+}
+
+// Drain makes every later report fail, so load balancers stop routing requests
+// to the proxy while it shuts down.
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Report returns the cached report or runs the checks if it is older than the TTL.
+// Concurrent callers wait for a single run instead of starting their own.
+func (c *Checker) Report(ctx context.Context) Report {
+	if c.draining.Load() {
+		return Report{Status: StatusFail, Checks: map[string]Result{
+			"shutdown": {Status: StatusFail, Critical: true, Error: "shutting down", CheckedAt: c.now().UTC()},
+		}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.lastTime.IsZero() && c.now().Sub(c.lastTime) < c.ttl {
+		return c.last
+	}
+	// A probe that disconnects must not leave a failed report in the cache.
+	c.last = c.run(context.WithoutCancel(ctx))
+	c.lastTime = c.now()
+	return c.last
+}
+
+func (c *Checker) run(ctx context.Context) Report {
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = c.runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(c.checks))}
+	for i, check := range c.checks {
+		report.Checks[check.Name] = results[i]
+		report.Status = worse(report.Status, results[i])
+	}
+	return report
+}
+
+func (c *Checker) runCheck(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	res := Result{
+		Status:    StatusOK,
+		Critical:  check.Critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: c.now().UTC(),
+	}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Merge combines reports, prefixing each check name with the key of its report and a slash.
+func Merge(reports map[string]Report) Report {
+	merged := Report{Status: StatusOK, Checks: make(map[string]Result)}
+	for prefix, r := range reports {
+		for name, res := range r.Checks {
+			merged.Checks[prefix+"/"+name] = res
+			merged.Status = worse(merged.Status, res)
+		}
+	}
+	return merged
+}
+
+// worse returns the report status after taking res into account.
+func worse(status string, res Result) string {
+	if res.Status == StatusOK || status == StatusFail {
+		return status
+	}
+	if res.Critical {
+		return StatusFail
+	}
+	return StatusDegraded
+}
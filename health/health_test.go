@@ -0,0 +1,105 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker_Statuses(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("unreachable") }
+
+	r := NewChecker(0, time.Second, Check{Name: "a", Critical: true, Run: ok}, Check{Name: "b", Run: ok}).Report(context.Background())
+	assert.Equal(t, StatusOK, r.Status)
+	assert.True(t, r.Ready())
+	assert.Len(t, r.Checks, 2)
+
+	r = NewChecker(0, time.Second, Check{Name: "a", Critical: true, Run: ok}, Check{Name: "b", Run: fail}).Report(context.Background())
+	assert.Equal(t, StatusDegraded, r.Status)
+	assert.True(t, r.Ready())
+	assert.Equal(t, StatusFail, r.Checks["b"].Status)
+	assert.Equal(t, "unreachable", r.Checks["b"].Error)
+
+	r = NewChecker(0, time.Second, Check{Name: "a", Critical: true, Run: fail}, Check{Name: "b", Run: fail}).Report(context.Background())
+	assert.Equal(t, StatusFail, r.Status)
+	assert.False(t, r.Ready())
+}
+
+func TestChecker_CachesReport(t *testing.T) {
+	var calls atomic.Int32
+	check := Check{Name: "a", Critical: true, Run: func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	}}
+	now := time.Unix(1700000000, 0)
+	c := NewChecker(10*time.Second, time.Second, check)
+	c.now = func() time.Time { return now }
+
+	c.Report(context.Background())
+	c.Report(context.Background())
+	assert.Equal(t, int32(1), calls.Load())
+
+	now = now.Add(11 * time.Second)
+	c.Report(context.Background())
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestChecker_Timeout(t *testing.T) {
+	slow := Check{Name: "slow", Critical: true, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	r := NewChecker(0, 10*time.Millisecond, slow).Report(context.Background())
+	assert.Equal(t, StatusFail, r.Status)
+	assert.Contains(t, r.Checks["slow"].Error, "deadline exceeded")
+}
+
+func TestChecker_IgnoresCallerCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	check := Check{Name: "a", Critical: true, Run: func(ctx context.Context) error { return ctx.Err() }}
+	r := NewChecker(time.Minute, time.Second, check).Report(ctx)
+	assert.Equal(t, StatusOK, r.Status)
+}
+
+func TestChecker_Drain(t *testing.T) {
+	var calls atomic.Int32
+	c := NewChecker(time.Minute, time.Second, Check{Name: "a", Critical: true, Run: func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	}})
+	assert.True(t, c.Report(context.Background()).Ready())
+
+	c.Drain()
+	r := c.Report(context.Background())
+	assert.False(t, r.Ready(), "a cached ok report must not hide the shutdown")
+	assert.Equal(t, StatusFail, r.Checks["shutdown"].Status)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestMerge(t *testing.T) {
+	r := Merge(map[string]Report{
+		"acme":   {Status: StatusOK, Checks: map[string]Result{"matrix": {Status: StatusOK, Critical: true}}},
+		"globex": {Status: StatusDegraded, Checks: map[string]Result{"pnm": {Status: StatusFail}}},
+	})
+	assert.Equal(t, StatusDegraded, r.Status)
+	assert.Contains(t, r.Checks, "acme/matrix")
+	assert.Contains(t, r.Checks, "globex/pnm")
+
+	r = Merge(nil)
+	assert.Equal(t, StatusOK, r.Status)
+	assert.Empty(t, r.Checks)
+}
+
+func TestReport_Summary(t *testing.T) {
+	r := Report{Status: StatusDegraded, Checks: map[string]Result{
+		"matrix": {Status: StatusOK, Critical: true},
+		"pnm":    {Status: StatusFail, Error: "dial tcp 10.0.0.5:443: connection refused"},
+	}}
+	assert.Equal(t, Summary{Status: StatusDegraded, Checks: map[string]string{"matrix": StatusOK, "pnm": StatusFail}}, r.Summary())
+}
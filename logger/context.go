@@ -0,0 +1,39 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+type ctxKey struct{}
+
+// WithContext returns a copy of ctx carrying l. Services log through Ctx so that
+// their lines carry the fields of the request they serve.
+func WithContext(ctx context.Context, l zerolog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, &l)
+}
+
+// Ctx returns the logger carried by ctx, or the global logger when there is none.
+func Ctx(ctx context.Context) *zerolog.Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*zerolog.Logger); ok {
+			return l
+		}
+	}
+	return &log
+}
+
+// AddStr adds a field to the logger carried by ctx, so every later line of the request includes it.
+// It does nothing when ctx carries no logger: the global logger is never modified.
+// Like zerolog's UpdateContext it must not race with lines logged by other goroutines of the request.
+func AddStr(ctx context.Context, key, value string) {
+	if ctx == nil {
+		return
+	}
+	if l, ok := ctx.Value(ctxKey{}).(*zerolog.Logger); ok {
+		l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Str(key, value)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCtx(t *testing.T) {
+	var buf bytes.Buffer
+	InitWithOptions(LevelDebug, &buf, Options{Format: FormatJSON, Redaction: DefaultRedaction()})
+
+	ctx := WithContext(context.Background(), With().Str("request_id", "abc").Logger())
+	AddStr(ctx, "user", "201")
+	Ctx(ctx).Info().Msg("first")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "abc", line["request_id"])
+	assert.Equal(t, "201", line["user"])
+	assert.Equal(t, "first", line["message"])
+
+	// Without a request logger Ctx falls back to the global one, which AddStr leaves untouched.
+	buf.Reset()
+	AddStr(context.Background(), "user", "202")
+	Ctx(context.Background()).Info().Msg("second")
+	assert.NotContains(t, buf.String(), `"user"`)
+	assert.NotContains(t, buf.String(), "request_id")
+}
+
+func TestDebugSampling(t *testing.T) {
+	var buf bytes.Buffer
+	InitWithOptions(LevelDebug, &buf, Options{Format: FormatJSON, DebugSample: 10})
+	t.Cleanup(func() { setRedaction(DefaultRedaction()) })
+
+	for range 100 {
+		Debug().Msg("noisy")
+	}
+	Info().Msg("kept")
+
+	lines := strings.Count(buf.String(), "\n")
+	assert.Equal(t, 11, lines, "one debug line out of ten plus every info line")
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "JSON")
+	t.Setenv("LOG_DEBUG_SAMPLE", "5")
+
+	opts := OptionsFromEnv()
+	assert.Equal(t, FormatJSON, opts.Format)
+	assert.Equal(t, uint32(5), opts.DebugSample)
+
+	t.Setenv("LOG_FORMAT", "")
+	t.Setenv("LOG_DEBUG_SAMPLE", "bogus")
+	opts = OptionsFromEnv()
+	assert.Equal(t, FormatConsole, opts.Format)
+	assert.Zero(t, opts.DebugSample)
+}
@@ -3,6 +3,7 @@ package logger
 import (
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,46 +22,81 @@ const (
 	LevelCritical Level = "CRITICAL"
 )
 
-// Init initializes the global logger with the specified level
-func Init(level Level) {
-	var zLevel zerolog.Level
-	switch strings.ToUpper(string(level)) {
-	case string(LevelDebug):
-		zLevel = zerolog.DebugLevel
-	case string(LevelInfo):
-		zLevel = zerolog.InfoLevel
-	case string(LevelWarning):
-		zLevel = zerolog.WarnLevel
-	case string(LevelCritical):
-		zLevel = zerolog.ErrorLevel
-	default:
-		zLevel = zerolog.InfoLevel
+// Format is the output format of the logger.
+type Format string
+
+const (
+	FormatConsole Format = "console"
+	FormatJSON    Format = "json"
+)
+
+// Options configures the output of the global logger.
+type Options struct {
+	// Format selects human-readable console output (default) or one JSON object per line.
+	Format Format
+	// DebugSample keeps one debug line out of DebugSample; 0 or 1 keeps them all.
+	DebugSample uint32
+	// Redaction configures how secrets and message bodies are hidden from the logs.
+	Redaction Redaction
+}
+
+// OptionsFromEnv reads LOG_FORMAT (console or json), LOG_DEBUG_SAMPLE and the
+// redaction variables described in RedactionFromEnv.
+func OptionsFromEnv() Options {
+	opts := Options{Format: FormatConsole, Redaction: RedactionFromEnv()}
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), string(FormatJSON)) {
+		opts.Format = FormatJSON
+	}
+	if v := os.Getenv("LOG_DEBUG_SAMPLE"); v != "" {
+		if parsed, err := strconv.ParseUint(v, 10, 32); err == nil {
+			opts.DebugSample = uint32(parsed)
+		}
 	}
+	return opts
+}
 
-	zerolog.SetGlobalLevel(zLevel)
-	// Configure zerolog for human-readable output
-	log = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).Level(zLevel).With().Timestamp().Logger()
+// Init initializes the global logger with the specified level, writing to stdout
+// with the options read from the environment.
+func Init(level Level) {
+	InitWithOptions(level, os.Stdout, OptionsFromEnv())
 }
 
 // InitWithWriter initializes the logger with a custom writer (useful for testing)
 func InitWithWriter(level Level, w io.Writer) {
-	var zLevel zerolog.Level
+	InitWithOptions(level, w, Options{Format: FormatConsole, Redaction: DefaultRedaction()})
+}
+
+// InitWithOptions initializes the global logger with the specified level, writer and options.
+func InitWithOptions(level Level, w io.Writer, opts Options) {
+	zLevel := parseLevel(level)
+	zerolog.SetGlobalLevel(zLevel)
+	setRedaction(opts.Redaction)
+
+	out := w
+	if opts.Format != FormatJSON {
+		// Configure zerolog for human-readable output
+		out = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}
+	}
+	l := zerolog.New(out).Level(zLevel).With().Timestamp().Logger()
+	if opts.DebugSample > 1 {
+		l = l.Sample(zerolog.LevelSampler{DebugSampler: &zerolog.BasicSampler{N: opts.DebugSample}})
+	}
+	log = l
+}
+
+func parseLevel(level Level) zerolog.Level {
 	switch strings.ToUpper(string(level)) {
 	case string(LevelDebug):
-		zLevel = zerolog.DebugLevel
+		return zerolog.DebugLevel
 	case string(LevelInfo):
-		zLevel = zerolog.InfoLevel
+		return zerolog.InfoLevel
 	case string(LevelWarning):
-		zLevel = zerolog.WarnLevel
+		return zerolog.WarnLevel
 	case string(LevelCritical):
-		zLevel = zerolog.ErrorLevel
+		return zerolog.ErrorLevel
 	default:
-		zLevel = zerolog.InfoLevel
+		return zerolog.InfoLevel
 	}
-
-	zerolog.SetGlobalLevel(zLevel)
-	// Configure zerolog for human-readable output
-	log = zerolog.New(zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}).Level(zLevel).With().Timestamp().Logger()
 }
 
 // Debug logs a debug message
@@ -0,0 +1,179 @@
+package logger
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// Redacted replaces hidden values in the logs.
+const Redacted = "[REDACTED]"
+
+// Redaction configures which values are hidden from the logs. Values logged with Interface
+// are redacted by key, recursively; plain Str fields holding secrets go through Secret.
+type Redaction struct {
+	// Enabled turns redaction on; it is on unless LOG_REDACT=false.
+	Enabled bool
+	// Bodies also hides message bodies (body, formatted_body, sms_text, message).
+	Bodies bool
+	// Fields are additional keys to hide, matched case-insensitively.
+	Fields []string
+}
+
+// Keys always hidden when redaction is enabled, besides any key containing
+// "password", "secret" or "token".
+var secretKeys = []string{"pushkey", "authorization"}
+
+var bodyKeys = []string{"body", "formatted_body", "sms_text", "message"}
+
+var redaction atomic.Pointer[redactor]
+
+type redactor struct {
+	keys map[string]bool
+}
+
+func init() {
+	setRedaction(DefaultRedaction())
+	zerolog.InterfaceMarshalFunc = marshalRedacted
+}
+
+// DefaultRedaction hides secrets and message bodies.
+func DefaultRedaction() Redaction {
+	return Redaction{Enabled: true, Bodies: true}
+}
+
+// RedactionFromEnv reads LOG_REDACT (default true), LOG_REDACT_BODIES (default true)
+// and LOG_REDACT_FIELDS, a comma-separated list of additional keys to hide.
+func RedactionFromEnv() Redaction {
+	r := DefaultRedaction()
+	if v := os.Getenv("LOG_REDACT"); v != "" {
+		r.Enabled = !isFalse(v)
+	}
+	if v := os.Getenv("LOG_REDACT_BODIES"); v != "" {
+		r.Bodies = !isFalse(v)
+	}
+	for _, f := range strings.Split(os.Getenv("LOG_REDACT_FIELDS"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			r.Fields = append(r.Fields, f)
+		}
+	}
+	return r
+}
+
+func isFalse(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "false", "0", "no", "off":
+		return true
+	}
+	return false
+}
+
+func setRedaction(r Redaction) {
+	if !r.Enabled {
+		redaction.Store(nil)
+		return
+	}
+	keys := make(map[string]bool)
+	for _, k := range secretKeys {
+		keys[k] = true
+	}
+	if r.Bodies {
+		for _, k := range bodyKeys {
+			keys[k] = true
+		}
+	}
+	for _, k := range r.Fields {
+		keys[strings.ToLower(k)] = true
+	}
+	redaction.Store(&redactor{keys: keys})
+}
+
+// Secret returns Redacted instead of s when redaction is enabled. Use it for Str fields
+// holding push keys, tokens and similar values.
+func Secret(s string) string {
+	if redaction.Load() == nil || s == "" {
+		return s
+	}
+	return Redacted
+}
+
+// Redact returns a copy of v, as decoded from its JSON encoding, with the hidden keys replaced.
+// It returns v unchanged when redaction is disabled.
+func Redact(v any) any {
+	r := redaction.Load()
+	if r == nil {
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return v
+	}
+	return r.redact(decoded)
+}
+
+// marshalRedacted is installed as zerolog's InterfaceMarshalFunc, so every Interface field is redacted.
+func marshalRedacted(v any) ([]byte, error) {
+	return json.Marshal(Redact(v))
+}
+
+func (r *redactor) hidden(key string) bool {
+	k := strings.ToLower(key)
+	return r.keys[k] || strings.Contains(k, "password") || strings.Contains(k, "secret") || strings.Contains(k, "token")
+}
+
+func (r *redactor) redact(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			if r.hidden(k) {
+				if child != nil && child != "" {
+					val[k] = Redacted
+				}
+				continue
+			}
+			val[k] = r.redact(child)
+		}
+		return val
+	case []any:
+		for i, child := range val {
+			val[i] = r.redact(child)
+		}
+		return val
+	case string:
+		return r.redactURL(val)
+	default:
+		return v
+	}
+}
+
+// redactURL hides the query parameters of a URL whose name is hidden, e.g. the pusher secret.
+func (r *redactor) redactURL(s string) string {
+	if !strings.Contains(s, "://") || !strings.Contains(s, "?") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	changed := false
+	for k := range q {
+		if r.hidden(k) {
+			q.Set(k, Redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return s
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
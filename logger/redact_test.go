@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type redactSample struct {
+	UserName  string            `json:"user_name"`
+	Password  string            `json:"password"`
+	TokenMsgs string            `json:"token_msgs"`
+	Body      string            `json:"body"`
+	Content   map[string]string `json:"content"`
+	URL       string            `json:"url"`
+}
+
+var sample = redactSample{
+	UserName:  "201",
+	Password:  "hunter2",
+	TokenMsgs: "device-token",
+	Body:      "hello",
+	Content:   map[string]string{"msgtype": "m.text", "body": "nested hello"},
+	URL:       "https://proxy.example.com/_matrix/push/v1/notify?secret=abcd",
+}
+
+// logJSON logs sample as JSON with the given redaction and returns the decoded line.
+func logJSON(t *testing.T, r Redaction) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	InitWithOptions(LevelInfo, &buf, Options{Format: FormatJSON, Redaction: r})
+	t.Cleanup(func() { setRedaction(DefaultRedaction()) })
+
+	Info().Interface("request", sample).Msg("test")
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	return line["request"].(map[string]any)
+}
+
+func TestRedaction_Default(t *testing.T) {
+	req := logJSON(t, DefaultRedaction())
+
+	assert.Equal(t, "201", req["user_name"])
+	assert.Equal(t, Redacted, req["password"])
+	assert.Equal(t, Redacted, req["token_msgs"])
+	assert.Equal(t, Redacted, req["body"])
+	assert.Equal(t, Redacted, req["content"].(map[string]any)["body"])
+	assert.Equal(t, "m.text", req["content"].(map[string]any)["msgtype"])
+	assert.NotContains(t, req["url"], "abcd")
+}
+
+func TestRedaction_KeepBodies(t *testing.T) {
+	req := logJSON(t, Redaction{Enabled: true, Fields: []string{"User_Name"}})
+
+	assert.Equal(t, Redacted, req["user_name"])
+	assert.Equal(t, Redacted, req["password"])
+	assert.Equal(t, "hello", req["body"])
+}
+
+func TestRedaction_Disabled(t *testing.T) {
+	req := logJSON(t, Redaction{})
+
+	assert.Equal(t, "hunter2", req["password"])
+	assert.Equal(t, sample.URL, req["url"])
+	assert.Equal(t, "abc", Secret("abc"))
+}
+
+func TestSecret(t *testing.T) {
+	setRedaction(DefaultRedaction())
+
+	assert.Equal(t, Redacted, Secret("device-token"))
+	assert.Equal(t, "", Secret(""))
+}
+
+func TestRedactionFromEnv(t *testing.T) {
+	t.Setenv("LOG_REDACT", "")
+	t.Setenv("LOG_REDACT_BODIES", "false")
+	t.Setenv("LOG_REDACT_FIELDS", "sender, room_name")
+
+	r := RedactionFromEnv()
+	assert.True(t, r.Enabled)
+	assert.False(t, r.Bodies)
+	assert.Equal(t, []string{"sender", "room_name"}, r.Fields)
+
+	t.Setenv("LOG_REDACT", "off")
+	assert.False(t, RedactionFromEnv().Enabled)
+}
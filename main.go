@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/nethesis/matrix2acrobits/api"
-	"github.com/nethesis/matrix2acrobits/db"
 	"github.com/nethesis/matrix2acrobits/logger"
-	"github.com/nethesis/matrix2acrobits/matrix"
-	"github.com/nethesis/matrix2acrobits/service"
-	"maunium.net/go/mautrix/id"
+	"github.com/nethesis/matrix2acrobits/server"
+	"github.com/nethesis/matrix2acrobits/tenant"
+	"github.com/nethesis/matrix2acrobits/tracing"
 )
 
 const defaultPort = "8080"
@@ -24,6 +28,17 @@ func main() {
 	logger.Init(logger.Level(logLevel))
 	logger.Info().Str("level", logLevel).Msg("logger initialized")
 
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize tracing")
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Warn().Err(err).Msg("failed to flush traces")
+		}
+	}()
+	logger.Info().Bool("enabled", tracing.Enabled()).Msg("tracing initialized")
+
 	port := os.Getenv("PROXY_PORT")
 	if port == "" {
 		port = defaultPort
@@ -31,15 +46,67 @@ func main() {
 
 	e := echo.New()
 	e.HideBanner = true
+	// Trust X-Forwarded-For only from loopback and private addresses (e.g. a local traefik),
+	// so clients cannot spoof their IP to evade per-IP rate limiting.
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
 	e.Pre(middleware.RemoveTrailingSlash())
 	e.Use(middleware.RequestID())
+	e.Use(tracing.Middleware())
+	e.Use(api.RequestLogger())
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
-	e.GET("/health", func(c echo.Context) error {
-		return c.JSON(200, map[string]string{"status": "ok"})
-	})
+	var configs []tenant.Config
+	if tenantsFile := os.Getenv("TENANTS_FILE"); tenantsFile != "" {
+		configs, err = tenant.LoadConfigs(tenantsFile)
+		if err != nil {
+			logger.Fatal().Err(err).Str("file", tenantsFile).Msg("failed to load tenants")
+		}
+		logger.Info().Int("count", len(configs)).Str("file", tenantsFile).Msg("multi-tenant mode enabled")
+	} else {
+		configs = []tenant.Config{singleTenantConfig()}
+	}
+
+	tenants := make([]*tenant.Tenant, 0, len(configs))
+	for _, cfg := range configs {
+		t, err := tenant.New(cfg)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize tenant")
+		}
+		tenants = append(tenants, t)
+	}
+
+	api.RegisterTenantRoutes(e, tenants)
+
+	serverCfg, err := server.ConfigFromEnv(":" + port)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid server configuration")
+	}
+	stopServer, err := server.Configure(e.Server, serverCfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to configure server")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		logger.Info().Str("port", port).Str("protocols", serverCfg.Describe()).Msg("starting server")
+		if err := e.StartServer(e.Server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal().Err(err).Msg("server stopped")
+		}
+	}()
+
+	<-ctx.Done()
+	// A second signal terminates the process without waiting for the drain.
+	stop()
+	logger.Info().Msg("shutdown signal received, draining")
+	gracefulShutdown(e, stopServer, tenants, shutdownConfigFromEnv())
+}
 
+// singleTenantConfig builds the configuration of the only tenant served when
+// TENANTS_FILE is not set, using the legacy environment variables.
+func singleTenantConfig() tenant.Config {
 	homeserver := os.Getenv("MATRIX_HOMESERVER_URL")
 	if homeserver == "" {
 		logger.Fatal().Msg("MATRIX_HOMESERVER_URL is required")
@@ -55,29 +122,12 @@ func main() {
 		logger.Fatal().Msg("AS_USER_ID is required (e.g., '@_acrobits_proxy:your.server.com')")
 	}
 
-	logger.Info().Str("homeserver", homeserver).Str("as_user_id", asUserID).Msg("initializing matrix client")
-
-	matrixClient, err := matrix.NewClient(matrix.Config{
-		HomeserverURL: homeserver,
-		AsToken:       adminToken,
-		AsUserID:      id.UserID(asUserID),
-	})
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to initialize matrix client")
-	}
-
 	// Initialize push token database
 	pushTokenDBPath := os.Getenv("PUSH_TOKEN_DB_PATH")
 	if pushTokenDBPath == "" {
 		pushTokenDBPath = "/tmp/push_tokens.db"
 	}
 
-	pushTokenDB, err := db.NewDatabase(pushTokenDBPath)
-	if err != nil {
-		logger.Fatal().Err(err).Str("path", pushTokenDBPath).Msg("failed to initialize push token database")
-	}
-	defer pushTokenDB.Close()
-
 	// Get proxy URL for pusher registration
 	proxyURL := os.Getenv("PROXY_URL")
 	if proxyURL == "" {
@@ -87,20 +137,16 @@ func main() {
 		logger.Info().Str("proxy_url", proxyURL).Msg("proxy URL configured for pusher registration")
 	}
 
-	svc := service.NewMessageService(matrixClient, pushTokenDB, proxyURL)
-	pushSvc := service.NewPushService(pushTokenDB)
-	api.RegisterRoutes(e, svc, pushSvc, adminToken, pushTokenDB)
-
-	// Load mappings from file if MAPPING_FILE env var is set
-	mappingFile := os.Getenv("MAPPING_FILE")
-	if mappingFile != "" {
-		if err := svc.LoadMappingsFromFile(mappingFile); err != nil {
-			logger.Error().Err(err).Str("file", mappingFile).Msg("failed to load mappings from file")
-		}
-	}
-
-	logger.Info().Str("port", port).Msg("starting server")
-	if err := e.Start(":" + port); err != nil {
-		logger.Fatal().Err(err).Msg("server stopped")
+	return tenant.Config{
+		Name:            "default",
+		HomeserverURL:   homeserver,
+		AsToken:         adminToken,
+		AsUserID:        asUserID,
+		HsToken:         os.Getenv("HS_TOKEN"),
+		ProxyURL:        proxyURL,
+		PushTokenDBPath: pushTokenDBPath,
+		CryptoDBPath:    os.Getenv("E2EE_DB_PATH"),
+		// Load mappings from file if MAPPING_FILE env var is set
+		MappingFile: os.Getenv("MAPPING_FILE"),
 	}
 }
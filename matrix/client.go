@@ -2,6 +2,9 @@ package matrix
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
@@ -10,7 +13,10 @@ import (
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/metrics"
 	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -22,6 +28,10 @@ type Config struct {
 	AsUserID      id.UserID
 	AsToken       string
 	HTTPClient    *http.Client
+	// Retry configures retries and the circuit breaker, see RetryConfigFromEnv.
+	Retry RetryConfig
+	// Tenant labels the metrics of the client's calls.
+	Tenant string
 }
 
 // MatrixClient is a client wrapper for performing Application Service actions.
@@ -29,9 +39,17 @@ type Config struct {
 // A mutex is used to make operations thread-safe.
 type MatrixClient struct {
 	cli            *mautrix.Client
+	asUserID       id.UserID
 	homeserverURL  string
 	homeserverName string
-	mu             sync.Mutex
+	mediaKey       []byte
+	// crypto is set when end-to-bridge encryption is enabled, see EnableCrypto.
+	crypto cryptoProvider
+	// retryCfg and breaker handle rate limiting and transient errors, see do.
+	retryCfg RetryConfig
+	breaker  *breaker
+	metrics  metrics.Tenant
+	mu       sync.Mutex
 }
 
 // NewClient creates a MatrixClient authenticated as an Application Service.
@@ -48,7 +66,7 @@ func NewClient(cfg Config) (*MatrixClient, error) {
 
 	httpClient := cfg.HTTPClient
 	if httpClient == nil {
-		httpClient = &http.Client{Timeout: 30 * time.Second}
+		httpClient = &http.Client{Timeout: 30 * time.Second, Transport: tracing.Transport(nil)}
 	}
 
 	// For v0.26.0, the AS token and user ID are passed to NewClient.
@@ -72,28 +90,53 @@ func NewClient(cfg Config) (*MatrixClient, error) {
 	}
 	homeserverName = strings.SplitN(homeserverName, ":", 2)[0] // Remove port if present
 
+	// Media URLs handed to clients are signed with a key derived from the AS token,
+	// so they stay valid across restarts without further configuration.
+	mac := hmac.New(sha256.New, []byte(cfg.AsToken))
+	mac.Write([]byte("matrix2acrobits media"))
+
 	return &MatrixClient{
 		cli:            client,
+		asUserID:       cfg.AsUserID,
 		homeserverURL:  cfg.HomeserverURL,
 		homeserverName: homeserverName,
+		mediaKey:       mac.Sum(nil),
+		retryCfg:       cfg.Retry,
+		breaker:        &breaker{threshold: cfg.Retry.BreakerThreshold, cooldown: cfg.Retry.BreakerCooldown},
+		metrics:        metrics.Tenant(cfg.Tenant),
 	}, nil
 }
 
 // SendMessage sends a message to a room, impersonating the specified userID.
-func (mc *MatrixClient) SendMessage(ctx context.Context, userID id.UserID, roomID id.RoomID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+// The homeserver answers a repeated txnID with the event it already sent; an empty txnID gets a fresh one.
+func (mc *MatrixClient) SendMessage(ctx context.Context, userID id.UserID, roomID id.RoomID, content *event.MessageEventContent, txnID string) (*mautrix.RespSendEvent, error) {
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: sending message event")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: sending message event")
 
 	mc.cli.UserID = userID
-	resp, err := mc.cli.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	ctx, end := mc.startCall(ctx, "send_message", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)))
+	var resp *mautrix.RespSendEvent
+	// Without a transaction ID each attempt would get a fresh one, and could be sent twice
+	err := mc.do(ctx, userID, txnID != "", func(ctx context.Context) (err error) {
+		if mc.crypto != nil {
+			resp, err = mc.crypto.send(ctx, userID, roomID, content, txnID)
+		} else {
+			resp, err = mc.cli.SendMessageEvent(ctx, roomID, event.EventMessage, content, mautrix.ReqSendEvent{TransactionID: txnID})
+		}
+		return err
+	})
+	if err == nil {
+		tracing.SetAttributes(ctx, tracing.AttrEventID.String(string(resp.EventID)))
+	}
+	end(err)
 	if err != nil {
-		logger.Error().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("matrix: failed to send message event")
+		logger.Ctx(ctx).Error().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("matrix: failed to send message event")
 		return nil, err
 	}
 
-	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(resp.EventID)).Msg("matrix: message event sent")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(resp.EventID)).Msg("matrix: message event sent")
 	return resp, nil
 }
 
@@ -103,19 +146,29 @@ func (mc *MatrixClient) Sync(ctx context.Context, userID id.UserID, batchToken s
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	logger.Debug().Str("user_id", string(userID)).Str("batch_token", batchToken).Msg("matrix: performing sync with token")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("batch_token", batchToken).Msg("matrix: performing sync with token")
 
 	mc.cli.UserID = userID
 
 	// The SyncRequest method signature: SyncRequest(ctx, timeoutMS, since, filter, fullState, setPresence)
 	// Pass batchToken as the 'since' parameter for incremental sync
-	resp, err := mc.cli.SyncRequest(ctx, 30000, batchToken, "", true, "online")
+	ctx, end := mc.startCall(ctx, "sync", tracing.AttrUserID.String(string(userID)))
+	var resp *mautrix.RespSync
+	err := mc.do(ctx, userID, true, func(ctx context.Context) (err error) {
+		if mc.crypto != nil {
+			resp, err = mc.crypto.sync(ctx, userID, batchToken)
+		} else {
+			resp, err = mc.cli.SyncRequest(ctx, 30000, batchToken, "", true, "online")
+		}
+		return err
+	})
+	end(err)
 	if err != nil {
-		logger.Error().Str("user_id", string(userID)).Err(err).Msg("matrix: sync failed")
+		logger.Ctx(ctx).Error().Str("user_id", string(userID)).Err(err).Msg("matrix: sync failed")
 		return nil, err
 	}
 
-	logger.Debug().Str("user_id", string(userID)).Int("rooms", len(resp.Rooms.Join)).Str("next_batch", resp.NextBatch).Msg("matrix: sync completed")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Int("rooms", len(resp.Rooms.Join)).Str("next_batch", resp.NextBatch).Msg("matrix: sync completed")
 	return resp, nil
 }
 
@@ -124,7 +177,7 @@ func (mc *MatrixClient) CreateDirectRoom(ctx context.Context, userID id.UserID,
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	logger.Debug().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Msg("matrix: creating direct room")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Msg("matrix: creating direct room")
 
 	mc.cli.UserID = userID
 	req := &mautrix.ReqCreateRoom{
@@ -137,13 +190,19 @@ func (mc *MatrixClient) CreateDirectRoom(ctx context.Context, userID id.UserID,
 	if aliasKey != "" {
 		req.RoomAliasName = aliasKey
 	}
-	resp, err := mc.cli.CreateRoom(ctx, req)
+	ctx, end := mc.startCall(ctx, "create_room", tracing.AttrUserID.String(string(userID)), attribute.String("matrix.target_user_id", string(targetUserID)))
+	var resp *mautrix.RespCreateRoom
+	err := mc.do(ctx, userID, false, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.CreateRoom(ctx, req)
+		return err
+	})
+	end(err)
 	if err != nil {
-		logger.Error().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Err(err).Msg("matrix: failed to create direct room")
+		logger.Ctx(ctx).Error().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Err(err).Msg("matrix: failed to create direct room")
 		return nil, err
 	}
 
-	logger.Info().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Str("room_id", string(resp.RoomID)).Msg("matrix: direct room created")
+	logger.Ctx(ctx).Info().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Str("room_id", string(resp.RoomID)).Msg("matrix: direct room created")
 	return resp, nil
 }
 
@@ -153,35 +212,290 @@ func (mc *MatrixClient) JoinRoom(ctx context.Context, userID id.UserID, roomID i
 	defer mc.mu.Unlock()
 	mc.cli.UserID = userID
 	req := &mautrix.ReqJoinRoom{}
-	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: joining local room")
-	return mc.cli.JoinRoom(ctx, string(roomID), req)
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: joining local room")
+	ctx, end := mc.startCall(ctx, "join_room", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)))
+	var resp *mautrix.RespJoinRoom
+	err := mc.do(ctx, userID, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.JoinRoom(ctx, string(roomID), req)
+		return err
+	})
+	end(err)
+	return resp, err
+}
+
+// InviteUser invites targetUserID to a room, impersonating the specified userID.
+func (mc *MatrixClient) InviteUser(ctx context.Context, userID id.UserID, roomID id.RoomID, targetUserID id.UserID) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("target_user_id", string(targetUserID)).Msg("matrix: inviting user")
+	ctx, end := mc.startCall(ctx, "invite_user", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)), attribute.String("matrix.target_user_id", string(targetUserID)))
+	err := mc.do(ctx, userID, false, func(ctx context.Context) error {
+		_, err := mc.cli.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{UserID: targetUserID})
+		return err
+	})
+	end(err)
+	return err
+}
+
+// LeaveRoom leaves a room, impersonating the specified userID.
+func (mc *MatrixClient) LeaveRoom(ctx context.Context, userID id.UserID, roomID id.RoomID) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: leaving room")
+	ctx, end := mc.startCall(ctx, "leave_room", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)))
+	err := mc.do(ctx, userID, false, func(ctx context.Context) error {
+		_, err := mc.cli.LeaveRoom(ctx, roomID)
+		return err
+	})
+	end(err)
+	return err
+}
+
+// MarkRead moves the read receipt and the fully read marker of userID to eventID,
+// so Matrix clients and the homeserver notification counts treat the room as read up to it.
+func (mc *MatrixClient) MarkRead(ctx context.Context, userID id.UserID, roomID id.RoomID, eventID id.EventID) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Msg("matrix: setting read markers")
+	ctx, end := mc.startCall(ctx, "set_read_markers", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)), tracing.AttrEventID.String(string(eventID)))
+	err := mc.do(ctx, userID, true, func(ctx context.Context) error {
+		return mc.cli.SetReadMarkers(ctx, roomID, &mautrix.ReqSetReadMarkers{Read: eventID, FullyRead: eventID})
+	})
+	end(err)
+	return err
+}
+
+// Membership returns the membership of memberID in a room as seen by userID,
+// or an empty membership when memberID was never part of the room.
+func (mc *MatrixClient) Membership(ctx context.Context, userID id.UserID, roomID id.RoomID, memberID id.UserID) (event.Membership, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	ctx, end := mc.startCall(ctx, "get_membership", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)))
+	var content event.MemberEventContent
+	err := mc.do(ctx, userID, true, func(ctx context.Context) error {
+		return mc.cli.StateEvent(ctx, roomID, event.StateMember, string(memberID), &content)
+	})
+	if errors.Is(err, mautrix.MNotFound) {
+		end(nil)
+		return "", nil
+	}
+	end(err)
+	if err != nil {
+		return "", err
+	}
+	return content.Membership, nil
+}
+
+// Tombstone returns the room that replaced roomID after an upgrade, as seen by userID,
+// or an empty room ID when roomID was not upgraded.
+func (mc *MatrixClient) Tombstone(ctx context.Context, userID id.UserID, roomID id.RoomID) (id.RoomID, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	ctx, end := mc.startCall(ctx, "get_tombstone", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)))
+	var content event.TombstoneEventContent
+	err := mc.do(ctx, userID, true, func(ctx context.Context) error {
+		return mc.cli.StateEvent(ctx, roomID, event.StateTombstone, "", &content)
+	})
+	if errors.Is(err, mautrix.MNotFound) {
+		end(nil)
+		return "", nil
+	}
+	end(err)
+	if err != nil {
+		return "", err
+	}
+	return content.ReplacementRoom, nil
+}
+
+// CreateRoomAlias points a room alias to roomID, impersonating the specified userID.
+// Like in ResolveRoomAlias, a bare alias is completed with the homeserver name.
+func (mc *MatrixClient) CreateRoomAlias(ctx context.Context, userID id.UserID, roomAlias string, roomID id.RoomID) error {
+	roomAlias = mc.fullAlias(roomAlias)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_alias", roomAlias).Str("room_id", string(roomID)).Msg("matrix: creating room alias")
+	ctx, end := mc.startCall(ctx, "create_alias", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)), attribute.String("matrix.room_alias", roomAlias))
+	err := mc.do(ctx, userID, false, func(ctx context.Context) error {
+		_, err := mc.cli.CreateAlias(ctx, id.RoomAlias(roomAlias), roomID)
+		return err
+	})
+	end(err)
+	return err
+}
+
+// DeleteRoomAlias removes a room alias, impersonating the specified userID.
+// Like in ResolveRoomAlias, a bare alias is completed with the homeserver name.
+func (mc *MatrixClient) DeleteRoomAlias(ctx context.Context, userID id.UserID, roomAlias string) error {
+	roomAlias = mc.fullAlias(roomAlias)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_alias", roomAlias).Msg("matrix: deleting room alias")
+	ctx, end := mc.startCall(ctx, "delete_alias", tracing.AttrUserID.String(string(userID)), attribute.String("matrix.room_alias", roomAlias))
+	err := mc.do(ctx, userID, false, func(ctx context.Context) error {
+		_, err := mc.cli.DeleteAlias(ctx, id.RoomAlias(roomAlias))
+		return err
+	})
+	end(err)
+	return err
+}
+
+// GetEvent fetches a single event of a room, impersonating the specified userID.
+func (mc *MatrixClient) GetEvent(ctx context.Context, userID id.UserID, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Msg("matrix: fetching event")
+	ctx, end := mc.startCall(ctx, "get_event", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)), tracing.AttrEventID.String(string(eventID)))
+	var evt *event.Event
+	err := mc.do(ctx, userID, true, func(ctx context.Context) (err error) {
+		evt, err = mc.cli.GetEvent(ctx, roomID, eventID)
+		return err
+	})
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+	return mc.decryptEvent(ctx, userID, roomID, evt), nil
+}
+
+// Messages fetches up to limit events of a room backwards from the pagination token from,
+// stopping at the token to when it is not empty, impersonating the specified userID.
+// The events of the returned chunk are in reverse chronological order.
+func (mc *MatrixClient) Messages(ctx context.Context, userID id.UserID, roomID id.RoomID, from, to string, limit int) (*mautrix.RespMessages, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("from", from).Int("limit", limit).Msg("matrix: fetching room messages")
+	ctx, end := mc.startCall(ctx, "messages", tracing.AttrUserID.String(string(userID)), tracing.AttrRoomID.String(string(roomID)))
+	var resp *mautrix.RespMessages
+	err := mc.do(ctx, userID, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.Messages(ctx, roomID, from, to, mautrix.DirectionBackward, nil, limit)
+		return err
+	})
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+	for i, evt := range resp.Chunk {
+		resp.Chunk[i] = mc.decryptEvent(ctx, userID, roomID, evt)
+	}
+	return resp, nil
+}
+
+// decryptEvent returns evt decrypted when encryption is enabled and evt is encrypted.
+// Events that cannot be decrypted are returned as they are, like any other event callers cannot read.
+// Callers hold mc.mu.
+func (mc *MatrixClient) decryptEvent(ctx context.Context, userID id.UserID, roomID id.RoomID, evt *event.Event) *event.Event {
+	if mc.crypto == nil || evt.Type != event.EventEncrypted || evt.Unsigned.RedactedBecause != nil {
+		return evt
+	}
+	evt.RoomID = roomID
+	decrypted, err := mc.crypto.decrypt(ctx, userID, evt)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("event_id", string(evt.ID)).Msg("matrix: cannot decrypt event")
+		return evt
+	}
+	return decrypted
+}
+
+// UploadMedia uploads data to the content repository, impersonating the specified userID.
+func (mc *MatrixClient) UploadMedia(ctx context.Context, userID id.UserID, data []byte, contentType, fileName string) (id.ContentURI, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = userID
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("content_type", contentType).Int("size", len(data)).Msg("matrix: uploading media")
+	ctx, end := mc.startCall(ctx, "upload_media", tracing.AttrUserID.String(string(userID)))
+	var resp *mautrix.RespMediaUpload
+	err := mc.do(ctx, userID, false, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.UploadBytesWithName(ctx, data, contentType, fileName)
+		return err
+	})
+	end(err)
+	if err != nil {
+		return id.ContentURI{}, err
+	}
+	return resp.ContentURI, nil
+}
+
+// DownloadMedia downloads content from the content repository as the AS user.
+// The caller must close the body of the returned response.
+func (mc *MatrixClient) DownloadMedia(ctx context.Context, uri id.ContentURI) (*http.Response, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cli.UserID = mc.asUserID
+	logger.Ctx(ctx).Debug().Str("uri", uri.String()).Msg("matrix: downloading media")
+	ctx, end := mc.startCall(ctx, "download_media", attribute.String("matrix.content_uri", uri.String()))
+	var resp *http.Response
+	err := mc.do(ctx, mc.asUserID, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.Download(ctx, uri)
+		return err
+	})
+	end(err)
+	return resp, err
+}
+
+// SignMedia returns the signature authorizing the download of uri through the proxy.
+func (mc *MatrixClient) SignMedia(uri id.ContentURI) string {
+	mac := hmac.New(sha256.New, mc.mediaKey)
+	mac.Write([]byte(uri.String()))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// VerifyMedia reports whether signature was returned by SignMedia for uri.
+func (mc *MatrixClient) VerifyMedia(uri id.ContentURI, signature string) bool {
+	return hmac.Equal([]byte(mc.SignMedia(uri)), []byte(signature))
 }
 
 // ResolveRoomAlias resolves a room alias to a room ID.
 func (mc *MatrixClient) ResolveRoomAlias(ctx context.Context, roomAlias string) string {
 	roomAlias = strings.TrimSpace(roomAlias)
 	if roomAlias == "" {
-		logger.Debug().Msg("matrix: empty room alias")
+		logger.Ctx(ctx).Debug().Msg("matrix: empty room alias")
 		return ""
 	}
-	if !strings.HasPrefix(roomAlias, "#") {
-		roomAlias = "#" + roomAlias + ":" + mc.homeserverName
-	}
+	roomAlias = mc.fullAlias(roomAlias)
 	// This action does not require impersonation, so no lock is needed.
-	resp, err := mc.cli.ResolveAlias(ctx, id.RoomAlias(roomAlias))
+	ctx, end := mc.startCall(ctx, "resolve_alias", attribute.String("matrix.room_alias", roomAlias))
+	var resp *mautrix.RespAliasResolve
+	err := mc.doUnlocked(ctx, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.ResolveAlias(ctx, id.RoomAlias(roomAlias))
+		return err
+	})
+	end(err)
 	if err != nil {
-		logger.Debug().Str("room_alias", roomAlias).Err(err).Msg("matrix: failed to resolve room alias")
+		logger.Ctx(ctx).Debug().Str("room_alias", roomAlias).Err(err).Msg("matrix: failed to resolve room alias")
 		return ""
 	}
 	return string(resp.RoomID)
 }
 
+// fullAlias completes a bare alias, e.g. "alice|bob", into "#alice|bob:<homeserver name>".
+func (mc *MatrixClient) fullAlias(roomAlias string) string {
+	if !strings.HasPrefix(roomAlias, "#") {
+		return "#" + roomAlias + ":" + mc.homeserverName
+	}
+	return roomAlias
+}
+
 func (mc *MatrixClient) GetRoomAliases(ctx context.Context, roomID id.RoomID) []string {
 	// This action does not require impersonation, so no lock is needed.
-	logger.Debug().Str("room_id", roomID.String()).Msg("matrix: fetching room aliases")
-	resp, err := mc.cli.GetAliases(ctx, roomID)
+	logger.Ctx(ctx).Debug().Str("room_id", roomID.String()).Msg("matrix: fetching room aliases")
+	ctx, end := mc.startCall(ctx, "get_aliases", tracing.AttrRoomID.String(string(roomID)))
+	var resp *mautrix.RespAliasList
+	err := mc.doUnlocked(ctx, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.GetAliases(ctx, roomID)
+		return err
+	})
+	end(err)
 	if err != nil {
-		logger.Error().Str("room_id", roomID.String()).Err(err).Msg("matrix: failed to get room aliases")
+		logger.Ctx(ctx).Error().Str("room_id", roomID.String()).Err(err).Msg("matrix: failed to get room aliases")
 		return []string{}
 	}
 	if resp == nil || len(resp.Aliases) == 0 {
@@ -192,7 +506,7 @@ func (mc *MatrixClient) GetRoomAliases(ctx context.Context, roomID id.RoomID) []
 	for _, a := range resp.Aliases {
 		aliases = append(aliases, string(a))
 	}
-	logger.Debug().Str("room_id", roomID.String()).Int("alias_count", len(aliases)).Msg("matrix: fetched room aliases")
+	logger.Ctx(ctx).Debug().Str("room_id", roomID.String()).Int("alias_count", len(aliases)).Msg("matrix: fetched room aliases")
 	return aliases
 }
 
@@ -201,24 +515,64 @@ func (mc *MatrixClient) ListJoinedRooms(ctx context.Context, userID id.UserID) (
 	defer mc.mu.Unlock()
 
 	mc.cli.UserID = userID
-	resp, err := mc.cli.JoinedRooms(ctx)
+	ctx, end := mc.startCall(ctx, "joined_rooms", tracing.AttrUserID.String(string(userID)))
+	var resp *mautrix.RespJoinedRooms
+	err := mc.do(ctx, userID, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.JoinedRooms(ctx)
+		return err
+	})
+	end(err)
 	if err != nil {
-		logger.Debug().Str("user_id", string(userID)).Err(err).Msg("matrix: failed to list joined rooms")
+		logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Err(err).Msg("matrix: failed to list joined rooms")
 		return nil, err
 	}
-	logger.Debug().Str("user_id", string(userID)).Int("joined_room_count", len(resp.JoinedRooms)).Msg("matrix: fetched joined rooms")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Int("joined_room_count", len(resp.JoinedRooms)).Msg("matrix: fetched joined rooms")
 	return resp.JoinedRooms, nil
 }
 
+// startCall starts the span of a homeserver call; the returned function records
+// its duration and outcome and ends the span.
+func (mc *MatrixClient) startCall(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "matrix."+method, attrs...)
+	return ctx, func(err error) {
+		mc.metrics.ObserveMatrixCall(method, start, err)
+		tracing.End(span, err)
+	}
+}
+
+// Whoami checks that the homeserver is reachable and accepts the AS token,
+// by asking who the Application Service user is.
+func (mc *MatrixClient) Whoami(ctx context.Context) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.cli.UserID = mc.asUserID
+	ctx, end := mc.startCall(ctx, "whoami", tracing.AttrUserID.String(string(mc.asUserID)))
+	var resp *mautrix.RespWhoami
+	err := mc.do(ctx, mc.asUserID, true, func(ctx context.Context) (err error) {
+		resp, err = mc.cli.Whoami(ctx)
+		return err
+	})
+	end(err)
+	if err != nil {
+		return fmt.Errorf("whoami: %w", err)
+	}
+	if resp.UserID != mc.asUserID {
+		return fmt.Errorf("whoami: homeserver returned %s instead of %s", resp.UserID, mc.asUserID)
+	}
+	return nil
+}
+
 // SetPusher registers or updates a push gateway for the specified user.
 // This is used to configure Matrix to send push notifications to the proxy's /_matrix/push/v1/notify endpoint.
 func (mc *MatrixClient) SetPusher(ctx context.Context, userID id.UserID, req *models.SetPusherRequest) error {
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
-	logger.Debug().
+	logger.Ctx(ctx).Debug().
 		Str("user_id", string(userID)).
-		Str("pushkey", req.Pushkey).
+		Str("pushkey", logger.Secret(req.Pushkey)).
 		Str("app_id", req.AppID).
 		Interface("kind", req.Kind).
 		Msg("matrix: setting pusher")
@@ -229,20 +583,25 @@ func (mc *MatrixClient) SetPusher(ctx context.Context, userID id.UserID, req *mo
 	urlPath := mc.cli.BuildClientURL("v3", "pushers", "set")
 
 	// Make the POST request
-	_, err := mc.cli.MakeRequest(ctx, http.MethodPost, urlPath, req, nil)
+	ctx, end := mc.startCall(ctx, "set_pusher", tracing.AttrUserID.String(string(userID)))
+	err := mc.do(ctx, userID, true, func(ctx context.Context) error {
+		_, err := mc.cli.MakeRequest(ctx, http.MethodPost, urlPath, req, nil)
+		return err
+	})
+	end(err)
 	if err != nil {
-		logger.Error().
+		logger.Ctx(ctx).Error().
 			Str("user_id", string(userID)).
-			Str("pushkey", req.Pushkey).
+			Str("pushkey", logger.Secret(req.Pushkey)).
 			Str("app_id", req.AppID).
 			Err(err).
 			Msg("matrix: failed to set pusher")
 		return fmt.Errorf("set pusher: %w", err)
 	}
 
-	logger.Info().
+	logger.Ctx(ctx).Info().
 		Str("user_id", string(userID)).
-		Str("pushkey", req.Pushkey).
+		Str("pushkey", logger.Secret(req.Pushkey)).
 		Str("app_id", req.AppID).
 		Msg("matrix: pusher set successfully")
 	return nil
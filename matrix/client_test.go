@@ -6,11 +6,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -189,3 +191,200 @@ func TestSetPusher_MissingURL(t *testing.T) {
 	err = client.SetPusher(context.Background(), id.UserID("@alice:example.com"), pusherReq)
 	assert.NoError(t, err)
 }
+
+func TestWhoami(t *testing.T) {
+	var whoamiUser string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/account/whoami", r.URL.Path)
+		assert.Equal(t, "Bearer as_token", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("user_id") != "@proxy:example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"not in namespace"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"user_id": whoamiUser})
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	whoamiUser = "@proxy:example.com"
+	assert.NoError(t, client.Whoami(context.Background()))
+
+	whoamiUser = "@someone:example.com"
+	assert.Error(t, client.Whoami(context.Background()))
+
+	// Whoami must act as the AS user even after impersonating someone else.
+	client.cli.UserID = id.UserID("@alice:example.com")
+	whoamiUser = "@proxy:example.com"
+	assert.NoError(t, client.Whoami(context.Background()))
+}
+
+func TestGetEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/event/$orig", r.URL.Path)
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"event_id":"$orig","type":"m.room.message","sender":"@alice:example.com","room_id":"!room:example.com","content":{"msgtype":"m.text","body":"hello"}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	evt, err := client.GetEvent(context.Background(), "@alice:example.com", "!room:example.com", "$orig")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$orig"), evt.ID)
+	assert.Equal(t, id.UserID("@alice:example.com"), evt.Sender)
+	assert.Equal(t, "hello", evt.Content.Raw["body"])
+}
+
+func TestMembership(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/_matrix/client/v3/rooms/!room:example.com/state/m.room.member/@bob:example.com" {
+			w.Write([]byte(`{"membership":"leave"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	membership, err := client.Membership(context.Background(), "@alice:example.com", "!room:example.com", "@bob:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, event.MembershipLeave, membership)
+
+	// A user who was never in the room has no membership
+	membership, err = client.Membership(context.Background(), "@alice:example.com", "!room:example.com", "@carol:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, membership)
+}
+
+func TestMarkRead(t *testing.T) {
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/read_markers", r.URL.Path)
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	require.NoError(t, client.MarkRead(context.Background(), "@alice:example.com", "!room:example.com", "$last"))
+	assert.Equal(t, map[string]string{"m.read": "$last", "m.fully_read": "$last"}, body)
+}
+
+func TestTombstone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!old:example.com/state/m.room.tombstone") {
+			w.Write([]byte(`{"body":"This room has been replaced","replacement_room":"!new:example.com"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	replacement, err := client.Tombstone(context.Background(), "@alice:example.com", "!old:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!new:example.com"), replacement)
+
+	// A room that was never upgraded has no tombstone
+	replacement, err = client.Tombstone(context.Background(), "@alice:example.com", "!current:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, replacement)
+}
+
+func TestMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/messages", r.URL.Path)
+		query := r.URL.Query()
+		assert.Equal(t, "@alice:example.com", query.Get("user_id"))
+		assert.Equal(t, "b", query.Get("dir"))
+		assert.Equal(t, "t_prev", query.Get("from"))
+		assert.Equal(t, "s_since", query.Get("to"))
+		assert.Equal(t, "50", query.Get("limit"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"start":"t_prev","end":"t_end","chunk":[{"event_id":"$b","type":"m.room.message","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"second"}},{"event_id":"$a","type":"m.room.message","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"first"}}]}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	resp, err := client.Messages(context.Background(), "@alice:example.com", "!room:example.com", "t_prev", "s_since", 50)
+	require.NoError(t, err)
+	assert.Equal(t, "t_end", resp.End)
+	require.Len(t, resp.Chunk, 2)
+	assert.Equal(t, id.EventID("$b"), resp.Chunk[0].ID)
+}
+
+func TestUploadAndDownloadMedia(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/media/v3/upload":
+			assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+			assert.Equal(t, "alice.vcf", r.URL.Query().Get("filename"))
+			assert.Equal(t, "text/vcard", r.Header.Get("Content-Type"))
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, "BEGIN:VCARD", string(body))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"content_uri":"mxc://example.com/abc"}`))
+		case "/_matrix/client/v1/media/download/example.com/abc":
+			// Downloads are made by the AS user
+			assert.Equal(t, "@proxy:example.com", r.URL.Query().Get("user_id"))
+			w.Header().Set("Content-Type", "text/vcard")
+			w.Write([]byte("BEGIN:VCARD"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	uri, err := client.UploadMedia(context.Background(), "@alice:example.com", []byte("BEGIN:VCARD"), "text/vcard", "alice.vcf")
+	require.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/abc", uri.String())
+
+	resp, err := client.DownloadMedia(context.Background(), uri)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "BEGIN:VCARD", string(body))
+
+	_, err = client.DownloadMedia(context.Background(), id.ContentURI{Homeserver: "example.com", FileID: "missing"})
+	assert.Error(t, err)
+}
+
+func TestSignMedia(t *testing.T) {
+	client, err := NewClient(Config{HomeserverURL: "http://localhost:8008", AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+	other, err := NewClient(Config{HomeserverURL: "http://localhost:8008", AsUserID: "@proxy:example.com", AsToken: "other_token"})
+	require.NoError(t, err)
+
+	uri := id.ContentURI{Homeserver: "example.com", FileID: "abc"}
+	sig := client.SignMedia(uri)
+	assert.True(t, client.VerifyMedia(uri, sig))
+	assert.False(t, client.VerifyMedia(id.ContentURI{Homeserver: "example.com", FileID: "abd"}, sig))
+	assert.False(t, client.VerifyMedia(uri, ""))
+	assert.False(t, other.VerifyMedia(uri, sig))
+}
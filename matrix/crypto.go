@@ -0,0 +1,94 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const defaultCryptoDeviceName = "Acrobits"
+
+// ErrCryptoUnavailable is returned by EnableCrypto when the binary was built without encryption support.
+var ErrCryptoUnavailable = errors.New("end-to-bridge encryption is not available: build with -tags goolm")
+
+// CryptoConfig configures end-to-bridge encryption: every impersonated user gets its own device,
+// whose keys are stored in a SQLite database, so the proxy can read and write encrypted rooms.
+type CryptoConfig struct {
+	Enabled bool
+	// DBPath is the SQLite database holding the device keys and the room state needed to encrypt.
+	DBPath string
+	// PickleKey encrypts the keys stored in the database.
+	PickleKey string
+	// DeviceName is the display name of the devices created for the users.
+	DeviceName string
+}
+
+// CryptoConfigFromEnv reads E2EE_ENABLED, E2EE_DB_PATH, E2EE_PICKLE_KEY and E2EE_DEVICE_NAME.
+func CryptoConfigFromEnv() CryptoConfig {
+	cfg := CryptoConfig{
+		Enabled:    strings.EqualFold(strings.TrimSpace(os.Getenv("E2EE_ENABLED")), "true"),
+		DBPath:     os.Getenv("E2EE_DB_PATH"),
+		PickleKey:  os.Getenv("E2EE_PICKLE_KEY"),
+		DeviceName: os.Getenv("E2EE_DEVICE_NAME"),
+	}
+	if cfg.DeviceName == "" {
+		cfg.DeviceName = defaultCryptoDeviceName
+	}
+	return cfg
+}
+
+func (c CryptoConfig) validate() error {
+	if c.DBPath == "" {
+		return errors.New("e2ee: database path is required")
+	}
+	if c.PickleKey == "" {
+		return errors.New("e2ee: pickle key is required")
+	}
+	return nil
+}
+
+// cryptoProvider performs the calls of users in encrypted rooms through their own device.
+// Callers hold mc.mu.
+type cryptoProvider interface {
+	// sync syncs as the device of userID, processes the keys it receives and replaces
+	// the encrypted timeline events it can decrypt. Events left encrypted could not be decrypted.
+	sync(ctx context.Context, userID id.UserID, since string) (*mautrix.RespSync, error)
+	// send sends content, encrypted when the room is encrypted, with the transaction ID txnID.
+	send(ctx context.Context, userID id.UserID, roomID id.RoomID, content *event.MessageEventContent, txnID string) (*mautrix.RespSendEvent, error)
+	// decrypt returns evt decrypted, or evt itself when it is not encrypted.
+	decrypt(ctx context.Context, userID id.UserID, evt *event.Event) (*event.Event, error)
+	close() error
+}
+
+// EnableCrypto turns on end-to-bridge encryption: from now on syncs and sent messages go through
+// per-user devices. It fails with ErrCryptoUnavailable when the binary has no encryption support.
+func (mc *MatrixClient) EnableCrypto(ctx context.Context, cfg CryptoConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	provider, err := newCryptoProvider(ctx, mc, cfg)
+	if err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.crypto = provider
+	return nil
+}
+
+// Close releases the resources held by the client, such as the encryption database.
+func (mc *MatrixClient) Close() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.crypto == nil {
+		return nil
+	}
+	err := mc.crypto.close()
+	mc.crypto = nil
+	return err
+}
@@ -0,0 +1,200 @@
+//go:build goolm
+
+package matrix
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/cryptohelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+	_ "modernc.org/sqlite"
+)
+
+// olmCrypto keeps one device per impersonated user. Devices are created with appservice login
+// and used through device masquerading (MSC3202), so the proxy never stores user passwords
+// or access tokens: only the device keys, in the SQLite database shared by all users.
+type olmCrypto struct {
+	homeserverURL string
+	asToken       string
+	httpClient    *http.Client
+	pickleKey     []byte
+	deviceName    string
+
+	db         *dbutil.Database
+	stateStore *sqlstatestore.SQLStateStore
+
+	mu      sync.Mutex
+	devices map[id.UserID]*userDevice
+}
+
+type userDevice struct {
+	cli    *mautrix.Client
+	helper *cryptohelper.CryptoHelper
+	// rooms whose state was loaded, so the members and the encryption settings are known before sending
+	rooms map[id.RoomID]bool
+}
+
+func newCryptoProvider(ctx context.Context, mc *MatrixClient, cfg CryptoConfig) (cryptoProvider, error) {
+	sqlDB, err := sql.Open("sqlite", cfg.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("e2ee: open database: %w", err)
+	}
+	// SQLite allows a single writer
+	sqlDB.SetMaxOpenConns(1)
+	db, err := dbutil.NewWithDB(sqlDB, "sqlite")
+	if err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("e2ee: open database: %w", err)
+	}
+	stateStore := sqlstatestore.NewSQLStateStore(db, dbutil.ZeroLogger(logger.Ctx(ctx).With().Str("component", "e2ee_state").Logger()), false)
+	if err := stateStore.Upgrade(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("e2ee: upgrade state store: %w", err)
+	}
+	logger.Ctx(ctx).Info().Str("db_path", cfg.DBPath).Msg("end-to-bridge encryption enabled")
+	return &olmCrypto{
+		homeserverURL: mc.homeserverURL,
+		asToken:       mc.cli.AccessToken,
+		httpClient:    mc.cli.Client,
+		pickleKey:     []byte(cfg.PickleKey),
+		deviceName:    cfg.DeviceName,
+		db:            db,
+		stateStore:    stateStore,
+		devices:       make(map[id.UserID]*userDevice),
+	}, nil
+}
+
+// device returns the device of userID, creating it or loading it from the database on first use.
+func (o *olmCrypto) device(ctx context.Context, userID id.UserID) (*userDevice, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if dev, ok := o.devices[userID]; ok {
+		return dev, nil
+	}
+
+	cli, err := mautrix.NewClient(o.homeserverURL, userID, o.asToken)
+	if err != nil {
+		return nil, fmt.Errorf("e2ee: create client: %w", err)
+	}
+	cli.Client = o.httpClient
+	cli.Log = logger.Ctx(ctx).With().Str("component", "e2ee").Str("user_id", string(userID)).Logger()
+	cli.SetAppServiceUserID = true
+	cli.SetAppServiceDeviceID = true
+	cli.StateStore = o.stateStore
+
+	helper, err := cryptohelper.NewCryptoHelper(cli, o.pickleKey, o.db)
+	if err != nil {
+		return nil, fmt.Errorf("e2ee: create crypto helper: %w", err)
+	}
+	helper.DBAccountID = string(userID)
+	helper.LoginAs = &mautrix.ReqLogin{
+		Type:                     mautrix.AuthTypeAppservice,
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: string(userID)},
+		InitialDeviceDisplayName: o.deviceName,
+	}
+	if err := helper.Init(ctx); err != nil {
+		return nil, fmt.Errorf("e2ee: initialize device of %s: %w", userID, err)
+	}
+	cli.Crypto = helper
+
+	logger.Ctx(ctx).Info().Str("user_id", string(userID)).Str("device_id", string(cli.DeviceID)).Msg("e2ee: device ready")
+	dev := &userDevice{cli: cli, helper: helper, rooms: make(map[id.RoomID]bool)}
+	o.devices[userID] = dev
+	return dev, nil
+}
+
+func (o *olmCrypto) sync(ctx context.Context, userID id.UserID, since string) (*mautrix.RespSync, error) {
+	dev, err := o.device(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dev.cli.SyncRequest(ctx, 30000, since, "", true, "online")
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the room state current first: encryption settings and members decide who gets the keys
+	mach := dev.helper.Machine()
+	for roomID, room := range resp.Rooms.Join {
+		for _, evt := range append(room.State.Events, room.Timeline.Events...) {
+			if evt.StateKey == nil {
+				continue
+			}
+			evt.RoomID = roomID
+			if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+				continue
+			}
+			mautrix.UpdateStateStore(ctx, o.stateStore, evt)
+			if evt.Type == event.StateMember {
+				mach.HandleMemberEvent(ctx, evt)
+			}
+		}
+		dev.rooms[roomID] = true
+	}
+	// Room keys arrive as to-device events, so they are processed before decrypting the timeline
+	mach.ProcessSyncResponse(ctx, resp, since)
+
+	for roomID, room := range resp.Rooms.Join {
+		for i, evt := range room.Timeline.Events {
+			if evt.Type != event.EventEncrypted || evt.Unsigned.RedactedBecause != nil {
+				continue
+			}
+			evt.RoomID = roomID
+			decrypted, err := o.decryptWith(ctx, dev, evt)
+			if err != nil {
+				logger.Ctx(ctx).Warn().Err(err).Str("user_id", string(userID)).Str("event_id", string(evt.ID)).Msg("e2ee: cannot decrypt event")
+				continue
+			}
+			room.Timeline.Events[i] = decrypted
+		}
+	}
+	return resp, nil
+}
+
+func (o *olmCrypto) send(ctx context.Context, userID id.UserID, roomID id.RoomID, content *event.MessageEventContent, txnID string) (*mautrix.RespSendEvent, error) {
+	dev, err := o.device(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !dev.rooms[roomID] {
+		// The user did not sync this room yet: load its state, otherwise an encrypted room looks unencrypted
+		if _, err := dev.cli.State(ctx, roomID); err != nil {
+			return nil, fmt.Errorf("e2ee: load room state: %w", err)
+		}
+		dev.rooms[roomID] = true
+	}
+	// The crypto helper encrypts the content when the room is encrypted
+	return dev.cli.SendMessageEvent(ctx, roomID, event.EventMessage, content, mautrix.ReqSendEvent{TransactionID: txnID})
+}
+
+func (o *olmCrypto) decrypt(ctx context.Context, userID id.UserID, evt *event.Event) (*event.Event, error) {
+	if evt.Type != event.EventEncrypted {
+		return evt, nil
+	}
+	dev, err := o.device(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return o.decryptWith(ctx, dev, evt)
+}
+
+func (o *olmCrypto) decryptWith(ctx context.Context, dev *userDevice, evt *event.Event) (*event.Event, error) {
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, err
+	}
+	return dev.helper.Decrypt(ctx, evt)
+}
+
+func (o *olmCrypto) close() error {
+	return o.db.Close()
+}
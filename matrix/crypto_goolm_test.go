@@ -0,0 +1,24 @@
+//go:build goolm
+
+package matrix
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableCrypto(t *testing.T) {
+	client, err := NewClient(Config{HomeserverURL: "http://localhost:8008", AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	dbPath := filepath.Join(t.TempDir(), "crypto.db")
+	require.NoError(t, client.EnableCrypto(t.Context(), CryptoConfig{Enabled: true, DBPath: dbPath, PickleKey: "secret", DeviceName: "Acrobits"}))
+	assert.FileExists(t, dbPath)
+	assert.NotNil(t, client.crypto)
+
+	assert.NoError(t, client.Close())
+	assert.Nil(t, client.crypto)
+}
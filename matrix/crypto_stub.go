@@ -0,0 +1,9 @@
+//go:build !goolm
+
+package matrix
+
+import "context"
+
+func newCryptoProvider(_ context.Context, _ *MatrixClient, _ CryptoConfig) (cryptoProvider, error) {
+	return nil, ErrCryptoUnavailable
+}
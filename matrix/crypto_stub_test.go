@@ -0,0 +1,20 @@
+//go:build !goolm
+
+package matrix
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableCrypto_Unavailable(t *testing.T) {
+	client, err := NewClient(Config{HomeserverURL: "http://localhost:8008", AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+
+	err = client.EnableCrypto(t.Context(), CryptoConfig{Enabled: true, DBPath: filepath.Join(t.TempDir(), "crypto.db"), PickleKey: "secret"})
+	assert.ErrorIs(t, err, ErrCryptoUnavailable)
+	assert.Nil(t, client.crypto)
+}
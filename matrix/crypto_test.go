@@ -0,0 +1,34 @@
+package matrix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCryptoConfigFromEnv(t *testing.T) {
+	t.Setenv("E2EE_ENABLED", "True")
+	t.Setenv("E2EE_DB_PATH", "/var/lib/proxy/crypto.db")
+	t.Setenv("E2EE_PICKLE_KEY", "secret")
+	t.Setenv("E2EE_DEVICE_NAME", "")
+
+	cfg := CryptoConfigFromEnv()
+	assert.True(t, cfg.Enabled)
+	assert.Equal(t, "/var/lib/proxy/crypto.db", cfg.DBPath)
+	assert.Equal(t, "secret", cfg.PickleKey)
+	assert.Equal(t, defaultCryptoDeviceName, cfg.DeviceName)
+	assert.NoError(t, cfg.validate())
+
+	t.Setenv("E2EE_ENABLED", "")
+	assert.False(t, CryptoConfigFromEnv().Enabled)
+}
+
+func TestEnableCrypto_InvalidConfig(t *testing.T) {
+	client, err := NewClient(Config{HomeserverURL: "http://localhost:8008", AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	assert.NoError(t, err)
+
+	assert.ErrorContains(t, client.EnableCrypto(t.Context(), CryptoConfig{Enabled: true, PickleKey: "secret"}), "database path")
+	assert.ErrorContains(t, client.EnableCrypto(t.Context(), CryptoConfig{Enabled: true, DBPath: "crypto.db"}), "pickle key")
+	assert.Nil(t, client.crypto)
+	assert.NoError(t, client.Close())
+}
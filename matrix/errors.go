@@ -0,0 +1,32 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+)
+
+// IsUnavailable reports whether err means the homeserver could not be reached or failed
+// temporarily (5xx, rate limiting, open circuit), so the same request may succeed later.
+func IsUnavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return true
+	}
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) {
+		if httpErr.Response == nil {
+			// The request never got an answer: connection refused, timeout, ...
+			return httpErr.WrappedError != nil
+		}
+		return httpErr.Response.StatusCode >= http.StatusInternalServerError || httpErr.Response.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
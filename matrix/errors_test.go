@@ -0,0 +1,42 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestIsUnavailable(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"errcode":"M_UNKNOWN","error":"status %d"}`, status)
+	}))
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+	call := func(code int) error {
+		status = code
+		_, err := client.JoinRoom(context.TODO(), "@alice:example.com", id.RoomID("!room:example.com"))
+		return err
+	}
+
+	assert.True(t, IsUnavailable(call(http.StatusBadGateway)))
+	assert.True(t, IsUnavailable(call(http.StatusTooManyRequests)))
+	assert.False(t, IsUnavailable(call(http.StatusForbidden)))
+
+	server.Close()
+	assert.True(t, IsUnavailable(call(http.StatusOK)), "connection refused")
+
+	assert.False(t, IsUnavailable(nil))
+	assert.False(t, IsUnavailable(errors.New("invalid recipient")))
+	assert.False(t, IsUnavailable(mautrix.HTTPError{WrappedError: context.Canceled}))
+}
@@ -0,0 +1,287 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryMaxWait     = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+
+	// retryBaseDelay and retryMaxDelay bound the jittered exponential backoff between attempts.
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+var (
+	// ErrRateLimited is matched by the errors of requests refused by the rate limiting of the
+	// homeserver (M_LIMIT_EXCEEDED).
+	ErrRateLimited = errors.New("homeserver rate limit exceeded")
+	// ErrUnavailable is matched by the errors of requests that failed because the homeserver could
+	// not be reached or failed temporarily, and of requests refused while the circuit is open.
+	ErrUnavailable = errors.New("homeserver unavailable")
+
+	errCircuitOpen = errors.New("homeserver unavailable: circuit breaker open")
+)
+
+// UnavailableError is returned by the MatrixClient methods when the homeserver is rate limiting
+// or unavailable, so the same request may succeed later. It matches ErrRateLimited or
+// ErrUnavailable, and the error returned by the homeserver.
+type UnavailableError struct {
+	// RetryAfter is how long to wait before trying again, zero when unknown.
+	RetryAfter  time.Duration
+	RateLimited bool
+	Err         error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() []error {
+	if e.RateLimited {
+		return []error{ErrRateLimited, e.Err}
+	}
+	return []error{ErrUnavailable, e.Err}
+}
+
+// RetryAfter returns how long the homeserver asked to wait before trying err's request again,
+// or zero when err does not say.
+func RetryAfter(err error) time.Duration {
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return unavailable.RetryAfter
+	}
+	return 0
+}
+
+// RetryConfig configures how the MatrixClient methods handle rate limiting and transient errors.
+// The zero value disables retries and the circuit breaker.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a call; 1 or less disables retries.
+	// Rate limited calls are always retried, the others only when idempotent.
+	MaxAttempts int
+	// MaxWait is the longest retry_after_ms honoured: a longer one is returned to the caller.
+	MaxWait time.Duration
+	// BreakerThreshold consecutive calls failing because the homeserver is unavailable open the
+	// circuit for BreakerCooldown, failing calls without contacting the homeserver; 0 disables it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// RetryConfigFromEnv reads MATRIX_RETRY_ATTEMPTS, MATRIX_RETRY_MAX_WAIT_SECONDS,
+// MATRIX_BREAKER_THRESHOLD and MATRIX_BREAKER_COOLDOWN_SECONDS.
+func RetryConfigFromEnv() RetryConfig {
+	cfg := RetryConfig{
+		MaxAttempts:      defaultRetryAttempts,
+		MaxWait:          defaultRetryMaxWait,
+		BreakerThreshold: defaultBreakerThreshold,
+		BreakerCooldown:  defaultBreakerCooldown,
+	}
+	if v := os.Getenv("MATRIX_RETRY_ATTEMPTS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.MaxAttempts = parsed
+		}
+	}
+	if v := os.Getenv("MATRIX_RETRY_MAX_WAIT_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.MaxWait = time.Duration(parsed) * time.Second
+		}
+	}
+	if v := os.Getenv("MATRIX_BREAKER_THRESHOLD"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.BreakerThreshold = parsed
+		}
+	}
+	if v := os.Getenv("MATRIX_BREAKER_COOLDOWN_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.BreakerCooldown = time.Duration(parsed) * time.Second
+		}
+	}
+	return cfg
+}
+
+// classify wraps the errors meaning the homeserver is rate limiting or unavailable in an
+// UnavailableError; other errors are returned as they are.
+func classify(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return err
+	}
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && (errors.Is(err, mautrix.MLimitExceeded) || httpErr.IsStatus(http.StatusTooManyRequests)) {
+		return &UnavailableError{RetryAfter: retryAfter(httpErr), RateLimited: true, Err: err}
+	}
+	if IsUnavailable(err) {
+		return &UnavailableError{Err: err}
+	}
+	return err
+}
+
+// retryAfter reads the delay asked by the homeserver: retry_after_ms in the body, or the
+// Retry-After header.
+func retryAfter(httpErr mautrix.HTTPError) time.Duration {
+	if httpErr.RespError != nil {
+		if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	if httpErr.Response != nil {
+		if seconds, err := strconv.Atoi(httpErr.Response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// backoff is the jittered delay before the attempt following the given number of attempts.
+func backoff(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, retryMaxDelay)
+	// Full jitter spreads the retries of the calls that failed together
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// do performs a homeserver request through the circuit breaker, retrying it as allowed by the
+// retry policy: rate limited requests were not processed and are attempted again after the delay
+// asked by the homeserver, other transient failures only when the request is idempotent.
+// Callers hold mc.mu, which is released while waiting; userID is impersonated at each attempt.
+func (mc *MatrixClient) do(ctx context.Context, userID id.UserID, idempotent bool, request func(ctx context.Context) error) error {
+	return mc.retry(ctx, idempotent, request, func(delay time.Duration) error {
+		mc.mu.Unlock()
+		err := sleep(ctx, delay)
+		mc.mu.Lock()
+		mc.cli.UserID = userID
+		return err
+	})
+}
+
+// doUnlocked is do for the requests made without impersonation, by callers not holding mc.mu.
+func (mc *MatrixClient) doUnlocked(ctx context.Context, idempotent bool, request func(ctx context.Context) error) error {
+	return mc.retry(ctx, idempotent, request, func(delay time.Duration) error {
+		return sleep(ctx, delay)
+	})
+}
+
+func (mc *MatrixClient) retry(ctx context.Context, idempotent bool, request func(ctx context.Context) error, wait func(time.Duration) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := mc.breaker.allow(); err != nil {
+			return err
+		}
+		err := classify(request(ctx))
+		mc.breaker.record(ctx, err)
+
+		var unavailable *UnavailableError
+		if !errors.As(err, &unavailable) || attempt >= mc.retryCfg.MaxAttempts {
+			return err
+		}
+		delay := unavailable.RetryAfter
+		switch {
+		case unavailable.RateLimited && delay > mc.retryCfg.MaxWait:
+			return err
+		case unavailable.RateLimited && delay == 0, !unavailable.RateLimited && idempotent:
+			delay = backoff(attempt)
+		case !unavailable.RateLimited:
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		logger.Ctx(ctx).Warn().Err(err).Int("attempt", attempt).Dur("retry_in", delay).Msg("matrix: request failed, retrying")
+		if wait(delay) != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for delay, or until ctx is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// breaker is the circuit breaker of a homeserver. It opens after threshold consecutive calls
+// failing because the homeserver is unavailable; once cooldown has passed, a single call probes
+// the homeserver and closes the circuit when it gets an answer.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns an UnavailableError when the circuit is open and the call must fail right away.
+func (b *breaker) allow() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+		return &UnavailableError{RetryAfter: max(wait, time.Second), Err: errCircuitOpen}
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts the outcome of a call: any answer of the homeserver closes the circuit.
+// Calls abandoned by the caller are not counted.
+func (b *breaker) record(ctx context.Context, err error) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	switch {
+	case errors.Is(err, ErrUnavailable):
+		if ctx.Err() != nil {
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+			if !wasOpen {
+				logger.Ctx(ctx).Warn().Err(err).Int("failures", b.failures).Dur("cooldown", b.cooldown).Msg("matrix: homeserver unavailable, circuit breaker open")
+			}
+		}
+	case errors.Is(err, context.Canceled):
+	default:
+		b.failures = 0
+		if wasOpen {
+			logger.Ctx(ctx).Info().Msg("matrix: homeserver available again, circuit breaker closed")
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+)
+
+// scriptedHomeserver answers each request with the next response of script, then with the last one.
+func scriptedHomeserver(t *testing.T, retry RetryConfig, script ...func(w http.ResponseWriter)) (*MatrixClient, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		w.Header().Set("Content-Type", "application/json")
+		script[min(n, len(script))-1](w)
+	}))
+	t.Cleanup(server.Close)
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token", Retry: retry})
+	require.NoError(t, err)
+	return client, &requests
+}
+
+func respond(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+var (
+	joined      = respond(http.StatusOK, `{"room_id":"!room:example.com"}`)
+	badGateway  = respond(http.StatusBadGateway, `{"errcode":"M_UNKNOWN","error":"bad gateway"}`)
+	rateLimited = func(ms int) func(w http.ResponseWriter) {
+		return respond(http.StatusTooManyRequests, `{"errcode":"M_LIMIT_EXCEEDED","error":"too many requests","retry_after_ms":`+strconv.Itoa(ms)+`}`)
+	}
+)
+
+func TestRetry_RateLimited(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 3, MaxWait: time.Second}
+
+	// The request was not processed, so even a call that is not idempotent is attempted again
+	client, requests := scriptedHomeserver(t, retry, rateLimited(20), respond(http.StatusOK, `{}`))
+	start := time.Now()
+	err := client.InviteUser(context.TODO(), "@alice:example.com", "!room:example.com", "@bob:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond, "retry_after_ms honoured")
+
+	// A longer wait than allowed is left to the caller
+	client, requests = scriptedHomeserver(t, retry, rateLimited(60000))
+	_, err = client.JoinRoom(context.TODO(), "@alice:example.com", "!room:example.com")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.NotErrorIs(t, err, ErrUnavailable)
+	assert.True(t, IsUnavailable(err))
+	assert.Equal(t, time.Minute, RetryAfter(err))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestRetry_Transient(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 3, MaxWait: time.Second}
+
+	client, requests := scriptedHomeserver(t, retry, badGateway, badGateway, joined)
+	resp, err := client.JoinRoom(context.TODO(), "@alice:example.com", "!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.RoomID)
+	assert.Equal(t, int32(3), requests.Load())
+
+	client, requests = scriptedHomeserver(t, retry, badGateway)
+	_, err = client.JoinRoom(context.TODO(), "@alice:example.com", "!room:example.com")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, int32(3), requests.Load(), "attempts are bounded")
+
+	// The homeserver may have processed the request before failing: not idempotent, not retried
+	client, requests = scriptedHomeserver(t, retry, badGateway, joined)
+	err = client.InviteUser(context.TODO(), "@alice:example.com", "!room:example.com", "@bob:example.com")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Other errors are returned as they are
+	client, requests = scriptedHomeserver(t, retry, respond(http.StatusForbidden, `{"errcode":"M_FORBIDDEN","error":"forbidden"}`))
+	_, err = client.JoinRoom(context.TODO(), "@alice:example.com", "!room:example.com")
+	require.Error(t, err)
+	assert.False(t, IsUnavailable(err))
+	var unavailable *UnavailableError
+	assert.False(t, errors.As(err, &unavailable))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestRetry_Breaker(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}
+	client, requests := scriptedHomeserver(t, retry, badGateway, badGateway, joined)
+	join := func() error {
+		_, err := client.JoinRoom(context.TODO(), "@alice:example.com", "!room:example.com")
+		return err
+	}
+
+	assert.ErrorIs(t, join(), ErrUnavailable)
+	assert.ErrorIs(t, join(), ErrUnavailable)
+
+	// The circuit is open: the call fails without contacting the homeserver
+	err := join()
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Positive(t, RetryAfter(err))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// After the cooldown a probe reaches the homeserver, and its answer closes the circuit
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, join())
+	require.NoError(t, join())
+	assert.Equal(t, int32(4), requests.Load())
+}
+
+func TestRetry_Disabled(t *testing.T) {
+	client, requests := scriptedHomeserver(t, RetryConfig{}, rateLimited(10), joined)
+	_, err := client.JoinRoom(context.TODO(), "@alice:example.com", "!room:example.com")
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, 10*time.Millisecond, RetryAfter(err))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts := 1; attempts < 10; attempts++ {
+		delay := backoff(attempts)
+		assert.GreaterOrEqual(t, delay, retryBaseDelay/2)
+		assert.LessOrEqual(t, delay, retryMaxDelay)
+	}
+}
+
+func TestRetryConfigFromEnv(t *testing.T) {
+	cfg := RetryConfigFromEnv()
+	assert.Equal(t, defaultRetryAttempts, cfg.MaxAttempts)
+	assert.Equal(t, defaultBreakerThreshold, cfg.BreakerThreshold)
+
+	t.Setenv("MATRIX_RETRY_ATTEMPTS", "1")
+	t.Setenv("MATRIX_RETRY_MAX_WAIT_SECONDS", "10")
+	t.Setenv("MATRIX_BREAKER_THRESHOLD", "0")
+	t.Setenv("MATRIX_BREAKER_COOLDOWN_SECONDS", "invalid")
+	cfg = RetryConfigFromEnv()
+	assert.Equal(t, 1, cfg.MaxAttempts)
+	assert.Equal(t, 10*time.Second, cfg.MaxWait)
+	assert.Equal(t, 0, cfg.BreakerThreshold)
+	assert.Equal(t, defaultBreakerCooldown, cfg.BreakerCooldown)
+}
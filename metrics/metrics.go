@@ -0,0 +1,160 @@
+// Package metrics holds the Prometheus collectors of the proxy and the /metrics handler.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "matrix2acrobits"
+
+// Outcome label values shared by the collectors below.
+const (
+	OutcomeOK       = "ok"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+)
+
+// LabelTenant is the label naming the tenant on every collector of the proxy.
+const LabelTenant = "tenant"
+
+// Registry holds every collector of the proxy. A dedicated registry keeps /metrics free of
+// collectors registered by dependencies on the default one.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// ClientRequestDuration observes the client API endpoints by outcome
+	// (ok, bad_request, unauthorized, not_found, rate_limited, error).
+	ClientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "client_request_duration_seconds",
+		Help:      "Duration of client API requests by endpoint and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelTenant, "endpoint", "outcome"})
+
+	// MatrixCallDuration observes calls to the homeserver by client method.
+	MatrixCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "matrix_call_duration_seconds",
+		Help:      "Duration of Matrix homeserver calls by method and outcome.",
+		// Sync long-polls for up to 30s.
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{LabelTenant, "method", "outcome"})
+
+	// AuthRequestDuration observes calls to the authentication backend (cache hits excluded).
+	AuthRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "auth_request_duration_seconds",
+		Help:      "Duration of authentication backend calls by backend and outcome (ok, rejected, error).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelTenant, "backend", "outcome"})
+
+	// CacheRequests counts lookups in the in-memory caches by result (hit, miss).
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result (hit, miss).",
+	}, []string{LabelTenant, "cache", "result"})
+
+	// CacheEntries is the number of entries held by the in-memory caches, expired ones included.
+	CacheEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_entries",
+		Help:      "Entries held by each in-memory cache, including expired entries not yet removed.",
+	}, []string{LabelTenant, "cache"})
+
+	// PushDeliveries counts push notifications forwarded to Acrobits PNM by result.
+	PushDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_deliveries_total",
+		Help:      "Push notifications by result (sent, rejected, failed, coalesced).",
+	}, []string{LabelTenant, "result"})
+
+	// Mappings is the number of entries in the mapping store.
+	Mappings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mappings",
+		Help:      "Entries in the extension to Matrix user mapping store.",
+	}, []string{LabelTenant})
+)
+
+// Cache names used as the "cache" label.
+const (
+	CacheAuth            = "auth"
+	CacheRoomAlias       = "room_alias"
+	CacheRoomAliases     = "room_aliases"
+	CacheRoomParticipant = "room_participant"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ClientRequestDuration,
+		MatrixCallDuration,
+		AuthRequestDuration,
+		CacheRequests,
+		CacheEntries,
+		PushDeliveries,
+		Mappings,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Tenant records the metrics of a tenant, labelled with its name.
+// The zero value records them with an empty tenant label.
+type Tenant string
+
+// ObserveClientRequest records the duration of a client API request started at start.
+func (t Tenant) ObserveClientRequest(endpoint, outcome string, start time.Time) {
+	ClientRequestDuration.WithLabelValues(string(t), endpoint, outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveMatrixCall records the duration of a homeserver call started at start.
+func (t Tenant) ObserveMatrixCall(method string, start time.Time, err error) {
+	MatrixCallDuration.WithLabelValues(string(t), method, errorOutcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveAuthRequest records the duration of an authentication backend call started at start.
+func (t Tenant) ObserveAuthRequest(backend, outcome string, start time.Time) {
+	AuthRequestDuration.WithLabelValues(string(t), backend, outcome).Observe(time.Since(start).Seconds())
+}
+
+// CacheLookup records a hit or a miss of cache.
+func (t Tenant) CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheRequests.WithLabelValues(string(t), cache, result).Inc()
+}
+
+// CacheEntries is the gauge of the entries held by cache.
+func (t Tenant) CacheEntries(cache string) prometheus.Gauge {
+	return CacheEntries.WithLabelValues(string(t), cache)
+}
+
+// PushDelivery counts a push notification by result.
+func (t Tenant) PushDelivery(result string) {
+	PushDeliveries.WithLabelValues(string(t), result).Inc()
+}
+
+// Mappings is the gauge of the entries in the mapping store.
+func (t Tenant) Mappings() prometheus.Gauge {
+	return Mappings.WithLabelValues(string(t))
+}
+
+func errorOutcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheLookup(t *testing.T) {
+	hits := testutil.ToFloat64(CacheRequests.WithLabelValues("acme", "test_cache", "hit"))
+	misses := testutil.ToFloat64(CacheRequests.WithLabelValues("acme", "test_cache", "miss"))
+	other := testutil.ToFloat64(CacheRequests.WithLabelValues("globex", "test_cache", "hit"))
+
+	acme := Tenant("acme")
+	acme.CacheLookup("test_cache", true)
+	acme.CacheLookup("test_cache", false)
+	acme.CacheLookup("test_cache", false)
+
+	assert.Equal(t, hits+1, testutil.ToFloat64(CacheRequests.WithLabelValues("acme", "test_cache", "hit")))
+	assert.Equal(t, misses+2, testutil.ToFloat64(CacheRequests.WithLabelValues("acme", "test_cache", "miss")))
+	assert.Equal(t, other, testutil.ToFloat64(CacheRequests.WithLabelValues("globex", "test_cache", "hit")), "other tenants are not counted")
+}
+
+func TestObserveMatrixCall(t *testing.T) {
+	acme := Tenant("acme")
+	acme.ObserveMatrixCall("test_method", time.Now(), nil)
+	acme.ObserveMatrixCall("test_method", time.Now(), errors.New("boom"))
+	acme.ObserveMatrixCall("test_method", time.Now(), errors.New("boom"))
+
+	assert.Equal(t, uint64(1), sampleCount(t, "acme", "test_method", OutcomeOK))
+	assert.Equal(t, uint64(2), sampleCount(t, "acme", "test_method", OutcomeError))
+}
+
+func sampleCount(t *testing.T, tenant, method, outcome string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, MatrixCallDuration.WithLabelValues(tenant, method, outcome).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestHandler(t *testing.T) {
+	Tenant("acme").PushDelivery("sent")
+	Tenant("acme").Mappings().Set(2)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `matrix2acrobits_push_deliveries_total{result="sent",tenant="acme"}`)
+	assert.Contains(t, string(body), `matrix2acrobits_mappings{tenant="acme"} 2`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
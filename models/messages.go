@@ -8,6 +8,11 @@ type SendMessageRequest struct {
 	Body                    string `json:"body"`
 	ContentType             string `json:"content_type"`
 	DispositionNotification string `json:"disposition_notification"`
+	// ReplacesMessageID is the message_id of an earlier message of the sender that this one edits.
+	ReplacesMessageID string `json:"replaces_message_id,omitempty"`
+	// IdempotencyKey identifies the message across client retries; when empty, identical messages
+	// sent within the deduplication window are considered retries.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 // SendMessageResponse reports the Matrix event ID returned to Acrobits.
@@ -31,6 +36,14 @@ type FetchMessagesResponse struct {
 	SentSMSs     []SMS  `json:"sent_smss"`
 }
 
+// MarkReadRequest acknowledges a message displayed by the client, e.g. when its notification is shown.
+type MarkReadRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	SMSID    string `json:"sms_id"`
+	StreamID string `json:"stream_id"`
+}
+
 // SMS represents a message in the Acrobits Modern API format.
 type SMS struct {
 	SMSID                   string `json:"sms_id"`
@@ -55,6 +68,9 @@ type PushTokenReportRequest struct {
 	AppIDMsgs  string `json:"appid_msgs"`
 	TokenCalls string `json:"token_calls"`
 	AppIDCalls string `json:"appid_calls"`
+	// Platform ("ios" or "android") and Language (e.g. "it" or "it-IT") are optional.
+	Platform string `json:"platform,omitempty"`
+	Language string `json:"language,omitempty"`
 }
 
 // PushTokenReportResponse is the successful response for push token reporting.
@@ -52,8 +52,8 @@ type AcrobitsPushRequest struct {
 	DeviceToken string `json:"DeviceToken"` // Device token
 	Selector    string `json:"Selector,omitempty"`
 
-	// For NotifyTextMessage (iOS 13+)
-	Badge           int    `json:"Badge,omitempty"`
+	// For NotifyTextMessage (iOS 13+); a nil Badge leaves the badge unchanged, zero clears it
+	Badge           *int   `json:"Badge,omitempty"`
 	Sound           string `json:"Sound,omitempty"`
 	UserName        string `json:"UserName,omitempty"`
 	UserDisplayName string `json:"UserDisplayName,omitempty"`
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default limits. Per-IP limits are looser because many phones may share one NAT address.
+var (
+	DefaultUserConfig = Config{
+		RPS:              2,
+		Burst:            20,
+		LockoutThreshold: 5,
+		LockoutBase:      30 * time.Second,
+		LockoutMax:       15 * time.Minute,
+		FailureWindow:    15 * time.Minute,
+	}
+	DefaultIPConfig = Config{
+		RPS:              20,
+		Burst:            200,
+		LockoutThreshold: 50,
+		LockoutBase:      30 * time.Second,
+		LockoutMax:       15 * time.Minute,
+		FailureWindow:    15 * time.Minute,
+	}
+)
+
+// Guard protects client endpoints with one Limiter keyed by username and one keyed by client IP.
+// The username limiter locks out a username per client IP, so that failures sent from one address
+// cannot lock the account out for its owner. A nil Guard allows everything.
+type Guard struct {
+	User *Limiter
+	IP   *Limiter
+}
+
+// GuardStats groups the counters of both limiters.
+type GuardStats struct {
+	User Stats `json:"user"`
+	IP   Stats `json:"ip"`
+}
+
+// NewGuard creates a Guard from the given per-username and per-IP configurations.
+func NewGuard(user, ip Config) *Guard {
+	return &Guard{User: New(user), IP: New(ip)}
+}
+
+// NewGuardFromEnv creates a Guard from the RATE_LIMIT_* environment variables,
+// falling back to DefaultUserConfig and DefaultIPConfig.
+func NewGuardFromEnv() *Guard {
+	return NewGuard(configFromEnv("RATE_LIMIT_USER_", DefaultUserConfig), configFromEnv("RATE_LIMIT_IP_", DefaultIPConfig))
+}
+
+// Allow reports whether a request from user at ip may proceed and, if not, how long to wait.
+// An empty user or ip is not checked. Tokens are taken only when both limiters allow the request,
+// so that a refused request does not use up the bucket of the other key.
+func (g *Guard) Allow(user, ip string) (bool, time.Duration) {
+	if g == nil {
+		return true, 0
+	}
+	if user != "" {
+		if wait := g.User.lockout(userAtIP(user, ip)); wait > 0 {
+			return false, wait
+		}
+	}
+	var ipToken reservation
+	if ip != "" {
+		token, wait, ok := g.IP.reserve(ip)
+		if !ok {
+			return false, wait
+		}
+		ipToken = token
+	}
+	if user != "" {
+		if _, wait, ok := g.User.reserve(user); !ok {
+			ipToken.cancel()
+			return false, wait
+		}
+		g.User.allowed.Add(1)
+	}
+	if ip != "" {
+		g.IP.allowed.Add(1)
+	}
+	return true, 0
+}
+
+// Failure records an authentication failure for user and ip.
+func (g *Guard) Failure(user, ip string) {
+	if g == nil {
+		return
+	}
+	if ip != "" {
+		g.IP.Failure(ip)
+	}
+	if user != "" {
+		g.User.Failure(userAtIP(user, ip))
+	}
+}
+
+// Success clears the failure history of user at ip. The IP history is kept on purpose:
+// one valid account must not reset the failures of a client guessing other accounts.
+func (g *Guard) Success(user, ip string) {
+	if g == nil || user == "" {
+		return
+	}
+	g.User.Success(userAtIP(user, ip))
+}
+
+// userAtIP is the key of the failures of user sent from ip.
+func userAtIP(user, ip string) string {
+	return user + "\x00" + ip
+}
+
+// Stats returns the counters of both limiters.
+func (g *Guard) Stats() GuardStats {
+	if g == nil {
+		return GuardStats{}
+	}
+	return GuardStats{User: g.User.Stats(), IP: g.IP.Stats()}
+}
+
+// configFromEnv overrides def with the environment variables starting with prefix:
+// RPS, BURST, LOCKOUT_THRESHOLD, LOCKOUT_BASE_SECONDS, LOCKOUT_MAX_SECONDS and FAILURE_WINDOW_SECONDS.
+func configFromEnv(prefix string, def Config) Config {
+	cfg := def
+	if v := os.Getenv(prefix + "RPS"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed >= 0 {
+			cfg.RPS = parsed
+		}
+	}
+	if v := os.Getenv(prefix + "BURST"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.Burst = parsed
+		}
+	}
+	if v := os.Getenv(prefix + "LOCKOUT_THRESHOLD"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.LockoutThreshold = parsed
+		}
+	}
+	if v := os.Getenv(prefix + "LOCKOUT_BASE_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.LockoutBase = time.Duration(parsed) * time.Second
+		}
+	}
+	if v := os.Getenv(prefix + "LOCKOUT_MAX_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.LockoutMax = time.Duration(parsed) * time.Second
+		}
+	}
+	if v := os.Getenv(prefix + "FAILURE_WINDOW_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.FailureWindow = time.Duration(parsed) * time.Second
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,253 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Config configures a Limiter. A zero RPS disables rate limiting and a zero
+// LockoutThreshold disables lockouts; the two features are independent.
+type Config struct {
+	// RPS and Burst define the token bucket applied to each key.
+	RPS   float64
+	Burst int
+	// LockoutThreshold is the number of consecutive failures after which a key is locked out.
+	LockoutThreshold int
+	// LockoutBase is the first cool-down; each further failure doubles it, up to LockoutMax.
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+	// FailureWindow resets the failure count of a key that has not failed for this long.
+	FailureWindow time.Duration
+}
+
+// Stats are the counters exposed for monitoring.
+type Stats struct {
+	Allowed      uint64 `json:"allowed"`
+	RateLimited  uint64 `json:"rate_limited"`
+	LockedOut    uint64 `json:"locked_out"`
+	AuthFailures uint64 `json:"auth_failures"`
+	Lockouts     uint64 `json:"lockouts"`
+	TrackedKeys  int    `json:"tracked_keys"`
+	LockedKeys   int    `json:"locked_keys"`
+}
+
+type keyState struct {
+	bucket      *rate.Limiter
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// Limiter applies per-key rate limiting and failure lockouts.
+// Keys are opaque strings, typically a username or a client IP.
+type Limiter struct {
+	cfg       Config
+	mu        sync.Mutex
+	keys      map[string]*keyState
+	lastSweep time.Time
+	now       func() time.Time
+
+	allowed      atomic.Uint64
+	rateLimited  atomic.Uint64
+	lockedOut    atomic.Uint64
+	authFailures atomic.Uint64
+	lockouts     atomic.Uint64
+}
+
+// New creates a Limiter, applying defaults to unset durations.
+func New(cfg Config) *Limiter {
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Max(1, math.Ceil(cfg.RPS)))
+	}
+	if cfg.LockoutBase <= 0 {
+		cfg.LockoutBase = 30 * time.Second
+	}
+	if cfg.LockoutMax < cfg.LockoutBase {
+		cfg.LockoutMax = 15 * time.Minute
+		if cfg.LockoutMax < cfg.LockoutBase {
+			cfg.LockoutMax = cfg.LockoutBase
+		}
+	}
+	if cfg.FailureWindow <= 0 {
+		cfg.FailureWindow = 15 * time.Minute
+	}
+	return &Limiter{
+		cfg:  cfg,
+		keys: make(map[string]*keyState),
+		now:  time.Now,
+	}
+}
+
+// Allow reports whether a request for key may proceed.
+// When it may not, the returned duration is how long the client should wait.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if _, wait, ok := l.reserve(key); !ok {
+		return false, wait
+	}
+	l.allowed.Add(1)
+	return true, 0
+}
+
+// reservation is the token taken from the bucket of a key by reserve.
+type reservation struct {
+	r   *rate.Reservation
+	now time.Time
+}
+
+// cancel gives the token back, for a request refused by another check.
+func (r reservation) cancel() {
+	if r.r != nil {
+		r.r.CancelAt(r.now)
+	}
+}
+
+// reserve is Allow without counting the request as allowed: the caller counts it, or cancels the
+// reservation when another check refuses the request.
+func (l *Limiter) reserve(key string) (reservation, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.maybeSweep(now)
+	st := l.state(key, now)
+
+	if now.Before(st.lockedUntil) {
+		l.lockedOut.Add(1)
+		return reservation{}, st.lockedUntil.Sub(now), false
+	}
+
+	if st.bucket == nil {
+		return reservation{}, 0, true
+	}
+	r := st.bucket.ReserveN(now, 1)
+	if !r.OK() {
+		l.rateLimited.Add(1)
+		return reservation{}, time.Second, false
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		l.rateLimited.Add(1)
+		return reservation{}, delay, false
+	}
+	return reservation{r: r, now: now}, 0, true
+}
+
+// lockout returns how long key is still locked out, zero when it is not. Unlike Allow it does not
+// take a token, nor track keys without failures.
+func (l *Limiter) lockout(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.keys[key]
+	if !ok {
+		return 0
+	}
+	now := l.now()
+	if !now.Before(st.lockedUntil) {
+		return 0
+	}
+	l.lockedOut.Add(1)
+	return st.lockedUntil.Sub(now)
+}
+
+// Failure records an authentication failure for key and returns the lockout
+// duration if the key is now locked out (zero otherwise).
+func (l *Limiter) Failure(key string) time.Duration {
+	l.authFailures.Add(1)
+	if l.cfg.LockoutThreshold <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	st := l.state(key, now)
+	if !st.lastFailure.IsZero() && now.Sub(st.lastFailure) > l.cfg.FailureWindow {
+		st.failures = 0
+	}
+	st.failures++
+	st.lastFailure = now
+
+	if st.failures < l.cfg.LockoutThreshold {
+		return 0
+	}
+	// Exponential cool-down: base, 2*base, 4*base, ... capped at max.
+	exp := st.failures - l.cfg.LockoutThreshold
+	cooldown := l.cfg.LockoutMax
+	if exp < 32 {
+		if d := l.cfg.LockoutBase << exp; d > 0 && d < l.cfg.LockoutMax {
+			cooldown = d
+		}
+	}
+	st.lockedUntil = now.Add(cooldown)
+	l.lockouts.Add(1)
+	return cooldown
+}
+
+// Success clears the failure history of key.
+func (l *Limiter) Success(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.keys[key]; ok {
+		st.failures = 0
+		st.lastFailure = time.Time{}
+		st.lockedUntil = time.Time{}
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	now := l.now()
+	tracked := len(l.keys)
+	locked := 0
+	for _, st := range l.keys {
+		if now.Before(st.lockedUntil) {
+			locked++
+		}
+	}
+	l.mu.Unlock()
+
+	return Stats{
+		Allowed:      l.allowed.Load(),
+		RateLimited:  l.rateLimited.Load(),
+		LockedOut:    l.lockedOut.Load(),
+		AuthFailures: l.authFailures.Load(),
+		Lockouts:     l.lockouts.Load(),
+		TrackedKeys:  tracked,
+		LockedKeys:   locked,
+	}
+}
+
+// state returns the state of key, creating it if needed. Must be called with l.mu held.
+func (l *Limiter) state(key string, now time.Time) *keyState {
+	st, ok := l.keys[key]
+	if !ok {
+		st = &keyState{}
+		if l.cfg.RPS > 0 {
+			st.bucket = rate.NewLimiter(rate.Limit(l.cfg.RPS), l.cfg.Burst)
+		}
+		l.keys[key] = st
+	}
+	st.lastSeen = now
+	return st
+}
+
+// maybeSweep drops idle keys that are neither locked out nor carrying recent failures,
+// at most once per failure window. Must be called with l.mu held.
+func (l *Limiter) maybeSweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.cfg.FailureWindow {
+		return
+	}
+	l.lastSweep = now
+	for key, st := range l.keys {
+		if now.Sub(st.lastSeen) > l.cfg.FailureWindow && !now.Before(st.lockedUntil) {
+			delete(l.keys, key)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(cfg Config) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := New(cfg)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestLimiter_RateLimit(t *testing.T) {
+	l, clock := newTestLimiter(Config{RPS: 1, Burst: 2})
+
+	ok, _ := l.Allow("201")
+	assert.True(t, ok)
+	ok, _ = l.Allow("201")
+	assert.True(t, ok)
+
+	ok, wait := l.Allow("201")
+	assert.False(t, ok)
+	assert.InDelta(t, time.Second, wait, float64(10*time.Millisecond))
+
+	// Other keys have their own bucket.
+	ok, _ = l.Allow("202")
+	assert.True(t, ok)
+
+	clock.advance(time.Second)
+	ok, _ = l.Allow("201")
+	assert.True(t, ok)
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(4), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.RateLimited)
+	assert.Equal(t, 2, stats.TrackedKeys)
+}
+
+func TestLimiter_ZeroRPSDisablesRateLimit(t *testing.T) {
+	l, _ := newTestLimiter(Config{})
+	for i := 0; i < 100; i++ {
+		ok, _ := l.Allow("201")
+		require.True(t, ok)
+	}
+}
+
+func TestLimiter_LockoutWithExponentialCooldown(t *testing.T) {
+	l, clock := newTestLimiter(Config{LockoutThreshold: 3, LockoutBase: 10 * time.Second, LockoutMax: 30 * time.Second})
+
+	assert.Zero(t, l.Failure("201"))
+	assert.Zero(t, l.Failure("201"))
+	assert.Equal(t, 10*time.Second, l.Failure("201"))
+
+	ok, wait := l.Allow("201")
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+
+	clock.advance(10 * time.Second)
+	ok, _ = l.Allow("201")
+	assert.True(t, ok)
+
+	// Each further failure doubles the cool-down, up to the maximum.
+	assert.Equal(t, 20*time.Second, l.Failure("201"))
+	clock.advance(20 * time.Second)
+	assert.Equal(t, 30*time.Second, l.Failure("201"))
+	clock.advance(30 * time.Second)
+	assert.Equal(t, 30*time.Second, l.Failure("201"))
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(6), stats.AuthFailures)
+	assert.Equal(t, uint64(4), stats.Lockouts)
+	assert.Equal(t, uint64(1), stats.LockedOut)
+	assert.Equal(t, 1, stats.LockedKeys)
+}
+
+func TestLimiter_SuccessResetsFailures(t *testing.T) {
+	l, _ := newTestLimiter(Config{LockoutThreshold: 2})
+
+	l.Failure("201")
+	l.Success("201")
+	assert.Zero(t, l.Failure("201"))
+	assert.NotZero(t, l.Failure("201"))
+
+	l.Success("201")
+	ok, _ := l.Allow("201")
+	assert.True(t, ok)
+}
+
+func TestLimiter_FailureWindow(t *testing.T) {
+	l, clock := newTestLimiter(Config{LockoutThreshold: 2, FailureWindow: time.Minute})
+
+	l.Failure("201")
+	clock.advance(2 * time.Minute)
+	assert.Zero(t, l.Failure("201"), "old failures must be forgotten")
+}
+
+func TestLimiter_SweepsIdleKeys(t *testing.T) {
+	l, clock := newTestLimiter(Config{RPS: 1, LockoutThreshold: 1, LockoutBase: time.Hour, LockoutMax: time.Hour, FailureWindow: time.Minute})
+
+	l.Allow("idle")
+	l.Failure("locked")
+	clock.advance(2 * time.Minute)
+	l.Allow("fresh")
+
+	stats := l.Stats()
+	assert.Equal(t, 2, stats.TrackedKeys, "idle key must be swept, locked key kept")
+	assert.Equal(t, 1, stats.LockedKeys)
+}
+
+func TestGuard(t *testing.T) {
+	g := NewGuard(Config{LockoutThreshold: 2}, Config{LockoutThreshold: 3})
+
+	g.Failure("201", "10.0.0.1")
+	g.Failure("202", "10.0.0.1")
+	g.Success("202", "10.0.0.1")
+
+	// The IP keeps its failures even though an account succeeded from it.
+	g.Failure("203", "10.0.0.1")
+	ok, wait := g.Allow("204", "10.0.0.1")
+	assert.False(t, ok)
+	assert.Positive(t, wait)
+
+	ok, _ = g.Allow("204", "10.0.0.2")
+	assert.True(t, ok)
+
+	stats := g.Stats()
+	assert.Equal(t, uint64(3), stats.IP.AuthFailures)
+	assert.Equal(t, uint64(1), stats.IP.Lockouts)
+
+	// A username is locked out only at the IP sending the failures.
+	g.Failure("205", "10.0.0.2")
+	g.Failure("205", "10.0.0.2")
+	ok, wait = g.Allow("205", "10.0.0.2")
+	assert.False(t, ok)
+	assert.Positive(t, wait)
+	ok, _ = g.Allow("205", "10.0.0.3")
+	assert.True(t, ok)
+	g.Success("205", "10.0.0.3")
+	ok, _ = g.Allow("205", "10.0.0.2")
+	assert.False(t, ok, "a success at another IP must not lift the lockout")
+
+	var nilGuard *Guard
+	ok, _ = nilGuard.Allow("201", "10.0.0.1")
+	assert.True(t, ok)
+	nilGuard.Failure("201", "10.0.0.1")
+	nilGuard.Success("201", "10.0.0.1")
+	assert.Equal(t, GuardStats{}, nilGuard.Stats())
+}
+
+func TestGuard_RefusedRequestKeepsTokens(t *testing.T) {
+	g := NewGuard(Config{RPS: 1, Burst: 1}, Config{RPS: 1, Burst: 2})
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	g.User.now, g.IP.now = clock.now, clock.now
+
+	ok, _ := g.Allow("201", "10.0.0.1")
+	assert.True(t, ok)
+
+	// The username is rate limited: the token taken from the IP bucket is given back.
+	for range 3 {
+		ok, _ = g.Allow("201", "10.0.0.1")
+		assert.False(t, ok)
+	}
+	ok, _ = g.Allow("202", "10.0.0.1")
+	assert.True(t, ok)
+
+	stats := g.Stats()
+	assert.Equal(t, uint64(2), stats.IP.Allowed)
+	assert.Equal(t, uint64(2), stats.User.Allowed)
+	assert.Equal(t, uint64(3), stats.User.RateLimited)
+	assert.Zero(t, stats.IP.RateLimited)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_USER_RPS", "0.5")
+	t.Setenv("RATE_LIMIT_USER_BURST", "3")
+	t.Setenv("RATE_LIMIT_USER_LOCKOUT_THRESHOLD", "0")
+	t.Setenv("RATE_LIMIT_USER_LOCKOUT_MAX_SECONDS", "60")
+
+	cfg := configFromEnv("RATE_LIMIT_USER_", DefaultUserConfig)
+	assert.Equal(t, 0.5, cfg.RPS)
+	assert.Equal(t, 3, cfg.Burst)
+	assert.Zero(t, cfg.LockoutThreshold)
+	assert.Equal(t, time.Minute, cfg.LockoutMax)
+	assert.Equal(t, DefaultUserConfig.LockoutBase, cfg.LockoutBase)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultACMECacheDir = "/var/lib/matrix2acrobits/acme"
+
+// ACMEConfig enables certificates obtained from an ACME CA such as Let's Encrypt.
+// Challenges are answered with TLS-ALPN-01 on the main listener and, when HTTPAddr is set,
+// with HTTP-01 on a second listener that redirects every other request to HTTPS.
+type ACMEConfig struct {
+	Domains []string
+	Email   string
+	// DirectoryURL is the ACME directory; empty means Let's Encrypt production.
+	// Point it to a staging or a local test CA (e.g. pebble) to try the setup.
+	DirectoryURL string
+	// CacheDir stores the account key and the certificates across restarts.
+	CacheDir string
+	// HTTPAddr is the listen address of the HTTP-01 challenge listener, usually ":80".
+	HTTPAddr string
+}
+
+// Enabled reports whether ACME is configured.
+func (c ACMEConfig) Enabled() bool {
+	return len(c.Domains) > 0
+}
+
+// ACMEConfigFromEnv reads ACME_DOMAINS (comma-separated), ACME_EMAIL, ACME_DIRECTORY_URL,
+// ACME_CACHE_DIR (default /var/lib/matrix2acrobits/acme) and ACME_HTTP_ADDR.
+func ACMEConfigFromEnv() ACMEConfig {
+	cfg := ACMEConfig{
+		Email:        strings.TrimSpace(os.Getenv("ACME_EMAIL")),
+		DirectoryURL: strings.TrimSpace(os.Getenv("ACME_DIRECTORY_URL")),
+		CacheDir:     strings.TrimSpace(os.Getenv("ACME_CACHE_DIR")),
+		HTTPAddr:     strings.TrimSpace(os.Getenv("ACME_HTTP_ADDR")),
+	}
+	for _, d := range strings.Split(os.Getenv("ACME_DOMAINS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			cfg.Domains = append(cfg.Domains, d)
+		}
+	}
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = defaultACMECacheDir
+	}
+	return cfg
+}
+
+// newACMEManager builds the autocert manager for cfg. Certificates are requested lazily,
+// on the first handshake for each domain, and renewed in the background before expiry.
+func newACMEManager(cfg ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m
+}
+
+// configureACME returns the TLS configuration backed by ACME and starts the HTTP-01 listener, if configured.
+func configureACME(cfg ACMEConfig) (*tls.Config, func(context.Context) error, error) {
+	m := newACMEManager(cfg)
+	if err := checkDirectory(context.Background(), m); err != nil {
+		// Not fatal: certificates cached in CacheDir may still be served.
+		logger.Warn().Err(err).Str("directory", cfg.DirectoryURL).Msg("acme: directory unreachable")
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+		// Required by the TLS-ALPN-01 challenge; Configure prepends h2 and http/1.1.
+		NextProtos: []string{acme.ALPNProto},
+	}
+
+	stop := func(context.Context) error { return nil }
+	if cfg.HTTPAddr != "" {
+		l, err := net.Listen("tcp", cfg.HTTPAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		challenge := &http.Server{Handler: m.HTTPHandler(nil), ReadHeaderTimeout: defaultReadHeaderTimeout}
+		go func() {
+			if err := challenge.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error().Err(err).Str("addr", cfg.HTTPAddr).Msg("acme: challenge listener stopped")
+			}
+		}()
+		logger.Info().Str("addr", l.Addr().String()).Msg("acme: http-01 challenge listener started")
+		stop = challenge.Shutdown
+	}
+	return tlsConfig, stop, nil
+}
+
+// checkDirectory fetches the ACME directory, to report a wrong ACME_DIRECTORY_URL
+// at startup rather than on the first handshake.
+func checkDirectory(ctx context.Context, m *autocert.Manager) error {
+	client := m.Client
+	if client == nil {
+		client = &acme.Client{DirectoryURL: autocert.DefaultACMEDirectory}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := client.Discover(ctx)
+	return err
+}
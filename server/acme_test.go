@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+// acmeDirectoryStub serves an ACME directory and counts the requests, so the setup can be
+// tested offline. Any other ACME call fails the test.
+func acmeDirectoryStub(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/directory" {
+			t.Errorf("unexpected ACME request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   srv.URL + "/new-nonce",
+			"newAccount": srv.URL + "/new-account",
+			"newOrder":   srv.URL + "/new-order",
+			"revokeCert": srv.URL + "/revoke-cert",
+			"keyChange":  srv.URL + "/key-change",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestACMEConfigFromEnv(t *testing.T) {
+	t.Setenv("ACME_DOMAINS", " proxy.example.com, ,chat.example.com")
+	t.Setenv("ACME_EMAIL", "admin@example.com")
+	t.Setenv("ACME_DIRECTORY_URL", "")
+	t.Setenv("ACME_CACHE_DIR", "")
+	t.Setenv("ACME_HTTP_ADDR", ":80")
+
+	cfg := ACMEConfigFromEnv()
+	assert.True(t, cfg.Enabled())
+	assert.Equal(t, []string{"proxy.example.com", "chat.example.com"}, cfg.Domains)
+	assert.Equal(t, defaultACMECacheDir, cfg.CacheDir)
+	assert.Equal(t, ":80", cfg.HTTPAddr)
+
+	t.Setenv("ACME_DOMAINS", "")
+	assert.False(t, ACMEConfigFromEnv().Enabled())
+}
+
+func TestConfigure_ACME(t *testing.T) {
+	stub, hits := acmeDirectoryStub(t)
+	cacheDir := t.TempDir()
+	// A certificate obtained by a previous run is served from the cache without contacting the CA.
+	certPEM, keyPEM := selfSigned(t, "proxy.example.com")
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "proxy.example.com"), append(keyPEM, certPEM...), 0o600))
+
+	hs := &http.Server{}
+	stop, err := Configure(hs, Config{HTTP2: true, ACME: ACMEConfig{
+		Domains:      []string{"proxy.example.com"},
+		DirectoryURL: stub.URL + "/directory",
+		CacheDir:     cacheDir,
+		HTTPAddr:     "127.0.0.1:0",
+	}})
+	require.NoError(t, err)
+	defer stop(t.Context())
+
+	assert.Equal(t, int32(1), hits.Load(), "the directory is checked at startup")
+	assert.Equal(t, []string{"h2", "http/1.1", acme.ALPNProto}, hs.TLSConfig.NextProtos)
+
+	addr := serve(t, hs)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "proxy.example.com", InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	require.NoError(t, err)
+	assert.Equal(t, "proxy.example.com", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	conn.Close()
+
+	// Hosts outside ACME_DOMAINS are refused before any order is placed.
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "other.example.com", InsecureSkipVerify: true})
+	assert.Error(t, err)
+}
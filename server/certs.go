@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// CertReloader serves a certificate read from a certificate and a key file and reloads it when
+// the files change, so a renewal (e.g. by certbot or cert-manager) needs no restart.
+// The files are checked at most once per interval, during TLS handshakes.
+type CertReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+	now               func() time.Time
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// NewCertReloader loads the certificate and fails if it cannot be read.
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, interval: interval, now: time.Now}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.now().Sub(r.lastCheck) >= r.interval {
+		r.lastCheck = r.now()
+		if r.changed() {
+			// During a renewal the key may be written after the certificate: keep serving
+			// the previous certificate and try again at the next check.
+			if err := r.loadLocked(); err != nil {
+				logger.Warn().Err(err).Str("cert_file", r.certFile).Msg("tls: failed to reload certificate, keeping the previous one")
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *CertReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastCheck = r.now()
+	return r.loadLocked()
+}
+
+func (r *CertReloader) loadLocked() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls key: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls key pair: %w", err)
+	}
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	logger.Info().Str("cert_file", r.certFile).Time("not_after", cert.Leaf.NotAfter).Msg("tls: certificate loaded")
+	return nil
+}
+
+// changed reports whether either file was modified since the last load.
+func (r *CertReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "old.example.com")
+
+	r, err := NewCertReloader(certFile, keyFile, time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "old.example.com", cert.Leaf.Subject.CommonName)
+
+	// Renewal: new files with a newer modification time.
+	writeCert(t, dir, "new.example.com")
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+
+	cert, _ = r.GetCertificate(nil)
+	assert.Equal(t, "old.example.com", cert.Leaf.Subject.CommonName, "files are not checked before the interval")
+
+	now = now.Add(time.Minute)
+	cert, _ = r.GetCertificate(nil)
+	assert.Equal(t, "new.example.com", cert.Leaf.Subject.CommonName)
+
+	// A half-written renewal keeps the current certificate.
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	later := future.Add(time.Hour)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	now = now.Add(time.Minute)
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "new.example.com", cert.Leaf.Subject.CommonName)
+}
+
+func TestNewCertReloader_MissingFile(t *testing.T) {
+	_, err := NewCertReloader("/nonexistent/tls.crt", "/nonexistent/tls.key", time.Minute)
+	assert.Error(t, err)
+}
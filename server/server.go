@@ -0,0 +1,172 @@
+// Package server configures the HTTP server of the proxy: timeouts, HTTP/2 and optional native TLS,
+// with certificates read from files and reloaded on renewal, or obtained through ACME.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// Defaults of the server timeouts. The write timeout must exceed the 30 second
+// Matrix sync long poll performed by fetch_messages.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultReloadInterval    = time.Minute
+)
+
+// Config describes how the proxy listens.
+type Config struct {
+	Addr string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// HTTP2 enables HTTP/2 over TLS. HTTP2Cleartext also accepts HTTP/2 without TLS (h2c),
+	// for reverse proxies speaking HTTP/2 to the backend.
+	HTTP2          bool
+	HTTP2Cleartext bool
+
+	// CertFile and KeyFile enable TLS with a certificate read from disk. The files are checked
+	// every ReloadInterval and reloaded when they change.
+	CertFile       string
+	KeyFile        string
+	ReloadInterval time.Duration
+
+	// ACME enables TLS with certificates obtained automatically, see ACMEConfig.
+	ACME ACMEConfig
+}
+
+// TLS reports whether the server terminates TLS.
+func (c Config) TLS() bool {
+	return c.CertFile != "" || c.ACME.Enabled()
+}
+
+// ConfigFromEnv reads the server configuration for the given listen address:
+//   - SERVER_READ_HEADER_TIMEOUT_SECONDS (default 10), SERVER_READ_TIMEOUT_SECONDS (default 30),
+//     SERVER_WRITE_TIMEOUT_SECONDS (default 60), SERVER_IDLE_TIMEOUT_SECONDS (default 120)
+//   - HTTP2_ENABLED (default true), HTTP2_CLEARTEXT (default false)
+//   - TLS_CERT_FILE, TLS_KEY_FILE, TLS_RELOAD_INTERVAL_SECONDS (default 60)
+//   - the ACME_* variables described in ACMEConfigFromEnv
+func ConfigFromEnv(addr string) (Config, error) {
+	cfg := Config{
+		Addr:              addr,
+		ReadHeaderTimeout: envSeconds("SERVER_READ_HEADER_TIMEOUT_SECONDS", defaultReadHeaderTimeout),
+		ReadTimeout:       envSeconds("SERVER_READ_TIMEOUT_SECONDS", defaultReadTimeout),
+		WriteTimeout:      envSeconds("SERVER_WRITE_TIMEOUT_SECONDS", defaultWriteTimeout),
+		IdleTimeout:       envSeconds("SERVER_IDLE_TIMEOUT_SECONDS", defaultIdleTimeout),
+		HTTP2:             envBool("HTTP2_ENABLED", true),
+		HTTP2Cleartext:    envBool("HTTP2_CLEARTEXT", false),
+		CertFile:          strings.TrimSpace(os.Getenv("TLS_CERT_FILE")),
+		KeyFile:           strings.TrimSpace(os.Getenv("TLS_KEY_FILE")),
+		ReloadInterval:    envSeconds("TLS_RELOAD_INTERVAL_SECONDS", defaultReloadInterval),
+		ACME:              ACMEConfigFromEnv(),
+	}
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.CertFile != "" && c.ACME.Enabled() {
+		return errors.New("TLS_CERT_FILE and ACME_DOMAINS are mutually exclusive")
+	}
+	return nil
+}
+
+// Configure applies cfg to hs: address, timeouts, protocols and TLS. The returned function
+// stops the background listeners started for TLS, if any; it must be called on shutdown.
+func Configure(hs *http.Server, cfg Config) (func(context.Context) error, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	hs.Addr = cfg.Addr
+	hs.ReadHeaderTimeout = cfg.ReadHeaderTimeout
+	hs.ReadTimeout = cfg.ReadTimeout
+	hs.WriteTimeout = cfg.WriteTimeout
+	hs.IdleTimeout = cfg.IdleTimeout
+
+	stop := func(context.Context) error { return nil }
+	switch {
+	case cfg.CertFile != "":
+		certs, err := NewCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		hs.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		logger.Info().Str("cert_file", cfg.CertFile).Dur("reload_interval", cfg.ReloadInterval).Msg("tls enabled with certificate files")
+	case cfg.ACME.Enabled():
+		tlsConfig, stopACME, err := configureACME(cfg.ACME)
+		if err != nil {
+			return nil, err
+		}
+		hs.TLSConfig = tlsConfig
+		stop = stopACME
+		logger.Info().Strs("domains", cfg.ACME.Domains).Str("directory", cfg.ACME.DirectoryURL).Msg("tls enabled with acme certificates")
+	}
+
+	if hs.TLSConfig != nil {
+		// http.Server enables HTTP/2 on a TLS listener only when "h2" is offered.
+		protos := []string{"http/1.1"}
+		if cfg.HTTP2 {
+			protos = append([]string{"h2"}, protos...)
+		}
+		hs.TLSConfig.NextProtos = append(protos, hs.TLSConfig.NextProtos...)
+	}
+	if cfg.HTTP2Cleartext {
+		hs.Protocols = new(http.Protocols)
+		hs.Protocols.SetHTTP1(true)
+		hs.Protocols.SetUnencryptedHTTP2(true)
+		hs.Protocols.SetHTTP2(cfg.HTTP2)
+	}
+	return stop, nil
+}
+
+func envSeconds(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			return time.Duration(parsed) * time.Second
+		}
+		logger.Warn().Str("variable", name).Str("value", v).Msg("invalid number of seconds, using default")
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	if v := os.Getenv(name); v != "" {
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			return parsed
+		}
+		logger.Warn().Str("variable", name).Str("value", v).Msg("invalid boolean, using default")
+	}
+	return def
+}
+
+// Describe returns the scheme and protocols served, for the startup log.
+func (c Config) Describe() string {
+	scheme := "http"
+	if c.TLS() {
+		scheme = "https"
+	}
+	if c.HTTP2 && (c.TLS() || c.HTTP2Cleartext) {
+		return fmt.Sprintf("%s (http/1.1, h2)", scheme)
+	}
+	return fmt.Sprintf("%s (http/1.1)", scheme)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSigned returns the PEM encoded certificate and key of a self-signed certificate for host.
+func selfSigned(t *testing.T, host string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeCert writes a self-signed certificate for host to dir and returns the file paths.
+func writeCert(t *testing.T, dir, host string) (certFile, keyFile string) {
+	t.Helper()
+	certPEM, keyPEM := selfSigned(t, host)
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	return certFile, keyFile
+}
+
+// serve starts hs like echo does, on a TLS listener when hs has a TLS configuration,
+// and returns its address. The handler replies with the protocol of the request.
+func serve(t *testing.T, hs *http.Server) string {
+	t.Helper()
+	hs.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if hs.TLSConfig != nil {
+		l = tls.NewListener(l, hs.TLSConfig)
+	}
+	go hs.Serve(l)
+	t.Cleanup(func() { hs.Close() })
+	return l.Addr().String()
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	buf := make([]byte, 64)
+	n, _ := resp.Body.Read(buf)
+	return string(buf[:n])
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	for _, name := range []string{"SERVER_READ_HEADER_TIMEOUT_SECONDS", "SERVER_READ_TIMEOUT_SECONDS", "SERVER_WRITE_TIMEOUT_SECONDS",
+		"SERVER_IDLE_TIMEOUT_SECONDS", "HTTP2_ENABLED", "HTTP2_CLEARTEXT", "TLS_CERT_FILE", "TLS_KEY_FILE", "ACME_DOMAINS"} {
+		t.Setenv(name, "")
+	}
+
+	cfg, err := ConfigFromEnv(":8080")
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", cfg.Addr)
+	assert.Equal(t, defaultWriteTimeout, cfg.WriteTimeout)
+	assert.True(t, cfg.HTTP2)
+	assert.False(t, cfg.TLS())
+	assert.Equal(t, "http (http/1.1)", cfg.Describe())
+
+	t.Setenv("SERVER_WRITE_TIMEOUT_SECONDS", "90")
+	t.Setenv("HTTP2_CLEARTEXT", "true")
+	cfg, err = ConfigFromEnv(":8080")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, cfg.WriteTimeout)
+	assert.Equal(t, "http (http/1.1, h2)", cfg.Describe())
+
+	t.Setenv("TLS_CERT_FILE", "/etc/tls.crt")
+	_, err = ConfigFromEnv(":8080")
+	assert.Error(t, err, "key file missing")
+
+	t.Setenv("TLS_KEY_FILE", "/etc/tls.key")
+	t.Setenv("ACME_DOMAINS", "proxy.example.com")
+	_, err = ConfigFromEnv(":8080")
+	assert.Error(t, err, "files and acme are exclusive")
+}
+
+func TestConfigure_Timeouts(t *testing.T) {
+	hs := &http.Server{}
+	stop, err := Configure(hs, Config{Addr: ":0", ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second, IdleTimeout: 4 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, stop(t.Context()))
+
+	assert.Equal(t, ":0", hs.Addr)
+	assert.Equal(t, time.Second, hs.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Second, hs.ReadTimeout)
+	assert.Equal(t, 3*time.Second, hs.WriteTimeout)
+	assert.Equal(t, 4*time.Second, hs.IdleTimeout)
+	assert.Nil(t, hs.TLSConfig)
+	assert.Nil(t, hs.Protocols)
+}
+
+func TestConfigure_TLS(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir(), "localhost")
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+
+	for _, tc := range []struct {
+		http2 bool
+		proto string
+	}{{true, "HTTP/2.0"}, {false, "HTTP/1.1"}} {
+		hs := &http.Server{}
+		_, err := Configure(hs, Config{HTTP2: tc.http2, CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Minute})
+		require.NoError(t, err)
+
+		addr := serve(t, hs)
+		assert.Equal(t, tc.proto, get(t, client, "https://"+addr+"/"))
+	}
+}
+
+func TestConfigure_HTTP2Cleartext(t *testing.T) {
+	hs := &http.Server{}
+	_, err := Configure(hs, Config{HTTP2: true, HTTP2Cleartext: true})
+	require.NoError(t, err)
+	addr := serve(t, hs)
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	assert.Equal(t, "HTTP/2.0", get(t, client, "http://"+addr+"/"))
+
+	// Plain HTTP/1.1 clients are still served.
+	assert.Equal(t, "HTTP/1.1", get(t, http.DefaultClient, "http://"+addr+"/"))
+}
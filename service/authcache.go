@@ -0,0 +1,207 @@
+package service
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/metrics"
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+const (
+	defaultAuthNegativeCacheTTL = 30 * time.Second
+	defaultAuthCacheMaxEntries  = 10000
+)
+
+// authResult is the outcome of an authentication attempt as stored in the authCache.
+type authResult struct {
+	mappings []*models.MappingRequest
+	ok       bool
+	err      error
+}
+
+// authCacheItem is the value stored in each element of the LRU list.
+type authCacheItem struct {
+	key   string
+	entry cacheEntry[authResult]
+}
+
+// authCache caches authentication results keyed by a salted hash of the credentials,
+// so plaintext secrets are never kept in memory as map keys.
+// Successes are cached for ttl together with their mappings; rejections are cached for
+// the shorter negativeTTL. The cache holds at most maxEntries, evicting the least recently used.
+type authCache struct {
+	mu          sync.Mutex
+	salt        []byte
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	entries     map[string]*list.Element
+	lru         *list.List // front is the most recently used
+	now         func() time.Time
+	stop        chan struct{}
+	stopOnce    sync.Once
+	metrics     metrics.Tenant
+}
+
+// newAuthCache creates an authCache. A ttl of zero disables caching entirely.
+func newAuthCache(ttl, negativeTTL time.Duration, maxEntries int) *authCache {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		// crypto/rand never fails on supported platforms; an unsalted hash is still not plaintext.
+		logger.Error().Err(err).Msg("authcache: failed to generate salt")
+	}
+	if negativeTTL > ttl {
+		negativeTTL = ttl
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultAuthCacheMaxEntries
+	}
+	return &authCache{
+		salt:        salt,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		now:         time.Now,
+		stop:        make(chan struct{}),
+	}
+}
+
+// enabled reports whether results are cached at all.
+func (c *authCache) enabled() bool {
+	return c != nil && c.ttl > 0
+}
+
+// key derives the cache key for a set of credentials.
+func (c *authCache) key(extension, secret, homeserverHost string) string {
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(extension))
+	mac.Write([]byte{0})
+	mac.Write([]byte(secret))
+	mac.Write([]byte{0})
+	mac.Write([]byte(homeserverHost))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// get returns a copy of the cached result for key, if present and not expired.
+func (c *authCache) get(key string) (authResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return authResult{}, false
+	}
+	item := elem.Value.(*authCacheItem)
+	if item.entry.isExpired(c.now()) {
+		c.removeElement(elem)
+		return authResult{}, false
+	}
+	c.lru.MoveToFront(elem)
+	res := item.entry.Value
+	res.mappings = copyMappings(res.mappings)
+	return res, true
+}
+
+// set stores res for key, choosing the TTL from the outcome, and evicts the least recently used entries.
+func (c *authCache) set(key string, res authResult) {
+	ttl := c.ttl
+	if !res.ok {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	res.mappings = copyMappings(res.mappings)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := cacheEntry[authResult]{Value: res, ExpiresAt: c.now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*authCacheItem).entry = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&authCacheItem{key: key, entry: entry})
+	c.metrics.CacheEntries(metrics.CacheAuth).Inc()
+	for c.lru.Len() > c.maxEntries {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// sweep removes all expired entries and returns how many were removed.
+func (c *authCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	removed := 0
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if elem.Value.(*authCacheItem).entry.isExpired(now) {
+			c.removeElement(elem)
+			removed++
+		}
+		elem = prev
+	}
+	return removed
+}
+
+// startSweeper periodically removes expired entries until close is called.
+func (c *authCache) startSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if removed := c.sweep(); removed > 0 {
+					logger.Debug().Int("removed", removed).Int("size", c.len()).Msg("authcache: expired entries swept")
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the sweeper.
+func (c *authCache) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// len returns the number of entries, including expired ones not yet swept.
+func (c *authCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *authCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*authCacheItem).key)
+	c.metrics.CacheEntries(metrics.CacheAuth).Dec()
+}
+
+// copyMappings deep-copies mappings so cached values cannot be mutated by callers.
+func copyMappings(in []*models.MappingRequest) []*models.MappingRequest {
+	out := make([]*models.MappingRequest, 0, len(in))
+	for _, m := range in {
+		cp := *m
+		cp.SubNumbers = append([]int(nil), m.SubNumbers...)
+		out = append(out, &cp)
+	}
+	return out
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthCache_KeyIsSaltedHash(t *testing.T) {
+	c1 := newAuthCache(time.Minute, time.Second, 10)
+	c2 := newAuthCache(time.Minute, time.Second, 10)
+
+	key := c1.key("201", "s3cret", "example.com")
+	assert.NotContains(t, key, "s3cret")
+	assert.NotContains(t, key, "201")
+	assert.Len(t, key, 64)
+	assert.Equal(t, key, c1.key("201", "s3cret", "example.com"))
+	// Different processes (salts) produce different keys
+	assert.NotEqual(t, key, c2.key("201", "s3cret", "example.com"))
+	// Field boundaries are preserved
+	assert.NotEqual(t, c1.key("20", "1s3cret", "example.com"), key)
+}
+
+func TestAuthCache_SetGet(t *testing.T) {
+	c := newAuthCache(time.Minute, 10*time.Second, 10)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.set("ok", authResult{mappings: []*models.MappingRequest{{Number: 201, MatrixID: "@a:b"}}, ok: true})
+	c.set("ko", authResult{ok: false, err: errors.New("rejected")})
+
+	res, found := c.get("ok")
+	require.True(t, found)
+	assert.True(t, res.ok)
+	require.Len(t, res.mappings, 1)
+	assert.Equal(t, 201, res.mappings[0].Number)
+
+	res, found = c.get("ko")
+	require.True(t, found)
+	assert.False(t, res.ok)
+	assert.EqualError(t, res.err, "rejected")
+
+	// Negative entries expire first
+	now = now.Add(11 * time.Second)
+	_, found = c.get("ko")
+	assert.False(t, found)
+	_, found = c.get("ok")
+	assert.True(t, found)
+
+	now = now.Add(time.Minute)
+	_, found = c.get("ok")
+	assert.False(t, found)
+	assert.Equal(t, 0, c.len(), "expired entries are removed on access")
+}
+
+func TestAuthCache_NegativeCachingDisabled(t *testing.T) {
+	c := newAuthCache(time.Minute, 0, 10)
+	c.set("ko", authResult{ok: false})
+	_, found := c.get("ko")
+	assert.False(t, found)
+}
+
+func TestAuthCache_LRUEviction(t *testing.T) {
+	c := newAuthCache(time.Minute, time.Second, 3)
+
+	for _, k := range []string{"a", "b", "c"} {
+		c.set(k, authResult{ok: true})
+	}
+	// Touch "a" so "b" becomes the least recently used
+	_, found := c.get("a")
+	require.True(t, found)
+
+	c.set("d", authResult{ok: true})
+	assert.Equal(t, 3, c.len())
+
+	_, found = c.get("b")
+	assert.False(t, found, "least recently used entry should be evicted")
+	for _, k := range []string{"a", "c", "d"} {
+		_, found = c.get(k)
+		assert.True(t, found, k)
+	}
+}
+
+func TestAuthCache_Sweep(t *testing.T) {
+	c := newAuthCache(time.Minute, time.Second, 100)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		c.set(strings.Repeat("k", i+1), authResult{ok: i%2 == 0})
+	}
+	assert.Equal(t, 5, c.len())
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 2, c.sweep(), "only negative entries have expired")
+	assert.Equal(t, 3, c.len())
+}
+
+func TestAuthCache_Sweeper(t *testing.T) {
+	c := newAuthCache(time.Minute, time.Millisecond, 100)
+	defer c.close()
+	c.set("ko", authResult{ok: false})
+
+	c.startSweeper(5 * time.Millisecond)
+	assert.Eventually(t, func() bool { return c.len() == 0 }, time.Second, 5*time.Millisecond)
+
+	// close is idempotent
+	c.close()
+}
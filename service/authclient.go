@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/metrics"
 	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // AuthResponse represents the JSON returned by the external testextauth endpoint.
@@ -29,52 +33,100 @@ type AuthClient interface {
 	Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error)
 }
 
+// errCredentialsRejected marks definite rejections from the auth endpoint, as opposed to transient failures.
+var errCredentialsRejected = errors.New("credentials rejected")
+
+// ErrInvalidCredentials is returned when the auth backend rejected the credentials of the client.
+// It is the only error counting as a failed login for the brute-force protection.
+var ErrInvalidCredentials = fmt.Errorf("%w: credentials rejected", ErrAuthentication)
+
+// ErrAuthUnavailable is returned when the auth backend could not check the credentials, e.g. while
+// it is unreachable: unlike ErrInvalidCredentials, it does not count as a failed login.
+var ErrAuthUnavailable = errors.New("authentication backend unavailable")
+
+// authError maps the error of a failed Validate to the error of the request: ErrInvalidCredentials
+// when the credentials were rejected, ErrAuthUnavailable when the backend failed.
+func authError(err error) error {
+	if errors.Is(err, ErrAuthUnavailable) {
+		return err
+	}
+	if authOutcome(false, err) == metrics.OutcomeRejected {
+		return ErrInvalidCredentials
+	}
+	return fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+}
+
 // HTTPAuthClient is the default AuthClient implementation that calls the external HTTP endpoint.
 type HTTPAuthClient struct {
-	url      string
-	client   *http.Client
-	mu       sync.RWMutex
-	cache    map[string]cachedAuth
-	cacheTTL time.Duration
+	url    string
+	client *http.Client
+	cache  *authCache
 }
 
-// NewHTTPAuthClient constructs an HTTPAuthClient.
+// NewHTTPAuthClient constructs an HTTPAuthClient caching results for cacheTTL (zero disables the cache),
+// with the default negative TTL and size bound.
 func NewHTTPAuthClient(url string, timeout time.Duration, cacheTTL time.Duration) *HTTPAuthClient {
+	return newHTTPAuthClient(url, timeout, newAuthCache(cacheTTL, defaultAuthNegativeCacheTTL, defaultAuthCacheMaxEntries))
+}
+
+func newHTTPAuthClient(url string, timeout time.Duration, cache *authCache) *HTTPAuthClient {
+	if cache.enabled() {
+		interval := cache.negativeTTL
+		if interval <= 0 {
+			interval = cache.ttl
+		}
+		cache.startSweeper(interval)
+	}
 	return &HTTPAuthClient{
 		url: url,
 		client: &http.Client{
-			Timeout: timeout,
+			Timeout:   timeout,
+			Transport: tracing.Transport(nil),
 		},
-		cache:    make(map[string]cachedAuth),
-		cacheTTL: cacheTTL,
+		cache: cache,
 	}
 }
 
-type cachedAuth struct {
-	expiry time.Time
+// Close stops the background cache sweeper.
+func (h *HTTPAuthClient) Close() error {
+	h.cache.close()
+	return nil
 }
 
 // Validate calls the configured external auth endpoint and converts its result
-// into an array of models.MappingRequest. It caches authentication success/failure.
+// into an array of models.MappingRequest.
+// Successful results are cached with their mappings; rejections (401/403) are cached briefly.
 // homeserverHost is used to build full Matrix IDs when the returned user_name is a localpart.
-func (h *HTTPAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+func (h *HTTPAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) (mappings []*models.MappingRequest, ok bool, err error) {
+	logger.Ctx(ctx).Debug().Str("extension", extension).Msg("authclient: validate called")
+	ctx, span := startAuthSpan(ctx, AuthBackendHTTP, extension)
+	defer func() { endAuthSpan(span, ok, err) }()
+
 	// check cache
-	key := extension + "|" + secret + "|" + homeserverHost
-	logger.Debug().Str("key", key).Msg("authclient: validate called")
-	if h.cacheTTL > 0 {
-		h.mu.RLock()
-		if c, ok := h.cache[key]; ok {
-			if time.Now().Before(c.expiry) {
-				h.mu.RUnlock()
-				logger.Debug().Str("key", key).Time("expiry", c.expiry).Msg("authclient: cache hit")
-				// Return empty array on cache hit for authenticated requests
-				return []*models.MappingRequest{}, true, nil
-			}
+	var key string
+	if h.cache.enabled() {
+		key = h.cache.key(extension, secret, homeserverHost)
+		res, hit := h.cache.get(key)
+		h.cache.metrics.CacheLookup(metrics.CacheAuth, hit)
+		span.SetAttributes(attribute.Bool("auth.cache_hit", hit))
+		if hit {
+			logger.Ctx(ctx).Debug().Str("extension", extension).Bool("authenticated", res.ok).Int("mappings", len(res.mappings)).Msg("authclient: cache hit")
+			return res.mappings, res.ok, res.err
 		}
-		h.mu.RUnlock()
-		logger.Debug().Str("key", key).Msg("authclient: cache miss or expired")
+		logger.Ctx(ctx).Debug().Str("extension", extension).Msg("authclient: cache miss or expired")
 	}
 
+	start := time.Now()
+	mappings, ok, err = h.validate(ctx, extension, secret, homeserverHost)
+	h.cache.metrics.ObserveAuthRequest(AuthBackendHTTP, authOutcome(ok, err), start)
+	if h.cache.enabled() && (ok || errors.Is(err, errCredentialsRejected)) {
+		h.cache.set(key, authResult{mappings: mappings, ok: ok, err: err})
+		logger.Ctx(ctx).Debug().Str("extension", extension).Bool("authenticated", ok).Msg("authclient: cached authentication result")
+	}
+	return mappings, ok, err
+}
+
+func (h *HTTPAuthClient) validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
 	payload := map[string]string{"extension": extension, "secret": secret}
 	body, _ := json.Marshal(payload)
 	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
@@ -83,7 +135,7 @@ func (h *HTTPAuthClient) Validate(ctx context.Context, extension, secret, homese
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	logger.Debug().Str("url", h.url).Str("extension", extension).Msg("authclient: sending auth request")
+	logger.Ctx(ctx).Debug().Str("url", h.url).Str("extension", extension).Msg("authclient: sending auth request")
 
 	resp, err := h.client.Do(req)
 	if err != nil {
@@ -91,76 +143,173 @@ func (h *HTTPAuthClient) Validate(ctx context.Context, extension, secret, homese
 	}
 	defer resp.Body.Close()
 
-	logger.Debug().Int("status", resp.StatusCode).Msg("authclient: received response")
+	logger.Ctx(ctx).Debug().Int("status", resp.StatusCode).Msg("authclient: received response")
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
-		logger.Debug().Int("status", resp.StatusCode).Bytes("body", b).Msg("authclient: non-200 response")
+		logger.Ctx(ctx).Debug().Int("status", resp.StatusCode).Bytes("body", b).Msg("authclient: non-200 response")
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return []*models.MappingRequest{}, false, fmt.Errorf("%w: status %d: %s", errCredentialsRejected, resp.StatusCode, string(b))
+		}
 		return []*models.MappingRequest{}, false, fmt.Errorf("status %d: %s", resp.StatusCode, string(b))
 	}
 
 	var responses []AuthResponse
 	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
-		logger.Debug().Err(err).Msg("authclient: failed to decode response")
+		logger.Ctx(ctx).Debug().Err(err).Msg("authclient: failed to decode response")
 		return []*models.MappingRequest{}, false, err
 	}
 
-	logger.Debug().Int("response_count", len(responses)).Msg("authclient: parsed auth response array")
-
-	// Cache successful authentication (without mapping data)
-	if h.cacheTTL > 0 {
-		h.mu.Lock()
-		h.cache[key] = cachedAuth{expiry: time.Now().Add(h.cacheTTL)}
-		h.mu.Unlock()
-		logger.Debug().Str("key", key).Time("expiry", time.Now().Add(h.cacheTTL)).Msg("authclient: cached successful authentication")
-	}
+	logger.Ctx(ctx).Debug().Int("response_count", len(responses)).Msg("authclient: parsed auth response array")
 
 	mappings := make([]*models.MappingRequest, 0, len(responses))
-	var mainNum int
-	var errNum error
 	for _, ar := range responses {
-		logger.Debug().Str("main_extension", ar.MainExtension).Strs("sub_extensions", ar.SubExtensions).Str("user_name", ar.UserName).Msg("authclient: processing auth response")
+		if mapping := mappingFromAuthResponse(ctx, ar, homeserverHost); mapping != nil {
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	return mappings, true, nil
+}
 
-		// Validate main_extension exists and is a number
-		mainExtStr := strings.TrimSpace(ar.MainExtension)
-		if mainExtStr == "" {
-			logger.Warn().Msg("authclient: response has empty main_extension, skipping")
+// mappingFromAuthResponse converts a single AuthResponse into a MappingRequest.
+// It is shared by all AuthClient implementations so every backend produces the same mappings.
+// UserName may be a localpart (combined with homeserverHost) or a full Matrix ID.
+// Returns nil if the response cannot be converted.
+func mappingFromAuthResponse(ctx context.Context, ar AuthResponse, homeserverHost string) *models.MappingRequest {
+	logger.Ctx(ctx).Debug().Str("main_extension", ar.MainExtension).Strs("sub_extensions", ar.SubExtensions).Str("user_name", ar.UserName).Msg("authclient: processing auth response")
+
+	// Validate main_extension exists and is a number
+	mainExtStr := strings.TrimSpace(ar.MainExtension)
+	if mainExtStr == "" {
+		logger.Ctx(ctx).Warn().Msg("authclient: response has empty main_extension, skipping")
+		return nil
+	}
+	mainNum, err := strconv.Atoi(mainExtStr)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Str("main_extension", mainExtStr).Err(err).Msg("authclient: main_extension is not a valid number, skipping")
+		return nil
+	}
+
+	// Parse sub extensions
+	subNums := make([]int, 0, len(ar.SubExtensions))
+	for _, ssub := range ar.SubExtensions {
+		ssub = strings.TrimSpace(ssub)
+		if ssub == "" {
 			continue
 		}
-		if mainNum, errNum = strconv.Atoi(mainExtStr); errNum != nil {
-			logger.Warn().Str("main_extension", mainExtStr).Err(errNum).Msg("authclient: main_extension is not a valid number, skipping")
-			continue
+		if v, err := strconv.Atoi(ssub); err == nil {
+			subNums = append(subNums, v)
+		} else {
+			logger.Ctx(ctx).Debug().Str("sub_extension", ssub).Err(err).Msg("authclient: skipping invalid sub_extension")
 		}
+	}
 
-		// Parse sub extensions
-		subNums := make([]int, 0, len(ar.SubExtensions))
-		for _, ssub := range ar.SubExtensions {
-			ssub = strings.TrimSpace(ssub)
-			if ssub == "" {
-				continue
-			}
-			if v, err := strconv.Atoi(ssub); err == nil {
-				subNums = append(subNums, v)
-			} else {
-				logger.Debug().Str("sub_extension", ssub).Err(err).Msg("authclient: skipping invalid sub_extension")
-			}
-		}
+	// Build matrix id
+	userName := strings.ToLower(strings.TrimSpace(ar.UserName))
+	if userName == "" {
+		logger.Ctx(ctx).Warn().Msg("authclient: response has empty user_name, skipping")
+		return nil
+	}
+	matrixID := userName
+	if !strings.HasPrefix(userName, "@") || !strings.Contains(userName, ":") {
+		matrixID = fmt.Sprintf("@%s:%s", strings.TrimPrefix(userName, "@"), homeserverHost)
+	}
 
-		// Build matrix id
-		if ar.UserName == "" {
-			logger.Warn().Msg("authclient: response has empty user_name, skipping")
-			continue
-		}
-		matrixID := fmt.Sprintf("@%s:%s", strings.ToLower(strings.TrimSpace(ar.UserName)), homeserverHost)
+	logger.Ctx(ctx).Debug().Int("number", mainNum).Str("matrix_id", matrixID).Ints("sub_numbers", subNums).Msg("authclient: added mapping from response")
+	return &models.MappingRequest{
+		Number:     mainNum,
+		MatrixID:   matrixID,
+		SubNumbers: subNums,
+	}
+}
 
-		mapping := &models.MappingRequest{
-			Number:     mainNum,
-			MatrixID:   matrixID,
-			SubNumbers: subNums,
-		}
-		mappings = append(mappings, mapping)
+// unavailableAuthClient rejects every request; it stands in for a backend that failed to initialize.
+type unavailableAuthClient struct {
+	err error
+}
+
+func (u unavailableAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+	return []*models.MappingRequest{}, false, fmt.Errorf("%w: %v", ErrAuthUnavailable, u.err)
+}
+
+// NewAuthClient builds the AuthClient selected by cfg.Auth.Backend.
+func NewAuthClient(cfg Config) (AuthClient, error) {
+	cfg = cfg.withDefaults()
 
-		logger.Debug().Int("number", mainNum).Str("matrix_id", matrixID).Ints("sub_numbers", subNums).Msg("authclient: added mapping from response")
+	var (
+		client AuthClient
+		err    error
+	)
+	switch cfg.Auth.Backend {
+	case AuthBackendHTTP:
+		// The HTTP client records its own metrics, so that cache hits are not counted as backend calls.
+		cache := newAuthCache(cfg.CacheTTL, cfg.AuthNegativeCacheTTL, cfg.AuthCacheMaxEntries)
+		cache.metrics = metrics.Tenant(cfg.Tenant)
+		return newHTTPAuthClient(cfg.ExtAuthURL, cfg.ExtAuthTimeout, cache), nil
+	case AuthBackendLDAP:
+		client, err = NewLDAPAuthClient(cfg.Auth.LDAP, cfg.ExtAuthTimeout)
+	case AuthBackendMatrix:
+		client, err = NewMatrixAuthClient(cfg.HomeserverURL, cfg.ExtAuthTimeout)
+	case AuthBackendFile:
+		client, err = NewFileAuthClient(cfg.Auth.File)
+	case AuthBackendOIDC:
+		client, err = NewOIDCAuthClient(cfg.Auth.OIDC, cfg.ExtAuthTimeout)
+	default:
+		return nil, fmt.Errorf("unknown auth backend %q", cfg.Auth.Backend)
 	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedAuthClient{backend: cfg.Auth.Backend, next: client, metrics: metrics.Tenant(cfg.Tenant)}, nil
+}
 
-	return mappings, true, nil
+// instrumentedAuthClient records the duration and outcome of every call to the wrapped backend.
+type instrumentedAuthClient struct {
+	backend string
+	next    AuthClient
+	metrics metrics.Tenant
+}
+
+func (i *instrumentedAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+	ctx, span := startAuthSpan(ctx, i.backend, extension)
+	start := time.Now()
+	mappings, ok, err := i.next.Validate(ctx, extension, secret, homeserverHost)
+	i.metrics.ObserveAuthRequest(i.backend, authOutcome(ok, err), start)
+	endAuthSpan(span, ok, err)
+	return mappings, ok, err
+}
+
+// Close closes the wrapped backend if it holds resources.
+func (i *instrumentedAuthClient) Close() error {
+	if closer, ok := i.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// authOutcome is the outcome label of a backend call; rejected credentials are told apart from errors.
+func authOutcome(ok bool, err error) string {
+	switch {
+	case ok:
+		return metrics.OutcomeOK
+	case err == nil, errors.Is(err, ErrAuthentication), errors.Is(err, errCredentialsRejected):
+		return metrics.OutcomeRejected
+	default:
+		return metrics.OutcomeError
+	}
+}
+
+// startAuthSpan starts the span of a Validate call. The secret is never recorded.
+func startAuthSpan(ctx context.Context, backend, extension string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "auth.validate", tracing.AttrAuthBackend.String(backend), tracing.AttrUsername.String(extension))
+}
+
+// endAuthSpan ends span with the outcome of a Validate call. Rejected credentials are not span errors.
+func endAuthSpan(span trace.Span, ok bool, err error) {
+	outcome := authOutcome(ok, err)
+	span.SetAttributes(attribute.String("auth.outcome", outcome))
+	if outcome != metrics.OutcomeError {
+		err = nil
+	}
+	tracing.End(span, err)
 }
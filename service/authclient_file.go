@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileAuthClient validates credentials against a static htpasswd-style file.
+// Each non-empty line not starting with '#' has the form:
+//
+//	extension:hash[:user_name[:sub1,sub2,...]]
+//
+// user_name may be a full Matrix ID, see splitUserField.
+// hash is either a bcrypt hash ($2a$, $2b$, $2y$) or "{SHA}" followed by the
+// base64 SHA-1 digest, as produced by `htpasswd -B` and `htpasswd -s`.
+// user_name defaults to the extension. The file is reloaded when its modification time changes.
+type FileAuthClient struct {
+	path    string
+	mu      sync.RWMutex
+	modTime time.Time
+	entries map[string]fileAuthEntry
+}
+
+type fileAuthEntry struct {
+	hash          string
+	userName      string
+	subExtensions []string
+}
+
+// NewFileAuthClient constructs a FileAuthClient and loads the file once to validate it.
+func NewFileAuthClient(path string) (*FileAuthClient, error) {
+	if path == "" {
+		return nil, errors.New("auth file path is required")
+	}
+	f := &FileAuthClient{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate checks secret against the hash stored for extension.
+func (f *FileAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+	if err := f.reload(); err != nil {
+		logger.Ctx(ctx).Error().Err(err).Str("file", f.path).Msg("authclient: failed to reload auth file, using previous entries")
+	}
+
+	f.mu.RLock()
+	entry, ok := f.entries[strings.TrimSpace(extension)]
+	f.mu.RUnlock()
+	if !ok || !checkPasswordHash(entry.hash, secret) {
+		logger.Ctx(ctx).Debug().Str("extension", extension).Msg("authclient: file credentials rejected")
+		return []*models.MappingRequest{}, false, ErrAuthentication
+	}
+
+	mapping := mappingFromAuthResponse(ctx, AuthResponse{
+		MainExtension: extension,
+		SubExtensions: entry.subExtensions,
+		UserName:      entry.userName,
+	}, homeserverHost)
+	if mapping == nil {
+		return []*models.MappingRequest{}, true, nil
+	}
+	return []*models.MappingRequest{mapping}, true, nil
+}
+
+// reload re-reads the file if its modification time changed since the last load.
+func (f *FileAuthClient) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat auth file: %w", err)
+	}
+
+	f.mu.RLock()
+	unchanged := f.entries != nil && info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open auth file: %w", err)
+	}
+	defer file.Close()
+
+	entries := make(map[string]fileAuthEntry)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			logger.Warn().Str("file", f.path).Int("line", lineNum).Msg("authclient: malformed auth file line, skipping")
+			continue
+		}
+		if !isSupportedPasswordHash(fields[1]) {
+			logger.Warn().Str("file", f.path).Int("line", lineNum).Msg("authclient: unsupported password hash in auth file, skipping")
+			continue
+		}
+		entry := fileAuthEntry{hash: fields[1], userName: fields[0]}
+		if len(fields) > 2 {
+			userName, subExtensions := splitUserField(fields[2])
+			if userName != "" {
+				entry.userName = userName
+			}
+			if subExtensions != "" {
+				entry.subExtensions = strings.Split(subExtensions, ",")
+			}
+		}
+		entries[fields[0]] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read auth file: %w", err)
+	}
+
+	f.mu.Lock()
+	f.entries = entries
+	f.modTime = info.ModTime()
+	f.mu.Unlock()
+
+	logger.Info().Str("file", f.path).Int("count", len(entries)).Msg("authclient: auth file loaded")
+	return nil
+}
+
+// splitUserField splits the "user_name[:sub1,sub2]" part of a line from the right, as user_name
+// may be a full Matrix ID: "@alice:example.com" has no sub extensions, while
+// "@alice:example.com:201,202" has. A Matrix ID with a port needs the sub extensions field,
+// even empty: "@alice:example.com:8448:".
+func splitUserField(field string) (userName, subExtensions string) {
+	i := strings.LastIndex(field, ":")
+	if i < 0 {
+		return strings.TrimSpace(field), ""
+	}
+	userName = strings.TrimSpace(field[:i])
+	if strings.HasPrefix(userName, "@") && !strings.Contains(userName, ":") {
+		// The colon is the one of the Matrix ID
+		return strings.TrimSpace(field), ""
+	}
+	return userName, strings.TrimSpace(field[i+1:])
+}
+
+func isSupportedPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// checkPasswordHash compares secret with a bcrypt or {SHA} hash.
+func checkPasswordHash(hash, secret string) bool {
+	if rest, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(secret))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(rest), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
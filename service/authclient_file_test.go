@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeAuthFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestFileAuthClient_Validate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "users")
+	writeAuthFile(t, path, "# extension:hash:user_name:sub_extensions\n"+
+		"201:"+string(hash)+":Giacomo:91201,92201\n"+
+		// {SHA} of "password"
+		"202:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"+
+		"204:"+string(hash)+":@alice:matrix.example.com:94201\n"+
+		"203:plaintext\n"+
+		"malformed\n")
+
+	c, err := NewFileAuthClient(path)
+	require.NoError(t, err)
+
+	t.Run("bcrypt hash", func(t *testing.T) {
+		mappings, ok, err := c.Validate(context.TODO(), "201", "s3cret", "example.com")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, mappings, 1)
+		assert.Equal(t, 201, mappings[0].Number)
+		assert.Equal(t, "@giacomo:example.com", mappings[0].MatrixID)
+		assert.Equal(t, []int{91201, 92201}, mappings[0].SubNumbers)
+	})
+
+	t.Run("matrix id as user name", func(t *testing.T) {
+		mappings, ok, err := c.Validate(context.TODO(), "204", "s3cret", "example.com")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, mappings, 1)
+		assert.Equal(t, "@alice:matrix.example.com", mappings[0].MatrixID)
+		assert.Equal(t, []int{94201}, mappings[0].SubNumbers)
+	})
+
+	t.Run("sha hash with default user name", func(t *testing.T) {
+		mappings, ok, err := c.Validate(context.TODO(), "202", "password", "example.com")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, mappings, 1)
+		assert.Equal(t, "@202:example.com", mappings[0].MatrixID)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "201", "wrong", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+	})
+
+	t.Run("plaintext entries are ignored", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "203", "plaintext", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown extension", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "999", "s3cret", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+	})
+
+	t.Run("reloads on change", func(t *testing.T) {
+		writeAuthFile(t, path, "204:"+string(hash)+"\n")
+		// Make sure the modification time differs even on coarse-grained filesystems
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, future, future))
+
+		_, ok, err := c.Validate(context.TODO(), "204", "s3cret", "example.com")
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		_, ok, _ = c.Validate(context.TODO(), "201", "s3cret", "example.com")
+		assert.False(t, ok)
+	})
+}
+
+func TestSplitUserField(t *testing.T) {
+	tests := []struct {
+		field, userName, subExtensions string
+	}{
+		{"giacomo", "giacomo", ""},
+		{"giacomo:91201,92201", "giacomo", "91201,92201"},
+		{"@alice:example.com", "@alice:example.com", ""},
+		{"@alice:example.com:91201,92201", "@alice:example.com", "91201,92201"},
+		{"@alice:example.com:8448:", "@alice:example.com:8448", ""},
+		{":91201", "", "91201"},
+	}
+	for _, tt := range tests {
+		userName, subExtensions := splitUserField(tt.field)
+		assert.Equal(t, tt.userName, userName, tt.field)
+		assert.Equal(t, tt.subExtensions, subExtensions, tt.field)
+	}
+}
+
+func TestNewFileAuthClient_MissingFile(t *testing.T) {
+	_, err := NewFileAuthClient(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+
+	_, err = NewFileAuthClient("")
+	assert.Error(t, err)
+}
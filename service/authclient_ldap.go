@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+// ldapConn is the subset of *ldap.Conn used by LDAPAuthClient, so tests can inject a fake directory.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPAuthClient validates credentials with a search-then-bind against an LDAP directory.
+// The user entry is found with UserFilter (using the service account, if any)
+// and the secret is verified by binding as that entry.
+type LDAPAuthClient struct {
+	cfg     LDAPConfig
+	timeout time.Duration
+	dial    func(url string) (ldapConn, error)
+}
+
+// NewLDAPAuthClient constructs an LDAPAuthClient, applying default filter and attribute names.
+func NewLDAPAuthClient(cfg LDAPConfig, timeout time.Duration) (*LDAPAuthClient, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("ldap url is required for ldap auth backend")
+	}
+	if cfg.BaseDN == "" {
+		return nil, errors.New("ldap base dn is required for ldap auth backend")
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(&(objectClass=person)(telephoneNumber=%s))"
+	}
+	if cfg.UserAttr == "" {
+		cfg.UserAttr = "uid"
+	}
+	if cfg.ExtensionAttr == "" {
+		cfg.ExtensionAttr = "telephoneNumber"
+	}
+	l := &LDAPAuthClient{cfg: cfg, timeout: timeout}
+	l.dial = func(url string) (ldapConn, error) {
+		conn, err := ldap.DialURL(url)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(l.timeout)
+		return conn, nil
+	}
+	return l, nil
+}
+
+// Validate looks up the entry owning extension and binds as it with secret.
+func (l *LDAPAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+	extension = strings.TrimSpace(extension)
+	// An empty password would be an unauthenticated bind, which most servers accept.
+	if extension == "" || secret == "" {
+		return []*models.MappingRequest{}, false, ErrAuthentication
+	}
+
+	conn, err := l.dial(l.cfg.URL)
+	if err != nil {
+		return []*models.MappingRequest{}, false, fmt.Errorf("ldap dial: %w", err)
+	}
+	defer conn.Close()
+
+	if l.cfg.BindDN != "" {
+		if err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+			return []*models.MappingRequest{}, false, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+
+	attrs := []string{l.cfg.UserAttr, l.cfg.ExtensionAttr}
+	if l.cfg.SubExtensionsAttr != "" {
+		attrs = append(attrs, l.cfg.SubExtensionsAttr)
+	}
+	search := ldap.NewSearchRequest(
+		l.cfg.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.timeout.Seconds()), false,
+		fmt.Sprintf(l.cfg.UserFilter, ldap.EscapeFilter(extension)),
+		attrs,
+		nil,
+	)
+	logger.Ctx(ctx).Debug().Str("url", l.cfg.URL).Str("filter", search.Filter).Msg("authclient: searching ldap user")
+	result, err := conn.Search(search)
+	if err != nil {
+		return []*models.MappingRequest{}, false, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		logger.Ctx(ctx).Debug().Str("extension", extension).Int("entries", len(result.Entries)).Msg("authclient: ldap user not found or ambiguous")
+		return []*models.MappingRequest{}, false, ErrAuthentication
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, secret); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			logger.Ctx(ctx).Debug().Str("extension", extension).Msg("authclient: ldap bind rejected")
+			return []*models.MappingRequest{}, false, ErrAuthentication
+		}
+		return []*models.MappingRequest{}, false, fmt.Errorf("ldap user bind: %w", err)
+	}
+
+	ar := AuthResponse{
+		MainExtension: entry.GetAttributeValue(l.cfg.ExtensionAttr),
+		UserName:      entry.GetAttributeValue(l.cfg.UserAttr),
+	}
+	if ar.MainExtension == "" {
+		ar.MainExtension = extension
+	}
+	if l.cfg.SubExtensionsAttr != "" {
+		ar.SubExtensions = entry.GetAttributeValues(l.cfg.SubExtensionsAttr)
+	}
+
+	mapping := mappingFromAuthResponse(ctx, ar, homeserverHost)
+	if mapping == nil {
+		return []*models.MappingRequest{}, true, nil
+	}
+	return []*models.MappingRequest{mapping}, true, nil
+}
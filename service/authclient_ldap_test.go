@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLDAPConn is an in-memory directory with a single user.
+type fakeLDAPConn struct {
+	binds   []string
+	filters []string
+}
+
+func (f *fakeLDAPConn) Bind(username, password string) error {
+	f.binds = append(f.binds, username)
+	switch {
+	case username == "cn=proxy,dc=example,dc=com" && password == "bindpw":
+		return nil
+	case username == "uid=giacomo,ou=people,dc=example,dc=com" && password == "s3cret":
+		return nil
+	default:
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+	}
+}
+
+func (f *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	f.filters = append(f.filters, req.Filter)
+	if req.Filter != "(&(objectClass=person)(telephoneNumber=201))" {
+		return &ldap.SearchResult{}, nil
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{
+		ldap.NewEntry("uid=giacomo,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":             {"Giacomo"},
+			"telephoneNumber": {"201"},
+			"mobile":          {"91201"},
+		}),
+	}}, nil
+}
+
+func (f *fakeLDAPConn) Close() error { return nil }
+
+func TestLDAPAuthClient_Validate(t *testing.T) {
+	c, err := NewLDAPAuthClient(LDAPConfig{
+		URL:               "ldap://ldap.example.com",
+		BindDN:            "cn=proxy,dc=example,dc=com",
+		BindPassword:      "bindpw",
+		BaseDN:            "dc=example,dc=com",
+		SubExtensionsAttr: "mobile",
+	}, 2*time.Second)
+	require.NoError(t, err)
+
+	conn := &fakeLDAPConn{}
+	c.dial = func(url string) (ldapConn, error) { return conn, nil }
+
+	t.Run("valid credentials", func(t *testing.T) {
+		mappings, ok, err := c.Validate(context.TODO(), "201", "s3cret", "example.com")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, mappings, 1)
+		assert.Equal(t, 201, mappings[0].Number)
+		assert.Equal(t, "@giacomo:example.com", mappings[0].MatrixID)
+		assert.Equal(t, []int{91201}, mappings[0].SubNumbers)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "201", "wrong", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+	})
+
+	t.Run("empty password is never sent to the directory", func(t *testing.T) {
+		conn.binds = nil
+		_, ok, err := c.Validate(context.TODO(), "201", "", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+		assert.Empty(t, conn.binds)
+	})
+
+	t.Run("unknown extension and filter escaping", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "*)(uid=*", "s3cret", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+		assert.Equal(t, `(&(objectClass=person)(telephoneNumber=\2a\29\28uid=\2a))`, conn.filters[len(conn.filters)-1])
+	})
+}
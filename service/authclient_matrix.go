@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
+	"maunium.net/go/mautrix"
+)
+
+// MatrixAuthClient validates credentials with an m.login.password login against the homeserver.
+// The extension is used as the login user; the session is logged out right away so no
+// access tokens or devices accumulate on the homeserver.
+type MatrixAuthClient struct {
+	homeserverURL string
+	client        *http.Client
+}
+
+// NewMatrixAuthClient constructs a MatrixAuthClient.
+func NewMatrixAuthClient(homeserverURL string, timeout time.Duration) (*MatrixAuthClient, error) {
+	if homeserverURL == "" {
+		return nil, errors.New("homeserver url is required for matrix auth backend")
+	}
+	return &MatrixAuthClient{
+		homeserverURL: homeserverURL,
+		client:        &http.Client{Timeout: timeout, Transport: tracing.Transport(nil)},
+	}, nil
+}
+
+// Validate logs in as extension with secret and maps the extension to the returned user ID.
+// Sub extensions are not known to the homeserver and are never returned.
+func (m *MatrixAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+	// A fresh client per call keeps the credentials of concurrent logins apart.
+	cli, err := mautrix.NewClient(m.homeserverURL, "", "")
+	if err != nil {
+		return []*models.MappingRequest{}, false, fmt.Errorf("create mautrix client: %w", err)
+	}
+	cli.Client = m.client
+
+	logger.Ctx(ctx).Debug().Str("homeserver", m.homeserverURL).Str("extension", extension).Msg("authclient: sending matrix password login")
+	resp, err := cli.Login(ctx, &mautrix.ReqLogin{
+		Type: mautrix.AuthTypePassword,
+		Identifier: mautrix.UserIdentifier{
+			Type: mautrix.IdentifierTypeUser,
+			User: strings.TrimSpace(extension),
+		},
+		Password:                 secret,
+		InitialDeviceDisplayName: "matrix2acrobits auth check",
+	})
+	if err != nil {
+		if errors.Is(err, mautrix.MForbidden) {
+			logger.Ctx(ctx).Debug().Str("extension", extension).Msg("authclient: matrix login rejected")
+			return []*models.MappingRequest{}, false, ErrAuthentication
+		}
+		return []*models.MappingRequest{}, false, fmt.Errorf("matrix login: %w", err)
+	}
+
+	cli.AccessToken = resp.AccessToken
+	if _, err := cli.Logout(ctx); err != nil {
+		logger.Ctx(ctx).Warn().Str("user_id", string(resp.UserID)).Err(err).Msg("authclient: failed to log out matrix auth session")
+	}
+
+	mapping := mappingFromAuthResponse(ctx, AuthResponse{
+		MainExtension: extension,
+		UserName:      string(resp.UserID),
+	}, homeserverHost)
+	if mapping == nil {
+		return []*models.MappingRequest{}, true, nil
+	}
+	return []*models.MappingRequest{mapping}, true, nil
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatrixAuthClient_Validate(t *testing.T) {
+	loggedOut := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_matrix/client/v3/login":
+			var body struct {
+				Identifier struct {
+					User string `json:"user"`
+				} `json:"identifier"`
+				Password string `json:"password"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if body.Identifier.User != "201" || body.Password != "s3cret" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Invalid password"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"user_id":"@giacomo:matrix.example.com","access_token":"tok","device_id":"DEV"}`))
+		case "/_matrix/client/v3/logout":
+			assert.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+			loggedOut = true
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewMatrixAuthClient(ts.URL, 2*time.Second)
+	require.NoError(t, err)
+
+	mappings, ok, err := c.Validate(context.TODO(), "201", "s3cret", "example.com")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, mappings, 1)
+	assert.Equal(t, 201, mappings[0].Number)
+	// The user ID returned by the homeserver is used as-is
+	assert.Equal(t, "@giacomo:matrix.example.com", mappings[0].MatrixID)
+	assert.True(t, loggedOut)
+
+	_, ok, err = c.Validate(context.TODO(), "201", "wrong", "example.com")
+	assert.ErrorIs(t, err, ErrAuthentication)
+	assert.False(t, ok)
+}
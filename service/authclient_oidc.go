@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
+)
+
+// OIDCAuthClient validates an OAuth2 access token, sent by the client as its password,
+// through the provider's token introspection endpoint (RFC 7662).
+// The token is accepted only if it is active and its extension claims include the requested extension.
+type OIDCAuthClient struct {
+	cfg    OIDCConfig
+	client *http.Client
+}
+
+// NewOIDCAuthClient constructs an OIDCAuthClient, applying default claim names.
+func NewOIDCAuthClient(cfg OIDCConfig, timeout time.Duration) (*OIDCAuthClient, error) {
+	if cfg.IntrospectionURL == "" {
+		return nil, errors.New("introspection url is required for oidc auth backend")
+	}
+	if cfg.ExtensionClaim == "" {
+		cfg.ExtensionClaim = "extension"
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "preferred_username"
+	}
+	return &OIDCAuthClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout, Transport: tracing.Transport(nil)},
+	}, nil
+}
+
+// Validate introspects secret and converts its claims into a mapping.
+func (o *OIDCAuthClient) Validate(ctx context.Context, extension, secret, homeserverHost string) ([]*models.MappingRequest, bool, error) {
+	form := url.Values{"token": {secret}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return []*models.MappingRequest{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+
+	logger.Ctx(ctx).Debug().Str("url", o.cfg.IntrospectionURL).Str("extension", extension).Msg("authclient: sending token introspection request")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return []*models.MappingRequest{}, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return []*models.MappingRequest{}, false, fmt.Errorf("status %d: %s", resp.StatusCode, string(b))
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return []*models.MappingRequest{}, false, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		logger.Ctx(ctx).Debug().Str("extension", extension).Msg("authclient: token is not active")
+		return []*models.MappingRequest{}, false, ErrAuthentication
+	}
+
+	ar := AuthResponse{
+		MainExtension: claimString(claims[o.cfg.ExtensionClaim]),
+		UserName:      claimString(claims[o.cfg.UserClaim]),
+	}
+	if o.cfg.SubExtensionsClaim != "" {
+		ar.SubExtensions = claimStrings(claims[o.cfg.SubExtensionsClaim])
+	}
+
+	// The token must belong to the extension the client claims to be.
+	extension = strings.TrimSpace(extension)
+	owned := ar.MainExtension == extension
+	for _, sub := range ar.SubExtensions {
+		owned = owned || strings.TrimSpace(sub) == extension
+	}
+	if !owned {
+		logger.Ctx(ctx).Warn().Str("extension", extension).Str("token_extension", ar.MainExtension).Msg("authclient: token does not belong to extension")
+		return []*models.MappingRequest{}, false, ErrAuthentication
+	}
+
+	mapping := mappingFromAuthResponse(ctx, ar, homeserverHost)
+	if mapping == nil {
+		return []*models.MappingRequest{}, true, nil
+	}
+	return []*models.MappingRequest{mapping}, true, nil
+}
+
+// claimString converts a string or numeric JSON claim to a string.
+func claimString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return strings.TrimSpace(val)
+	case float64:
+		return fmt.Sprintf("%.0f", val)
+	default:
+		return ""
+	}
+}
+
+// claimStrings converts a JSON array claim (or a single value) to a string slice.
+func claimStrings(v interface{}) []string {
+	if arr, ok := v.([]interface{}); ok {
+		out := make([]string, 0, len(arr))
+		for _, item := range arr {
+			if s := claimString(item); s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	if s := claimString(v); s != "" {
+		return []string{s}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCAuthClient_Validate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "proxy" || pass != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		switch r.PostForm.Get("token") {
+		case "good-token":
+			_, _ = w.Write([]byte(`{"active":true,"preferred_username":"Giacomo","extension":201,"sub_extensions":["91201"]}`))
+		default:
+			_, _ = w.Write([]byte(`{"active":false}`))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewOIDCAuthClient(OIDCConfig{
+		IntrospectionURL:   ts.URL,
+		ClientID:           "proxy",
+		ClientSecret:       "client-secret",
+		SubExtensionsClaim: "sub_extensions",
+	}, 2*time.Second)
+	require.NoError(t, err)
+
+	t.Run("active token", func(t *testing.T) {
+		mappings, ok, err := c.Validate(context.TODO(), "201", "good-token", "example.com")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, mappings, 1)
+		assert.Equal(t, 201, mappings[0].Number)
+		assert.Equal(t, "@giacomo:example.com", mappings[0].MatrixID)
+		assert.Equal(t, []int{91201}, mappings[0].SubNumbers)
+	})
+
+	t.Run("sub extension owns the token", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "91201", "good-token", "example.com")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("token of another extension", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "202", "good-token", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+	})
+
+	t.Run("inactive token", func(t *testing.T) {
+		_, ok, err := c.Validate(context.TODO(), "201", "expired", "example.com")
+		assert.ErrorIs(t, err, ErrAuthentication)
+		assert.False(t, ok)
+	})
+}
+
+func TestNewOIDCAuthClient_MissingURL(t *testing.T) {
+	_, err := NewOIDCAuthClient(OIDCConfig{}, time.Second)
+	assert.Error(t, err)
+}
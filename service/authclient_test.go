@@ -2,12 +2,15 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -119,7 +122,7 @@ func TestHTTPAuthClient_ExtensionNotFound(t *testing.T) {
 	require.Len(t, mappings, 2)
 }
 
-func TestHTTPAuthClient_CacheHitReturnsEmptyMappings(t *testing.T) {
+func TestHTTPAuthClient_CacheHitReturnsMappings(t *testing.T) {
 	callCount := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		callCount++
@@ -132,7 +135,8 @@ func TestHTTPAuthClient_CacheHitReturnsEmptyMappings(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	c := NewHTTPAuthClient(ts.URL, 2*time.Second, 100*time.Millisecond)
+	c := NewHTTPAuthClient(ts.URL, 2*time.Second, time.Minute)
+	defer c.Close()
 
 	// First call should make request and return all mappings
 	mappings1, ok1, err1 := c.Validate(context.TODO(), "202", "secret", "example.com")
@@ -141,12 +145,21 @@ func TestHTTPAuthClient_CacheHitReturnsEmptyMappings(t *testing.T) {
 	require.Len(t, mappings1, 2)
 	require.Equal(t, 1, callCount)
 
-	// Second call should use cache and return empty mappings
+	// Mutating the returned mappings must not affect the cache
+	mappings1[0].SubNumbers[0] = 0
+
+	// Second call should use cache and return the same mappings
 	mappings2, ok2, err2 := c.Validate(context.TODO(), "202", "secret", "example.com")
 	require.NoError(t, err2)
 	require.True(t, ok2)
-	require.Len(t, mappings2, 0)   // Cache returns empty array
+	require.Len(t, mappings2, 2)
+	require.Equal(t, []int{91201}, mappings2[0].SubNumbers)
 	require.Equal(t, 1, callCount) // No additional call
+
+	// A different password is a different cache entry
+	_, _, err3 := c.Validate(context.TODO(), "202", "other", "example.com")
+	require.NoError(t, err3)
+	require.Equal(t, 2, callCount)
 }
 
 func TestHTTPAuthClient_CacheFailedAuth(t *testing.T) {
@@ -158,7 +171,8 @@ func TestHTTPAuthClient_CacheFailedAuth(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	c := NewHTTPAuthClient(ts.URL, 2*time.Second, 100*time.Millisecond)
+	c := NewHTTPAuthClient(ts.URL, 2*time.Second, time.Minute)
+	defer c.Close()
 
 	// First call should make request and fail
 	mappings1, ok1, err1 := c.Validate(context.TODO(), "999", "wrongsecret", "example.com")
@@ -167,10 +181,64 @@ func TestHTTPAuthClient_CacheFailedAuth(t *testing.T) {
 	require.Empty(t, mappings1)
 	require.Equal(t, 1, callCount)
 
-	// Second call should NOT use cache (failed auth not cached) and make new request
+	// Second call should use the negative cache
 	mappings2, ok2, err2 := c.Validate(context.TODO(), "999", "wrongsecret", "example.com")
 	require.Error(t, err2)
 	require.False(t, ok2)
 	require.Empty(t, mappings2)
-	require.Equal(t, 2, callCount) // Additional call made
+	require.Equal(t, 1, callCount)
+
+	// Once the negative TTL is over, the endpoint is asked again
+	c.cache.now = func() time.Time { return time.Now().Add(defaultAuthNegativeCacheTTL + time.Second) }
+	_, ok3, err3 := c.Validate(context.TODO(), "999", "wrongsecret", "example.com")
+	require.Error(t, err3)
+	require.False(t, ok3)
+	require.Equal(t, 2, callCount)
+}
+
+func TestHTTPAuthClient_ServerErrorsAreNotCached(t *testing.T) {
+	callCount := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	c := NewHTTPAuthClient(ts.URL, 2*time.Second, time.Minute)
+	defer c.Close()
+
+	_, _, err := c.Validate(context.TODO(), "201", "secret", "example.com")
+	require.Error(t, err)
+	_, _, err = c.Validate(context.TODO(), "201", "secret", "example.com")
+	require.Error(t, err)
+	require.Equal(t, 2, callCount)
+}
+
+func TestNewAuthClient(t *testing.T) {
+	_, err := NewAuthClient(Config{})
+	assert.NoError(t, err, "http is the default backend")
+
+	_, err = NewAuthClient(Config{Auth: AuthConfig{Backend: "kerberos"}})
+	assert.Error(t, err)
+
+	_, err = NewAuthClient(Config{Auth: AuthConfig{Backend: AuthBackendLDAP}})
+	assert.Error(t, err, "ldap requires a url")
+
+	c, err := NewAuthClient(Config{HomeserverURL: "https://matrix.example.com", Auth: AuthConfig{Backend: AuthBackendMatrix}})
+	require.NoError(t, err)
+	require.IsType(t, &instrumentedAuthClient{}, c)
+	assert.IsType(t, &MatrixAuthClient{}, c.(*instrumentedAuthClient).next)
+}
+
+func TestAuthError(t *testing.T) {
+	assert.Equal(t, ErrInvalidCredentials, authError(ErrAuthentication))
+	assert.Equal(t, ErrInvalidCredentials, authError(fmt.Errorf("%w: status 401", errCredentialsRejected)))
+
+	err := authError(errors.New("ldap dial: connection refused"))
+	assert.ErrorIs(t, err, ErrAuthUnavailable)
+	assert.NotErrorIs(t, err, ErrAuthentication)
+
+	_, _, err = unavailableAuthClient{err: errors.New("bad config")}.Validate(context.TODO(), "201", "secret", "example.com")
+	assert.Equal(t, err, authError(err))
+	assert.NotErrorIs(t, err, ErrAuthentication)
 }
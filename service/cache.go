@@ -3,6 +3,8 @@ package service
 import (
 	"sync"
 	"time"
+
+	"github.com/nethesis/matrix2acrobits/metrics"
 )
 
 // cacheEntry is a wrapper around a cached value with an expiration time.
@@ -23,6 +25,7 @@ type RoomAliasCache struct {
 	entries map[string]cacheEntry[string]
 	ttl     time.Duration
 	now     func() time.Time
+	metrics metrics.Tenant
 }
 
 // NewRoomAliasCache creates a new RoomAliasCache with the specified TTL.
@@ -41,14 +44,17 @@ func (c *RoomAliasCache) Get(alias string) string {
 
 	entry, ok := c.entries[alias]
 	if !ok {
+		c.metrics.CacheLookup(metrics.CacheRoomAlias, false)
 		return ""
 	}
 
 	if entry.isExpired(c.now()) {
 		// Entry expired, but we don't remove it here to avoid write lock
+		c.metrics.CacheLookup(metrics.CacheRoomAlias, false)
 		return ""
 	}
 
+	c.metrics.CacheLookup(metrics.CacheRoomAlias, true)
 	return entry.Value
 }
 
@@ -57,16 +63,30 @@ func (c *RoomAliasCache) Set(alias string, roomID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if _, exists := c.entries[alias]; !exists {
+		c.metrics.CacheEntries(metrics.CacheRoomAlias).Inc()
+	}
 	c.entries[alias] = cacheEntry[string]{
 		Value:     roomID,
 		ExpiresAt: c.now().Add(c.ttl),
 	}
 }
 
+// Delete removes the cached room ID of alias.
+func (c *RoomAliasCache) Delete(alias string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[alias]; exists {
+		delete(c.entries, alias)
+		c.metrics.CacheEntries(metrics.CacheRoomAlias).Dec()
+	}
+}
+
 // Clear removes all entries from the cache.
 func (c *RoomAliasCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.metrics.CacheEntries(metrics.CacheRoomAlias).Sub(float64(len(c.entries)))
 	c.entries = make(map[string]cacheEntry[string])
 }
 
@@ -77,6 +97,7 @@ type RoomAliasesCache struct {
 	entries map[string]cacheEntry[[]string]
 	ttl     time.Duration
 	now     func() time.Time
+	metrics metrics.Tenant
 }
 
 // NewRoomAliasesCache creates a new RoomAliasesCache with the specified TTL.
@@ -95,14 +116,17 @@ func (c *RoomAliasesCache) Get(roomID string) []string {
 
 	entry, ok := c.entries[roomID]
 	if !ok {
+		c.metrics.CacheLookup(metrics.CacheRoomAliases, false)
 		return nil
 	}
 
 	if entry.isExpired(c.now()) {
 		// Entry expired, but we don't remove it here to avoid write lock
+		c.metrics.CacheLookup(metrics.CacheRoomAliases, false)
 		return nil
 	}
 
+	c.metrics.CacheLookup(metrics.CacheRoomAliases, true)
 	// Return a copy to avoid external mutation
 	// Handle empty slices explicitly to preserve non-nil empty slices
 	if len(entry.Value) == 0 {
@@ -124,16 +148,30 @@ func (c *RoomAliasesCache) Set(roomID string, aliases []string) {
 	} else {
 		aliasCopy = []string{}
 	}
+	if _, exists := c.entries[roomID]; !exists {
+		c.metrics.CacheEntries(metrics.CacheRoomAliases).Inc()
+	}
 	c.entries[roomID] = cacheEntry[[]string]{
 		Value:     aliasCopy,
 		ExpiresAt: c.now().Add(c.ttl),
 	}
 }
 
+// Delete removes the cached aliases of roomID.
+func (c *RoomAliasesCache) Delete(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[roomID]; exists {
+		delete(c.entries, roomID)
+		c.metrics.CacheEntries(metrics.CacheRoomAliases).Dec()
+	}
+}
+
 // Clear removes all entries from the cache.
 func (c *RoomAliasesCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.metrics.CacheEntries(metrics.CacheRoomAliases).Sub(float64(len(c.entries)))
 	c.entries = make(map[string]cacheEntry[[]string])
 }
 
@@ -145,6 +183,7 @@ type RoomParticipantCache struct {
 	entries map[string]cacheEntry[string]
 	ttl     time.Duration
 	now     func() time.Time
+	metrics metrics.Tenant
 }
 
 // NewRoomParticipantCache creates a new RoomParticipantCache with the specified TTL.
@@ -164,14 +203,17 @@ func (c *RoomParticipantCache) Get(key string) string {
 
 	entry, ok := c.entries[key]
 	if !ok {
+		c.metrics.CacheLookup(metrics.CacheRoomParticipant, false)
 		return ""
 	}
 
 	if entry.isExpired(c.now()) {
 		// Entry expired, but we don't remove it here to avoid write lock
+		c.metrics.CacheLookup(metrics.CacheRoomParticipant, false)
 		return ""
 	}
 
+	c.metrics.CacheLookup(metrics.CacheRoomParticipant, true)
 	return entry.Value
 }
 
@@ -181,6 +223,9 @@ func (c *RoomParticipantCache) Set(key string, identifier string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if _, exists := c.entries[key]; !exists {
+		c.metrics.CacheEntries(metrics.CacheRoomParticipant).Inc()
+	}
 	c.entries[key] = cacheEntry[string]{
 		Value:     identifier,
 		ExpiresAt: c.now().Add(c.ttl),
@@ -191,5 +236,6 @@ func (c *RoomParticipantCache) Set(key string, identifier string) {
 func (c *RoomParticipantCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.metrics.CacheEntries(metrics.CacheRoomParticipant).Sub(float64(len(c.entries)))
 	c.entries = make(map[string]cacheEntry[string])
 }
@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nethesis/matrix2acrobits/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -307,3 +309,23 @@ func TestRoomAliasesCacheNilReturnVsEmpty(t *testing.T) {
 	result3 := cache.Get("room1")
 	assert.Nil(t, result3, "expired entry should return nil")
 }
+
+func TestRoomAliasCacheMetrics(t *testing.T) {
+	hits := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("acme", metrics.CacheRoomAlias, "hit"))
+	misses := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("acme", metrics.CacheRoomAlias, "miss"))
+	entries := testutil.ToFloat64(metrics.CacheEntries.WithLabelValues("acme", metrics.CacheRoomAlias))
+
+	cache := NewRoomAliasCache(time.Minute)
+	cache.metrics = "acme"
+	cache.Get("a|b")
+	cache.Set("a|b", "!room:example.com")
+	cache.Set("a|b", "!room:example.com")
+	cache.Get("a|b")
+
+	assert.Equal(t, hits+1, testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("acme", metrics.CacheRoomAlias, "hit")))
+	assert.Equal(t, misses+1, testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("acme", metrics.CacheRoomAlias, "miss")))
+	assert.Equal(t, entries+1, testutil.ToFloat64(metrics.CacheEntries.WithLabelValues("acme", metrics.CacheRoomAlias)))
+
+	cache.Clear()
+	assert.Equal(t, entries, testutil.ToFloat64(metrics.CacheEntries.WithLabelValues("acme", metrics.CacheRoomAlias)))
+}
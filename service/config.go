@@ -0,0 +1,286 @@
+package service
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultExtAuthURL      = "https://voice.gs.nethserver.net/freepbx/testextauth"
+	defaultExtAuthTimeout  = 5 * time.Second
+	defaultCacheTTLSeconds = 3600
+	// defaultSendDedupWindow covers the retries of Acrobits after its request timeout, which come
+	// after the Matrix retries of the proxy gave up; Acrobits cannot send an idempotency key.
+	defaultSendDedupWindow = 60 * time.Second
+)
+
+// Config holds the settings used to build a MessageService.
+// Every tenant served by the proxy gets its own Config.
+type Config struct {
+	// Tenant labels the metrics of the service.
+	Tenant string
+	// ProxyURL is the public-facing URL of this proxy, used for pusher registration.
+	ProxyURL string
+	// HomeserverURL is used to derive the host part of Matrix IDs built from auth responses.
+	HomeserverURL string
+	// ExtAuthURL is the external endpoint validating extension+secret pairs.
+	ExtAuthURL string
+	// ExtAuthTimeout bounds each call to the authentication backend.
+	ExtAuthTimeout time.Duration
+	// CacheTTL is the time-to-live of the room caches and of successful authentications.
+	CacheTTL time.Duration
+	// AuthNegativeCacheTTL is how long rejected credentials are cached; zero disables it.
+	AuthNegativeCacheTTL time.Duration
+	// AuthCacheMaxEntries bounds the number of cached authentications.
+	AuthCacheMaxEntries int
+	// Auth selects and configures the authentication backend.
+	Auth AuthConfig
+	// RedactionMode is how messages redacted on Matrix are delivered: RedactionHide or RedactionPlaceholder.
+	RedactionMode string
+	// RedactionPlaceholder is the text of redacted messages in RedactionPlaceholder mode.
+	RedactionPlaceholder string
+	// AllowEdits lets clients replace their own messages through replaces_message_id.
+	AllowEdits bool
+	// Markdown converts Markdown in messages sent by clients to an HTML formatted_body.
+	Markdown bool
+	// NoticePrefix is prepended to m.notice messages, usually sent by bots.
+	NoticePrefix string
+	// UndecryptablePlaceholder is the text of encrypted messages the proxy cannot decrypt.
+	UndecryptablePlaceholder string
+	// BackfillLimit caps the events fetched per room when a sync skipped part of its timeline; zero disables it.
+	BackfillLimit int
+	// FetchPageSize is the maximum number of messages returned by a fetch; the rest follow at the next fetch.
+	FetchPageSize int
+	// InviteAllowedSenders lists whose invites users accept automatically, comma separated:
+	// Matrix user IDs, server names, InviteSendersLocal for the users of the homeserver or "*" for anyone.
+	// When empty, invites are never accepted automatically.
+	InviteAllowedSenders string
+	// ReadReceipts is when messages delivered to clients are marked as read in Matrix:
+	// ReadReceiptsFetch, ReadReceiptsNotification or ReadReceiptsNever, the default: marking messages
+	// read on behalf of the user is opt-in.
+	ReadReceipts string
+	// SendDedupWindow is how long identical messages without idempotency key are considered retries
+	// of the first one; zero disables it.
+	SendDedupWindow time.Duration
+	// QueueEnabled accepts the messages sent while the homeserver is unavailable and delivers them
+	// later; it requires the push token database.
+	QueueEnabled bool
+	// QueueMaxAge is how long a queued message is attempted before the sender is told it failed.
+	QueueMaxAge time.Duration
+	// Language is the language of the texts written for users whose devices did not report one,
+	// e.g. the notice of a queued message that failed; see PUSH_LANGUAGE.
+	Language string
+}
+
+// Supported authentication backends.
+const (
+	AuthBackendHTTP   = "http"
+	AuthBackendLDAP   = "ldap"
+	AuthBackendMatrix = "matrix"
+	AuthBackendFile   = "file"
+	AuthBackendOIDC   = "oidc"
+)
+
+// AuthConfig selects the AuthClient implementation and holds backend-specific settings.
+// The "http" backend uses Config.ExtAuthURL; the "matrix" backend uses Config.HomeserverURL.
+type AuthConfig struct {
+	Backend string     `json:"backend,omitempty"`
+	LDAP    LDAPConfig `json:"ldap,omitempty"`
+	File    string     `json:"file,omitempty"`
+	OIDC    OIDCConfig `json:"oidc,omitempty"`
+}
+
+// LDAPConfig configures the LDAP bind backend.
+type LDAPConfig struct {
+	// URL of the directory, e.g. ldaps://ldap.example.com
+	URL string `json:"url"`
+	// BindDN and BindPassword are the service account used to search users; empty for anonymous search.
+	BindDN       string `json:"bind_dn,omitempty"`
+	BindPassword string `json:"bind_password,omitempty"`
+	BaseDN       string `json:"base_dn"`
+	// UserFilter is an LDAP filter where %s is replaced with the escaped extension.
+	UserFilter string `json:"user_filter,omitempty"`
+	// UserAttr holds the Matrix localpart, ExtensionAttr the main extension, SubExtensionsAttr the secondary ones.
+	UserAttr          string `json:"user_attr,omitempty"`
+	ExtensionAttr     string `json:"extension_attr,omitempty"`
+	SubExtensionsAttr string `json:"sub_extensions_attr,omitempty"`
+}
+
+// OIDCConfig configures the OAuth2 token introspection (RFC 7662) backend.
+type OIDCConfig struct {
+	IntrospectionURL string `json:"introspection_url"`
+	ClientID         string `json:"client_id,omitempty"`
+	ClientSecret     string `json:"client_secret,omitempty"`
+	// Claims carrying the main extension, the Matrix localpart and the secondary extensions.
+	ExtensionClaim     string `json:"extension_claim,omitempty"`
+	UserClaim          string `json:"user_claim,omitempty"`
+	SubExtensionsClaim string `json:"sub_extensions_claim,omitempty"`
+}
+
+// ConfigFromEnv builds a Config from the process environment, applying the documented defaults.
+func ConfigFromEnv(proxyURL string) Config {
+	cfg := Config{
+		ProxyURL:       proxyURL,
+		HomeserverURL:  os.Getenv("MATRIX_HOMESERVER_URL"),
+		ExtAuthURL:     os.Getenv("EXT_AUTH_URL"),
+		ExtAuthTimeout: defaultExtAuthTimeout,
+		CacheTTL:       defaultCacheTTLSeconds * time.Second,
+		// Rejected credentials are cached briefly to absorb retries with the same wrong password
+		AuthNegativeCacheTTL:     defaultAuthNegativeCacheTTL,
+		AuthCacheMaxEntries:      defaultAuthCacheMaxEntries,
+		RedactionMode:            strings.ToLower(strings.TrimSpace(os.Getenv("MESSAGE_REDACTION_MODE"))),
+		RedactionPlaceholder:     os.Getenv("MESSAGE_REDACTION_PLACEHOLDER"),
+		AllowEdits:               strings.EqualFold(strings.TrimSpace(os.Getenv("MESSAGE_EDITS_ENABLED")), "true"),
+		Markdown:                 strings.EqualFold(strings.TrimSpace(os.Getenv("MESSAGE_MARKDOWN_ENABLED")), "true"),
+		NoticePrefix:             defaultNoticePrefix,
+		UndecryptablePlaceholder: os.Getenv("MESSAGE_UNDECRYPTABLE_PLACEHOLDER"),
+		BackfillLimit:            defaultBackfillLimit,
+		FetchPageSize:            defaultFetchPageSize,
+		SendDedupWindow:          defaultSendDedupWindow,
+		QueueEnabled:             strings.EqualFold(strings.TrimSpace(os.Getenv("MESSAGE_QUEUE_ENABLED")), "true"),
+		ReadReceipts:             strings.ToLower(strings.TrimSpace(os.Getenv("READ_RECEIPTS"))),
+		Language:                 pushLanguageFromEnv(),
+		Auth: AuthConfig{
+			Backend: os.Getenv("AUTH_BACKEND"),
+			LDAP: LDAPConfig{
+				URL:               os.Getenv("AUTH_LDAP_URL"),
+				BindDN:            os.Getenv("AUTH_LDAP_BIND_DN"),
+				BindPassword:      os.Getenv("AUTH_LDAP_BIND_PASSWORD"),
+				BaseDN:            os.Getenv("AUTH_LDAP_BASE_DN"),
+				UserFilter:        os.Getenv("AUTH_LDAP_USER_FILTER"),
+				UserAttr:          os.Getenv("AUTH_LDAP_USER_ATTR"),
+				ExtensionAttr:     os.Getenv("AUTH_LDAP_EXTENSION_ATTR"),
+				SubExtensionsAttr: os.Getenv("AUTH_LDAP_SUB_EXTENSIONS_ATTR"),
+			},
+			File: os.Getenv("AUTH_FILE"),
+			OIDC: OIDCConfig{
+				IntrospectionURL:   os.Getenv("AUTH_OIDC_INTROSPECTION_URL"),
+				ClientID:           os.Getenv("AUTH_OIDC_CLIENT_ID"),
+				ClientSecret:       os.Getenv("AUTH_OIDC_CLIENT_SECRET"),
+				ExtensionClaim:     os.Getenv("AUTH_OIDC_EXTENSION_CLAIM"),
+				UserClaim:          os.Getenv("AUTH_OIDC_USER_CLAIM"),
+				SubExtensionsClaim: os.Getenv("AUTH_OIDC_SUB_EXTENSIONS_CLAIM"),
+			},
+		},
+	}
+
+	// INVITE_ALLOWED_SENDERS is opt-in: unset or empty, auto-join is disabled
+	if v, ok := os.LookupEnv("INVITE_ALLOWED_SENDERS"); ok {
+		cfg.InviteAllowedSenders = v
+	}
+
+	// An empty MESSAGE_NOTICE_PREFIX disables the prefix
+	if v, ok := os.LookupEnv("MESSAGE_NOTICE_PREFIX"); ok {
+		cfg.NoticePrefix = v
+	}
+
+	// Parse cache TTL from environment, default to 1 hour (3600 seconds)
+	if v := os.Getenv("CACHE_TTL_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.CacheTTL = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if v := os.Getenv("AUTH_NEGATIVE_CACHE_TTL_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.AuthNegativeCacheTTL = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if v := os.Getenv("AUTH_CACHE_MAX_ENTRIES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.AuthCacheMaxEntries = parsed
+		}
+	}
+
+	if v := os.Getenv("MESSAGE_BACKFILL_LIMIT"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.BackfillLimit = parsed
+		}
+	}
+
+	if v := os.Getenv("MESSAGE_FETCH_PAGE_SIZE"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.FetchPageSize = parsed
+		}
+	}
+
+	if v := os.Getenv("MESSAGE_DEDUP_WINDOW_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.SendDedupWindow = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if v := os.Getenv("MESSAGE_QUEUE_MAX_AGE_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.QueueMaxAge = time.Duration(parsed) * time.Second
+		}
+	}
+
+	if v := os.Getenv("EXT_AUTH_TIMEOUT_S"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.ExtAuthTimeout = time.Duration(parsed) * time.Second
+		}
+	}
+
+	return cfg
+}
+
+// withDefaults fills unset fields with the built-in defaults.
+func (c Config) withDefaults() Config {
+	if c.ExtAuthURL == "" {
+		c.ExtAuthURL = defaultExtAuthURL
+	}
+	if c.ExtAuthTimeout <= 0 {
+		c.ExtAuthTimeout = defaultExtAuthTimeout
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultCacheTTLSeconds * time.Second
+	}
+	if c.RedactionMode != RedactionPlaceholder {
+		c.RedactionMode = RedactionHide
+	}
+	if c.RedactionPlaceholder == "" {
+		c.RedactionPlaceholder = defaultRedactionPlaceholder
+	}
+	if c.BackfillLimit < 0 {
+		c.BackfillLimit = 0
+	}
+	if c.SendDedupWindow < 0 {
+		c.SendDedupWindow = 0
+	}
+	if c.QueueMaxAge <= 0 {
+		c.QueueMaxAge = defaultQueueMaxAge
+	}
+	if c.FetchPageSize <= 0 {
+		c.FetchPageSize = defaultFetchPageSize
+	}
+	if c.UndecryptablePlaceholder == "" {
+		c.UndecryptablePlaceholder = defaultUndecryptablePlaceholder
+	}
+	if c.ReadReceipts != ReadReceiptsFetch && c.ReadReceipts != ReadReceiptsNotification {
+		c.ReadReceipts = ReadReceiptsNever
+	}
+	if c.Language == "" {
+		c.Language = defaultPushLanguage
+	}
+	if c.Auth.Backend == "" {
+		c.Auth.Backend = AuthBackendHTTP
+	}
+	return c
+}
+
+// homeserverHost returns the hostname of HomeserverURL, or an empty string if it cannot be parsed.
+func (c Config) homeserverHost() string {
+	if c.HomeserverURL == "" {
+		return ""
+	}
+	u, err := url.Parse(c.HomeserverURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
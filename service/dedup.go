@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// sentMessageRetention is how long the event of each sent message is remembered for retries.
+	sentMessageRetention = 24 * time.Hour
+	// txnIDPrefix starts the transaction IDs chosen by the proxy, which are also provisional message IDs.
+	txnIDPrefix = "m2a."
+)
+
+// sendTxnIDs returns the Matrix transaction IDs a message may have been sent with, the one to use
+// first. They are derived from the sender, the recipient, the message and the idempotency key of
+// the client or, without one, the time bucket of the deduplication window: the previous bucket is
+// included so a retry across the bucket boundary is still recognized. It returns nil when the
+// message cannot be told apart from a new one.
+func (s *MessageService) sendTxnIDs(sender id.UserID, recipient string, req *models.SendMessageRequest) []string {
+	txnID := func(key string) string { return sendHash(sender, recipient, req, key) }
+
+	if key := strings.TrimSpace(req.IdempotencyKey); key != "" {
+		return []string{txnID("key:" + key)}
+	}
+	if s.dedupWindow <= 0 {
+		return nil
+	}
+	bucket := s.now().UnixNano() / int64(s.dedupWindow)
+	return []string{
+		txnID("bucket:" + strconv.FormatInt(bucket, 10)),
+		txnID("bucket:" + strconv.FormatInt(bucket-1, 10)),
+	}
+}
+
+// sendHash identifies the message of req from sender to recipient, qualified by key.
+func sendHash(sender id.UserID, recipient string, req *models.SendMessageRequest, key string) string {
+	h := sha256.New()
+	for _, part := range []string{string(sender), recipient, req.Body, req.ContentType, req.ReplacesMessageID, key} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return txnIDPrefix + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// inFlightSend is a message being sent, see beginSend.
+type inFlightSend struct {
+	txnID    string
+	requests int
+}
+
+// beginSend registers the message of req as being sent and returns the transaction IDs to use,
+// those of txnIDs preceded by the one of the same message still being sent, if any: a retry made
+// while the first request is in flight keeps its transaction ID, whatever the bucket it falls in.
+// The returned function ends the registration.
+func (s *MessageService) beginSend(sender id.UserID, recipient string, req *models.SendMessageRequest, txnIDs []string) ([]string, func()) {
+	if len(txnIDs) == 0 || strings.TrimSpace(req.IdempotencyKey) != "" {
+		return txnIDs, func() {}
+	}
+	key := sendHash(sender, recipient, req, "in-flight")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sending == nil {
+		s.sending = make(map[string]*inFlightSend)
+	}
+	send := s.sending[key]
+	if send == nil {
+		send = &inFlightSend{txnID: txnIDs[0]}
+		s.sending[key] = send
+	} else if send.txnID != txnIDs[0] {
+		txnIDs = append([]string{send.txnID}, txnIDs...)
+	}
+	send.requests++
+	return txnIDs, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if send.requests--; send.requests == 0 {
+			delete(s.sending, key)
+		}
+	}
+}
+
+// sentMessage returns the event already sent with one of txnIDs, or an empty string.
+func (s *MessageService) sentMessage(ctx context.Context, txnIDs []string) string {
+	if s.pushTokenDB == nil {
+		return ""
+	}
+	for _, txnID := range txnIDs {
+		eventID, err := s.pushTokenDB.GetSentMessage(txnID)
+		if err != nil {
+			logger.Ctx(ctx).Warn().Err(err).Str("txn_id", txnID).Msg("cannot look up sent message")
+			continue
+		}
+		if eventID != "" {
+			return eventID
+		}
+	}
+	return ""
+}
+
+// recordSentMessage remembers the event sent with txnID and forgets the ones past the retention.
+// Without database, retries still reach the homeserver, which deduplicates recent transactions.
+func (s *MessageService) recordSentMessage(ctx context.Context, txnID string, eventID id.EventID) {
+	if s.pushTokenDB == nil || txnID == "" {
+		return
+	}
+	if err := s.pushTokenDB.SaveSentMessage(txnID, string(eventID)); err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("txn_id", txnID).Msg("cannot record sent message")
+		return
+	}
+	if _, err := s.pushTokenDB.PruneSentMessages(s.now().Add(-sentMessageRetention)); err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Msg("cannot prune sent messages")
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendMessage_Retries(t *testing.T) {
+	ctx := context.TODO()
+	message := func(body, key string) *models.SendMessageRequest {
+		return &models.SendMessageRequest{From: "@alice:example.com", To: "!room:example.com", Body: body, IdempotencyKey: key}
+	}
+
+	t.Run("retry within the window", func(t *testing.T) {
+		pushTokenDB, err := db.NewDatabase(t.TempDir() + "/push_tokens.db")
+		require.NoError(t, err)
+		defer pushTokenDB.Close()
+		client, h := newFakeHomeserver(t, nil)
+		svc := newMessageService(client, pushTokenDB, Config{SendDedupWindow: time.Minute}.withDefaults(), nil)
+		now := time.Date(2026, 10, 19, 10, 0, 59, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+
+		first, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		// The retry falls in the next bucket of the window
+		now = now.Add(2 * time.Second)
+		retry, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		assert.Equal(t, first.ID, retry.ID)
+		assert.Len(t, h.txnIDs(), 1, "the retry is not sent again")
+
+		other, err := svc.SendMessage(ctx, message("hello again", ""))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.ID, other.ID)
+
+		// The same text sent later is a new message
+		now = now.Add(3 * time.Minute)
+		later, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.ID, later.ID)
+	})
+
+	t.Run("idempotency key", func(t *testing.T) {
+		pushTokenDB, err := db.NewDatabase(t.TempDir() + "/push_tokens.db")
+		require.NoError(t, err)
+		defer pushTokenDB.Close()
+		client, h := newFakeHomeserver(t, nil)
+		svc := newMessageService(client, pushTokenDB, Config{}.withDefaults(), nil)
+
+		first, err := svc.SendMessage(ctx, message("ok", "k1"))
+		require.NoError(t, err)
+		svc.now = func() time.Time { return time.Now().Add(time.Hour) }
+		retry, err := svc.SendMessage(ctx, message("ok", "k1"))
+		require.NoError(t, err)
+		assert.Equal(t, first.ID, retry.ID)
+
+		second, err := svc.SendMessage(ctx, message("ok", "k2"))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.Len(t, h.txnIDs(), 2)
+	})
+
+	t.Run("without database", func(t *testing.T) {
+		client, h := newFakeHomeserver(t, nil)
+		svc := newMessageService(client, nil, Config{SendDedupWindow: time.Minute}.withDefaults(), nil)
+		svc.now = func() time.Time { return time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC) }
+
+		first, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		retry, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		// The homeserver recognizes the transaction ID
+		assert.Equal(t, first.ID, retry.ID)
+		require.Len(t, h.txnIDs(), 2)
+		assert.Equal(t, h.txnIDs()[0], h.txnIDs()[1])
+	})
+
+	t.Run("retry while the first request is in flight", func(t *testing.T) {
+		client, h := newFakeHomeserver(t, nil)
+		svc := newMessageService(client, nil, Config{SendDedupWindow: time.Minute}.withDefaults(), nil)
+		now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+
+		// The first request is still waiting for the homeserver when the retry falls two buckets later
+		req := message("hello", "")
+		txnIDs, done := svc.beginSend("@alice:example.com", "!room:example.com", req, svc.sendTxnIDs("@alice:example.com", "!room:example.com", req))
+		now = now.Add(3 * time.Minute)
+		_, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		assert.Equal(t, []string{txnIDs[0]}, h.txnIDs())
+
+		// Once no request is in flight, the bucket of the time decides again
+		done()
+		_, err = svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		require.Len(t, h.txnIDs(), 2)
+		assert.NotEqual(t, txnIDs[0], h.txnIDs()[1])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		client, _ := newFakeHomeserver(t, nil)
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		first, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		second, err := svc.SendMessage(ctx, message("hello", ""))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.ID, second.ID)
+	})
+}
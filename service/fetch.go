@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultBackfillLimit = 200
+	defaultFetchPageSize = 100
+	// backfillBatchSize is the number of events requested by each /messages call.
+	backfillBatchSize = 50
+)
+
+// pendingSMS is a fetched message with what is needed to order it and to deliver it later.
+type pendingSMS struct {
+	SMS       models.SMS `json:"sms"`
+	Sent      bool       `json:"sent"`
+	Timestamp int64      `json:"timestamp"`
+	// EventID is the Matrix event of a message shown under its provisional ID, see reconcileOutbound.
+	EventID string `json:"event_id,omitempty"`
+}
+
+// sortedRoomIDs returns the rooms of a sync response ordered by ID.
+func sortedRoomIDs(rooms map[id.RoomID]*mautrix.SyncJoinedRoom) []id.RoomID {
+	roomIDs := make([]id.RoomID, 0, len(rooms))
+	for roomID := range rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	slices.Sort(roomIDs)
+	return roomIDs
+}
+
+// backfill returns, in chronological order, the events of a limited timeline skipped by the sync:
+// the ones between the pagination token from (the prev_batch of the timeline) and the previous sync
+// token to. At most backfillLimit events are returned, the most recent ones.
+func (s *MessageService) backfill(ctx context.Context, userID id.UserID, roomID id.RoomID, from, to string) []*event.Event {
+	if s.backfillLimit <= 0 || from == "" {
+		return nil
+	}
+	var events []*event.Event
+	for len(events) < s.backfillLimit {
+		resp, err := s.matrixClient.Messages(ctx, userID, roomID, from, to, min(backfillBatchSize, s.backfillLimit-len(events)))
+		if err != nil {
+			logger.Ctx(ctx).Warn().Err(err).Str("room_id", string(roomID)).Int("fetched", len(events)).Msg("backfill failed, skipped messages are lost")
+			break
+		}
+		events = append(events, resp.Chunk...)
+		if len(resp.Chunk) == 0 || resp.End == "" || resp.End == from {
+			break
+		}
+		from = resp.End
+	}
+	if len(events) >= s.backfillLimit {
+		events = events[:s.backfillLimit]
+		logger.Ctx(ctx).Warn().Str("room_id", string(roomID)).Int("limit", s.backfillLimit).Msg("backfill limit reached, older skipped messages may be lost")
+	}
+	// /messages returns the events backwards
+	slices.Reverse(events)
+	logger.Ctx(ctx).Debug().Str("room_id", string(roomID)).Int("count", len(events)).Msg("backfilled limited timeline")
+	return events
+}
+
+// nextPage orders fetched messages by timestamp and returns the first page; the others are kept
+// for the next fetches of userID.
+func (s *MessageService) nextPage(userID string, fetched []pendingSMS) []pendingSMS {
+	sort.SliceStable(fetched, func(i, j int) bool { return fetched[i].Timestamp < fetched[j].Timestamp })
+	if len(fetched) <= s.pageSize {
+		return fetched
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[userID] = append(s.pending[userID], fetched[s.pageSize:]...)
+	return fetched[:s.pageSize]
+}
+
+// nextPendingPage returns the next page of the messages kept by nextPage, if any.
+func (s *MessageService) nextPendingPage(userID string) ([]pendingSMS, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending[userID]
+	if len(pending) == 0 {
+		return nil, false
+	}
+	if len(pending) <= s.pageSize {
+		delete(s.pending, userID)
+		return pending, true
+	}
+	s.pending[userID] = pending[s.pageSize:]
+	return pending[:s.pageSize], true
+}
+
+// fetchResponse splits a page of messages into the received and the sent ones.
+func (s *MessageService) fetchResponse(page []pendingSMS) *models.FetchMessagesResponse {
+	received, sent := make([]models.SMS, 0, len(page)), make([]models.SMS, 0, 8)
+	for _, msg := range page {
+		if msg.Sent {
+			sent = append(sent, msg.SMS)
+		} else {
+			received = append(received, msg.SMS)
+		}
+	}
+	return &models.FetchMessagesResponse{
+		Date:         s.now().UTC().Format(time.RFC3339),
+		ReceivedSMSs: received,
+		SentSMSs:     sent,
+	}
+}
+
+// FlushPendingMessages stores the messages not yet delivered in the push token database,
+// so they are delivered after a restart: the batch tokens already moved past them.
+func (s *MessageService) FlushPendingMessages() error {
+	if s.pushTokenDB == nil {
+		return nil
+	}
+	s.mu.RLock()
+	pending := make(map[string]string, len(s.pending))
+	for userID, messages := range s.pending {
+		data, err := json.Marshal(messages)
+		if err != nil {
+			s.mu.RUnlock()
+			return fmt.Errorf("flush pending messages: %w", err)
+		}
+		pending[userID] = string(data)
+	}
+	s.mu.RUnlock()
+
+	if err := s.pushTokenDB.SavePendingMessages(pending); err != nil {
+		return fmt.Errorf("flush pending messages: %w", err)
+	}
+	logger.Info().Int("count", len(pending)).Msg("pending messages flushed")
+	return nil
+}
+
+// loadPendingMessages returns the messages left undelivered by a previous run, if any.
+func loadPendingMessages(pushTokenDB *db.Database) map[string][]pendingSMS {
+	pending := make(map[string][]pendingSMS)
+	if pushTokenDB == nil {
+		return pending
+	}
+	stored, err := pushTokenDB.LoadPendingMessages()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to load pending messages")
+		return pending
+	}
+	for userID, data := range stored {
+		var messages []pendingSMS
+		if err := json.Unmarshal([]byte(data), &messages); err != nil {
+			logger.Warn().Err(err).Str("user_id", userID).Msg("failed to decode pending messages")
+			continue
+		}
+		pending[userID] = messages
+	}
+	logger.Debug().Int("count", len(pending)).Msg("pending messages loaded")
+	return pending
+}
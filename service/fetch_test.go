@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncRoutes returns homeserver routes answering /sync with two rooms, the second one with a
+// limited timeline, and /messages with the events skipped by that sync.
+func syncRoutes(t *testing.T) homeserverRoutes {
+	return homeserverRoutes{
+		"GET /_matrix/client/v3/sync": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"next_batch":"s_next","rooms":{"join":{
+				"!b:example.com":{"timeline":{"limited":true,"prev_batch":"t_gap","events":[
+					{"event_id":"$b3","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"b3"}}
+				]}},
+				"!a:example.com":{"timeline":{"events":[
+					{"event_id":"$a2","type":"m.room.message","sender":"@carol:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"a2"}},
+					{"event_id":"$a4","type":"m.room.message","sender":"@carol:example.com","origin_server_ts":4000,"content":{"msgtype":"m.text","body":"a4"}}
+				]}}
+			}}}`))
+		},
+		"GET /_matrix/client/v3/rooms/{room}/messages": func(w http.ResponseWriter, r *http.Request) {
+			if r.PathValue("room") != "!b:example.com" {
+				writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+				return
+			}
+			assert.Equal(t, "s_prev", r.URL.Query().Get("to"))
+			if r.URL.Query().Get("from") == "t_gap" {
+				w.Write([]byte(`{"start":"t_gap","end":"t_older","chunk":[
+					{"event_id":"$b1","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":1500,"content":{"msgtype":"m.text","body":"b1"}}
+				]}`))
+				return
+			}
+			w.Write([]byte(`{"start":"t_older","chunk":[
+				{"event_id":"$b0","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"b0"}}
+			]}`))
+		},
+	}
+}
+
+func smsIDs(resp *models.FetchMessagesResponse) []string {
+	ids := make([]string, 0, len(resp.ReceivedSMSs))
+	for _, sms := range resp.ReceivedSMSs {
+		ids = append(ids, sms.SMSID)
+	}
+	return ids
+}
+
+func TestFetchMessages_OrderAndBackfill(t *testing.T) {
+	client, _ := newFakeHomeserver(t, syncRoutes(t))
+	svc := newMessageService(client, nil, Config{BackfillLimit: 10}.withDefaults(), nil)
+	svc.setBatchToken("@alice:example.com", "s_prev")
+
+	resp, err := svc.FetchMessages(context.TODO(), &models.FetchMessagesRequest{Username: "@alice:example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$b0", "$b1", "$a2", "$b3", "$a4"}, smsIDs(resp))
+
+	// The backfill is capped, keeping the events closest to the sync
+	client, _ = newFakeHomeserver(t, syncRoutes(t))
+	svc = newMessageService(client, nil, Config{BackfillLimit: 1}.withDefaults(), nil)
+	svc.setBatchToken("@alice:example.com", "s_prev")
+	resp, err = svc.FetchMessages(context.TODO(), &models.FetchMessagesRequest{Username: "@alice:example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$b1", "$a2", "$b3", "$a4"}, smsIDs(resp))
+}
+
+func TestFetchMessages_PageSize(t *testing.T) {
+	path := t.TempDir() + "/push_tokens.db"
+	dbi, err := db.NewDatabase(path)
+	require.NoError(t, err)
+	client, _ := newFakeHomeserver(t, syncRoutes(t))
+
+	svc := newMessageService(client, dbi, Config{FetchPageSize: 2}.withDefaults(), nil)
+	resp, err := svc.FetchMessages(context.TODO(), &models.FetchMessagesRequest{Username: "@alice:example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$a2", "$b3"}, smsIDs(resp))
+
+	// The remainder survives a restart and is delivered before syncing again
+	require.NoError(t, svc.Close())
+	require.NoError(t, dbi.Close())
+	dbi, err = db.NewDatabase(path)
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	svc = newMessageService(client, dbi, Config{FetchPageSize: 2}.withDefaults(), nil)
+	resp, err = svc.FetchMessages(context.TODO(), &models.FetchMessagesRequest{Username: "@alice:example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$a4"}, smsIDs(resp))
+	assert.Equal(t, "s_next", svc.getBatchToken("@alice:example.com"))
+}
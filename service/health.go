@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// healthChecker is implemented by dependencies that can report whether they are reachable.
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckAuth checks that the authentication backend is reachable.
+// Backends without a meaningful check (e.g. matrix, covered by the homeserver check) always pass.
+func (s *MessageService) CheckAuth(ctx context.Context) error {
+	if checker, ok := s.authClient.(healthChecker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// CheckPNM checks that the Acrobits push notification service is reachable.
+func (s *PushService) CheckPNM(ctx context.Context) error {
+	return checkReachable(ctx, s.httpClient, s.pnmURL)
+}
+
+// Check checks that the external auth endpoint is reachable.
+func (h *HTTPAuthClient) Check(ctx context.Context) error {
+	return checkReachable(ctx, h.client, h.url)
+}
+
+// Check checks that the introspection endpoint is reachable.
+func (o *OIDCAuthClient) Check(ctx context.Context) error {
+	return checkReachable(ctx, o.client, o.cfg.IntrospectionURL)
+}
+
+// Check connects to the directory and, when configured, binds with the service account.
+func (l *LDAPAuthClient) Check(ctx context.Context) error {
+	conn, err := l.dial(l.cfg.URL)
+	if err != nil {
+		return fmt.Errorf("ldap dial: %w", err)
+	}
+	defer conn.Close()
+	if l.cfg.BindDN != "" {
+		if err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+			return fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+	return nil
+}
+
+// Check checks that the auth file can be read.
+func (f *FileAuthClient) Check(ctx context.Context) error {
+	return f.reload()
+}
+
+// Check forwards to the wrapped backend.
+func (i *instrumentedAuthClient) Check(ctx context.Context) error {
+	if checker, ok := i.next.(healthChecker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// Check reports why the backend could not be initialized.
+func (u unavailableAuthClient) Check(ctx context.Context) error {
+	return fmt.Errorf("auth backend unavailable: %w", u.err)
+}
+
+// checkReachable sends a HEAD request to url. Any answer below 500 proves the service is up,
+// since endpoints meant for POST commonly reject HEAD with 4xx.
+func checkReachable(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReachable(t *testing.T) {
+	status := http.StatusMethodNotAllowed
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	client := NewHTTPAuthClient(ts.URL, time.Second, 0)
+	defer client.Close()
+	assert.NoError(t, client.Check(context.Background()), "4xx proves the endpoint is up")
+
+	status = http.StatusServiceUnavailable
+	assert.Error(t, client.Check(context.Background()))
+
+	ts.Close()
+	assert.Error(t, client.Check(context.Background()))
+}
+
+func TestCheckAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	require.NoError(t, os.WriteFile(path, []byte("201:{SHA}x\n"), 0o600))
+
+	c, err := NewAuthClient(Config{Auth: AuthConfig{Backend: AuthBackendFile, File: path}})
+	require.NoError(t, err)
+	svc := newMessageService(nil, nil, Config{}, c)
+	assert.NoError(t, svc.CheckAuth(context.Background()))
+
+	require.NoError(t, os.Remove(path))
+	// The file is re-read only when its modification time changes; a missing file fails stat.
+	assert.Error(t, svc.CheckAuth(context.Background()))
+
+	svc = newMessageService(nil, nil, Config{}, unavailableAuthClient{err: errors.New("bad config")})
+	assert.ErrorContains(t, svc.CheckAuth(context.Background()), "bad config")
+
+	// The matrix backend has no check of its own.
+	c, err = NewAuthClient(Config{HomeserverURL: "https://matrix.example.com", Auth: AuthConfig{Backend: AuthBackendMatrix}})
+	require.NoError(t, err)
+	svc = newMessageService(nil, nil, Config{}, c)
+	assert.NoError(t, svc.CheckAuth(context.Background()))
+}
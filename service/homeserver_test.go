@@ -0,0 +1,128 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/stretchr/testify/require"
+)
+
+// homeserverRoutes maps http.ServeMux patterns, e.g. "GET /_matrix/client/v3/sync", to the handlers
+// answering them.
+type homeserverRoutes map[string]http.HandlerFunc
+
+// fakeHomeserver is the Matrix homeserver of the service tests. Unless overridden by the routes it
+// accepts joins and message sends, answering a repeated transaction ID with the same event like
+// Synapse, and answers other requests with M_NOT_FOUND. Requests are served one at a time, so the
+// routes may keep state without locking, and recorded as "<method> <path> as <user>" with the
+// client API prefix trimmed.
+type fakeHomeserver struct {
+	mu       sync.Mutex
+	mux      *http.ServeMux
+	requests []string
+	events   map[string]string // transaction ID -> event ID
+	sent     []string          // event IDs of the messages sent, in order
+	status   int
+	errcode  string
+}
+
+func newFakeHomeserver(t *testing.T, routes homeserverRoutes) (*matrix.MatrixClient, *fakeHomeserver) {
+	t.Helper()
+	h := &fakeHomeserver{mux: http.NewServeMux(), events: make(map[string]string)}
+	defaults := homeserverRoutes{
+		"POST /_matrix/client/v3/join/{room}": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"room_id":%q}`, r.PathValue("room"))
+		},
+		"PUT /_matrix/client/v3/rooms/{room}/send/{type}/{txn}": h.send,
+		"/": func(w http.ResponseWriter, r *http.Request) {
+			writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+		},
+	}
+	for pattern, handler := range defaults {
+		if _, ok := routes[pattern]; !ok {
+			h.mux.HandleFunc(pattern, handler)
+		}
+	}
+	for pattern, handler := range routes {
+		h.mux.HandleFunc(pattern, handler)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	client, err := matrix.NewClient(matrix.Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "as_token"})
+	require.NoError(t, err)
+	return client, h
+}
+
+func (h *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+	h.requests = append(h.requests, r.Method+" "+path+" as "+r.URL.Query().Get("user_id"))
+	w.Header().Set("Content-Type", "application/json")
+	if h.status != 0 {
+		writeMatrixError(w, h.status, h.errcode)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *fakeHomeserver) send(w http.ResponseWriter, r *http.Request) {
+	txnID := r.PathValue("txn")
+	if h.events[txnID] == "" {
+		h.sent = append(h.sent, fmt.Sprintf("$event%d", len(h.sent)+1))
+		h.events[txnID] = h.sent[len(h.sent)-1]
+	}
+	fmt.Fprintf(w, `{"event_id":%q}`, h.events[txnID])
+}
+
+// fail has every request answered with status and errcode, until called with status 0.
+func (h *fakeHomeserver) fail(status int, errcode string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status, h.errcode = status, errcode
+}
+
+// calls returns the requests received other than lookups.
+func (h *fakeHomeserver) calls() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.callsLocked()
+}
+
+// lookups returns the number of GET requests received.
+func (h *fakeHomeserver) lookups() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.requests) - len(h.callsLocked())
+}
+
+func (h *fakeHomeserver) callsLocked() []string {
+	var calls []string
+	for _, request := range h.requests {
+		if !strings.HasPrefix(request, http.MethodGet+" ") {
+			calls = append(calls, request)
+		}
+	}
+	return calls
+}
+
+// txnIDs returns the transaction IDs of the message sends received, repeats included.
+func (h *fakeHomeserver) txnIDs() []string {
+	var txnIDs []string
+	for _, call := range h.calls() {
+		if path, _, ok := strings.Cut(strings.TrimPrefix(call, http.MethodPut+" "), " as "); ok && strings.Contains(path, "/send/m.room.message/") {
+			txnIDs = append(txnIDs, path[strings.LastIndex(path, "/")+1:])
+		}
+	}
+	return txnIDs
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, errcode string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errcode":%q,"error":%q}`, errcode, strings.ToLower(http.StatusText(status)))
+}
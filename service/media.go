@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Content types of Acrobits messages.
+const (
+	ContentTypeText         = "text/plain"
+	ContentTypeVCard        = "text/vcard"
+	ContentTypeFileTransfer = "application/x-acro-filetransfer+json"
+)
+
+// maxVCardSize bounds the contact cards downloaded to be delivered inline.
+const maxVCardSize = 64 * 1024
+
+// ErrMediaNotFound is returned when media is requested with an invalid signature or does not exist.
+var ErrMediaNotFound = errors.New("media not found")
+
+// fileTransfer is the body of application/x-acro-filetransfer+json messages.
+type fileTransfer struct {
+	Body        string                   `json:"body,omitempty"`
+	Attachments []fileTransferAttachment `json:"attachments"`
+}
+
+type fileTransferAttachment struct {
+	ContentType string `json:"content-type,omitempty"`
+	ContentURL  string `json:"content-url"`
+	ContentSize int    `json:"content-size,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// acrobitsContent returns the Acrobits content type and text of a message: locations become geo: URIs,
+// contact cards are delivered inline as text/vcard, stickers as image attachments and polls as text.
+func (s *MessageService) acrobitsContent(ctx context.Context, evtType event.Type, msg *event.MessageEventContent) (string, string) {
+	switch {
+	case evtType == event.EventSticker:
+		if transfer, ok := s.stickerTransfer(msg); ok {
+			return ContentTypeFileTransfer, transfer
+		}
+		return ContentTypeText, msg.Body
+	case msg.MsgType == event.MsgLocation:
+		return ContentTypeText, locationText(msg)
+	case msg.MsgType == event.MsgFile && isVCard(msg.GetInfo().MimeType):
+		card, err := s.downloadVCard(ctx, msg)
+		if err == nil {
+			return ContentTypeVCard, card
+		}
+		logger.Ctx(ctx).Warn().Err(err).Str("url", string(msg.URL)).Msg("cannot download contact card, delivering its name")
+		return ContentTypeText, msg.Body
+	}
+	return ContentTypeText, messageText(ctx, msg)
+}
+
+// locationText returns the geo: URI of a location, after its description when it has one.
+func locationText(msg *event.MessageEventContent) string {
+	geo := msg.GeoURI
+	if geo == "" {
+		return msg.Body
+	}
+	desc := strings.TrimSpace(msg.Body)
+	if desc == "" || strings.Contains(desc, geo) {
+		return geo
+	}
+	return desc + "\n" + geo
+}
+
+// stickerTransfer returns the file transfer body of a sticker, whose image is downloaded through the proxy.
+func (s *MessageService) stickerTransfer(msg *event.MessageEventContent) (string, bool) {
+	uri, err := msg.URL.Parse()
+	if err != nil {
+		return "", false
+	}
+	contentURL := s.mediaURL(uri)
+	if contentURL == "" {
+		return "", false
+	}
+	info := msg.GetInfo()
+	transfer := fileTransfer{
+		Body: msg.Body,
+		Attachments: []fileTransferAttachment{{
+			ContentType: info.MimeType,
+			ContentURL:  contentURL,
+			ContentSize: info.Size,
+			Filename:    uri.FileID + extensionFor(info.MimeType),
+			Description: msg.Body,
+		}},
+	}
+	data, err := json.Marshal(transfer)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// mediaURL returns the signed proxy URL serving uri, or an empty string when the proxy URL is unknown.
+func (s *MessageService) mediaURL(uri id.ContentURI) string {
+	if s.proxyURL == "" || s.matrixClient == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/api/client/media/%s/%s?sig=%s",
+		strings.TrimSuffix(s.proxyURL, "/"), url.PathEscape(uri.Homeserver), url.PathEscape(uri.FileID), s.matrixClient.SignMedia(uri))
+}
+
+// OpenMedia returns the content of the media server/mediaID, if signature was issued for it by mediaURL.
+// The caller must close the body of the returned response.
+func (s *MessageService) OpenMedia(ctx context.Context, server, mediaID, signature string) (*http.Response, error) {
+	uri := id.ContentURI{Homeserver: server, FileID: mediaID}
+	if s.matrixClient == nil || !s.matrixClient.VerifyMedia(uri, signature) {
+		return nil, ErrMediaNotFound
+	}
+	resp, err := s.matrixClient.DownloadMedia(ctx, uri)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("uri", uri.String()).Msg("media download failed")
+		return nil, fmt.Errorf("%w: %w", ErrMediaNotFound, err)
+	}
+	return resp, nil
+}
+
+// downloadVCard returns the content of a contact card file.
+func (s *MessageService) downloadVCard(ctx context.Context, msg *event.MessageEventContent) (string, error) {
+	if s.matrixClient == nil {
+		return "", errors.New("matrix client not available")
+	}
+	if msg.GetInfo().Size > maxVCardSize {
+		return "", fmt.Errorf("contact card too large: %d bytes", msg.GetInfo().Size)
+	}
+	uri, err := msg.URL.Parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid content URI: %w", err)
+	}
+	resp, err := s.matrixClient.DownloadMedia(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVCardSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxVCardSize {
+		return "", fmt.Errorf("contact card larger than %d bytes", maxVCardSize)
+	}
+	return string(data), nil
+}
+
+// pollText renders a poll as its question followed by the numbered answers.
+func pollText(evt *event.Event) (string, bool) {
+	if evt.Content.Parsed == nil {
+		if err := evt.Content.ParseRaw(event.EventUnstablePollStart); err != nil {
+			return "", false
+		}
+	}
+	poll, ok := evt.Content.Parsed.(*event.PollStartEventContent)
+	if !ok || poll.PollStart.Question.Text == "" {
+		return "", false
+	}
+	lines := []string{"📊 " + poll.PollStart.Question.Text}
+	for i, answer := range poll.PollStart.Answers {
+		lines = append(lines, strconv.Itoa(i+1)+". "+answer.Text)
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// outgoingContent builds the content of a message sent from Acrobits: contact cards are uploaded
+// and sent as m.file, a body made of a geo: URI is sent as m.location, anything else as text.
+func (s *MessageService) outgoingContent(ctx context.Context, sender id.UserID, req *models.SendMessageRequest) (*event.MessageEventContent, error) {
+	contentType := ContentTypeText
+	if req.ContentType != "" {
+		if parsed, _, err := mime.ParseMediaType(req.ContentType); err == nil {
+			contentType = parsed
+		}
+	}
+	if isVCard(contentType) {
+		return s.vCardContent(ctx, sender, req.Body)
+	}
+	if geo, ok := parseGeoURI(req.Body); ok {
+		return &event.MessageEventContent{
+			MsgType: event.MsgLocation,
+			Body:    "Location: " + geo,
+			GeoURI:  geo,
+		}, nil
+	}
+	return s.textContent(req.Body), nil
+}
+
+// vCardContent uploads a contact card and returns the m.file content referencing it.
+func (s *MessageService) vCardContent(ctx context.Context, sender id.UserID, card string) (*event.MessageEventContent, error) {
+	if strings.TrimSpace(card) == "" {
+		return nil, fmt.Errorf("%w: empty contact card", ErrInvalidContent)
+	}
+	if len(card) > maxVCardSize {
+		return nil, fmt.Errorf("%w: contact card larger than %d bytes", ErrInvalidContent, maxVCardSize)
+	}
+	fileName := "contact.vcf"
+	if name := vCardName(card); name != "" {
+		fileName = name + ".vcf"
+	}
+	uri, err := s.matrixClient.UploadMedia(ctx, sender, []byte(card), ContentTypeVCard, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("upload contact card: %w", mapAuthErr(err))
+	}
+	return &event.MessageEventContent{
+		MsgType:  event.MsgFile,
+		Body:     fileName,
+		FileName: fileName,
+		URL:      uri.CUString(),
+		Info: &event.FileInfo{
+			MimeType: ContentTypeVCard,
+			Size:     len(card),
+		},
+	}, nil
+}
+
+// vCardName returns the formatted name (FN) of a contact card, usable as a file name.
+func vCardName(card string) string {
+	for _, line := range strings.Split(card, "\n") {
+		line = strings.TrimSpace(line)
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// The property may carry parameters, e.g. "FN;CHARSET=UTF-8:Alice"
+		if name, _, _ := strings.Cut(key, ";"); strings.EqualFold(name, "FN") {
+			return strings.Map(func(r rune) rune {
+				if strings.ContainsRune(`/\:*?"<>|`, r) {
+					return '_'
+				}
+				return r
+			}, strings.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// parseGeoURI reports whether body is only a geo: URI (RFC 5870) and returns it.
+func parseGeoURI(body string) (string, bool) {
+	geo := strings.TrimSpace(body)
+	if len(geo) < 4 || !strings.EqualFold(geo[:4], "geo:") || strings.ContainsAny(geo, " \n\t") {
+		return "", false
+	}
+	coords, _, _ := strings.Cut(geo[4:], ";")
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", false
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || i == 0 && (v < -90 || v > 90) || i == 1 && (v < -180 || v > 180) {
+			return "", false
+		}
+	}
+	return "geo:" + geo[4:], true
+}
+
+func isVCard(contentType string) bool {
+	switch strings.ToLower(contentType) {
+	case ContentTypeVCard, "text/x-vcard", "text/directory":
+		return true
+	}
+	return false
+}
+
+// extensionFor returns the file extension of common image types, used to name attachments.
+func extensionFor(mimeType string) string {
+	switch mimeType {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const testVCard = "BEGIN:VCARD\r\nVERSION:3.0\r\nFN;CHARSET=UTF-8:Alice Smith\r\nTEL:+391234\r\nEND:VCARD\r\n"
+
+// mediaRoutes returns homeserver routes storing uploads and serving them back.
+func mediaRoutes() homeserverRoutes {
+	media := map[string][]byte{"mxc://example.com/card": []byte(testVCard)}
+	return homeserverRoutes{
+		"POST /_matrix/media/v3/upload": func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			media["mxc://example.com/uploaded"] = data
+			w.Write([]byte(`{"content_uri":"mxc://example.com/uploaded"}`))
+		},
+		"GET /_matrix/client/v1/media/download/{server}/{media}": func(w http.ResponseWriter, r *http.Request) {
+			data, ok := media["mxc://"+r.PathValue("server")+"/"+r.PathValue("media")]
+			if !ok {
+				writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+				return
+			}
+			w.Header().Set("Content-Type", "text/vcard")
+			w.Write(data)
+		},
+	}
+}
+
+func TestAcrobitsContent(t *testing.T) {
+	client, _ := newFakeHomeserver(t, mediaRoutes())
+	svc := newMessageService(client, nil, Config{ProxyURL: "https://proxy.example.com/"}.withDefaults(), nil)
+	ctx := context.TODO()
+
+	t.Run("location", func(t *testing.T) {
+		contentType, text := svc.acrobitsContent(ctx, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgLocation, Body: "Office", GeoURI: "geo:45.07,7.68"})
+		assert.Equal(t, ContentTypeText, contentType)
+		assert.Equal(t, "Office\ngeo:45.07,7.68", text)
+
+		_, text = svc.acrobitsContent(ctx, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgLocation, Body: "Location: geo:45.07,7.68", GeoURI: "geo:45.07,7.68"})
+		assert.Equal(t, "geo:45.07,7.68", text)
+	})
+
+	t.Run("contact card", func(t *testing.T) {
+		msg := &event.MessageEventContent{MsgType: event.MsgFile, Body: "alice.vcf", URL: "mxc://example.com/card", Info: &event.FileInfo{MimeType: "text/x-vcard"}}
+		contentType, text := svc.acrobitsContent(ctx, event.EventMessage, msg)
+		assert.Equal(t, ContentTypeVCard, contentType)
+		assert.Equal(t, testVCard, text)
+
+		// A card that cannot be downloaded is delivered as its name
+		msg.URL = "mxc://example.com/missing"
+		contentType, text = svc.acrobitsContent(ctx, event.EventMessage, msg)
+		assert.Equal(t, ContentTypeText, contentType)
+		assert.Equal(t, "alice.vcf", text)
+	})
+
+	t.Run("other files", func(t *testing.T) {
+		contentType, text := svc.acrobitsContent(ctx, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgFile, Body: "report.pdf", URL: "mxc://example.com/pdf", Info: &event.FileInfo{MimeType: "application/pdf"}})
+		assert.Equal(t, ContentTypeText, contentType)
+		assert.Equal(t, "report.pdf", text)
+	})
+
+	t.Run("sticker", func(t *testing.T) {
+		msg := &event.MessageEventContent{Body: "thumbs up", URL: "mxc://example.com/sticker", Info: &event.FileInfo{MimeType: "image/png", Size: 1234}}
+		contentType, text := svc.acrobitsContent(ctx, event.EventSticker, msg)
+		require.Equal(t, ContentTypeFileTransfer, contentType)
+
+		var transfer fileTransfer
+		require.NoError(t, json.Unmarshal([]byte(text), &transfer))
+		require.Len(t, transfer.Attachments, 1)
+		attachment := transfer.Attachments[0]
+		assert.Equal(t, "image/png", attachment.ContentType)
+		assert.Equal(t, 1234, attachment.ContentSize)
+		assert.Equal(t, "sticker.png", attachment.Filename)
+		uri := id.ContentURI{Homeserver: "example.com", FileID: "sticker"}
+		assert.Equal(t, "https://proxy.example.com/api/client/media/example.com/sticker?sig="+svc.matrixClient.SignMedia(uri), attachment.ContentURL)
+
+		// Without a public URL the sticker cannot be downloaded, so only its description is delivered
+		svc := newMessageService(nil, nil, Config{}.withDefaults(), nil)
+		contentType, text = svc.acrobitsContent(ctx, event.EventSticker, msg)
+		assert.Equal(t, ContentTypeText, contentType)
+		assert.Equal(t, "thumbs up", text)
+	})
+}
+
+func TestCollapseTimeline_Polls(t *testing.T) {
+	svc := newMessageService(nil, nil, Config{}.withDefaults(), nil)
+	events := timelineEvents(t, `[
+		{"event_id":"$p","type":"org.matrix.msc3381.poll.start","sender":"@bob:example.com","content":{"org.matrix.msc3381.poll.start":{"kind":"org.matrix.msc3381.poll.disclosed","max_selections":1,"question":{"org.matrix.msc1767.text":"Lunch?"},"answers":[{"id":"a","org.matrix.msc1767.text":"Pizza"},{"id":"b","org.matrix.msc1767.text":"Sushi"}]}}}
+	]`)
+
+	messages := svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", events)
+
+	require.Len(t, messages, 1)
+	assert.Equal(t, "📊 Lunch?\n1. Pizza\n2. Sushi", messages[0].Body)
+	assert.Equal(t, ContentTypeText, messages[0].ContentType)
+}
+
+func TestOutgoingContent(t *testing.T) {
+	client, _ := newFakeHomeserver(t, mediaRoutes())
+	svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+	ctx := context.TODO()
+
+	t.Run("location", func(t *testing.T) {
+		content, err := svc.outgoingContent(ctx, "@alice:example.com", &models.SendMessageRequest{Body: " geo:45.07,7.68;u=20 "})
+		require.NoError(t, err)
+		assert.Equal(t, event.MsgLocation, content.MsgType)
+		assert.Equal(t, "geo:45.07,7.68;u=20", content.GeoURI)
+	})
+
+	t.Run("contact card", func(t *testing.T) {
+		content, err := svc.outgoingContent(ctx, "@alice:example.com", &models.SendMessageRequest{Body: testVCard, ContentType: "text/vcard; charset=utf-8"})
+		require.NoError(t, err)
+		assert.Equal(t, event.MsgFile, content.MsgType)
+		assert.Equal(t, "Alice Smith.vcf", content.FileName)
+		assert.Equal(t, id.ContentURIString("mxc://example.com/uploaded"), content.URL)
+		assert.Equal(t, ContentTypeVCard, content.Info.MimeType)
+		assert.Equal(t, len(testVCard), content.Info.Size)
+
+		_, err = svc.outgoingContent(ctx, "@alice:example.com", &models.SendMessageRequest{Body: " ", ContentType: "text/x-vcard"})
+		assert.ErrorIs(t, err, ErrInvalidContent)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		for _, body := range []string{"hello", "geo:91,7", "see geo:45,7", "geo:abc,def"} {
+			content, err := svc.outgoingContent(ctx, "@alice:example.com", &models.SendMessageRequest{Body: body, ContentType: "text/plain"})
+			require.NoError(t, err)
+			assert.Equal(t, event.MsgText, content.MsgType, body)
+			assert.Equal(t, body, content.Body)
+		}
+	})
+}
+
+func TestOpenMedia(t *testing.T) {
+	client, _ := newFakeHomeserver(t, mediaRoutes())
+	svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+	ctx := context.TODO()
+	uri := id.ContentURI{Homeserver: "example.com", FileID: "card"}
+
+	resp, err := svc.OpenMedia(ctx, "example.com", "card", client.SignMedia(uri))
+	require.NoError(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, testVCard, string(data))
+
+	_, err = svc.OpenMedia(ctx, "example.com", "card", "bad")
+	assert.ErrorIs(t, err, ErrMediaNotFound)
+
+	missing := id.ContentURI{Homeserver: "example.com", FileID: "missing"}
+	_, err = svc.OpenMedia(ctx, "example.com", "missing", client.SignMedia(missing))
+	assert.ErrorIs(t, err, ErrMediaNotFound)
+}
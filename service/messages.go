@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,9 +15,11 @@ import (
 	"github.com/nethesis/matrix2acrobits/db"
 	"github.com/nethesis/matrix2acrobits/logger"
 	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/metrics"
 	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"maunium.net/go/mautrix"
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -26,10 +28,14 @@ var (
 	ErrInvalidRecipient = errors.New("recipient is not resolvable to a Matrix user or room")
 	ErrMappingNotFound  = errors.New("mapping not found")
 	ErrInvalidSender    = errors.New("sender is not resolvable to a Matrix user")
+	// ErrHomeserverToken is returned when the homeserver rejects the as_token of the proxy: a broken
+	// configuration rather than wrong client credentials.
+	ErrHomeserverToken = errors.New("homeserver rejected the application service token")
 )
 
 // MessageService handles sending/fetching messages plus the mapping store.
 type MessageService struct {
+	metrics      metrics.Tenant
 	matrixClient *matrix.MatrixClient
 	pushTokenDB  *db.Database
 	now          func() time.Time
@@ -40,15 +46,46 @@ type MessageService struct {
 	authClient     AuthClient
 	// Homeserver host used to build Matrix IDs from auth response
 	homeserverHost string
+	// How edits and redactions are mapped to Acrobits messages
+	redactionMode        string
+	redactionPlaceholder string
+	allowEdits           bool
+	// Text of the encrypted messages that cannot be decrypted
+	undecryptablePlaceholder string
+	// How fetched messages are completed and paged
+	backfillLimit int
+	pageSize      int
+	// How long identical messages are considered retries, see sendTxnIDs
+	dedupWindow time.Duration
+	// Messages sent while the homeserver is unavailable, see enqueueMessage
+	queueEnabled bool
+	queueMaxAge  time.Duration
+	queue        *outboundQueue
+	// Senders whose invites are accepted, see Config.InviteAllowedSenders
+	inviteSenders []string
+	// When delivered messages are marked as read, see Config.ReadReceipts
+	readReceipts string
+	// Language of the texts written for users whose devices did not report one
+	language string
+	// How rich text is converted
+	markdown     bool
+	noticePrefix string
 
 	mu          sync.RWMutex
 	mappings    map[string]mappingEntry
-	batchTokens map[string]string // userID -> next_batch token
+	batchTokens map[string]string       // userID -> next_batch token
+	pending     map[string][]pendingSMS // userID -> messages beyond the page size, see nextPage
 
 	// Caches for room resolution
 	roomAliasCache       *RoomAliasCache
 	roomAliasesCache     *RoomAliasesCache
 	roomParticipantCache *RoomParticipantCache
+	// Direct rooms checked recently, by alias key, see checkDirectRoom; guarded by mu
+	checkedRooms map[string]cacheEntry[id.RoomID]
+	// Application service transactions processed recently, see HandleAppServiceTransaction; guarded by mu
+	appServiceTxns []string
+	// Messages being sent, by content, see beginSend; guarded by mu
+	sending map[string]*inFlightSend
 }
 
 type mappingEntry struct {
@@ -61,295 +98,413 @@ type mappingEntry struct {
 }
 
 // NewMessageService wires the provided Matrix client and push token database into the service layer.
+// Settings are read from the environment; see ConfigFromEnv.
+// If the configured auth backend cannot be built, the error is logged and every authentication fails.
 func NewMessageService(matrixClient *matrix.MatrixClient, pushTokenDB *db.Database, proxyURL string) *MessageService {
-	// Parse cache TTL from environment, default to 1 hour (3600 seconds)
-	cacheTTLStr := os.Getenv("CACHE_TTL_SECONDS")
-	cacheTTLSeconds := 3600
-	if cacheTTLStr != "" {
-		if parsed, err := strconv.Atoi(cacheTTLStr); err == nil && parsed > 0 {
-			cacheTTLSeconds = parsed
-		}
+	svc, err := NewMessageServiceWithConfig(matrixClient, pushTokenDB, ConfigFromEnv(proxyURL))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to initialize auth backend, rejecting all authentications")
+		svc = newMessageService(matrixClient, pushTokenDB, ConfigFromEnv(proxyURL).withDefaults(), unavailableAuthClient{err: err})
 	}
-	cacheTTL := time.Duration(cacheTTLSeconds) * time.Second
-	logger.Debug().Int("cache_ttl_seconds", cacheTTLSeconds).Msg("initialized message service with cache TTL")
+	return svc
+}
 
-	// External auth configuration
-	extAuthURL := os.Getenv("EXT_AUTH_URL")
-	if extAuthURL == "" {
-		extAuthURL = "https://voice.gs.nethserver.net/freepbx/testextauth"
+// NewMessageServiceWithConfig builds a MessageService from an explicit Config.
+// Each tenant uses its own instance so mappings, caches and auth state are never shared.
+func NewMessageServiceWithConfig(matrixClient *matrix.MatrixClient, pushTokenDB *db.Database, cfg Config) (*MessageService, error) {
+	cfg = cfg.withDefaults()
+	authClient, err := NewAuthClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("auth backend %q: %w", cfg.Auth.Backend, err)
 	}
+	logger.Debug().Str("auth_backend", cfg.Auth.Backend).Msg("auth backend initialized")
+	svc := newMessageService(matrixClient, pushTokenDB, cfg, authClient)
+	if svc.queueEnabled {
+		svc.startOutboundQueue()
+	}
+	return svc, nil
+}
 
-	extAuthTimeoutS := 5
-	if v := os.Getenv("EXT_AUTH_TIMEOUT_S"); v != "" {
-		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-			extAuthTimeoutS = parsed
-		}
+func newMessageService(matrixClient *matrix.MatrixClient, pushTokenDB *db.Database, cfg Config, authClient AuthClient) *MessageService {
+	logger.Debug().Dur("cache_ttl", cfg.CacheTTL).Msg("initialized message service with cache TTL")
+
+	svc := &MessageService{
+		metrics:                  metrics.Tenant(cfg.Tenant),
+		matrixClient:             matrixClient,
+		pushTokenDB:              pushTokenDB,
+		now:                      time.Now,
+		proxyURL:                 cfg.ProxyURL,
+		mappings:                 make(map[string]mappingEntry),
+		batchTokens:              loadBatchTokens(pushTokenDB),
+		pending:                  loadPendingMessages(pushTokenDB),
+		roomAliasCache:           NewRoomAliasCache(cfg.CacheTTL),
+		roomAliasesCache:         NewRoomAliasesCache(cfg.CacheTTL),
+		roomParticipantCache:     NewRoomParticipantCache(cfg.CacheTTL),
+		extAuthURL:               cfg.ExtAuthURL,
+		extAuthTimeout:           cfg.ExtAuthTimeout,
+		authClient:               authClient,
+		homeserverHost:           cfg.homeserverHost(),
+		redactionMode:            cfg.RedactionMode,
+		redactionPlaceholder:     cfg.RedactionPlaceholder,
+		allowEdits:               cfg.AllowEdits,
+		markdown:                 cfg.Markdown,
+		noticePrefix:             cfg.NoticePrefix,
+		undecryptablePlaceholder: cfg.UndecryptablePlaceholder,
+		backfillLimit:            cfg.BackfillLimit,
+		pageSize:                 cfg.FetchPageSize,
+		dedupWindow:              cfg.SendDedupWindow,
+		queueEnabled:             cfg.QueueEnabled && pushTokenDB != nil,
+		queueMaxAge:              cfg.QueueMaxAge,
+		inviteSenders:            parseInviteSenders(cfg.InviteAllowedSenders),
+		readReceipts:             cfg.ReadReceipts,
+		language:                 cfg.Language,
 	}
+	svc.roomAliasCache.metrics = svc.metrics
+	svc.roomAliasesCache.metrics = svc.metrics
+	svc.roomParticipantCache.metrics = svc.metrics
+	return svc
+}
 
-	// Derive homeserver host from MATRIX_HOMESERVER_URL if present
-	homeserverHost := ""
-	if hsURL := os.Getenv("MATRIX_HOMESERVER_URL"); hsURL != "" {
-		if u, err := url.Parse(hsURL); err == nil {
-			homeserverHost = u.Hostname()
+// Close saves the sync batch tokens, so clients do not receive old messages again after a restart,
+// and the messages not yet delivered because of the page size,
+// and releases background resources held by the service, such as the auth cache sweeper.
+// It makes a last delivery attempt for the queued messages, so it must be called before the
+// Matrix client and the push token database are closed.
+func (s *MessageService) Close() error {
+	var errs []error
+	s.stopOutboundQueue()
+	if err := s.FlushBatchTokens(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.FlushPendingMessages(); err != nil {
+		errs = append(errs, err)
+	}
+	if closer, ok := s.authClient.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return errors.Join(errs...)
+}
 
-	return &MessageService{
-		matrixClient:         matrixClient,
-		pushTokenDB:          pushTokenDB,
-		now:                  time.Now,
-		proxyURL:             proxyURL,
-		mappings:             make(map[string]mappingEntry),
-		batchTokens:          make(map[string]string),
-		roomAliasCache:       NewRoomAliasCache(cacheTTL),
-		roomAliasesCache:     NewRoomAliasesCache(cacheTTL),
-		roomParticipantCache: NewRoomParticipantCache(cacheTTL),
-		extAuthURL:           extAuthURL,
-		extAuthTimeout:       time.Duration(extAuthTimeoutS) * time.Second,
-		authClient:           NewHTTPAuthClient(extAuthURL, time.Duration(extAuthTimeoutS)*time.Second, cacheTTL),
-		homeserverHost:       homeserverHost,
+// FlushBatchTokens stores the sync batch tokens held in memory in the push token database.
+func (s *MessageService) FlushBatchTokens() error {
+	if s.pushTokenDB == nil {
+		return nil
+	}
+	s.mu.RLock()
+	tokens := make(map[string]string, len(s.batchTokens))
+	for userID, token := range s.batchTokens {
+		tokens[userID] = token
 	}
+	s.mu.RUnlock()
+
+	if err := s.pushTokenDB.SaveBatchTokens(tokens); err != nil {
+		return fmt.Errorf("flush batch tokens: %w", err)
+	}
+	logger.Info().Int("count", len(tokens)).Msg("batch tokens flushed")
+	return nil
+}
+
+// loadBatchTokens returns the batch tokens saved by a previous run, if any.
+func loadBatchTokens(pushTokenDB *db.Database) map[string]string {
+	if pushTokenDB == nil {
+		return make(map[string]string)
+	}
+	tokens, err := pushTokenDB.LoadBatchTokens()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to load batch tokens, starting with full syncs")
+		return make(map[string]string)
+	}
+	logger.Debug().Int("count", len(tokens)).Msg("batch tokens loaded")
+	return tokens
 }
 
 // SendMessage translates an Acrobits send_message request into Matrix /send.
 // Only 1-to-1 direct messaging is supported.
 // Both sender and recipient are resolved to Matrix user IDs using local mappings if necessary.
 func (s *MessageService) SendMessage(ctx context.Context, req *models.SendMessageRequest) (*models.SendMessageResponse, error) {
+	var attrs []attribute.KeyValue
+	if req != nil {
+		attrs = append(attrs, tracing.AttrUsername.String(strings.TrimSpace(req.From)))
+	}
+	ctx, span := tracing.Start(ctx, "message.send", attrs...)
+	resp, err := s.sendMessage(ctx, req)
+	if resp != nil {
+		span.SetAttributes(tracing.AttrEventID.String(resp.ID))
+	}
+	tracing.End(span, err)
+	return resp, err
+}
+
+func (s *MessageService) sendMessage(ctx context.Context, req *models.SendMessageRequest) (*models.SendMessageResponse, error) {
 	// Debug full request
-	logger.Debug().Interface("request", req).Msg("send message request received")
+	logger.Ctx(ctx).Debug().Interface("request", req).Msg("send message request received")
 
 	senderStr := strings.TrimSpace(req.From)
 	if senderStr == "" {
-		logger.Warn().Msg("send message: empty sender")
+		logger.Ctx(ctx).Warn().Msg("send message: empty sender")
 		return nil, ErrInvalidSender
 	}
 
 	// If sender is already a Matrix ID, skip external auth
 	if !strings.HasPrefix(senderStr, "@") {
 		// Not a Matrix ID - check if we have a mapping for it
-		resolvedMatrix := s.resolveMatrixUser(senderStr)
+		resolvedMatrix := s.resolveMatrixUser(ctx, senderStr)
 		if resolvedMatrix == "" {
 			// No mapping exists - try external auth if password is provided
 			if strings.TrimSpace(req.Password) == "" {
-				logger.Warn().Str("sender", senderStr).Msg("sender not resolvable and no password provided")
+				logger.Ctx(ctx).Warn().Str("sender", senderStr).Msg("sender not resolvable and no password provided")
 				return nil, ErrAuthentication
 			}
-			mappings, ok, err := s.authClient.Validate(ctx, senderStr, strings.TrimSpace(req.Password), s.homeserverHost)
+			mappings, _, err := s.authClient.Validate(ctx, senderStr, strings.TrimSpace(req.Password), s.homeserverHost)
 			if err != nil {
-				if !ok {
-					logger.Warn().Str("sender", senderStr).Msg("external auth failed: unauthorized")
-					return nil, ErrAuthentication
+				if err = authError(err); errors.Is(err, ErrAuthentication) {
+					logger.Ctx(ctx).Warn().Str("sender", senderStr).Msg("external auth failed: unauthorized")
+					return nil, err
 				}
-				logger.Error().Err(err).Msg("external auth request failed")
-				return nil, fmt.Errorf("external auth request failed: %w", err)
+				logger.Ctx(ctx).Error().Err(err).Msg("external auth request failed")
+				return nil, err
 			}
 			// Persist all mappings returned by auth
 			for _, mapReq := range mappings {
 				if _, err := s.SaveMapping(mapReq); err != nil {
-					logger.Error().Err(err).Msg("failed to save mapping from external auth response (send)")
+					logger.Ctx(ctx).Error().Err(err).Msg("failed to save mapping from external auth response (send)")
 					return nil, fmt.Errorf("failed to save mapping: %w", err)
 				}
 			}
 		} else {
-			logger.Debug().Str("sender", senderStr).Str("resolved_matrix_id", string(resolvedMatrix)).Msg("sender resolved from existing mapping, skipping external auth")
+			logger.Ctx(ctx).Debug().Str("sender", senderStr).Str("resolved_matrix_id", string(resolvedMatrix)).Msg("sender resolved from existing mapping, skipping external auth")
 		}
 	} else {
-		logger.Debug().Str("sender", senderStr).Msg("sender is already a Matrix ID, skipping external auth")
+		logger.Ctx(ctx).Debug().Str("sender", senderStr).Msg("sender is already a Matrix ID, skipping external auth")
 	}
 
 	// Resolve sender to Matrix ID using mappings
-	senderMatrix := s.resolveMatrixUser(req.From)
+	senderMatrix := s.resolveMatrixUser(ctx, req.From)
 	if senderMatrix == "" {
-		logger.Warn().Str("from", req.From).Msg("resolved to empty Matrix user ID")
+		logger.Ctx(ctx).Warn().Str("from", req.From).Msg("resolved to empty Matrix user ID")
 		return nil, ErrAuthentication
 	}
+	tracing.SetAttributes(ctx, tracing.AttrUserID.String(string(senderMatrix)))
 
 	recipientStr := strings.TrimSpace(req.To)
 	if recipientStr == "" {
-		logger.Warn().Msg("send message: empty recipient")
+		logger.Ctx(ctx).Warn().Msg("send message: empty recipient")
 		return nil, ErrInvalidRecipient
 	}
 
+	// A retry of a message already sent, or queued, gets the original message_id back
+	txnIDs, done := s.beginSend(senderMatrix, recipientStr, req, s.sendTxnIDs(senderMatrix, recipientStr, req))
+	defer done()
+	if messageID := s.queuedMessage(ctx, txnIDs); messageID != "" {
+		logger.Ctx(ctx).Info().Str("sender", string(senderMatrix)).Str("message_id", messageID).Msg("send message retried, returning the message already queued")
+		return &models.SendMessageResponse{ID: messageID}, nil
+	}
+	if eventID := s.sentMessage(ctx, txnIDs); eventID != "" {
+		logger.Ctx(ctx).Info().Str("sender", string(senderMatrix)).Str("event_id", eventID).Msg("send message retried, returning the message already sent")
+		return &models.SendMessageResponse{ID: eventID}, nil
+	}
+	var txnID string
+	if len(txnIDs) > 0 {
+		txnID = txnIDs[0]
+	}
+	// Messages to a recipient of messages still queued wait behind them, to keep the order
+	if messageID, ok := s.enqueueBehind(ctx, senderMatrix, recipientStr, req, txnID); ok {
+		return &models.SendMessageResponse{ID: messageID}, nil
+	}
+
+	eventID, err := s.deliverMessage(ctx, senderMatrix, recipientStr, req, txnID)
+	if err != nil {
+		// While the homeserver is unavailable the message waits in the outbound queue
+		if messageID, ok := s.enqueueMessage(ctx, senderMatrix, req, txnID, err); ok {
+			return &models.SendMessageResponse{ID: messageID}, nil
+		}
+		return nil, err
+	}
+	s.recordSentMessage(ctx, txnID, eventID)
+	return &models.SendMessageResponse{ID: string(eventID)}, nil
+}
+
+// deliverMessage sends the message of req from sender to recipient, a user or a room, with the
+// Matrix transaction ID txnID, and returns its event ID.
+func (s *MessageService) deliverMessage(ctx context.Context, senderMatrix id.UserID, recipientStr string, req *models.SendMessageRequest, txnID string) (id.EventID, error) {
 	// Check if recipient is a room ID first
 	var roomID id.RoomID
 	var recipientMatrix id.UserID
 	if strings.HasPrefix(recipientStr, "!") {
 		// It's already a room ID, use it directly
 		roomID = id.RoomID(recipientStr)
-		logger.Debug().Str("recipient", string(roomID)).Msg("recipient is a room ID, using directly")
+		logger.Ctx(ctx).Debug().Str("recipient", string(roomID)).Msg("recipient is a room ID, using directly")
 	} else {
 		// Try to resolve as Matrix user ID or mapping
-		recipientMatrix = s.resolveMatrixUser(recipientStr)
+		recipientMatrix = s.resolveMatrixUser(ctx, recipientStr)
 		if recipientMatrix == "" {
-			logger.Warn().Str("recipient", recipientStr).Msg("recipient is not a valid Matrix user ID or room ID")
-			return nil, ErrInvalidRecipient
+			logger.Ctx(ctx).Warn().Str("recipient", recipientStr).Msg("recipient is not a valid Matrix user ID or room ID")
+			return "", ErrInvalidRecipient
 		}
 
-		logger.Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Msg("resolved sender and recipient to Matrix user IDs")
+		logger.Ctx(ctx).Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Msg("resolved sender and recipient to Matrix user IDs")
 
 		// For 1-to-1 messaging, ensure a direct room exists between sender and recipient
 		var err error
 		roomID, err = s.ensureDirectRoom(ctx, senderMatrix, recipientMatrix)
 		if err != nil {
-			logger.Error().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Err(err).Msg("failed to ensure direct room")
-			return nil, err
+			logger.Ctx(ctx).Error().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Err(err).Msg("failed to ensure direct room")
+			return "", err
 		}
 	}
 
 	if recipientMatrix != "" {
-		logger.Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Str("room_id", string(roomID)).Msg("sending message to direct room")
+		logger.Ctx(ctx).Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Str("room_id", string(roomID)).Msg("sending message to direct room")
 	} else {
-		logger.Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Msg("sending message to room")
+		logger.Ctx(ctx).Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Msg("sending message to room")
 	}
-	// Ensure the sender is a member of the room (in case join failed during room creation)
-	_, err := s.matrixClient.JoinRoom(ctx, senderMatrix, roomID)
-	if err != nil {
-		logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to join room")
-		return nil, fmt.Errorf("send message: %w", err)
+	tracing.SetAttributes(ctx, tracing.AttrRoomID.String(string(roomID)))
+	// Ensure the sender is a member of the room; ensureDirectRoom already did for direct rooms
+	if recipientMatrix == "" {
+		if _, err := s.matrixClient.JoinRoom(ctx, senderMatrix, roomID); err != nil {
+			logger.Ctx(ctx).Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to join room")
+			return "", fmt.Errorf("send message: %w", err)
+		}
 	}
 
-	content := &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    req.Body,
+	content, err := s.outgoingContent(ctx, senderMatrix, req)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Str("sender", string(senderMatrix)).Str("content_type", req.ContentType).Err(err).Msg("cannot build message content")
+		return "", err
+	}
+	if req.ReplacesMessageID != "" {
+		original, err := s.editTarget(ctx, senderMatrix, roomID, s.resolveQueuedID(ctx, req.ReplacesMessageID))
+		if err != nil {
+			logger.Ctx(ctx).Warn().Str("sender", string(senderMatrix)).Str("replaces_message_id", req.ReplacesMessageID).Err(err).Msg("cannot edit message")
+			return "", err
+		}
+		content.SetEdit(original)
 	}
 
-	resp, err := s.matrixClient.SendMessage(ctx, senderMatrix, roomID, content)
+	resp, err := s.matrixClient.SendMessage(ctx, senderMatrix, roomID, content, txnID)
+	if recipientMatrix != "" && errors.Is(err, mautrix.MForbidden) {
+		// The direct room changed since it was checked: check it again and retry once
+		logger.Ctx(ctx).Info().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("direct room refused the message, checking it again")
+		s.forgetDirectRoomChecks(roomID)
+		if roomID, err = s.ensureDirectRoom(ctx, senderMatrix, recipientMatrix); err == nil {
+			resp, err = s.matrixClient.SendMessage(ctx, senderMatrix, roomID, content, txnID)
+		}
+	}
 	if err != nil {
-		logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to send message")
-		return nil, fmt.Errorf("send message: %w", mapAuthErr(err))
+		logger.Ctx(ctx).Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to send message")
+		return "", fmt.Errorf("send message: %w", mapAuthErr(err))
 	}
 
-	logger.Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Str("event_id", string(resp.EventID)).Msg("message sent successfully")
-	return &models.SendMessageResponse{ID: string(resp.EventID)}, nil
+	logger.Ctx(ctx).Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Str("event_id", string(resp.EventID)).Msg("message sent successfully")
+	return resp.EventID, nil
 }
 
 // FetchMessages translates Matrix /sync into the Acrobits fetch_messages response.
 func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMessagesRequest) (*models.FetchMessagesResponse, error) {
-	logger.Debug().Interface("request", req).Msg("fetch messages request received")
-
-	// Authenticate user using external auth (require password)
-	userName := strings.TrimSpace(req.Username)
-	if userName == "" {
-		logger.Warn().Msg("fetch messages: empty username")
-		return nil, ErrAuthentication
+	var attrs []attribute.KeyValue
+	if req != nil {
+		attrs = append(attrs, tracing.AttrUsername.String(strings.TrimSpace(req.Username)))
 	}
+	ctx, span := tracing.Start(ctx, "message.fetch", attrs...)
+	resp, err := s.fetchMessages(ctx, req)
+	tracing.End(span, err)
+	return resp, err
+}
 
-	// If username is already a Matrix ID, skip external auth
-	if !strings.HasPrefix(userName, "@") {
-		// Not a Matrix ID - check if we have a mapping for it
-		resolvedMatrix := s.resolveMatrixUser(userName)
-		if resolvedMatrix == "" {
-			// No mapping exists - try external auth if password is provided
-			if strings.TrimSpace(req.Password) == "" {
-				logger.Warn().Str("username", userName).Msg("username not resolvable and no password provided")
-				return nil, ErrAuthentication
-			}
-			mappings, ok, err := s.authClient.Validate(ctx, userName, strings.TrimSpace(req.Password), s.homeserverHost)
-			if err != nil {
-				if !ok {
-					logger.Warn().Str("username", userName).Msg("external auth failed: unauthorized")
-					return nil, ErrAuthentication
-				}
-				logger.Error().Err(err).Msg("external auth request failed")
-				return nil, fmt.Errorf("external auth request failed: %w", err)
-			}
-			// Persist all mappings returned by auth
-			for _, mapReq := range mappings {
-				if _, err := s.SaveMapping(mapReq); err != nil {
-					logger.Error().Err(err).Msg("failed to save mapping from external auth response (fetch)")
-					return nil, fmt.Errorf("failed to save mapping: %w", err)
-				}
-			}
-		} else {
-			logger.Debug().Str("username", userName).Str("resolved_matrix_id", string(resolvedMatrix)).Msg("username resolved from existing mapping, skipping external auth")
-		}
-	} else {
-		logger.Debug().Str("username", userName).Msg("username is already a Matrix ID, skipping external auth")
-	}
+func (s *MessageService) fetchMessages(ctx context.Context, req *models.FetchMessagesRequest) (*models.FetchMessagesResponse, error) {
+	logger.Ctx(ctx).Debug().Interface("request", req).Msg("fetch messages request received")
 
-	// Resolve username to Matrix ID using mappings
-	userID := s.resolveMatrixUser(userName)
-	if userID == "" {
-		logger.Warn().Str("username", userName).Msg("resolved to empty Matrix user ID")
-		return nil, ErrAuthentication
+	userID, err := s.authenticateUser(ctx, req.Username, req.Password)
+	if err != nil {
+		return nil, err
 	}
+	tracing.SetAttributes(ctx, tracing.AttrUserID.String(string(userID)))
 
-	logger.Debug().Str("user_id", string(userID)).Msg("syncing messages from matrix")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Msg("syncing messages from matrix")
+
+	// Messages left over by the previous fetch are delivered before syncing again
+	if page, ok := s.nextPendingPage(string(userID)); ok {
+		logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Int("count", len(page)).Msg("delivering pending messages")
+		s.markDelivered(ctx, userID, page)
+		return s.fetchResponse(page), nil
+	}
 
 	// Retrieve the last batch token for this user
 	batchToken := s.getBatchToken(string(userID))
-	logger.Debug().Str("user_id", string(userID)).Str("batch_token", batchToken).Msg("using batch token for incremental sync")
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("batch_token", batchToken).Msg("using batch token for incremental sync")
 
 	resp, err := s.matrixClient.Sync(ctx, userID, batchToken)
 	if err != nil {
 		// If the token is invalid (e.g. expired or from a different session), retry with a full sync.
 		if strings.Contains(err.Error(), "Invalid stream token") || strings.Contains(err.Error(), "M_UNKNOWN") {
-			logger.Warn().Err(err).Msg("invalid stream token, retrying with full sync")
+			logger.Ctx(ctx).Warn().Err(err).Msg("invalid stream token, retrying with full sync")
 			s.clearBatchToken(string(userID))
+			batchToken = ""
 			resp, err = s.matrixClient.Sync(ctx, userID, "")
 		}
 	}
 	if err != nil {
-		logger.Error().Str("user_id", string(userID)).Err(err).Msg("matrix sync failed")
+		logger.Ctx(ctx).Error().Str("user_id", string(userID)).Err(err).Msg("matrix sync failed")
 		return nil, fmt.Errorf("sync messages: %w", mapAuthErr(err))
 	}
 
 	// Store the next_batch token for subsequent calls
 	if resp.NextBatch != "" {
 		s.setBatchToken(string(userID), resp.NextBatch)
-		logger.Debug().Str("user_id", string(userID)).Str("next_batch", resp.NextBatch).Msg("stored next batch token")
+		logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("next_batch", resp.NextBatch).Msg("stored next batch token")
 	}
 
-	received, sent := make([]models.SMS, 0, 8), make([]models.SMS, 0, 8)
+	// Conversations started from Matrix clients begin with an invite; their messages follow at the next fetch
+	s.acceptInvites(ctx, userID, resp.Rooms.Invite)
 
-	// Resolve the caller's identifier (e.g. "91201" -> "201")
-	callerIdentifier := s.resolveMatrixIDToIdentifier(string(userID))
-
-	for roomID, room := range resp.Rooms.Join {
-		for _, evt := range room.Timeline.Events {
-			if evt.Type != event.EventMessage {
-				continue
-			}
-
-			eventRoomID := evt.RoomID
-			if eventRoomID == "" {
-				eventRoomID = roomID
-			}
+	fetched := make([]pendingSMS, 0, 8)
 
-			logger.Debug().Str("event_id", string(evt.ID)).Str("room_id", string(eventRoomID)).Msg("processing message event")
+	// Resolve the caller's identifier (e.g. "91201" -> "201")
+	callerIdentifier := s.resolveMatrixIDToIdentifier(ctx, string(userID))
+
+	// Rooms are visited in a fixed order, so messages with the same timestamp always come out the same way
+	for _, roomID := range sortedRoomIDs(resp.Rooms.Join) {
+		room := resp.Rooms.Join[roomID]
+		events := room.Timeline.Events
+		if room.Timeline.Limited && batchToken != "" {
+			// The sync skipped events since the previous one: fetch them, or they are never delivered
+			events = append(s.backfill(ctx, userID, roomID, room.Timeline.PrevBatch, batchToken), events...)
+		}
+		for _, msg := range s.collapseTimeline(ctx, userID, roomID, events) {
+			logger.Ctx(ctx).Debug().Str("event_id", string(msg.ID)).Str("room_id", string(roomID)).Msg("processing message event")
 
-			body := ""
-			if b, ok := evt.Content.Raw["body"].(string); ok {
-				body = b
-			}
 			sms := models.SMS{
-				SMSID:       string(evt.ID),
-				SendingDate: time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
-				SMSText:     body,
-				ContentType: "text/plain",
+				SMSID:       string(msg.ID),
+				SendingDate: time.UnixMilli(msg.Timestamp).UTC().Format(time.RFC3339),
+				SMSText:     msg.Body,
+				ContentType: msg.ContentType,
 				StreamID:    string(roomID),
 			}
 
 			// Determine if I sent the message
-			senderMatrixID := string(evt.Sender)
+			senderMatrixID := string(msg.Sender)
 			isSent := isSentBy(senderMatrixID, string(userID))
 
 			// Remap sender to identifier (e.g. "202" or "91201")
-			sms.Sender = string(s.resolveMatrixIDToIdentifier(senderMatrixID))
+			sms.Sender = string(s.resolveMatrixIDToIdentifier(ctx, senderMatrixID))
+			if msg.ContentType == ContentTypeText {
+				sms.SMSText = s.renderText(msg.MsgType, sms.Sender, msg.Body)
+			}
 
 			// Determine Recipient
 			if isSent {
 				// I sent it. Recipient is the other person in the room.
-				other := s.resolveRoomIDToOtherIdentifier(ctx, eventRoomID, string(userID))
+				other := s.resolveRoomIDToOtherIdentifier(ctx, roomID, string(userID))
 				sms.Recipient = other
-				sent = append(sent, sms)
 			} else {
 				// I received it. Recipient is me.
 				sms.Recipient = callerIdentifier
-				received = append(received, sms)
 			}
+			fetched = append(fetched, pendingSMS{SMS: sms, Sent: isSent, Timestamp: msg.Timestamp})
 			// Debug each processed message
-			logger.Debug().
+			logger.Ctx(ctx).Debug().
 				Str("sender", sms.Sender).
 				Str("recipient", sms.Recipient).
 				Bool("is_sent", isSent).
@@ -359,13 +514,63 @@ func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMes
 		}
 	}
 
-	logger.Debug().Str("user_id", string(userID)).Int("received_count", len(received)).Int("sent_count", len(sent)).Msg("processed sync messages")
+	fetched = s.reconcileOutbound(ctx, userID, callerIdentifier, fetched)
+	page := s.nextPage(string(userID), fetched)
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Int("fetched_count", len(fetched)).Int("page_count", len(page)).Msg("processed sync messages")
+	s.markDelivered(ctx, userID, page)
+
+	return s.fetchResponse(page), nil
+}
+
+// authenticateUser validates the credentials of a client and returns its Matrix user ID.
+// Users already mapped, or given as Matrix IDs, are not checked against the auth backend again.
+func (s *MessageService) authenticateUser(ctx context.Context, userName, password string) (id.UserID, error) {
+	userName = strings.TrimSpace(userName)
+	if userName == "" {
+		logger.Ctx(ctx).Warn().Msg("empty username")
+		return "", ErrAuthentication
+	}
+
+	// If username is already a Matrix ID, skip external auth
+	if !strings.HasPrefix(userName, "@") {
+		// Not a Matrix ID - check if we have a mapping for it
+		resolvedMatrix := s.resolveMatrixUser(ctx, userName)
+		if resolvedMatrix == "" {
+			// No mapping exists - try external auth if password is provided
+			if strings.TrimSpace(password) == "" {
+				logger.Ctx(ctx).Warn().Str("username", userName).Msg("username not resolvable and no password provided")
+				return "", ErrAuthentication
+			}
+			mappings, _, err := s.authClient.Validate(ctx, userName, strings.TrimSpace(password), s.homeserverHost)
+			if err != nil {
+				if err = authError(err); errors.Is(err, ErrAuthentication) {
+					logger.Ctx(ctx).Warn().Str("username", userName).Msg("external auth failed: unauthorized")
+					return "", err
+				}
+				logger.Ctx(ctx).Error().Err(err).Msg("external auth request failed")
+				return "", err
+			}
+			// Persist all mappings returned by auth
+			for _, mapReq := range mappings {
+				if _, err := s.SaveMapping(mapReq); err != nil {
+					logger.Ctx(ctx).Error().Err(err).Msg("failed to save mapping from external auth response")
+					return "", fmt.Errorf("failed to save mapping: %w", err)
+				}
+			}
+		} else {
+			logger.Ctx(ctx).Debug().Str("username", userName).Str("resolved_matrix_id", string(resolvedMatrix)).Msg("username resolved from existing mapping, skipping external auth")
+		}
+	} else {
+		logger.Ctx(ctx).Debug().Str("username", userName).Msg("username is already a Matrix ID, skipping external auth")
+	}
 
-	return &models.FetchMessagesResponse{
-		Date:         s.now().UTC().Format(time.RFC3339),
-		ReceivedSMSs: received,
-		SentSMSs:     sent,
-	}, nil
+	// Resolve username to Matrix ID using mappings
+	userID := s.resolveMatrixUser(ctx, userName)
+	if userID == "" {
+		logger.Ctx(ctx).Warn().Str("username", userName).Msg("resolved to empty Matrix user ID")
+		return "", ErrAuthentication
+	}
+	return userID, nil
 }
 
 // resolveMatrixUser resolves an identifier to a valid Matrix user ID.
@@ -376,7 +581,7 @@ func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMes
 //     (if a sub_number matches, returns the matrix_id of that entry)
 //
 // Returns empty string if the identifier cannot be resolved.
-func (s *MessageService) resolveMatrixUser(identifier string) id.UserID {
+func (s *MessageService) resolveMatrixUser(ctx context.Context, identifier string) id.UserID {
 	identifier = strings.TrimSpace(identifier)
 
 	// If it's already a valid Matrix user ID, return it
@@ -386,7 +591,7 @@ func (s *MessageService) resolveMatrixUser(identifier string) id.UserID {
 
 	// Try to look up in mappings (e.g., phone number to Matrix user)
 	if entry, ok := s.getMapping(identifier); ok && entry.MatrixID != "" {
-		logger.Debug().Str("original_identifier", identifier).Str("resolved_user", entry.MatrixID).Msg("identifier resolved from mapping")
+		logger.Ctx(ctx).Debug().Str("original_identifier", identifier).Str("resolved_user", entry.MatrixID).Msg("identifier resolved from mapping")
 		return id.UserID(entry.MatrixID)
 	}
 
@@ -396,7 +601,7 @@ func (s *MessageService) resolveMatrixUser(identifier string) id.UserID {
 		for _, subNum := range entry.SubNumbers {
 			if strings.EqualFold(fmt.Sprintf("%d", subNum), identifier) {
 				s.mu.RUnlock()
-				logger.Debug().Str("original_identifier", identifier).Int("sub_number", subNum).Str("resolved_user", entry.MatrixID).Msg("identifier resolved from sub_number mapping")
+				logger.Ctx(ctx).Debug().Str("original_identifier", identifier).Int("sub_number", subNum).Str("resolved_user", entry.MatrixID).Msg("identifier resolved from sub_number mapping")
 				return id.UserID(entry.MatrixID)
 			}
 		}
@@ -404,7 +609,7 @@ func (s *MessageService) resolveMatrixUser(identifier string) id.UserID {
 	s.mu.RUnlock()
 
 	// Could not resolve
-	logger.Warn().Str("identifier", identifier).Msg("identifier could not be resolved to a Matrix user ID")
+	logger.Ctx(ctx).Warn().Str("identifier", identifier).Msg("identifier could not be resolved to a Matrix user ID")
 	return ""
 }
 
@@ -415,7 +620,7 @@ func (s *MessageService) resolveMatrixUser(identifier string) id.UserID {
 //   - Returns the original Matrix ID if no mapping is found
 //
 // Sub_numbers are never returned directly; if a sub_number is matched, the main number is returned instead.
-func (s *MessageService) resolveMatrixIDToIdentifier(matrixID string) string {
+func (s *MessageService) resolveMatrixIDToIdentifier(ctx context.Context, matrixID string) string {
 	matrixID = strings.TrimSpace(matrixID)
 
 	s.mu.RLock()
@@ -424,7 +629,7 @@ func (s *MessageService) resolveMatrixIDToIdentifier(matrixID string) string {
 		if strings.EqualFold(entry.MatrixID, matrixID) {
 			// Prefer Number as the identifier
 			if entry.Number != 0 {
-				logger.Debug().Str("matrix_id", matrixID).Int("number", entry.Number).Msg("resolved matrix id to number")
+				logger.Ctx(ctx).Debug().Str("matrix_id", matrixID).Int("number", entry.Number).Msg("resolved matrix id to number")
 				return fmt.Sprintf("%d", entry.Number)
 			}
 		}
@@ -441,7 +646,7 @@ func (s *MessageService) resolveRoomIDToOtherIdentifier(ctx context.Context, roo
 
 	// Check cache first
 	if cachedIdentifier := s.roomParticipantCache.Get(cacheKey); cachedIdentifier != "" {
-		logger.Debug().Str("room_id", string(roomID)).Str("my_matrix_id", myMatrixID).Str("cached_identifier", cachedIdentifier).Msg("resolved other participant from cache")
+		logger.Ctx(ctx).Debug().Str("room_id", string(roomID)).Str("my_matrix_id", myMatrixID).Str("cached_identifier", cachedIdentifier).Msg("resolved other participant from cache")
 		return cachedIdentifier
 	}
 
@@ -449,7 +654,7 @@ func (s *MessageService) resolveRoomIDToOtherIdentifier(ctx context.Context, roo
 	var aliases []string
 	if cachedAliases := s.roomAliasesCache.Get(string(roomID)); cachedAliases != nil {
 		aliases = cachedAliases
-		logger.Debug().Str("room_id", string(roomID)).Int("alias_count", len(aliases)).Msg("fetched room aliases from cache")
+		logger.Ctx(ctx).Debug().Str("room_id", string(roomID)).Int("alias_count", len(aliases)).Msg("fetched room aliases from cache")
 	} else {
 		// Fetch aliases from Matrix server
 		aliases = s.matrixClient.GetRoomAliases(ctx, roomID)
@@ -459,7 +664,7 @@ func (s *MessageService) resolveRoomIDToOtherIdentifier(ctx context.Context, roo
 	}
 
 	for _, alias := range aliases {
-		logger.Debug().Str("alias", alias).Msg("processing room alias")
+		logger.Ctx(ctx).Debug().Str("alias", alias).Msg("processing room alias")
 
 		// Normalize alias to form "localpart1|localpart2" (strip leading '#' and domain suffix)
 		normalizeLocal := func(v string) string {
@@ -475,7 +680,7 @@ func (s *MessageService) resolveRoomIDToOtherIdentifier(ctx context.Context, roo
 		norm := normalizeLocal(alias)
 		parts := strings.SplitN(norm, "|", 2)
 		if len(parts) != 2 {
-			logger.Debug().Str("alias", alias).Msg("room alias does not conform to expected format after normalization")
+			logger.Ctx(ctx).Debug().Str("alias", alias).Msg("room alias does not conform to expected format after normalization")
 			continue
 		}
 		left := strings.TrimSpace(parts[0])
@@ -485,16 +690,16 @@ func (s *MessageService) resolveRoomIDToOtherIdentifier(ctx context.Context, roo
 
 		var otherLocal string
 		if strings.EqualFold(left, me) {
-			logger.Debug().Str("my_matrix_id", myMatrixID).Str("other_localpart", right).Msg("resolved other participant from room alias")
+			logger.Ctx(ctx).Debug().Str("my_matrix_id", myMatrixID).Str("other_localpart", right).Msg("resolved other participant from room alias")
 			otherLocal = right
 		} else if strings.EqualFold(right, me) {
-			logger.Debug().Str("my_matrix_id", myMatrixID).Str("other_localpart", left).Msg("resolved other participant from room alias")
+			logger.Ctx(ctx).Debug().Str("my_matrix_id", myMatrixID).Str("other_localpart", left).Msg("resolved other participant from room alias")
 			otherLocal = left
 		} else {
 			continue
 		}
 
-		logger.Debug().Str("other_localpart", otherLocal).Msg("returning other participant localpart as identifier")
+		logger.Ctx(ctx).Debug().Str("other_localpart", otherLocal).Msg("returning other participant localpart as identifier")
 
 		// Now transform the other localpart to a matrix ID, then search inside mapping: return the number
 		s.mu.RLock()
@@ -506,7 +711,7 @@ func (s *MessageService) resolveRoomIDToOtherIdentifier(ctx context.Context, roo
 				if entry.Number != 0 {
 					identifier := fmt.Sprintf("%d", entry.Number)
 					s.roomParticipantCache.Set(cacheKey, identifier)
-					logger.Debug().Str("other_localpart", otherLocal).Int("number", entry.Number).Msg("resolved other participant to number from mapping and cached")
+					logger.Ctx(ctx).Debug().Str("other_localpart", otherLocal).Int("number", entry.Number).Msg("resolved other participant to number from mapping and cached")
 					return identifier
 				}
 			}
@@ -547,28 +752,33 @@ func generateRoomAliasKey(actingUserID id.UserID, targetUserID id.UserID) string
 func (s *MessageService) ensureDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID) (id.RoomID, error) {
 	key := generateRoomAliasKey(actingUserID, targetUserID)
 
-	logger.Debug().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Msg("ensuring direct room exists")
+	logger.Ctx(ctx).Debug().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Msg("ensuring direct room exists")
 
 	// Check cache first
 	if cachedRoomID := s.roomAliasCache.Get(key); cachedRoomID != "" {
-		logger.Debug().Str("alias", key).Str("room_id", cachedRoomID).Msg("direct room found in cache")
-		return id.RoomID(cachedRoomID), nil
+		logger.Ctx(ctx).Debug().Str("alias", key).Str("room_id", cachedRoomID).Msg("direct room found in cache")
+		return s.checkDirectRoom(ctx, actingUserID, targetUserID, key, id.RoomID(cachedRoomID))
 	}
 
 	// Search between existing rooms
-	logger.Debug().Str("key", key).Msg("Searching for direct room with alias")
+	logger.Ctx(ctx).Debug().Str("key", key).Msg("Searching for direct room with alias")
 	roomID := s.matrixClient.ResolveRoomAlias(ctx, key)
 	if roomID != "" {
 		s.roomAliasCache.Set(key, roomID)
-		logger.Debug().Str("alias", key).Str("room_id", roomID).Msg("direct room already exists and cached")
-		return id.RoomID(roomID), nil
+		logger.Ctx(ctx).Debug().Str("alias", key).Str("room_id", roomID).Msg("direct room already exists and cached")
+		return s.checkDirectRoom(ctx, actingUserID, targetUserID, key, id.RoomID(roomID))
 	}
 
+	return s.createDirectRoom(ctx, actingUserID, targetUserID, key)
+}
+
+// createDirectRoom creates the direct room of two users, with the alias key, and joins the target user.
+func (s *MessageService) createDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID, key string) (id.RoomID, error) {
 	// Create a new direct room with the alias
-	logger.Info().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Msg("creating new direct room")
+	logger.Ctx(ctx).Info().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Msg("creating new direct room")
 	resp, err := s.matrixClient.CreateDirectRoom(ctx, actingUserID, targetUserID, key)
 	if err != nil {
-		logger.Error().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Err(err).Msg("failed to create direct room")
+		logger.Ctx(ctx).Error().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Err(err).Msg("failed to create direct room")
 		return "", err
 	}
 
@@ -578,7 +788,7 @@ func (s *MessageService) ensureDirectRoom(ctx context.Context, actingUserID, tar
 	// Ensure the target user joins the room so they can see it in their sync
 	_, err = s.matrixClient.JoinRoom(ctx, targetUserID, resp.RoomID)
 	if err != nil {
-		logger.Error().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Str("room_id", string(resp.RoomID)).Err(err).Msg("target user failed to join room")
+		logger.Ctx(ctx).Error().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Str("room_id", string(resp.RoomID)).Err(err).Msg("target user failed to join room")
 		return "", fmt.Errorf("join room as target user: %w", err)
 	}
 
@@ -600,7 +810,11 @@ func (s *MessageService) setMapping(entry mappingEntry) mappingEntry {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	entry.UpdatedAt = s.now()
-	s.mappings[fmt.Sprintf("%d", entry.Number)] = entry
+	key := fmt.Sprintf("%d", entry.Number)
+	if _, exists := s.mappings[key]; !exists {
+		s.metrics.Mappings().Inc()
+	}
+	s.mappings[key] = entry
 	logger.Debug().Int("number", entry.Number).Str("room_id", string(entry.RoomID)).Msg("mapping stored")
 	return entry
 }
@@ -711,12 +925,11 @@ func isSentBy(sender, username string) bool {
 	return strings.EqualFold(normalizeMatrixID(sender), normalizeMatrixID(username))
 }
 
+// mapAuthErr maps the token errors of the homeserver to ErrHomeserverToken: requests to the homeserver
+// carry the as_token, never the credentials of the client.
 func mapAuthErr(err error) error {
-	if errors.Is(err, ErrAuthentication) {
-		return err
-	}
 	if errors.Is(err, mautrix.MUnknownToken) || errors.Is(err, mautrix.MMissingToken) {
-		return fmt.Errorf("%w", ErrAuthentication)
+		return fmt.Errorf("%w: %v", ErrHomeserverToken, err)
 	}
 	return err
 }
@@ -755,49 +968,63 @@ func isPhoneNumberRune(r rune) bool {
 // ReportPushToken saves a push token to the database.
 // It accepts selector, token_msgs, appid_msgs, token_calls, and appid_calls from the Acrobits client.
 func (s *MessageService) ReportPushToken(ctx context.Context, req *models.PushTokenReportRequest) (*models.PushTokenReportResponse, error) {
+	var attrs []attribute.KeyValue
+	if req != nil {
+		attrs = append(attrs,
+			tracing.AttrUsername.String(strings.TrimSpace(req.UserName)),
+			tracing.AttrSelector.String(strings.TrimSpace(req.Selector)),
+		)
+	}
+	ctx, span := tracing.Start(ctx, "push_token.report", attrs...)
+	resp, err := s.reportPushToken(ctx, req)
+	tracing.End(span, err)
+	return resp, err
+}
+
+func (s *MessageService) reportPushToken(ctx context.Context, req *models.PushTokenReportRequest) (*models.PushTokenReportResponse, error) {
 	if req == nil {
 		return nil, errors.New("request cannot be nil")
 	}
 
 	userName := strings.TrimSpace(req.UserName)
 	if userName == "" {
-		logger.Warn().Msg("push token report: empty username")
+		logger.Ctx(ctx).Warn().Msg("push token report: empty username")
 		return nil, errors.New("username is required")
 	}
 
 	selector := strings.TrimSpace(req.Selector)
 	if selector == "" {
-		logger.Warn().Msg("push token report: empty selector")
+		logger.Ctx(ctx).Warn().Msg("push token report: empty selector")
 		return nil, errors.New("selector is required")
 	}
 
 	// Require password field for push token reporting
 	password := strings.TrimSpace(req.Password)
 	if password == "" {
-		logger.Warn().Msg("push token report: empty password")
+		logger.Ctx(ctx).Warn().Msg("push token report: empty password")
 		return nil, errors.New("password is required")
 	}
 
 	if s.pushTokenDB == nil {
-		logger.Warn().Msg("push token report: database not initialized")
+		logger.Ctx(ctx).Warn().Msg("push token report: database not initialized")
 		return nil, errors.New("push token storage not available")
 	}
 
 	// Validate extension + secret with external auth via AuthClient
-	mappings, ok, err := s.authClient.Validate(ctx, userName, strings.TrimSpace(req.Password), s.homeserverHost)
+	mappings, _, err := s.authClient.Validate(ctx, userName, strings.TrimSpace(req.Password), s.homeserverHost)
 	if err != nil {
-		if !ok {
-			logger.Warn().Str("username", userName).Msg("external auth failed: unauthorized")
-			return nil, ErrAuthentication
+		if err = authError(err); errors.Is(err, ErrAuthentication) {
+			logger.Ctx(ctx).Warn().Str("username", userName).Msg("external auth failed: unauthorized")
+			return nil, err
 		}
-		logger.Error().Err(err).Msg("external auth request failed")
-		return nil, fmt.Errorf("external auth request failed: %w", err)
+		logger.Ctx(ctx).Error().Err(err).Msg("external auth request failed")
+		return nil, err
 	}
 
 	// Save all mappings from auth response
 	for _, mapReq := range mappings {
 		if _, err := s.SaveMapping(mapReq); err != nil {
-			logger.Error().Err(err).Msg("failed to save mapping from external auth response")
+			logger.Ctx(ctx).Error().Err(err).Msg("failed to save mapping from external auth response")
 			return nil, fmt.Errorf("failed to save mapping: %w", err)
 		}
 	}
@@ -810,18 +1037,34 @@ func (s *MessageService) ReportPushToken(ctx context.Context, req *models.PushTo
 		req.TokenCalls,
 		req.AppIDCalls,
 	); err != nil {
-		logger.Error().Err(err).Str("selector", selector).Msg("failed to save push token")
+		logger.Ctx(ctx).Error().Err(err).Str("selector", selector).Msg("failed to save push token")
 		return nil, fmt.Errorf("failed to save push token: %w", err)
 	}
 
-	logger.Info().Str("selector", selector).Msg("push token reported and saved")
+	logger.Ctx(ctx).Info().Str("selector", selector).Msg("push token reported and saved")
+
+	// The username finds the quiet hours of the user when its pushes are delivered
+	if err := s.pushTokenDB.SetPushTokenUser(selector, userName); err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("selector", selector).Msg("failed to store push token user")
+	}
+	// The platform and language shape the pushes of the device, see PushService.translateToAcrobits
+	platform, language := strings.ToLower(strings.TrimSpace(req.Platform)), normalizeLanguage(req.Language)
+	if err := s.pushTokenDB.SetPushTokenDevice(selector, platform, language); err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("selector", selector).Msg("failed to store push token platform")
+	}
+
+	gatewaySecret, err := s.ensureGatewaySecret(selector)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Str("selector", selector).Msg("failed to store push gateway secret")
+		return nil, fmt.Errorf("failed to store push gateway secret: %w", err)
+	}
 
 	// Register pusher with Matrix homeserver if we have a push token and proxy URL configured
 	if s.proxyURL != "" && req.TokenMsgs != "" {
 		// Resolve selector to Matrix user ID
-		matrixUserID := s.resolveMatrixUser(userName)
+		matrixUserID := s.resolveMatrixUser(ctx, userName)
 		if matrixUserID == "" {
-			logger.Warn().Str("selector", selector).Msg("could not resolve selector to Matrix user ID for pusher registration")
+			logger.Ctx(ctx).Warn().Str("selector", selector).Msg("could not resolve selector to Matrix user ID for pusher registration")
 		} else {
 			// Construct pusher registration request
 			httpKind := "http"
@@ -835,36 +1078,71 @@ func (s *MessageService) ReportPushToken(ctx context.Context, req *models.PushTo
 				Pushkey:           req.TokenMsgs,
 				Data: &models.PusherData{
 					Format: "event_id_only",
-					URL:    strings.TrimSuffix(s.proxyURL, "/") + "/_matrix/push/v1/notify",
+					URL:    pushGatewayURL(s.proxyURL, gatewaySecret),
 				},
 			}
 
 			// Call Matrix client to register pusher
 			if err := s.matrixClient.SetPusher(ctx, matrixUserID, pusherReq); err != nil {
 				// Log error but don't fail the request - push token was still saved
-				logger.Error().
+				logger.Ctx(ctx).Error().
 					Err(err).
 					Str("selector", selector).
 					Str("matrix_user_id", string(matrixUserID)).
-					Str("pushkey", req.TokenMsgs).
-					Str("gateway_url", pusherReq.Data.URL).
+					Str("pushkey", logger.Secret(req.TokenMsgs)).
+					Str("gateway_url", pushGatewayURL(s.proxyURL, "")).
 					Msg("failed to register pusher with Matrix homeserver")
 			} else {
-				logger.Info().
+				logger.Ctx(ctx).Info().
 					Str("selector", selector).
 					Str("matrix_user_id", string(matrixUserID)).
-					Str("pushkey", req.TokenMsgs).
-					Str("gateway_url", pusherReq.Data.URL).
+					Str("pushkey", logger.Secret(req.TokenMsgs)).
+					Str("gateway_url", pushGatewayURL(s.proxyURL, "")).
 					Msg("successfully registered pusher with Matrix homeserver")
 			}
 		}
 	} else if s.proxyURL == "" {
-		logger.Debug().Msg("PROXY_URL not configured, skipping pusher registration with Matrix")
+		logger.Ctx(ctx).Debug().Msg("PROXY_URL not configured, skipping pusher registration with Matrix")
 	}
 
 	return &models.PushTokenReportResponse{}, nil
 }
 
+// ensureGatewaySecret returns the push gateway secret of selector, generating and storing one
+// the first time. The secret is kept across reports so in-flight notifications stay valid.
+func (s *MessageService) ensureGatewaySecret(selector string) (string, error) {
+	token, err := s.pushTokenDB.GetPushToken(selector)
+	if err != nil {
+		return "", err
+	}
+	if token != nil && token.GatewaySecret != "" {
+		return token.GatewaySecret, nil
+	}
+	secret, err := generateGatewaySecret()
+	if err != nil {
+		return "", err
+	}
+	if err := s.pushTokenDB.SetGatewaySecret(selector, secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// pushGatewayURL builds the pusher data.url, carrying secret as a query parameter when set.
+// The push gateway spec fixes the path, so a path in proxyURL, such as the path_prefix of a
+// tenant, is dropped: the root of the host dispatches notifications to the tenants.
+func pushGatewayURL(proxyURL, secret string) string {
+	base := strings.TrimSuffix(proxyURL, "/")
+	if parsed, err := url.Parse(proxyURL); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		base = parsed.Scheme + "://" + parsed.Host
+	}
+	u := base + "/_matrix/push/v1/notify"
+	if secret != "" {
+		u += "?" + PushGatewaySecretParam + "=" + url.QueryEscape(secret)
+	}
+	return u
+}
+
 // getBatchToken retrieves the stored batch token for a user
 func (s *MessageService) getBatchToken(userID string) string {
 	s.mu.RLock()
@@ -879,9 +1157,15 @@ func (s *MessageService) setBatchToken(userID string, token string) {
 	s.batchTokens[userID] = token
 }
 
-// clearBatchToken removes the batch token for a user
+// clearBatchToken removes the batch token for a user, including the one saved by FlushBatchTokens
 func (s *MessageService) clearBatchToken(userID string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	delete(s.batchTokens, userID)
+	s.mu.Unlock()
+
+	if s.pushTokenDB != nil {
+		if err := s.pushTokenDB.DeleteBatchToken(userID); err != nil {
+			logger.Warn().Str("user_id", userID).Err(err).Msg("failed to delete saved batch token")
+		}
+	}
 }
@@ -2,7 +2,7 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -12,6 +12,7 @@ import (
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
 )
 
 func TestNewMessageService(t *testing.T) {
@@ -133,30 +134,37 @@ func TestConvertEvent(t *testing.T) {
 
 func TestMapAuthErr(t *testing.T) {
 	tests := []struct {
-		name      string
-		err       error
-		isAuthErr bool
+		name    string
+		err     error
+		isToken bool
 	}{
 		{
-			name:      "Already ErrAuthentication",
-			err:       ErrAuthentication,
-			isAuthErr: true,
+			name:    "Unknown token",
+			err:     mautrix.MUnknownToken,
+			isToken: true,
 		},
 		{
-			name:      "Generic error",
-			err:       assert.AnError,
-			isAuthErr: false,
+			name:    "Missing token",
+			err:     mautrix.MMissingToken,
+			isToken: true,
+		},
+		{
+			name:    "Client credentials",
+			err:     ErrAuthentication,
+			isToken: false,
+		},
+		{
+			name:    "Generic error",
+			err:     assert.AnError,
+			isToken: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			err := mapAuthErr(tt.err)
-			if tt.isAuthErr {
-				assert.Equal(t, ErrAuthentication, err)
-			} else {
-				assert.NotEqual(t, ErrAuthentication, err)
-			}
+			assert.Equal(t, tt.isToken, errors.Is(err, ErrHomeserverToken))
+			assert.False(t, tt.isToken && errors.Is(err, ErrAuthentication), "a token error is not a client authentication error")
 		})
 	}
 }
@@ -374,7 +382,7 @@ func TestResolveMatrixUser_SubNumbers(t *testing.T) {
 		})
 
 		// Resolve using a sub_number
-		result := svc.resolveMatrixUser("91201")
+		result := svc.resolveMatrixUser(context.TODO(), "91201")
 		assert.Equal(t, "@giacomo:example.com", string(result), "should resolve sub_number to matrix_id")
 	})
 
@@ -387,7 +395,7 @@ func TestResolveMatrixUser_SubNumbers(t *testing.T) {
 		})
 
 		// Resolve using the main number
-		result := svc.resolveMatrixUser("202")
+		result := svc.resolveMatrixUser(context.TODO(), "202")
 		assert.Equal(t, "@mario:example.com", string(result), "should resolve main number to matrix_id")
 	})
 
@@ -401,21 +409,21 @@ func TestResolveMatrixUser_SubNumbers(t *testing.T) {
 		})
 
 		// Resolve using a different sub_number
-		result := svc.resolveMatrixUser("3344")
+		result := svc.resolveMatrixUser(context.TODO(), "3344")
 		assert.Equal(t, "@giacomo:example.com", string(result), "should resolve any sub_number to matrix_id")
 	})
 
 	// Test case 4: Matrix ID passed directly
 	t.Run("matrix id passed directly", func(t *testing.T) {
 		svc := NewMessageService(nil, nil, "")
-		result := svc.resolveMatrixUser("@test:example.com")
+		result := svc.resolveMatrixUser(context.TODO(), "@test:example.com")
 		assert.Equal(t, "@test:example.com", string(result), "should return matrix_id as-is if it starts with @")
 	})
 
 	// Test case 5: No mapping found
 	t.Run("no mapping found", func(t *testing.T) {
 		svc := NewMessageService(nil, nil, "")
-		result := svc.resolveMatrixUser("9999")
+		result := svc.resolveMatrixUser(context.TODO(), "9999")
 		assert.Equal(t, "", string(result), "should return empty string if no mapping found")
 	})
 
@@ -429,7 +437,7 @@ func TestResolveMatrixUser_SubNumbers(t *testing.T) {
 		})
 
 		// Resolve with different case (though phone numbers are typically numeric)
-		result := svc.resolveMatrixUser("91201")
+		result := svc.resolveMatrixUser(context.TODO(), "91201")
 		assert.Equal(t, "@giacomo:example.com", string(result), "should resolve case-insensitively")
 	})
 }
@@ -446,7 +454,7 @@ func TestResolveMatrixIDToIdentifier_SubNumbers(t *testing.T) {
 		})
 
 		// Resolve using a sub_number - should return the main number
-		result := svc.resolveMatrixIDToIdentifier("@giacomo:example.com")
+		result := svc.resolveMatrixIDToIdentifier(context.TODO(), "@giacomo:example.com")
 		assert.Equal(t, "201", result, "should return main number when matrix_id matches via sub_number")
 	})
 
@@ -460,7 +468,7 @@ func TestResolveMatrixIDToIdentifier_SubNumbers(t *testing.T) {
 		})
 
 		// Resolve using the matrix_id - should return the main number
-		result := svc.resolveMatrixIDToIdentifier("@mario:example.com")
+		result := svc.resolveMatrixIDToIdentifier(context.TODO(), "@mario:example.com")
 		assert.Equal(t, "202", result, "should return main number when matrix_id matches")
 	})
 
@@ -475,7 +483,7 @@ func TestResolveMatrixIDToIdentifier_SubNumbers(t *testing.T) {
 		})
 
 		// Try to resolve using the main number
-		result := svc.resolveMatrixIDToIdentifier("@giacomo:example.com")
+		result := svc.resolveMatrixIDToIdentifier(context.TODO(), "@giacomo:example.com")
 		assert.Equal(t, "201", result)
 		assert.NotEqual(t, "3344", result, "should never return sub_number directly")
 		assert.NotEqual(t, "91201", result, "should never return sub_number directly")
@@ -492,14 +500,14 @@ func TestResolveMatrixIDToIdentifier_SubNumbers(t *testing.T) {
 		})
 
 		// Try with uppercase
-		result := svc.resolveMatrixIDToIdentifier("@GIACOMO:EXAMPLE.COM")
+		result := svc.resolveMatrixIDToIdentifier(context.TODO(), "@GIACOMO:EXAMPLE.COM")
 		assert.Equal(t, "201", result, "should match case-insensitively")
 	})
 
 	// Test case 6: No mapping found, return original matrix_id
 	t.Run("no mapping returns original matrix_id", func(t *testing.T) {
 		svc := NewMessageService(nil, nil, "")
-		result := svc.resolveMatrixIDToIdentifier("@unknown:example.com")
+		result := svc.resolveMatrixIDToIdentifier(context.TODO(), "@unknown:example.com")
 		assert.Equal(t, "@unknown:example.com", result, "should return original matrix_id when no mapping found")
 	})
 }
@@ -636,7 +644,7 @@ func (f *fakeAuthClient) Validate(ctx context.Context, extension, secret, homese
 			{Number: 1, MatrixID: "@alice:" + homeserverHost, SubNumbers: []int{}},
 		}, true, nil
 	}
-	return []*models.MappingRequest{}, false, fmt.Errorf("unauthorized")
+	return []*models.MappingRequest{}, false, ErrAuthentication
 }
 
 func TestReportPushToken_Auth401DoesNotSave(t *testing.T) {
@@ -666,3 +674,30 @@ func TestReportPushToken_Auth401DoesNotSave(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, token)
 }
+
+func TestBatchTokensSurviveRestart(t *testing.T) {
+	path := t.TempDir() + "/push_tokens.db"
+	dbi, err := db.NewDatabase(path)
+	require.NoError(t, err)
+
+	svc := NewMessageService(nil, dbi, "")
+	svc.setBatchToken("@alice:example.com", "s1")
+	svc.setBatchToken("@bob:example.com", "s2")
+	require.NoError(t, svc.Close())
+	require.NoError(t, dbi.Close())
+
+	dbi, err = db.NewDatabase(path)
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	svc = NewMessageService(nil, dbi, "")
+	defer svc.Close()
+	assert.Equal(t, "s1", svc.getBatchToken("@alice:example.com"))
+	assert.Equal(t, "s2", svc.getBatchToken("@bob:example.com"))
+
+	// A cleared token is not restored by the next start.
+	svc.clearBatchToken("@bob:example.com")
+	tokens, err := dbi.LoadBatchTokens()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"@alice:example.com": "s1"}, tokens)
+}
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultQueueMaxAge = time.Hour
+	// queuePollInterval is how often the queue looks for messages due for another attempt.
+	queuePollInterval = 5 * time.Second
+	// queueRetryMin and queueRetryMax bound the exponential backoff between attempts.
+	queueRetryMin = 5 * time.Second
+	queueRetryMax = 5 * time.Minute
+	// queueBatchSize is the number of messages attempted by each pass.
+	queueBatchSize      = 20
+	queueAttemptTimeout = 30 * time.Second
+	// queueCloseTimeout bounds the last delivery attempt made on shutdown.
+	queueCloseTimeout = 5 * time.Second
+	// queueRetention is how long a delivered message is remembered, to show it under its provisional ID,
+	// and a failed one, until its notice is known to be handed out.
+	queueRetention = 24 * time.Hour
+	// queueFailureExcerpt is the number of characters of the message quoted in the notice.
+	queueFailureExcerpt = 60
+)
+
+// outboundQueue runs the delivery of the messages accepted while the homeserver was unavailable.
+type outboundQueue struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startOutboundQueue starts delivering queued messages in the background, including the ones
+// left over by a previous run.
+func (s *MessageService) startOutboundQueue() {
+	s.queue = &outboundQueue{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.runOutboundQueue(s.queue)
+}
+
+// stopOutboundQueue stops the background delivery and makes a last attempt for the messages due.
+// Messages still queued stay in the database and are delivered after a restart.
+func (s *MessageService) stopOutboundQueue() {
+	if s.queue == nil {
+		return
+	}
+	close(s.queue.stop)
+	<-s.queue.done
+	s.queue = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), queueCloseTimeout)
+	defer cancel()
+	s.processOutboundQueue(ctx)
+	if n, err := s.pushTokenDB.CountOutboundMessages(); err == nil && n > 0 {
+		logger.Warn().Int("count", n).Msg("outbound messages still queued, delivery resumes at the next start")
+	}
+}
+
+func (s *MessageService) runOutboundQueue(q *outboundQueue) {
+	defer close(q.done)
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+		s.processOutboundQueue(context.Background())
+		if now := s.now(); now.Sub(lastPrune) > time.Hour {
+			lastPrune = now
+			if _, err := s.pushTokenDB.PruneOutboundMessages(now.Add(-queueRetention)); err != nil {
+				logger.Warn().Err(err).Msg("cannot prune outbound messages")
+			}
+		}
+	}
+}
+
+// processOutboundQueue attempts the delivery of the queued messages that are due.
+func (s *MessageService) processOutboundQueue(ctx context.Context) {
+	due, err := s.pushTokenDB.DueOutboundMessages(s.now(), queueBatchSize)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("cannot read the outbound queue")
+		return
+	}
+	for _, m := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		s.attemptOutbound(ctx, m)
+	}
+}
+
+// attemptOutbound sends a queued message. On failure it is attempted again with backoff, while
+// the homeserver is unavailable and the message is younger than the queue maximum age.
+func (s *MessageService) attemptOutbound(ctx context.Context, m *db.OutboundMessage) {
+	log := logger.Ctx(ctx).With().Str("message_id", m.ID).Str("sender", m.UserID).Logger()
+	var req models.SendMessageRequest
+	err := json.Unmarshal([]byte(m.Request), &req)
+	if err == nil && s.queuedAhead(ctx, id.UserID(m.UserID), strings.TrimSpace(req.To), m.ID) {
+		// The older messages to the recipient are sent first, this one is attempted at the next pass
+		log.Debug().Msg("older message to the recipient still queued, queued message kept")
+		return
+	}
+	if err != nil {
+		m.Status, m.LastError = db.OutboundFailed, fmt.Sprintf("invalid queued request: %v", err)
+	} else {
+		attemptCtx, cancel := context.WithTimeout(ctx, queueAttemptTimeout)
+		// The transaction ID is the provisional ID, so an attempt the homeserver received is never sent twice
+		eventID, err := s.deliverMessage(attemptCtx, id.UserID(m.UserID), strings.TrimSpace(req.To), &req, m.ID)
+		cancel()
+		m.Attempts++
+		switch {
+		case err == nil:
+			m.Status, m.EventID, m.LastError = db.OutboundSent, string(eventID), ""
+			log.Info().Str("event_id", m.EventID).Int("attempts", m.Attempts).Msg("queued message sent")
+		case matrix.IsUnavailable(err) && s.now().Sub(m.CreatedAt) < s.queueMaxAge:
+			m.NextAttempt, m.LastError = s.now().Add(queueRetryDelay(m.Attempts)), err.Error()
+			log.Debug().Err(err).Time("next_attempt", m.NextAttempt).Msg("homeserver still unavailable, queued message kept")
+		default:
+			m.Status, m.LastError = db.OutboundFailed, err.Error()
+		}
+	}
+	if m.Status == db.OutboundFailed {
+		log.Warn().Str("error", m.LastError).Int("attempts", m.Attempts).Msg("queued message not delivered, the sender is notified")
+	}
+	if err := s.pushTokenDB.UpdateOutboundMessage(m); err != nil {
+		log.Error().Err(err).Msg("cannot update queued message")
+	}
+}
+
+// queueRetryDelay is the backoff before the attempt following the given number of attempts.
+func queueRetryDelay(attempts int) time.Duration {
+	delay := queueRetryMin
+	for i := 1; i < attempts && delay < queueRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, queueRetryMax)
+}
+
+// enqueueMessage queues the message of req when sending failed because the homeserver is
+// unavailable, and returns the provisional message_id for the client: the transaction ID.
+// It reports false when the message is not queued and the error must reach the client.
+func (s *MessageService) enqueueMessage(ctx context.Context, sender id.UserID, req *models.SendMessageRequest, txnID string, sendErr error) (string, bool) {
+	if !s.queueEnabled || s.pushTokenDB == nil || !matrix.IsUnavailable(sendErr) {
+		return "", false
+	}
+	messageID, ok := s.storeOutbound(ctx, sender, req, txnID)
+	if ok {
+		logger.Ctx(ctx).Warn().Err(sendErr).Str("sender", string(sender)).Str("message_id", messageID).Msg("homeserver unavailable, message queued")
+	}
+	return messageID, ok
+}
+
+// enqueueBehind queues the message of req without sending it when sender has messages to
+// recipient still queued, so that they are delivered in order.
+func (s *MessageService) enqueueBehind(ctx context.Context, sender id.UserID, recipient string, req *models.SendMessageRequest, txnID string) (string, bool) {
+	if !s.queueEnabled || s.pushTokenDB == nil || !s.queuedAhead(ctx, sender, recipient, "") {
+		return "", false
+	}
+	messageID, ok := s.storeOutbound(ctx, sender, req, txnID)
+	if ok {
+		logger.Ctx(ctx).Info().Str("sender", string(sender)).Str("message_id", messageID).Msg("older messages to the recipient still queued, message queued behind them")
+	}
+	return messageID, ok
+}
+
+// queuedAhead reports whether sender has messages to recipient queued before the one with ID
+// messageID, or at all when messageID is empty.
+func (s *MessageService) queuedAhead(ctx context.Context, sender id.UserID, recipient, messageID string) bool {
+	queued, err := s.pushTokenDB.QueuedOutboundMessages(string(sender))
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("sender", string(sender)).Msg("cannot read the outbound queue")
+		return false
+	}
+	for _, m := range queued {
+		if m.ID == messageID {
+			return false
+		}
+		var req models.SendMessageRequest
+		if json.Unmarshal([]byte(m.Request), &req) == nil && strings.TrimSpace(req.To) == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// storeOutbound stores the message of req in the outbound queue and returns its provisional
+// message_id: the transaction ID.
+func (s *MessageService) storeOutbound(ctx context.Context, sender id.UserID, req *models.SendMessageRequest, txnID string) (string, bool) {
+	if txnID == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return "", false
+		}
+		txnID = txnIDPrefix + hex.EncodeToString(random)
+	}
+	stored := *req
+	stored.Password = ""
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return "", false
+	}
+
+	now := s.now()
+	if _, err := s.pushTokenDB.EnqueueOutboundMessage(db.OutboundMessage{
+		ID:          txnID,
+		UserID:      string(sender),
+		Request:     string(data),
+		NextAttempt: now.Add(queueRetryMin),
+		CreatedAt:   now,
+	}); err != nil {
+		logger.Ctx(ctx).Error().Err(err).Str("sender", string(sender)).Msg("cannot queue message")
+		return "", false
+	}
+	return txnID, true
+}
+
+// queuedMessage returns the provisional message_id of a message queued with one of txnIDs, or an
+// empty string.
+func (s *MessageService) queuedMessage(ctx context.Context, txnIDs []string) string {
+	if s.pushTokenDB == nil {
+		return ""
+	}
+	for _, txnID := range txnIDs {
+		m, err := s.pushTokenDB.GetOutboundMessage(txnID)
+		if err != nil {
+			logger.Ctx(ctx).Warn().Err(err).Str("txn_id", txnID).Msg("cannot look up queued message")
+			continue
+		}
+		if m != nil {
+			return m.ID
+		}
+	}
+	return ""
+}
+
+// resolveQueuedID returns the event of a message sent from the queue when messageID is its
+// provisional ID, and messageID otherwise.
+func (s *MessageService) resolveQueuedID(ctx context.Context, messageID string) string {
+	if s.pushTokenDB == nil || !strings.HasPrefix(messageID, txnIDPrefix) {
+		return messageID
+	}
+	m, err := s.pushTokenDB.GetOutboundMessage(messageID)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("message_id", messageID).Msg("cannot look up queued message")
+		return messageID
+	}
+	if m != nil && m.EventID != "" {
+		return m.EventID
+	}
+	return messageID
+}
+
+// reconcileOutbound shows the messages sent from the queue under the provisional ID the client
+// knows, and adds a notice from the recipient for each queued message that could not be sent.
+// A failed message is kept, marked notified, until the next fetch: the notice is then known to
+// have been handed out, or still waiting in the pages of the user. Pruning removes the others.
+func (s *MessageService) reconcileOutbound(ctx context.Context, userID id.UserID, callerIdentifier string, fetched []pendingSMS) []pendingSMS {
+	if s.pushTokenDB == nil {
+		return fetched
+	}
+	settled, err := s.pushTokenDB.SettledOutboundMessages(string(userID))
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("user_id", string(userID)).Msg("cannot read the outbound queue")
+		return fetched
+	}
+
+	provisional := make(map[string]string)
+	for _, m := range settled {
+		switch m.Status {
+		case db.OutboundSent:
+			provisional[m.EventID] = m.ID
+		case db.OutboundFailed:
+			m.Status = db.OutboundNotified
+			if err := s.pushTokenDB.UpdateOutboundMessage(m); err != nil {
+				// Without the mark the notice would be repeated: report it at the next fetch
+				logger.Ctx(ctx).Warn().Err(err).Str("message_id", m.ID).Msg("cannot mark failed queued message notified")
+				continue
+			}
+			fetched = append(fetched, s.failureNotice(ctx, m, callerIdentifier))
+		case db.OutboundNotified:
+			if err := s.pushTokenDB.DeleteOutboundMessage(m.ID); err != nil {
+				logger.Ctx(ctx).Warn().Err(err).Str("message_id", m.ID).Msg("cannot delete notified queued message")
+			}
+		}
+	}
+	for i := range fetched {
+		if messageID, ok := provisional[fetched[i].SMS.SMSID]; ok && fetched[i].Sent {
+			fetched[i].EventID, fetched[i].SMS.SMSID = fetched[i].SMS.SMSID, messageID
+		}
+	}
+	return fetched
+}
+
+// failureNotice is the message telling the sender that a queued message was not delivered,
+// shown in the conversation with its recipient in the language of the sender's device.
+func (s *MessageService) failureNotice(ctx context.Context, m *db.OutboundMessage, callerIdentifier string) pendingSMS {
+	var req models.SendMessageRequest
+	_ = json.Unmarshal([]byte(m.Request), &req)
+	texts := textsIn(s.deviceLanguage(ctx, strings.TrimSpace(req.From)), s.language)
+	excerpt := strings.TrimSpace(req.Body)
+	if utf8.RuneCountInString(excerpt) > queueFailureExcerpt {
+		excerpt = string([]rune(excerpt)[:queueFailureExcerpt]) + "…"
+	}
+	now := s.now()
+	return pendingSMS{
+		SMS: models.SMS{
+			SMSID:       m.ID + ".failed",
+			SendingDate: now.UTC().Format(time.RFC3339),
+			Sender:      strings.TrimSpace(req.To),
+			Recipient:   callerIdentifier,
+			SMSText:     fmt.Sprintf(texts.failed, excerpt),
+			ContentType: ContentTypeText,
+		},
+		Timestamp: now.UnixMilli(),
+	}
+}
+
+// deviceLanguage returns the language reported with the latest push token of userName, or an
+// empty string.
+func (s *MessageService) deviceLanguage(ctx context.Context, userName string) string {
+	tokens, err := s.pushTokenDB.ListPushTokens()
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("username", userName).Msg("cannot read the push tokens")
+		return ""
+	}
+	for _, token := range tokens {
+		if token.UserName == userName && token.Language != "" {
+			return token.Language
+		}
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newQueueService returns a message service queueing outbound messages, and its homeserver,
+// whose /sync returns the messages sent so far, with the given additional routes.
+func newQueueService(t *testing.T, routes homeserverRoutes) (*MessageService, *fakeHomeserver, *db.Database) {
+	t.Helper()
+	var homeserver *fakeHomeserver
+	routes = maps.Clone(routes)
+	if routes == nil {
+		routes = make(homeserverRoutes)
+	}
+	routes["GET /_matrix/client/v3/sync"] = func(w http.ResponseWriter, r *http.Request) {
+		events := make([]string, 0, len(homeserver.sent))
+		for i, eventID := range homeserver.sent {
+			events = append(events, fmt.Sprintf(`{"event_id":%q,"type":"m.room.message","sender":"@alice:example.com","origin_server_ts":%d,"content":{"msgtype":"m.text","body":"hello"}}`, eventID, 1000+i))
+		}
+		fmt.Fprintf(w, `{"next_batch":"s_next","rooms":{"join":{"!room:example.com":{"timeline":{"events":[%s]}}}}}`, strings.Join(events, ","))
+	}
+	client, homeserver := newFakeHomeserver(t, routes)
+	pushTokenDB, err := db.NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	t.Cleanup(func() { pushTokenDB.Close() })
+	svc := newMessageService(client, pushTokenDB, Config{QueueEnabled: true, SendDedupWindow: time.Minute}.withDefaults(), nil)
+	return svc, homeserver, pushTokenDB
+}
+
+func TestOutboundQueue(t *testing.T) {
+	ctx := context.TODO()
+	message := func(body string) *models.SendMessageRequest {
+		return &models.SendMessageRequest{From: "@alice:example.com", Password: "secret", To: "!room:example.com", Body: body}
+	}
+
+	t.Run("delivered when the homeserver is back", func(t *testing.T) {
+		svc, homeserver, pushTokenDB := newQueueService(t, nil)
+		now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+
+		homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+		resp, err := svc.SendMessage(ctx, message("hello"))
+		require.NoError(t, err)
+		provisional := resp.ID
+		assert.True(t, strings.HasPrefix(provisional, txnIDPrefix))
+
+		// A retry of the client gets the same provisional ID
+		retry, err := svc.SendMessage(ctx, message("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, provisional, retry.ID)
+
+		queued, err := pushTokenDB.GetOutboundMessage(provisional)
+		require.NoError(t, err)
+		assert.NotContains(t, queued.Request, "secret", "the password is not stored")
+
+		// Still down: the message is kept and attempted later
+		now = now.Add(10 * time.Second)
+		svc.processOutboundQueue(ctx)
+		queued, err = pushTokenDB.GetOutboundMessage(provisional)
+		require.NoError(t, err)
+		assert.Equal(t, db.OutboundQueued, queued.Status)
+		assert.Equal(t, 1, queued.Attempts)
+		assert.True(t, queued.NextAttempt.After(now))
+
+		homeserver.fail(0, "")
+		now = now.Add(time.Minute)
+		svc.processOutboundQueue(ctx)
+		queued, err = pushTokenDB.GetOutboundMessage(provisional)
+		require.NoError(t, err)
+		assert.Equal(t, db.OutboundSent, queued.Status)
+		assert.Equal(t, "$event1", queued.EventID)
+
+		// The next fetch shows the message under the ID the client knows
+		fetched, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		require.Len(t, fetched.SentSMSs, 1)
+		assert.Equal(t, provisional, fetched.SentSMSs[0].SMSID)
+	})
+
+	t.Run("read receipts", func(t *testing.T) {
+		receipts, markers := receiptsRoutes(t)
+		const readMarkers = "POST /_matrix/client/v3/rooms/{room}/read_markers"
+		svc, homeserver, _ := newQueueService(t, homeserverRoutes{readMarkers: receipts[readMarkers]})
+		svc.readReceipts = ReadReceiptsFetch
+		now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+
+		homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+		resp, err := svc.SendMessage(ctx, message("hello"))
+		require.NoError(t, err)
+		homeserver.fail(0, "")
+		now = now.Add(time.Minute)
+		svc.processOutboundQueue(ctx)
+
+		// The messages shown under their provisional ID are marked as read under their event
+		fetched, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		require.Len(t, fetched.SentSMSs, 1)
+		assert.Equal(t, resp.ID, fetched.SentSMSs[0].SMSID)
+		assert.Equal(t, []string{"!room:example.com $event1 $event1 as @alice:example.com"}, markers())
+
+		require.NoError(t, svc.MarkRead(ctx, &models.MarkReadRequest{Username: "@alice:example.com", SMSID: resp.ID, StreamID: "!room:example.com"}))
+		require.Len(t, markers(), 2)
+		assert.Equal(t, "!room:example.com $event1 $event1 as @alice:example.com", markers()[1])
+	})
+
+	t.Run("sender notified of a failure", func(t *testing.T) {
+		svc, homeserver, pushTokenDB := newQueueService(t, nil)
+		now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+
+		homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+		resp, err := svc.SendMessage(ctx, message("are you there?"))
+		require.NoError(t, err)
+
+		now = now.Add(2 * time.Hour)
+		svc.processOutboundQueue(ctx)
+		queued, err := pushTokenDB.GetOutboundMessage(resp.ID)
+		require.NoError(t, err)
+		assert.Equal(t, db.OutboundFailed, queued.Status)
+
+		homeserver.fail(0, "")
+		fetched, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		require.Len(t, fetched.ReceivedSMSs, 1)
+		assert.Equal(t, "Message not delivered: are you there?", fetched.ReceivedSMSs[0].SMSText)
+		assert.Equal(t, "!room:example.com", fetched.ReceivedSMSs[0].Sender)
+
+		// The failure is reported once; the message is dropped at the next fetch
+		queued, err = pushTokenDB.GetOutboundMessage(resp.ID)
+		require.NoError(t, err)
+		assert.Equal(t, db.OutboundNotified, queued.Status)
+
+		fetched, err = svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		assert.Empty(t, fetched.ReceivedSMSs)
+		queued, err = pushTokenDB.GetOutboundMessage(resp.ID)
+		require.NoError(t, err)
+		assert.Nil(t, queued)
+	})
+
+	t.Run("order kept", func(t *testing.T) {
+		svc, homeserver, pushTokenDB := newQueueService(t, nil)
+		now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+
+		homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+		first, err := svc.SendMessage(ctx, message("first"))
+		require.NoError(t, err)
+		for range 2 {
+			now = now.Add(10 * time.Second)
+			svc.processOutboundQueue(ctx)
+		}
+
+		// Back online, a new message to the recipient waits behind the queued one
+		homeserver.fail(0, "")
+		now = now.Add(time.Second)
+		second, err := svc.SendMessage(ctx, message("second"))
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(second.ID, txnIDPrefix))
+		other, err := svc.SendMessage(ctx, &models.SendMessageRequest{From: "@alice:example.com", To: "!other:example.com", Body: "elsewhere"})
+		require.NoError(t, err)
+		assert.False(t, strings.HasPrefix(other.ID, txnIDPrefix), "other recipients are not held")
+
+		// Only the second message is due, it is not sent before the first one
+		now = now.Add(6 * time.Second)
+		svc.processOutboundQueue(ctx)
+		queued, err := pushTokenDB.GetOutboundMessage(second.ID)
+		require.NoError(t, err)
+		assert.Equal(t, db.OutboundQueued, queued.Status)
+		assert.Zero(t, queued.Attempts)
+
+		now = now.Add(10 * time.Second)
+		svc.processOutboundQueue(ctx)
+		txnIDs := homeserver.txnIDs()
+		require.Len(t, txnIDs, 3)
+		assert.Equal(t, []string{first.ID, second.ID}, txnIDs[1:])
+	})
+
+	t.Run("failure notice in the language of the device", func(t *testing.T) {
+		svc, homeserver, pushTokenDB := newQueueService(t, nil)
+		now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		svc.now = func() time.Time { return now }
+		require.NoError(t, pushTokenDB.SavePushToken("sel", "token", "com.example.app", "", ""))
+		require.NoError(t, pushTokenDB.SetPushTokenUser("sel", "@alice:example.com"))
+		require.NoError(t, pushTokenDB.SetPushTokenDevice("sel", "ios", "it"))
+
+		homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+		_, err := svc.SendMessage(ctx, message("ci sei?"))
+		require.NoError(t, err)
+		now = now.Add(2 * time.Hour)
+		svc.processOutboundQueue(ctx)
+
+		homeserver.fail(0, "")
+		fetched, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		require.Len(t, fetched.ReceivedSMSs, 1)
+		assert.Equal(t, "Messaggio non consegnato: ci sei?", fetched.ReceivedSMSs[0].SMSText)
+	})
+
+	t.Run("other errors are not queued", func(t *testing.T) {
+		svc, homeserver, _ := newQueueService(t, nil)
+		homeserver.fail(http.StatusForbidden, "M_FORBIDDEN")
+		_, err := svc.SendMessage(ctx, message("hello"))
+		assert.Error(t, err)
+
+		svc.queueEnabled = false
+		homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+		_, err = svc.SendMessage(ctx, message("hello"))
+		assert.Error(t, err)
+	})
+}
+
+func TestOutboundQueue_Close(t *testing.T) {
+	svc, homeserver, pushTokenDB := newQueueService(t, nil)
+	homeserver.fail(http.StatusBadGateway, "M_UNKNOWN")
+	resp, err := svc.SendMessage(context.TODO(), &models.SendMessageRequest{From: "@alice:example.com", To: "!room:example.com", Body: "bye"})
+	require.NoError(t, err)
+
+	svc.now = func() time.Time { return time.Now().Add(time.Minute) }
+	svc.startOutboundQueue()
+	homeserver.fail(0, "")
+	// Closing makes a last attempt for the messages due
+	require.NoError(t, svc.Close())
+	queued, err := pushTokenDB.GetOutboundMessage(resp.ID)
+	require.NoError(t, err)
+	assert.Equal(t, db.OutboundSent, queued.Status)
+}
+
+func TestQueueRetryDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Second, queueRetryDelay(1))
+	assert.Equal(t, 10*time.Second, queueRetryDelay(2))
+	assert.Equal(t, 40*time.Second, queueRetryDelay(4))
+	assert.Equal(t, queueRetryMax, queueRetryDelay(20))
+}
@@ -8,12 +8,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/db"
 	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/metrics"
 	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
 )
 
 const acrobitsPushURL = "https://pnm.cloudsoftphone.com/pnm2/send"
@@ -27,6 +31,25 @@ var (
 type PushService struct {
 	pushTokenDB *db.Database
 	httpClient  *http.Client
+	// allowedSources are homeserver addresses allowed to notify without a pusher secret.
+	allowedSources []netip.Prefix
+	metrics        metrics.Tenant
+
+	// pnmURL is the Acrobits PNM send endpoint; tests replace it.
+	pnmURL string
+	now    func() time.Time
+	// language is the language of devices that did not report one; genericVerbApps are the
+	// AppIDs and platforms needing NotifyGenericTextMessage, see pushVerb.
+	language        string
+	genericVerbApps map[string]bool
+
+	mu sync.Mutex
+	// unread is the last unread count notified to each pushkey, see badgeOnly.
+	unread map[string]int
+	// coalesceWindow and windows merge bursts of pushes, see coalesce.
+	coalesceWindow time.Duration
+	windows        map[string]*pushWindow
+	closed         bool
 }
 
 // NewPushService creates a new push notification service
@@ -34,63 +57,99 @@ func NewPushService(pushTokenDB *db.Database) *PushService {
 	return &PushService{
 		pushTokenDB: pushTokenDB,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: tracing.Transport(nil),
 		},
+		pnmURL:          acrobitsPushURL,
+		now:             time.Now,
+		language:        pushLanguageFromEnv(),
+		genericVerbApps: genericVerbAppsFromEnv(),
+		unread:          make(map[string]int),
+		coalesceWindow:  pushCoalesceWindowFromEnv(),
+		windows:         make(map[string]*pushWindow),
 	}
 }
 
+// SetTenant labels the metrics of the service with the name of its tenant.
+func (s *PushService) SetTenant(name string) {
+	s.metrics = metrics.Tenant(name)
+}
+
 // HandleMatrixPushNotification processes a Matrix push notification and forwards it to Acrobits
 func (s *PushService) HandleMatrixPushNotification(ctx context.Context, req *models.MatrixPushNotifyRequest) (*models.MatrixPushNotifyResponse, error) {
-	logger.Debug().Interface("notification", req.Notification).Msg("processing matrix push notification")
+	ctx, span := tracing.Start(ctx, "push.notify",
+		tracing.AttrEventID.String(req.Notification.EventID),
+		tracing.AttrRoomID.String(req.Notification.RoomID),
+	)
+	resp, err := s.handleMatrixPushNotification(ctx, req)
+	tracing.End(span, err)
+	return resp, err
+}
+
+func (s *PushService) handleMatrixPushNotification(ctx context.Context, req *models.MatrixPushNotifyRequest) (*models.MatrixPushNotifyResponse, error) {
+	logger.Ctx(ctx).Debug().Interface("notification", req.Notification).Msg("processing matrix push notification")
 
 	rejected := make([]string, 0)
 
 	// Process each device in the notification
 	for _, device := range req.Notification.Devices {
-		logger.Debug().
-			Str("pushkey", device.Pushkey).
+		logger.Ctx(ctx).Debug().
+			Str("pushkey", logger.Secret(device.Pushkey)).
 			Str("app_id", device.AppID).
 			Msg("processing device for push notification")
 
 		// Look up the push token in our database using the pushkey
 		token, err := s.pushTokenDB.GetPushTokenByPushkey(device.Pushkey)
 		if err != nil {
-			logger.Error().
-				Str("pushkey", device.Pushkey).
+			logger.Ctx(ctx).Error().
+				Str("pushkey", logger.Secret(device.Pushkey)).
 				Err(err).
 				Msg("error looking up push token in database")
+			s.metrics.PushDelivery("failed")
 			rejected = append(rejected, device.Pushkey)
 			continue
 		}
 		if token == nil {
-			logger.Warn().
-				Str("pushkey", device.Pushkey).
+			logger.Ctx(ctx).Warn().
+				Str("pushkey", logger.Secret(device.Pushkey)).
 				Msg("push token not found in database, marking as rejected")
+			s.metrics.PushDelivery("rejected")
 			rejected = append(rejected, device.Pushkey)
 			continue
 		}
 
-		// Translate Matrix notification to Acrobits format
-		acrobitsReq := s.translateToAcrobits(req.Notification, device, token)
+		badgeOnly := s.badgeOnly(device.Pushkey, req.Notification)
+		if badgeOnly && req.Notification.Counts == nil {
+			logger.Ctx(ctx).Debug().Str("selector", token.Selector).Msg("counts-only notification without counts, nothing to push")
+			continue
+		}
 
-		// Send to Acrobits
-		if err := s.sendToAcrobits(ctx, acrobitsReq); err != nil {
-			logger.Error().
-				Str("pushkey", device.Pushkey).
-				Str("selector", token.Selector).
-				Err(err).
-				Msg("failed to send push notification to Acrobits")
-
-			// If Acrobits returns 404, the token is invalid
-			if errors.Is(err, ErrPushTokenNotFound) {
-				rejected = append(rejected, device.Pushkey)
-			}
-		} else {
-			logger.Info().
-				Str("pushkey", device.Pushkey).
+		// Translate Matrix notification to Acrobits format
+		acrobitsReq := s.translateToAcrobits(ctx, req.Notification, device, token, badgeOnly)
+
+		mode := pushNormal
+		switch {
+		case badgeOnly:
+			mode = pushBadgeOnly
+		case device.Tweaks["highlight"] == true:
+			mode = pushUrgent
+		case req.Notification.Prio == "low":
+			mode = pushLow
+		}
+		if mode == pushLow || (mode != pushBadgeOnly && s.inQuietHours(ctx, token)) {
+			acrobitsReq.Sound = ""
+		}
+		if s.coalesce(ctx, device.Pushkey, acrobitsReq, mode, s.textsFor(token.Language)) {
+			s.metrics.PushDelivery("coalesced")
+			logger.Ctx(ctx).Debug().
 				Str("selector", token.Selector).
 				Str("event_id", req.Notification.EventID).
-				Msg("push notification sent successfully to Acrobits")
+				Msg("push notification held for the coalesced summary")
+			continue
+		}
+
+		if s.deliver(ctx, acrobitsReq) {
+			rejected = append(rejected, device.Pushkey)
 		}
 	}
 
@@ -99,15 +158,76 @@ func (s *PushService) HandleMatrixPushNotification(ctx context.Context, req *mod
 	}, nil
 }
 
-// translateToAcrobits converts a Matrix notification to Acrobits push format
-func (s *PushService) translateToAcrobits(notification models.MatrixNotification, device models.MatrixDevice, token *db.PushToken) *models.AcrobitsPushRequest {
+// deliver sends a push to Acrobits PNM, recording the outcome. It reports whether PNM rejected
+// the device token, which is then reported to the homeserver.
+func (s *PushService) deliver(ctx context.Context, req *models.AcrobitsPushRequest) (rejected bool) {
+	req = forTransport(req)
+	if err := s.sendToAcrobits(ctx, req); err != nil {
+		logger.Ctx(ctx).Error().
+			Str("pushkey", logger.Secret(req.DeviceToken)).
+			Str("selector", req.Selector).
+			Err(err).
+			Msg("failed to send push notification to Acrobits")
+
+		// If Acrobits returns 404, the token is invalid
+		if errors.Is(err, ErrPushTokenNotFound) {
+			s.metrics.PushDelivery("rejected")
+			return true
+		}
+		s.metrics.PushDelivery("failed")
+		return false
+	}
+	s.metrics.PushDelivery("sent")
+	logger.Ctx(ctx).Info().
+		Str("pushkey", logger.Secret(req.DeviceToken)).
+		Str("selector", req.Selector).
+		Str("event_id", req.ID).
+		Bool("sound", req.Sound != "").
+		Msg("push notification sent successfully to Acrobits")
+	return false
+}
+
+// badgeOnly reports whether a notification only updates the badge of the device: counts-only
+// notifications, sent by the homeserver when messages are read elsewhere, and notifications whose
+// unread count went down. The unread count is remembered for the next notification of pushkey.
+func (s *PushService) badgeOnly(pushkey string, notification models.MatrixNotification) bool {
+	countsOnly := notification.EventID == ""
+	if notification.Counts == nil {
+		return countsOnly
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, known := s.unread[pushkey]
+	s.unread[pushkey] = notification.Counts.Unread
+	return countsOnly || (known && notification.Counts.Unread < previous)
+}
+
+// translateToAcrobits converts a Matrix notification to Acrobits push format.
+// A badgeOnly push carries the unread count alone: no text and no sound, so the phone updates
+// its badge silently. A message without body, as with event_id_only pushers or encrypted rooms,
+// gets a fallback text in the language of the device.
+func (s *PushService) translateToAcrobits(ctx context.Context, notification models.MatrixNotification, device models.MatrixDevice, token *db.PushToken, badgeOnly bool) *models.AcrobitsPushRequest {
 	req := &models.AcrobitsPushRequest{
-		Verb:        "NotifyTextMessage",
+		Verb:        s.pushVerb(token.AppIDMsgs, token.Platform),
 		AppID:       token.AppIDMsgs,
 		DeviceToken: token.TokenMsgs,
 		Selector:    token.Selector,
 	}
 
+	// Set badge count from unread messages
+	if notification.Counts != nil {
+		badge := notification.Counts.Unread
+		req.Badge = &badge
+	}
+
+	if badgeOnly {
+		req.ThreadID = notification.RoomID
+		logger.Ctx(ctx).Debug().
+			Interface("acrobits_request", req).
+			Msg("translated Matrix notification to silent Acrobits badge update")
+		return req
+	}
+
 	// Extract message body from content
 	if notification.Content != nil {
 		if body, ok := notification.Content["body"].(string); ok {
@@ -117,10 +237,8 @@ func (s *PushService) translateToAcrobits(notification models.MatrixNotification
 			req.ContentType = msgtype
 		}
 	}
-
-	// Set badge count from unread messages
-	if notification.Counts != nil {
-		req.Badge = notification.Counts.Unread
+	if req.Message == "" {
+		req.Message = s.textsFor(token.Language).fallback(req.ContentType)
 	}
 
 	// Set sender information
@@ -141,18 +259,16 @@ func (s *PushService) translateToAcrobits(notification models.MatrixNotification
 		req.ThreadID = notification.RoomID
 	}
 
-	// Determine sound from tweaks
+	// Determine sound from tweaks: push rules without a sound action notify silently
 	if device.Tweaks != nil {
 		if sound, ok := device.Tweaks["sound"].(string); ok && sound != "" {
 			req.Sound = sound
-		} else {
-			req.Sound = "default"
 		}
 	} else {
 		req.Sound = "default"
 	}
 
-	logger.Debug().
+	logger.Ctx(ctx).Debug().
 		Interface("acrobits_request", req).
 		Msg("translated Matrix notification to Acrobits format")
 
@@ -160,21 +276,24 @@ func (s *PushService) translateToAcrobits(notification models.MatrixNotification
 }
 
 // sendToAcrobits sends a push notification to the Acrobits PNM service
-func (s *PushService) sendToAcrobits(ctx context.Context, req *models.AcrobitsPushRequest) error {
+func (s *PushService) sendToAcrobits(ctx context.Context, req *models.AcrobitsPushRequest) (err error) {
+	ctx, span := tracing.Start(ctx, "pnm.send", tracing.AttrSelector.String(req.Selector))
+	defer func() { tracing.End(span, err) }()
+
 	body, err := json.Marshal(req)
 	if err != nil {
 		return fmt.Errorf("failed to marshal acrobits request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", acrobitsPushURL, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.pnmURL, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("failed to create http request: %w", err)
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	logger.Debug().
-		Str("url", acrobitsPushURL).
+	logger.Ctx(ctx).Debug().
+		Str("url", s.pnmURL).
 		Str("selector", req.Selector).
 		Msg("sending push notification to Acrobits PNM")
 
@@ -191,14 +310,14 @@ func (s *PushService) sendToAcrobits(ctx context.Context, req *models.AcrobitsPu
 
 	var acrobitsResp models.AcrobitsPushResponse
 	if err := json.Unmarshal(respBody, &acrobitsResp); err != nil {
-		logger.Warn().
+		logger.Ctx(ctx).Warn().
 			Str("response_body", string(respBody)).
 			Err(err).
 			Msg("failed to parse acrobits response")
 		return fmt.Errorf("failed to parse acrobits response: %w", err)
 	}
 
-	logger.Debug().
+	logger.Ctx(ctx).Debug().
 		Int("code", acrobitsResp.Code).
 		Str("response", acrobitsResp.Response).
 		Msg("received response from Acrobits PNM")
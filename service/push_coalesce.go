@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+// defaultPushCoalesceWindow is how long the pushes following a delivered one are merged by default.
+const defaultPushCoalesceWindow = 3 * time.Second
+
+// pushMode is how a push takes part in coalescing.
+type pushMode int
+
+const (
+	// pushNormal opens a window when none is open, and is delivered right away; otherwise it is held.
+	pushNormal pushMode = iota
+	// pushLow (prio "low") is never delivered on its own: it is always held for the summary.
+	pushLow
+	// pushUrgent (highlight tweak, e.g. a mention) is always delivered right away.
+	pushUrgent
+	// pushBadgeOnly is delivered right away and updates the badge of the summary.
+	pushBadgeOnly
+)
+
+// pushWindow collects the pushes of a device held during a coalescing window.
+type pushWindow struct {
+	pending []*models.AcrobitsPushRequest
+	// badge is the latest unread count notified in the window
+	badge *int
+	// sounded is set once a push with sound was delivered in the window, so the summary is silent
+	sounded bool
+	// texts are in the language of the device, for the summary
+	texts pushTexts
+	timer *time.Timer
+}
+
+// pushCoalesceWindowFromEnv reads PUSH_COALESCE_SECONDS; zero disables coalescing.
+func pushCoalesceWindowFromEnv() time.Duration {
+	if v := os.Getenv("PUSH_COALESCE_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			return time.Duration(parsed) * time.Second
+		}
+	}
+	return defaultPushCoalesceWindow
+}
+
+// SetCoalesceWindow sets how long the pushes following a delivered one are merged into a single
+// summary push per device; zero disables coalescing.
+func (s *PushService) SetCoalesceWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coalesceWindow = window
+}
+
+// coalesce reports whether req is held for the summary of the coalescing window of pushkey,
+// opening the window when needed. The summary is delivered when the window ends.
+func (s *PushService) coalesce(ctx context.Context, pushkey string, req *models.AcrobitsPushRequest, mode pushMode, texts pushTexts) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.coalesceWindow <= 0 || s.closed {
+		return false
+	}
+
+	w := s.windows[pushkey]
+	if w == nil {
+		if mode == pushBadgeOnly {
+			return false
+		}
+		w = &pushWindow{texts: texts}
+		s.windows[pushkey] = w
+		// The summary is delivered after the request is answered: keep the logger, not the deadline
+		flushCtx := context.WithoutCancel(ctx)
+		w.timer = time.AfterFunc(s.coalesceWindow, func() { s.flushWindow(flushCtx, pushkey) })
+		if mode != pushLow {
+			w.badge = req.Badge
+			w.sounded = req.Sound != ""
+			return false
+		}
+	}
+
+	if req.Badge != nil {
+		w.badge = req.Badge
+	}
+	switch mode {
+	case pushBadgeOnly:
+		return false
+	case pushUrgent:
+		w.sounded = w.sounded || req.Sound != ""
+		return false
+	}
+	w.pending = append(w.pending, req)
+	return true
+}
+
+// flushWindow closes the coalescing window of pushkey and delivers the summary of the held pushes.
+func (s *PushService) flushWindow(ctx context.Context, pushkey string) {
+	s.mu.Lock()
+	w := s.windows[pushkey]
+	delete(s.windows, pushkey)
+	s.mu.Unlock()
+	if w == nil || len(w.pending) == 0 {
+		return
+	}
+
+	summary := summarizePushes(w)
+	logger.Ctx(ctx).Debug().Str("selector", summary.Selector).Int("count", len(w.pending)).Msg("delivering coalesced push summary")
+	if s.deliver(ctx, summary) {
+		// The homeserver learns about the invalid token from the next notification
+		logger.Ctx(ctx).Warn().Str("selector", summary.Selector).Msg("coalesced push summary rejected by Acrobits")
+	}
+}
+
+// summarizePushes merges the pushes held in a window into one: a single push is delivered as is,
+// several ones become "3 new messages", naming the sender when they all come from the same one,
+// in the language of the device.
+func summarizePushes(w *pushWindow) *models.AcrobitsPushRequest {
+	last := w.pending[len(w.pending)-1]
+	summary := *last
+	summary.Badge = w.badge
+	if w.sounded {
+		summary.Sound = ""
+	} else {
+		for _, req := range w.pending {
+			if req.Sound != "" {
+				summary.Sound = req.Sound
+				break
+			}
+		}
+	}
+	if len(w.pending) == 1 {
+		return &summary
+	}
+
+	sender, thread := last.UserDisplayName, last.ThreadID
+	for _, req := range w.pending {
+		if req.UserDisplayName != sender {
+			sender = ""
+		}
+		if req.ThreadID != thread {
+			thread = ""
+		}
+	}
+	summary.Message = w.texts.summaryText(len(w.pending), sender)
+	// The summary already names the sender, which the generic verb would write again, see forTransport
+	if sender == "" || summary.Verb == verbGenericTextMessage {
+		summary.UserName, summary.UserDisplayName = "", ""
+	}
+	summary.ThreadID = thread
+	summary.ContentType = ""
+	return &summary
+}
+
+// Close delivers the summaries of the open coalescing windows, so no held push is lost on shutdown.
+// Later pushes are delivered without coalescing.
+func (s *PushService) Close() {
+	s.mu.Lock()
+	s.closed = true
+	pushkeys := make([]string, 0, len(s.windows))
+	for pushkey, w := range s.windows {
+		w.timer.Stop()
+		pushkeys = append(pushkeys, pushkey)
+	}
+	s.mu.Unlock()
+
+	for _, pushkey := range pushkeys {
+		s.flushWindow(context.Background(), pushkey)
+	}
+}
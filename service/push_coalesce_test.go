@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPNMRecorder returns a push service delivering to a fake Acrobits PNM, with one device
+// registered by user "201", and a function returning the pushes received so far.
+func newPNMRecorder(t *testing.T) (*PushService, *db.Database, func() []models.AcrobitsPushRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var pushes []models.AcrobitsPushRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var push models.AcrobitsPushRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&push))
+		mu.Lock()
+		pushes = append(pushes, push)
+		mu.Unlock()
+		w.Write([]byte(`{"code":200,"response":"ok"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	pushTokenDB, err := db.NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	t.Cleanup(func() { pushTokenDB.Close() })
+	require.NoError(t, pushTokenDB.SavePushToken("selector", "pushkey", "app", "", ""))
+	require.NoError(t, pushTokenDB.SetPushTokenUser("selector", "201"))
+
+	pushSvc := NewPushService(pushTokenDB)
+	pushSvc.pnmURL = server.URL
+	return pushSvc, pushTokenDB, func() []models.AcrobitsPushRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]models.AcrobitsPushRequest(nil), pushes...)
+	}
+}
+
+func notifyMessage(eventID, sender string, unread int, tweaks map[string]interface{}) *models.MatrixPushNotifyRequest {
+	return &models.MatrixPushNotifyRequest{Notification: models.MatrixNotification{
+		EventID:           eventID,
+		RoomID:            "!room:example.com",
+		Sender:            sender,
+		SenderDisplayName: sender,
+		Counts:            &models.MatrixCounts{Unread: unread},
+		Devices:           []models.MatrixDevice{{AppID: "app", Pushkey: "pushkey", Tweaks: tweaks}},
+	}}
+}
+
+func TestPushCoalescing(t *testing.T) {
+	ctx := context.TODO()
+	sound := map[string]interface{}{"sound": "default"}
+
+	t.Run("burst", func(t *testing.T) {
+		pushSvc, _, pushes := newPNMRecorder(t)
+		pushSvc.SetCoalesceWindow(time.Hour)
+		for i, eventID := range []string{"$1", "$2", "$3", "$4"} {
+			_, err := pushSvc.HandleMatrixPushNotification(ctx, notifyMessage(eventID, "201", i+1, sound))
+			require.NoError(t, err)
+		}
+		// Only the first push is delivered during the window
+		require.Len(t, pushes(), 1)
+		assert.Equal(t, "$1", pushes()[0].ID)
+		assert.Equal(t, "default", pushes()[0].Sound)
+
+		pushSvc.Close()
+		require.Len(t, pushes(), 2)
+		summary := pushes()[1]
+		assert.Equal(t, "3 new messages from 201", summary.Message)
+		assert.Equal(t, "$4", summary.ID)
+		assert.Equal(t, 4, *summary.Badge)
+		assert.Empty(t, summary.Sound, "the first push already played a sound")
+	})
+
+	t.Run("highlight and low priority", func(t *testing.T) {
+		pushSvc, _, pushes := newPNMRecorder(t)
+		pushSvc.SetCoalesceWindow(time.Hour)
+
+		low := notifyMessage("$1", "201", 1, sound)
+		low.Notification.Prio = "low"
+		_, err := pushSvc.HandleMatrixPushNotification(ctx, low)
+		require.NoError(t, err)
+		assert.Empty(t, pushes(), "low priority pushes wait for the summary")
+
+		_, err = pushSvc.HandleMatrixPushNotification(ctx, notifyMessage("$2", "202", 2, map[string]interface{}{"sound": "default", "highlight": true}))
+		require.NoError(t, err)
+		require.Len(t, pushes(), 1, "highlights are delivered right away")
+		assert.Equal(t, "$2", pushes()[0].ID)
+
+		pushSvc.Close()
+		require.Len(t, pushes(), 2)
+		assert.Equal(t, "$1", pushes()[1].ID)
+		assert.Empty(t, pushes()[1].Sound)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		pushSvc, _, pushes := newPNMRecorder(t)
+		pushSvc.SetCoalesceWindow(0)
+		for i, eventID := range []string{"$1", "$2"} {
+			_, err := pushSvc.HandleMatrixPushNotification(ctx, notifyMessage(eventID, "201", i+1, sound))
+			require.NoError(t, err)
+		}
+		assert.Len(t, pushes(), 2)
+	})
+
+	t.Run("window end", func(t *testing.T) {
+		pushSvc, _, pushes := newPNMRecorder(t)
+		pushSvc.SetCoalesceWindow(50 * time.Millisecond)
+		for i, eventID := range []string{"$1", "$2", "$3"} {
+			_, err := pushSvc.HandleMatrixPushNotification(ctx, notifyMessage(eventID, "201", i+1, sound))
+			require.NoError(t, err)
+		}
+		assert.Eventually(t, func() bool { return len(pushes()) == 2 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, "2 new messages from 201", pushes()[1].Message)
+	})
+}
+
+func TestPushQuietHours(t *testing.T) {
+	pushSvc, pushTokenDB, pushes := newPNMRecorder(t)
+	pushSvc.SetCoalesceWindow(0)
+	require.NoError(t, pushTokenDB.SaveQuietHours(db.QuietHours{User: "201", Start: "00:00", End: "00:00"}))
+
+	_, err := pushSvc.HandleMatrixPushNotification(context.TODO(), notifyMessage("$1", "202", 1, map[string]interface{}{"sound": "default"}))
+	require.NoError(t, err)
+	require.Len(t, pushes(), 1)
+	assert.Empty(t, pushes()[0].Sound, "pushes are silent during quiet hours")
+
+	_, err = pushTokenDB.DeleteQuietHours("201")
+	require.NoError(t, err)
+	_, err = pushSvc.HandleMatrixPushNotification(context.TODO(), notifyMessage("$2", "202", 2, map[string]interface{}{"sound": "default"}))
+	require.NoError(t, err)
+	assert.Equal(t, "default", pushes()[1].Sound)
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+// PushGatewaySecretParam is the query parameter of the pusher data.url carrying the per-pusher secret.
+const PushGatewaySecretParam = "secret"
+
+// ErrPushGatewayUnauthorized is returned when a notify request comes neither from an allowed
+// source address nor with the secret of the pushers it targets.
+var ErrPushGatewayUnauthorized = errors.New("push gateway request not authorized")
+
+// ParseSources parses a comma-separated list of IP addresses and CIDR prefixes.
+func ParseSources(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source prefix %q: %w", item, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address %q: %w", item, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// SetAllowedSources sets the homeserver addresses allowed to call the push gateway without a secret.
+func (s *PushService) SetAllowedSources(sources []netip.Prefix) {
+	s.allowedSources = sources
+}
+
+// OwnsPushkey reports whether pushkey belongs to a device registered with this service.
+func (s *PushService) OwnsPushkey(pushkey string) bool {
+	if s.pushTokenDB == nil {
+		return false
+	}
+	token, err := s.pushTokenDB.GetPushTokenByPushkey(pushkey)
+	return err == nil && token != nil
+}
+
+// AuthorizeNotify checks a push gateway request. It is accepted when remoteIP is an allowed
+// source, or when secret matches the stored secret of every known pushkey in the request.
+// Unknown pushkeys are left to HandleMatrixPushNotification, which rejects them.
+func (s *PushService) AuthorizeNotify(ctx context.Context, remoteIP, secret string, req *models.MatrixPushNotifyRequest) error {
+	if s.isAllowedSource(remoteIP) {
+		return nil
+	}
+	if secret == "" {
+		logger.Ctx(ctx).Warn().Str("remote_ip", remoteIP).Msg("push gateway: request without secret from untrusted source")
+		return ErrPushGatewayUnauthorized
+	}
+	if s.pushTokenDB == nil {
+		return ErrPushGatewayUnauthorized
+	}
+
+	for _, device := range req.Notification.Devices {
+		token, err := s.pushTokenDB.GetPushTokenByPushkey(device.Pushkey)
+		if err != nil {
+			return fmt.Errorf("failed to look up push token: %w", err)
+		}
+		if token == nil {
+			continue
+		}
+		if token.GatewaySecret == "" || subtle.ConstantTimeCompare([]byte(token.GatewaySecret), []byte(secret)) != 1 {
+			logger.Ctx(ctx).Warn().Str("remote_ip", remoteIP).Str("selector", token.Selector).Msg("push gateway: secret does not match pusher")
+			return ErrPushGatewayUnauthorized
+		}
+	}
+	return nil
+}
+
+func (s *PushService) isAllowedSource(remoteIP string) bool {
+	if len(s.allowedSources) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range s.allowedSources {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateGatewaySecret returns a random 256-bit hex secret.
+func generateGatewaySecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate gateway secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSources(t *testing.T) {
+	sources, err := ParseSources(" 192.0.2.10, 10.0.0.0/8 ,,::1,::ffff:198.51.100.1")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.10/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("198.51.100.1/32"),
+	}, sources)
+
+	sources, err = ParseSources("")
+	require.NoError(t, err)
+	assert.Empty(t, sources)
+
+	_, err = ParseSources("not-an-ip")
+	assert.Error(t, err)
+	_, err = ParseSources("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestAuthorizeNotify(t *testing.T) {
+	tmpDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer tmpDB.Close()
+
+	require.NoError(t, tmpDB.SavePushToken("sel-a", "pushkey-a", "app", "", ""))
+	require.NoError(t, tmpDB.SetGatewaySecret("sel-a", "secret-a"))
+	require.NoError(t, tmpDB.SavePushToken("sel-legacy", "pushkey-legacy", "app", "", ""))
+
+	notify := func(pushkeys ...string) *models.MatrixPushNotifyRequest {
+		req := &models.MatrixPushNotifyRequest{}
+		for _, pk := range pushkeys {
+			req.Notification.Devices = append(req.Notification.Devices, models.MatrixDevice{Pushkey: pk})
+		}
+		return req
+	}
+
+	pushSvc := NewPushService(tmpDB)
+	sources, err := ParseSources("192.0.2.0/24")
+	require.NoError(t, err)
+	pushSvc.SetAllowedSources(sources)
+
+	t.Run("allowed source without secret", func(t *testing.T) {
+		assert.NoError(t, pushSvc.AuthorizeNotify(context.TODO(), "192.0.2.7", "", notify("pushkey-a")))
+		assert.NoError(t, pushSvc.AuthorizeNotify(context.TODO(), "::ffff:192.0.2.7", "", notify("pushkey-legacy")))
+	})
+
+	t.Run("untrusted source without secret", func(t *testing.T) {
+		assert.ErrorIs(t, pushSvc.AuthorizeNotify(context.TODO(), "203.0.113.1", "", notify("pushkey-a")), ErrPushGatewayUnauthorized)
+	})
+
+	t.Run("matching secret", func(t *testing.T) {
+		assert.NoError(t, pushSvc.AuthorizeNotify(context.TODO(), "203.0.113.1", "secret-a", notify("pushkey-a")))
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		assert.ErrorIs(t, pushSvc.AuthorizeNotify(context.TODO(), "203.0.113.1", "secret-b", notify("pushkey-a")), ErrPushGatewayUnauthorized)
+	})
+
+	t.Run("secret of another pusher", func(t *testing.T) {
+		assert.ErrorIs(t, pushSvc.AuthorizeNotify(context.TODO(), "203.0.113.1", "secret-a", notify("pushkey-a", "pushkey-legacy")), ErrPushGatewayUnauthorized)
+	})
+
+	t.Run("unknown pushkey is left to the handler", func(t *testing.T) {
+		assert.NoError(t, pushSvc.AuthorizeNotify(context.TODO(), "203.0.113.1", "anything", notify("unknown")))
+	})
+}
+
+func TestEnsureGatewaySecret(t *testing.T) {
+	tmpDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer tmpDB.Close()
+	require.NoError(t, tmpDB.SavePushToken("sel", "pushkey", "app", "", ""))
+
+	svc := NewMessageService(nil, tmpDB, "")
+	first, err := svc.ensureGatewaySecret("sel")
+	require.NoError(t, err)
+	assert.Len(t, first, 64)
+
+	second, err := svc.ensureGatewaySecret("sel")
+	require.NoError(t, err)
+	assert.Equal(t, first, second, "secret must be stable across reports")
+
+	assert.Equal(t, "https://proxy.example.com/_matrix/push/v1/notify?secret="+first, pushGatewayURL("https://proxy.example.com/", first))
+	assert.Equal(t, "https://proxy.example.com/_matrix/push/v1/notify", pushGatewayURL("https://proxy.example.com", ""))
+	assert.Equal(t, "https://proxy.example.com/_matrix/push/v1/notify", pushGatewayURL("https://proxy.example.com/globex", ""), "the path prefix is not part of pusher URLs")
+}
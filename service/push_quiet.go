@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// ErrInvalidQuietHours is returned when a do-not-disturb schedule cannot be parsed.
+var ErrInvalidQuietHours = errors.New("invalid quiet hours")
+
+// ErrQuietHoursNotFound is returned when a user has no do-not-disturb schedule.
+var ErrQuietHoursNotFound = errors.New("quiet hours not found")
+
+// quietHoursLayout is the format of the start and end of a schedule.
+const quietHoursLayout = "15:04"
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// SetQuietHours validates and stores the do-not-disturb schedule of a user. During quiet hours
+// pushes are still delivered, but without sound.
+func (s *PushService) SetQuietHours(q db.QuietHours) (*db.QuietHours, error) {
+	q.User = strings.TrimSpace(q.User)
+	if q.User == "" {
+		return nil, fmt.Errorf("%w: user is required", ErrInvalidQuietHours)
+	}
+	for _, t := range []string{q.Start, q.End} {
+		if _, err := time.Parse(quietHoursLayout, t); err != nil {
+			return nil, fmt.Errorf("%w: time %q is not HH:MM", ErrInvalidQuietHours, t)
+		}
+	}
+	q.Timezone = strings.TrimSpace(q.Timezone)
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone %q", ErrInvalidQuietHours, q.Timezone)
+	}
+	days := make([]string, 0, len(q.Days))
+	for _, day := range q.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		if !slices.Contains(weekdays, day) {
+			return nil, fmt.Errorf("%w: unknown day %q", ErrInvalidQuietHours, day)
+		}
+		if !slices.Contains(days, day) {
+			days = append(days, day)
+		}
+	}
+	q.Days = days
+
+	if s.pushTokenDB == nil {
+		return nil, errors.New("push token storage not available")
+	}
+	if err := s.pushTokenDB.SaveQuietHours(q); err != nil {
+		return nil, err
+	}
+	logger.Info().Str("user", q.User).Str("start", q.Start).Str("end", q.End).Str("timezone", q.Timezone).Strs("days", q.Days).Msg("quiet hours set")
+	return s.pushTokenDB.GetQuietHours(q.User)
+}
+
+// ListQuietHours returns the do-not-disturb schedules of all users.
+func (s *PushService) ListQuietHours() ([]*db.QuietHours, error) {
+	if s.pushTokenDB == nil {
+		return nil, errors.New("push token storage not available")
+	}
+	return s.pushTokenDB.ListQuietHours()
+}
+
+// DeleteQuietHours removes the do-not-disturb schedule of a user.
+func (s *PushService) DeleteQuietHours(user string) error {
+	if s.pushTokenDB == nil {
+		return errors.New("push token storage not available")
+	}
+	deleted, err := s.pushTokenDB.DeleteQuietHours(strings.TrimSpace(user))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrQuietHoursNotFound
+	}
+	logger.Info().Str("user", user).Msg("quiet hours removed")
+	return nil
+}
+
+// inQuietHours reports whether the user of token is in its do-not-disturb schedule.
+func (s *PushService) inQuietHours(ctx context.Context, token *db.PushToken) bool {
+	if s.pushTokenDB == nil || token.UserName == "" {
+		return false
+	}
+	q, err := s.pushTokenDB.GetQuietHours(token.UserName)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("selector", token.Selector).Msg("failed to look up quiet hours")
+		return false
+	}
+	return q != nil && quietHoursActive(q, s.now())
+}
+
+// quietHoursActive reports whether now falls in the schedule q. A schedule ending before it starts
+// spans midnight and belongs to the day it starts on; one ending when it starts lasts the whole day.
+func quietHoursActive(q *db.QuietHours, now time.Time) bool {
+	start, err := time.Parse(quietHoursLayout, q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(quietHoursLayout, q.End)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return false
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+
+	onDay := func(t time.Time) bool {
+		return len(q.Days) == 0 || slices.Contains(q.Days, weekdays[t.Weekday()])
+	}
+	switch {
+	case from < to:
+		return minute >= from && minute < to && onDay(now)
+	case from > to:
+		if minute >= from {
+			return onDay(now)
+		}
+		return minute < to && onDay(now.AddDate(0, 0, -1))
+	default:
+		return onDay(now)
+	}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuietHoursActive(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	require.NoError(t, err)
+	at := func(day, clock string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", day+" "+clock, rome)
+		require.NoError(t, err)
+		return tm
+	}
+
+	overnight := &db.QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Rome", Days: []string{"fri"}}
+	// 2026-10-16 is a Friday
+	assert.False(t, quietHoursActive(overnight, at("2026-10-16", "21:59")))
+	assert.True(t, quietHoursActive(overnight, at("2026-10-16", "22:00")))
+	assert.True(t, quietHoursActive(overnight, at("2026-10-17", "06:59")), "the night started on Friday")
+	assert.False(t, quietHoursActive(overnight, at("2026-10-17", "07:00")))
+	assert.False(t, quietHoursActive(overnight, at("2026-10-17", "23:00")), "Saturday is not in the schedule")
+	assert.False(t, quietHoursActive(overnight, at("2026-10-16", "03:00")), "the night started on Thursday")
+
+	// The schedule is evaluated in its own timezone
+	lunch := &db.QuietHours{Start: "12:00", End: "13:00", Timezone: "Europe/Rome"}
+	assert.True(t, quietHoursActive(lunch, at("2026-10-16", "12:30").UTC()))
+	assert.False(t, quietHoursActive(&db.QuietHours{Start: "12:00", End: "13:00"}, at("2026-10-16", "12:30")))
+
+	assert.True(t, quietHoursActive(&db.QuietHours{Start: "00:00", End: "00:00", Days: []string{"fri"}}, at("2026-10-16", "18:00").UTC()))
+}
+
+func TestSetQuietHours(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(t.TempDir() + "/push_tokens.db")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+	pushSvc := NewPushService(pushTokenDB)
+
+	q, err := pushSvc.SetQuietHours(db.QuietHours{User: " 201 ", Start: "22:00", End: "07:00", Timezone: "Europe/Rome", Days: []string{"Monday", "tue", "mon"}})
+	require.NoError(t, err)
+	assert.Equal(t, "201", q.User)
+	assert.Equal(t, []string{"mon", "tue"}, q.Days)
+
+	for _, invalid := range []db.QuietHours{
+		{Start: "22:00", End: "07:00"},
+		{User: "201", Start: "25:00", End: "07:00"},
+		{User: "201", Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"},
+		{User: "201", Start: "22:00", End: "07:00", Days: []string{"someday"}},
+	} {
+		_, err := pushSvc.SetQuietHours(invalid)
+		assert.ErrorIs(t, err, ErrInvalidQuietHours)
+	}
+
+	require.NoError(t, pushSvc.DeleteQuietHours("201"))
+	assert.ErrorIs(t, pushSvc.DeleteQuietHours("201"), ErrQuietHoursNotFound)
+}
@@ -144,18 +144,62 @@ func TestHandleMatrixPushNotification(t *testing.T) {
 			AppIDCalls: "app.id.calls",
 		}
 
-		acrobitsReq := pushSvc.translateToAcrobits(notification, device, token)
+		acrobitsReq := pushSvc.translateToAcrobits(context.TODO(), notification, device, token, false)
 
 		assert.Equal(t, "NotifyTextMessage", acrobitsReq.Verb)
 		assert.Equal(t, "device-token-123", acrobitsReq.DeviceToken)
 		assert.Equal(t, "app.id.msgs", acrobitsReq.AppID)
 		assert.Equal(t, "selector123", acrobitsReq.Selector)
 		assert.Equal(t, "Test message", acrobitsReq.Message)
-		assert.Equal(t, 3, acrobitsReq.Badge)
+		require.NotNil(t, acrobitsReq.Badge)
+		assert.Equal(t, 3, *acrobitsReq.Badge)
 		assert.Equal(t, "Bob Smith", acrobitsReq.UserDisplayName)
 		assert.Equal(t, "@bob:example.org", acrobitsReq.UserName)
 		assert.Equal(t, "$xyz", acrobitsReq.ID)
 		assert.Equal(t, "!test:example.org", acrobitsReq.ThreadID)
 		assert.Equal(t, "bing", acrobitsReq.Sound)
 	})
+	t.Run("silent badge update", func(t *testing.T) {
+		pushSvc := NewPushService(tmpDB)
+
+		notification := models.MatrixNotification{
+			Counts: &models.MatrixCounts{Unread: 0},
+			RoomID: "!test:example.org",
+		}
+		device := models.MatrixDevice{AppID: "test.app.id", Pushkey: "test-pushkey", Tweaks: map[string]interface{}{"sound": "bing"}}
+		token := &db.PushToken{Selector: "selector123", TokenMsgs: "device-token-123", AppIDMsgs: "app.id.msgs"}
+
+		acrobitsReq := pushSvc.translateToAcrobits(context.TODO(), notification, device, token, true)
+
+		require.NotNil(t, acrobitsReq.Badge)
+		assert.Equal(t, 0, *acrobitsReq.Badge)
+		assert.Empty(t, acrobitsReq.Message)
+		assert.Empty(t, acrobitsReq.Sound)
+		assert.Empty(t, acrobitsReq.ID)
+
+		// A zero badge is sent, so the phone clears it
+		data, err := json.Marshal(acrobitsReq)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"Badge":0`)
+	})
+}
+
+func TestBadgeOnly(t *testing.T) {
+	pushSvc := NewPushService(nil)
+	message := func(unread int) models.MatrixNotification {
+		return models.MatrixNotification{EventID: "$event", Counts: &models.MatrixCounts{Unread: unread}}
+	}
+
+	assert.False(t, pushSvc.badgeOnly("key", message(2)))
+	assert.False(t, pushSvc.badgeOnly("key", message(3)))
+	// Messages were read elsewhere while a new one arrived
+	assert.True(t, pushSvc.badgeOnly("key", message(1)))
+	assert.False(t, pushSvc.badgeOnly("key", message(1)))
+
+	// Counts-only notifications never sound
+	assert.True(t, pushSvc.badgeOnly("key", models.MatrixNotification{Counts: &models.MatrixCounts{Unread: 0}}))
+	assert.True(t, pushSvc.badgeOnly("key", models.MatrixNotification{}))
+
+	// Counts are tracked per pushkey
+	assert.False(t, pushSvc.badgeOnly("other", message(0)))
 }
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+const (
+	verbTextMessage        = "NotifyTextMessage"
+	verbGenericTextMessage = "NotifyGenericTextMessage"
+
+	// maxPushMessageBytes caps Message: APNs and FCM payloads are limited to 4 KB, shared with
+	// the other fields and the envelope added by PNM.
+	maxPushMessageBytes = 2048
+	truncationMark      = "…"
+
+	defaultPushLanguage = "en"
+)
+
+// pushTexts are the texts the proxy writes in pushes, in one language.
+type pushTexts struct {
+	// message is the fallback for a notification without body; media have their own fallback.
+	message, image, video, audio, file, location string
+	// summary and summaryFrom format the coalesced pushes, see summarizePushes.
+	summary, summaryFrom string
+	// failed formats the notice of a queued message that could not be sent, see failureNotice.
+	failed string
+}
+
+// pushCatalog holds the texts by language; defaultPushLanguage covers the others.
+var pushCatalog = map[string]pushTexts{
+	"en": {
+		message: "New message", image: "Image", video: "Video", audio: "Audio message", file: "File", location: "Location",
+		summary: "%d new messages", summaryFrom: "%d new messages from %s",
+		failed: "Message not delivered: %s",
+	},
+	"it": {
+		message: "Nuovo messaggio", image: "Immagine", video: "Video", audio: "Messaggio audio", file: "File", location: "Posizione",
+		summary: "%d nuovi messaggi", summaryFrom: "%d nuovi messaggi da %s",
+		failed: "Messaggio non consegnato: %s",
+	},
+	"de": {
+		message: "Neue Nachricht", image: "Bild", video: "Video", audio: "Audionachricht", file: "Datei", location: "Standort",
+		summary: "%d neue Nachrichten", summaryFrom: "%d neue Nachrichten von %s",
+		failed: "Nachricht nicht zugestellt: %s",
+	},
+	"fr": {
+		message: "Nouveau message", image: "Image", video: "Vidéo", audio: "Message audio", file: "Fichier", location: "Position",
+		summary: "%d nouveaux messages", summaryFrom: "%d nouveaux messages de %s",
+		failed: "Message non remis : %s",
+	},
+	"es": {
+		message: "Nuevo mensaje", image: "Imagen", video: "Vídeo", audio: "Mensaje de audio", file: "Archivo", location: "Ubicación",
+		summary: "%d mensajes nuevos", summaryFrom: "%d mensajes nuevos de %s",
+		failed: "Mensaje no entregado: %s",
+	},
+}
+
+// normalizeLanguage reduces a language tag such as "it-IT" or "pt_BR" to its primary subtag.
+func normalizeLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
+
+// textsFor returns the texts in language, falling back to the default language of the service.
+func (s *PushService) textsFor(language string) pushTexts {
+	return textsIn(language, s.language)
+}
+
+// textsIn returns the texts in language, falling back to fallback and then to defaultPushLanguage.
+func textsIn(language, fallback string) pushTexts {
+	if texts, ok := pushCatalog[normalizeLanguage(language)]; ok {
+		return texts
+	}
+	if texts, ok := pushCatalog[fallback]; ok {
+		return texts
+	}
+	return pushCatalog[defaultPushLanguage]
+}
+
+// fallback returns the text shown for a message of msgtype without body, e.g. an encrypted one.
+func (t pushTexts) fallback(msgtype string) string {
+	switch msgtype {
+	case "m.image":
+		return t.image
+	case "m.video":
+		return t.video
+	case "m.audio":
+		return t.audio
+	case "m.file":
+		return t.file
+	case "m.location":
+		return t.location
+	}
+	return t.message
+}
+
+// summaryText describes count coalesced messages, from sender when they share one.
+func (t pushTexts) summaryText(count int, sender string) string {
+	if sender != "" {
+		return fmt.Sprintf(t.summaryFrom, count, sender)
+	}
+	return fmt.Sprintf(t.summary, count)
+}
+
+// pushLanguageFromEnv reads PUSH_LANGUAGE, the language of devices that did not report one.
+func pushLanguageFromEnv() string {
+	if language := normalizeLanguage(os.Getenv("PUSH_LANGUAGE")); language != "" {
+		return language
+	}
+	return defaultPushLanguage
+}
+
+// genericVerbAppsFromEnv reads PUSH_GENERIC_VERB_APPS, the AppIDs and platforms whose clients
+// only understand NotifyGenericTextMessage.
+func genericVerbAppsFromEnv() map[string]bool {
+	apps := make(map[string]bool)
+	for _, app := range strings.Split(os.Getenv("PUSH_GENERIC_VERB_APPS"), ",") {
+		if app = strings.TrimSpace(app); app != "" {
+			apps[strings.ToLower(app)] = true
+		}
+	}
+	return apps
+}
+
+// pushVerb chooses the verb understood by the client owning the push token.
+func (s *PushService) pushVerb(appID, platform string) string {
+	if s.genericVerbApps[strings.ToLower(appID)] || (platform != "" && s.genericVerbApps[strings.ToLower(platform)]) {
+		return verbGenericTextMessage
+	}
+	return verbTextMessage
+}
+
+// forTransport returns the push as sent to PNM: NotifyGenericTextMessage has no sender, thread
+// or id fields, so the sender is written in the message, and the message is truncated to
+// maxPushMessageBytes.
+func forTransport(req *models.AcrobitsPushRequest) *models.AcrobitsPushRequest {
+	out := *req
+	if out.Verb == verbGenericTextMessage {
+		if out.Message != "" && out.UserDisplayName != "" {
+			out.Message = out.UserDisplayName + ": " + out.Message
+		}
+		out.UserName, out.UserDisplayName, out.ContentType, out.ID, out.ThreadID = "", "", "", "", ""
+	}
+	out.Message = truncateUTF8(out.Message, maxPushMessageBytes)
+	return &out
+}
+
+// truncateUTF8 shortens s to at most limit bytes, marking the cut, without splitting a character.
+func truncateUTF8(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	cut := limit - len(truncationMark)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncationMark
+}
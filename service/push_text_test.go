@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	assert.Equal(t, "short", truncateUTF8("short", 10))
+	assert.Equal(t, "abcdefg…", truncateUTF8("abcdefghijklmnop", 10))
+
+	// A cut in the middle of a character moves back to its start
+	long := strings.Repeat("è", maxPushMessageBytes)
+	truncated := truncateUTF8(long, maxPushMessageBytes)
+	assert.True(t, utf8.ValidString(truncated))
+	assert.LessOrEqual(t, len(truncated), maxPushMessageBytes)
+	assert.True(t, strings.HasSuffix(truncated, truncationMark))
+
+	emoji := strings.Repeat("😀", 10)
+	assert.Equal(t, "😀…", truncateUTF8(emoji, 9))
+}
+
+func TestPushVerb(t *testing.T) {
+	t.Setenv("PUSH_GENERIC_VERB_APPS", "com.example.Legacy, android")
+	pushSvc := NewPushService(nil)
+
+	assert.Equal(t, verbTextMessage, pushSvc.pushVerb("com.example.app", "ios"))
+	assert.Equal(t, verbTextMessage, pushSvc.pushVerb("com.example.app", ""))
+	assert.Equal(t, verbGenericTextMessage, pushSvc.pushVerb("com.example.legacy", "ios"))
+	assert.Equal(t, verbGenericTextMessage, pushSvc.pushVerb("com.example.app", "Android"))
+}
+
+func TestForTransport(t *testing.T) {
+	req := &models.AcrobitsPushRequest{
+		Verb:            verbGenericTextMessage,
+		UserName:        "@bob:example.org",
+		UserDisplayName: "Bob",
+		Message:         "Hello",
+		ContentType:     "m.text",
+		ID:              "$event",
+		ThreadID:        "!room:example.org",
+	}
+	out := forTransport(req)
+	assert.Equal(t, "Bob: Hello", out.Message)
+	assert.Empty(t, out.UserName)
+	assert.Empty(t, out.ID)
+	assert.Empty(t, out.ThreadID)
+	assert.Equal(t, "Hello", req.Message, "the original push is left untouched")
+
+	req = &models.AcrobitsPushRequest{Verb: verbTextMessage, UserDisplayName: "Bob", Message: strings.Repeat("a", 5000), ID: "$event"}
+	out = forTransport(req)
+	assert.Len(t, out.Message, maxPushMessageBytes)
+	assert.Equal(t, "Bob", out.UserDisplayName)
+	assert.Equal(t, "$event", out.ID)
+}
+
+func TestPushFallbackText(t *testing.T) {
+	t.Setenv("PUSH_LANGUAGE", "de-DE")
+	pushSvc := NewPushService(nil)
+	device := models.MatrixDevice{Pushkey: "pushkey"}
+	translate := func(content map[string]interface{}, language string) string {
+		token := &db.PushToken{Selector: "selector", TokenMsgs: "pushkey", Language: language}
+		notification := models.MatrixNotification{EventID: "$event", Content: content}
+		return pushSvc.translateToAcrobits(context.TODO(), notification, device, token, false).Message
+	}
+
+	assert.Equal(t, "Hello", translate(map[string]interface{}{"msgtype": "m.text", "body": "Hello"}, "it"))
+	assert.Equal(t, "Nuovo messaggio", translate(nil, "it"))
+	assert.Equal(t, "Immagine", translate(map[string]interface{}{"msgtype": "m.image"}, "it-IT"))
+	assert.Equal(t, "Neue Nachricht", translate(nil, ""), "devices without language use PUSH_LANGUAGE")
+	assert.Equal(t, "Neue Nachricht", translate(nil, "xx"))
+}
+
+func TestPushGenericVerbDelivery(t *testing.T) {
+	t.Setenv("PUSH_GENERIC_VERB_APPS", "android")
+	pushSvc, pushTokenDB, pushes := newPNMRecorder(t)
+	require.NoError(t, pushTokenDB.SetPushTokenDevice("selector", "android", "it"))
+	pushSvc.SetCoalesceWindow(time.Hour)
+
+	for i, eventID := range []string{"$1", "$2", "$3"} {
+		_, err := pushSvc.HandleMatrixPushNotification(context.TODO(), notifyMessage(eventID, "Bob", i+1, nil))
+		require.NoError(t, err)
+	}
+	pushSvc.Close()
+
+	require.Len(t, pushes(), 2)
+	assert.Equal(t, verbGenericTextMessage, pushes()[0].Verb)
+	assert.Equal(t, "Bob: Nuovo messaggio", pushes()[0].Message)
+	assert.Empty(t, pushes()[0].ID)
+	assert.Equal(t, "2 nuovi messaggi da Bob", pushes()[1].Message)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"maunium.net/go/mautrix/id"
+)
+
+// Read receipt policies, see Config.ReadReceipts.
+const (
+	// ReadReceiptsFetch marks messages as read as soon as fetch_messages delivers them.
+	ReadReceiptsFetch = "fetch"
+	// ReadReceiptsNotification marks messages as read only when the client acknowledges them through mark_read,
+	// e.g. when their notification is displayed.
+	ReadReceiptsNotification = "notification"
+	// ReadReceiptsNever leaves the read markers to Matrix clients.
+	ReadReceiptsNever = "never"
+)
+
+// ErrInvalidReceipt is returned when a read acknowledgement does not name the message it refers to.
+var ErrInvalidReceipt = errors.New("sms_id and stream_id are required")
+
+// markDelivered moves the read markers of userID to the latest message of each room of a fetched page,
+// when the policy is ReadReceiptsFetch. The page is ordered by timestamp.
+func (s *MessageService) markDelivered(ctx context.Context, userID id.UserID, page []pendingSMS) {
+	if s.readReceipts != ReadReceiptsFetch {
+		return
+	}
+	latest := make(map[id.RoomID]id.EventID)
+	var roomIDs []id.RoomID
+	for _, msg := range page {
+		roomID := id.RoomID(msg.SMS.StreamID)
+		if roomID == "" || msg.SMS.SMSID == "" {
+			continue
+		}
+		if _, ok := latest[roomID]; !ok {
+			roomIDs = append(roomIDs, roomID)
+		}
+		latest[roomID] = id.EventID(msg.SMS.SMSID)
+		if msg.EventID != "" {
+			latest[roomID] = id.EventID(msg.EventID)
+		}
+	}
+	for _, roomID := range roomIDs {
+		// A failed receipt only leaves the room unread in Matrix clients: the messages are delivered anyway
+		if err := s.matrixClient.MarkRead(ctx, userID, roomID, latest[roomID]); err != nil {
+			logger.Ctx(ctx).Warn().Err(err).Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("failed to mark fetched messages as read")
+		}
+	}
+}
+
+// MarkRead acknowledges a message displayed by the client: the read markers of the user move to it.
+// With the ReadReceiptsNever policy the acknowledgement is accepted and ignored.
+func (s *MessageService) MarkRead(ctx context.Context, req *models.MarkReadRequest) error {
+	var attrs []attribute.KeyValue
+	if req != nil {
+		attrs = append(attrs, tracing.AttrUsername.String(strings.TrimSpace(req.Username)))
+	}
+	ctx, span := tracing.Start(ctx, "message.mark_read", attrs...)
+	err := s.markRead(ctx, req)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *MessageService) markRead(ctx context.Context, req *models.MarkReadRequest) error {
+	userID, err := s.authenticateUser(ctx, req.Username, req.Password)
+	if err != nil {
+		return err
+	}
+	tracing.SetAttributes(ctx, tracing.AttrUserID.String(string(userID)))
+
+	smsID, streamID := strings.TrimSpace(req.SMSID), strings.TrimSpace(req.StreamID)
+	if smsID == "" || streamID == "" {
+		return ErrInvalidReceipt
+	}
+	if s.readReceipts == ReadReceiptsNever {
+		logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("sms_id", smsID).Msg("read receipts disabled, acknowledgement ignored")
+		return nil
+	}
+	// A message sent from the outbound queue is acknowledged under its provisional ID
+	smsID = s.resolveQueuedID(ctx, smsID)
+	if err := s.matrixClient.MarkRead(ctx, userID, id.RoomID(streamID), id.EventID(smsID)); err != nil {
+		logger.Ctx(ctx).Error().Err(err).Str("user_id", string(userID)).Str("room_id", streamID).Str("sms_id", smsID).Msg("failed to mark message as read")
+		return fmt.Errorf("mark read: %w", mapAuthErr(err))
+	}
+	logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", streamID).Str("sms_id", smsID).Msg("message marked as read")
+	return nil
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiptsRoutes returns homeserver routes answering /sync with two rooms and recording the read
+// markers set, and the markers recorded, as "<room> <m.read> <m.fully_read> as <user>".
+func receiptsRoutes(t *testing.T) (homeserverRoutes, func() []string) {
+	var mu sync.Mutex
+	var markers []string
+	routes := homeserverRoutes{
+		"GET /_matrix/client/v3/sync": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"next_batch":"s_next","rooms":{"join":{
+				"!a:example.com":{"timeline":{"events":[
+					{"event_id":"$a1","type":"m.room.message","sender":"@carol:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"a1"}},
+					{"event_id":"$a3","type":"m.room.message","sender":"@alice:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"a3"}}
+				]}},
+				"!b:example.com":{"timeline":{"events":[
+					{"event_id":"$b2","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"b2"}}
+				]}}
+			}}}`))
+		},
+		"POST /_matrix/client/v3/rooms/{room}/read_markers": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			mu.Lock()
+			markers = append(markers, r.PathValue("room")+" "+body["m.read"]+" "+body["m.fully_read"]+" as "+r.URL.Query().Get("user_id"))
+			mu.Unlock()
+			w.Write([]byte(`{}`))
+		},
+	}
+	return routes, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), markers...)
+	}
+}
+
+func TestFetchMessages_ReadReceipts(t *testing.T) {
+	ctx := context.TODO()
+
+	t.Run("fetch", func(t *testing.T) {
+		routes, markers := receiptsRoutes(t)
+		client, _ := newFakeHomeserver(t, routes)
+		svc := newMessageService(client, nil, Config{ReadReceipts: ReadReceiptsFetch}.withDefaults(), nil)
+		_, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		// The latest delivered message of each room, sent or received
+		assert.ElementsMatch(t, []string{
+			"!a:example.com $a3 $a3 as @alice:example.com",
+			"!b:example.com $b2 $b2 as @alice:example.com",
+		}, markers())
+	})
+
+	t.Run("only delivered pages", func(t *testing.T) {
+		routes, markers := receiptsRoutes(t)
+		client, _ := newFakeHomeserver(t, routes)
+		svc := newMessageService(client, nil, Config{ReadReceipts: ReadReceiptsFetch, FetchPageSize: 2}.withDefaults(), nil)
+		_, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{
+			"!a:example.com $a1 $a1 as @alice:example.com",
+			"!b:example.com $b2 $b2 as @alice:example.com",
+		}, markers())
+
+		_, err = svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+		require.NoError(t, err)
+		assert.Equal(t, "!a:example.com $a3 $a3 as @alice:example.com", markers()[2])
+	})
+
+	for _, policy := range []string{ReadReceiptsNotification, ReadReceiptsNever} {
+		t.Run(policy, func(t *testing.T) {
+			routes, markers := receiptsRoutes(t)
+			client, _ := newFakeHomeserver(t, routes)
+			svc := newMessageService(client, nil, Config{ReadReceipts: policy}.withDefaults(), nil)
+			_, err := svc.FetchMessages(ctx, &models.FetchMessagesRequest{Username: "@alice:example.com"})
+			require.NoError(t, err)
+			assert.Empty(t, markers())
+		})
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+	ctx := context.TODO()
+	req := &models.MarkReadRequest{Username: "@alice:example.com", SMSID: "$b2", StreamID: "!b:example.com"}
+
+	routes, markers := receiptsRoutes(t)
+	client, _ := newFakeHomeserver(t, routes)
+	svc := newMessageService(client, nil, Config{ReadReceipts: ReadReceiptsNotification}.withDefaults(), nil)
+	require.NoError(t, svc.MarkRead(ctx, req))
+	assert.Equal(t, []string{"!b:example.com $b2 $b2 as @alice:example.com"}, markers())
+
+	err := svc.MarkRead(ctx, &models.MarkReadRequest{Username: "@alice:example.com", SMSID: "$b2"})
+	assert.ErrorIs(t, err, ErrInvalidReceipt)
+
+	err = svc.MarkRead(ctx, &models.MarkReadRequest{SMSID: "$b2", StreamID: "!b:example.com"})
+	assert.ErrorIs(t, err, ErrAuthentication)
+
+	// Acknowledgements are accepted but ignored when receipts are disabled
+	routes, markers = receiptsRoutes(t)
+	client, _ = newFakeHomeserver(t, routes)
+	svc = newMessageService(client, nil, Config{ReadReceipts: ReadReceiptsNever}.withDefaults(), nil)
+	require.NoError(t, svc.MarkRead(ctx, req))
+	assert.Empty(t, markers())
+}
+
+func TestConfigFromEnv_ReadReceipts(t *testing.T) {
+	t.Setenv("READ_RECEIPTS", "")
+	assert.Equal(t, ReadReceiptsNever, ConfigFromEnv("").withDefaults().ReadReceipts)
+
+	t.Setenv("READ_RECEIPTS", " Notification ")
+	assert.Equal(t, ReadReceiptsNotification, ConfigFromEnv("").withDefaults().ReadReceipts)
+
+	t.Setenv("READ_RECEIPTS", "sometimes")
+	assert.Equal(t, ReadReceiptsNever, ConfigFromEnv("").withDefaults().ReadReceipts)
+
+	t.Setenv("READ_RECEIPTS", "fetch")
+	assert.Equal(t, ReadReceiptsFetch, ConfigFromEnv("").withDefaults().ReadReceipts)
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Supported ways of showing messages redacted on Matrix.
+const (
+	// RedactionHide drops redacted messages from the fetched messages.
+	RedactionHide = "hide"
+	// RedactionPlaceholder delivers redacted messages with the placeholder text, so the phone
+	// shows that they were deleted.
+	RedactionPlaceholder = "placeholder"
+)
+
+const (
+	defaultRedactionPlaceholder     = "Message deleted"
+	defaultUndecryptablePlaceholder = "Unable to decrypt this message"
+)
+
+var (
+	// ErrInvalidEdit is returned when a message cannot replace the one it references.
+	ErrInvalidEdit = errors.New("message cannot be edited")
+	// ErrInvalidContent is returned when the body of a message does not match its content type.
+	ErrInvalidContent = errors.New("invalid message content")
+)
+
+// timelineMessage is a message of a room timeline as delivered to Acrobits,
+// once edits, reply fallbacks and redactions are applied.
+type timelineMessage struct {
+	ID        id.EventID
+	Sender    id.UserID
+	Timestamp int64
+	MsgType   event.MessageType
+	// ContentType is the Acrobits content type of Body, see acrobitsContent.
+	ContentType string
+	Body        string
+}
+
+// collapseTimeline turns the events of a room timeline into the messages delivered to Acrobits:
+//   - m.replace edits are folded into the message they edit, which carries the latest text;
+//     when the original is not part of the batch, only the latest edit is delivered;
+//   - the content is converted by acrobitsContent, which strips reply fallback quotes;
+//   - polls are delivered as text;
+//   - encrypted messages left encrypted, because encryption is disabled or the keys are missing,
+//     are delivered with the undecryptable placeholder;
+//   - redacted messages are hidden or replaced with the placeholder, depending on the redaction mode.
+//     A redaction of a message delivered by an earlier fetch yields a placeholder message with
+//     the ID of the redaction event.
+func (s *MessageService) collapseTimeline(ctx context.Context, userID id.UserID, roomID id.RoomID, events []*event.Event) []timelineMessage {
+	messages := make(map[id.EventID]*event.MessageEventContent)
+	senders := make(map[id.EventID]id.UserID)
+	redacted := make(map[id.EventID]bool)
+	latestEdit := make(map[id.EventID]*event.Event)
+	encrypted := make(map[id.EventID]bool)
+
+	for _, evt := range events {
+		switch evt.Type {
+		case event.EventMessage, event.EventSticker:
+			if msg := messageContent(evt); msg != nil {
+				messages[evt.ID] = msg
+				senders[evt.ID] = evt.Sender
+			}
+		case event.EventEncrypted:
+			encrypted[evt.ID] = true
+		case event.EventRedaction:
+			if target := redactedEventID(evt); target != "" {
+				redacted[target] = true
+			}
+		}
+	}
+	for _, evt := range events {
+		msg := messages[evt.ID]
+		if msg == nil || redacted[evt.ID] || evt.Unsigned.RedactedBecause != nil {
+			continue
+		}
+		original := msg.RelatesTo.GetReplaceID()
+		if original == "" {
+			continue
+		}
+		// Only the sender of a message can edit it. Timeline events are in order, so the last edit wins
+		if sender, ok := senders[original]; !ok || sender == evt.Sender {
+			latestEdit[original] = evt
+		}
+	}
+
+	result := make([]timelineMessage, 0, len(messages))
+	for _, evt := range events {
+		if evt.Type == event.EventRedaction {
+			target := redactedEventID(evt)
+			if target == "" || messages[target] != nil || encrypted[target] || s.redactionMode != RedactionPlaceholder {
+				continue
+			}
+			// The message was delivered by an earlier fetch: tell the phone it is gone
+			original, err := s.matrixClient.GetEvent(ctx, userID, roomID, target)
+			if err != nil {
+				logger.Ctx(ctx).Debug().Err(err).Str("event_id", string(target)).Msg("cannot fetch redacted event, skipping redaction")
+				continue
+			}
+			if original.Type != event.EventMessage && original.Type != event.EventEncrypted {
+				continue
+			}
+			result = append(result, s.placeholder(evt.ID, original.Sender, evt.Timestamp))
+			continue
+		}
+		if evt.Type == event.EventEncrypted {
+			if redacted[evt.ID] || evt.Unsigned.RedactedBecause != nil {
+				if s.redactionMode == RedactionPlaceholder {
+					result = append(result, s.placeholder(evt.ID, evt.Sender, evt.Timestamp))
+				}
+				continue
+			}
+			result = append(result, timelineMessage{ID: evt.ID, Sender: evt.Sender, Timestamp: evt.Timestamp, ContentType: ContentTypeText, Body: s.undecryptablePlaceholder})
+			continue
+		}
+		if evt.Type == event.EventUnstablePollStart {
+			if redacted[evt.ID] || evt.Unsigned.RedactedBecause != nil {
+				continue
+			}
+			if text, ok := pollText(evt); ok {
+				result = append(result, timelineMessage{ID: evt.ID, Sender: evt.Sender, Timestamp: evt.Timestamp, ContentType: ContentTypeText, Body: text})
+			}
+			continue
+		}
+
+		msg := messages[evt.ID]
+		if msg == nil {
+			continue
+		}
+		if original := msg.RelatesTo.GetReplaceID(); original != "" {
+			// Edits of messages in this batch are folded into them; otherwise only the latest one is delivered
+			if messages[original] != nil || latestEdit[original] != evt || redacted[original] {
+				continue
+			}
+			result = append(result, s.timelineMessage(ctx, evt, editedContent(msg)))
+			continue
+		}
+
+		if redacted[evt.ID] || evt.Unsigned.RedactedBecause != nil {
+			if s.redactionMode == RedactionPlaceholder {
+				result = append(result, s.placeholder(evt.ID, evt.Sender, evt.Timestamp))
+			}
+			continue
+		}
+
+		content := msg
+		if edit := latestEdit[evt.ID]; edit != nil {
+			content = editedContent(messages[edit.ID])
+		}
+		result = append(result, s.timelineMessage(ctx, evt, content))
+	}
+	return result
+}
+
+// timelineMessage returns the message delivered for evt with the given content.
+func (s *MessageService) timelineMessage(ctx context.Context, evt *event.Event, content *event.MessageEventContent) timelineMessage {
+	contentType, body := s.acrobitsContent(ctx, evt.Type, content)
+	return timelineMessage{ID: evt.ID, Sender: evt.Sender, Timestamp: evt.Timestamp, MsgType: content.MsgType, ContentType: contentType, Body: body}
+}
+
+// placeholder returns the message delivered in place of a redacted one.
+func (s *MessageService) placeholder(eventID id.EventID, sender id.UserID, timestamp int64) timelineMessage {
+	return timelineMessage{ID: eventID, Sender: sender, Timestamp: timestamp, ContentType: ContentTypeText, Body: s.redactionPlaceholder}
+}
+
+// messageContent returns the parsed content of a message event, or nil if it cannot be parsed.
+func messageContent(evt *event.Event) *event.MessageEventContent {
+	if evt.Content.Parsed == nil {
+		if err := evt.Content.ParseRaw(event.EventMessage); err != nil {
+			return nil
+		}
+	}
+	msg, _ := evt.Content.Parsed.(*event.MessageEventContent)
+	return msg
+}
+
+// redactedEventID returns the event redacted by evt. Since room version 11 it is part of the content.
+func redactedEventID(evt *event.Event) id.EventID {
+	if evt.Redacts != "" {
+		return evt.Redacts
+	}
+	if target, ok := evt.Content.Raw["redacts"].(string); ok {
+		return id.EventID(target)
+	}
+	return ""
+}
+
+// editedContent returns the content set by an edit: its m.new_content, or the fallback content without the "* " marker.
+func editedContent(edit *event.MessageEventContent) *event.MessageEventContent {
+	if edit.NewContent != nil {
+		return edit.NewContent
+	}
+	content := *edit
+	content.Body = strings.TrimPrefix(content.Body, "* ")
+	content.FormattedBody = strings.TrimPrefix(content.FormattedBody, "* ")
+	content.RelatesTo = nil
+	return &content
+}
+
+// editTarget checks that sender may replace the message replacesID in roomID and returns the event
+// the edit must reference: the original message, even when replacesID is itself an edit.
+func (s *MessageService) editTarget(ctx context.Context, sender id.UserID, roomID id.RoomID, replacesID string) (id.EventID, error) {
+	if !s.allowEdits {
+		return "", fmt.Errorf("%w: edits are disabled", ErrInvalidEdit)
+	}
+	original, err := s.matrixClient.GetEvent(ctx, sender, roomID, id.EventID(replacesID))
+	if err != nil {
+		if errors.Is(err, mautrix.MNotFound) || errors.Is(err, mautrix.MForbidden) {
+			return "", fmt.Errorf("%w: message %s not found", ErrInvalidEdit, replacesID)
+		}
+		return "", fmt.Errorf("fetch edited message: %w", mapAuthErr(err))
+	}
+	if original.Type != event.EventMessage || original.Unsigned.RedactedBecause != nil {
+		return "", fmt.Errorf("%w: %s is not a message", ErrInvalidEdit, replacesID)
+	}
+	if original.Sender != sender {
+		return "", fmt.Errorf("%w: %s was sent by another user", ErrInvalidEdit, replacesID)
+	}
+	if msg := messageContent(original); msg != nil && msg.RelatesTo.GetReplaceID() != "" {
+		return msg.RelatesTo.GetReplaceID(), nil
+	}
+	return original.ID, nil
+}
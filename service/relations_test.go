@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func timelineEvents(t *testing.T, raw string) []*event.Event {
+	t.Helper()
+	var events []*event.Event
+	require.NoError(t, json.Unmarshal([]byte(raw), &events))
+	return events
+}
+
+func bodies(messages []timelineMessage) map[id.EventID]string {
+	out := make(map[id.EventID]string, len(messages))
+	for _, m := range messages {
+		out[m.ID] = m.Body
+	}
+	return out
+}
+
+// eventRoutes returns homeserver routes serving the given events of !room:example.com by ID.
+func eventRoutes(events map[string]string) homeserverRoutes {
+	return homeserverRoutes{
+		"GET /_matrix/client/v3/rooms/{room}/event/{event}": func(w http.ResponseWriter, r *http.Request) {
+			body, ok := events[r.PathValue("event")]
+			if r.PathValue("room") != "!room:example.com" || !ok {
+				writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+				return
+			}
+			w.Write([]byte(body))
+		},
+	}
+}
+
+func TestCollapseTimeline_Edits(t *testing.T) {
+	svc := newMessageService(nil, nil, Config{}.withDefaults(), nil)
+	events := timelineEvents(t, `[
+		{"event_id":"$a","type":"m.room.message","sender":"@alice:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"helo"}},
+		{"event_id":"$a1","type":"m.room.message","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"* hello","m.new_content":{"msgtype":"m.text","body":"hello"},"m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}},
+		{"event_id":"$a2","type":"m.room.message","sender":"@alice:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"* hello!","m.new_content":{"msgtype":"m.text","body":"hello!"},"m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}},
+		{"event_id":"$b1","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":4000,"content":{"msgtype":"m.text","body":"* fixed","m.relates_to":{"rel_type":"m.replace","event_id":"$old"}}},
+		{"event_id":"$b2","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":5000,"content":{"msgtype":"m.text","body":"* fixed again","m.new_content":{"msgtype":"m.text","body":"fixed again"},"m.relates_to":{"rel_type":"m.replace","event_id":"$old"}}},
+		{"event_id":"$c1","type":"m.room.message","sender":"@bob:example.com","origin_server_ts":6000,"content":{"msgtype":"m.text","body":"* hijack","m.new_content":{"msgtype":"m.text","body":"hijack"},"m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}}
+	]`)
+
+	messages := svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", events)
+
+	// Edits by another sender are not applied, and the original keeps its timestamp
+	require.Len(t, messages, 2)
+	assert.Equal(t, timelineMessage{ID: "$a", Sender: "@alice:example.com", Timestamp: 1000, MsgType: event.MsgText, ContentType: ContentTypeText, Body: "hello!"}, messages[0])
+	assert.Equal(t, timelineMessage{ID: "$b2", Sender: "@bob:example.com", Timestamp: 5000, MsgType: event.MsgText, ContentType: ContentTypeText, Body: "fixed again"}, messages[1])
+}
+
+func TestCollapseTimeline_Replies(t *testing.T) {
+	svc := newMessageService(nil, nil, Config{}.withDefaults(), nil)
+	events := timelineEvents(t, `[
+		{"event_id":"$r","type":"m.room.message","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"> <@alice:example.com> are you there?\n> second line\n\nyes","m.relates_to":{"m.in_reply_to":{"event_id":"$q"}}}},
+		{"event_id":"$n","type":"m.room.message","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"> quoted on purpose\n\nno reply"}}
+	]`)
+
+	messages := bodies(svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", events))
+
+	assert.Equal(t, "yes", messages["$r"])
+	assert.Equal(t, "> quoted on purpose\n\nno reply", messages["$n"])
+}
+
+func TestCollapseTimeline_Redactions(t *testing.T) {
+	raw := `[
+		{"event_id":"$a","type":"m.room.message","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"oops"}},
+		{"event_id":"$b","type":"m.room.message","sender":"@alice:example.com","content":{},"unsigned":{"redacted_because":{"event_id":"$x","type":"m.room.redaction","sender":"@alice:example.com","content":{}}}},
+		{"event_id":"$c","type":"m.room.message","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"kept"}},
+		{"event_id":"$ra","type":"m.room.redaction","sender":"@alice:example.com","redacts":"$a","content":{}},
+		{"event_id":"$rold","type":"m.room.redaction","sender":"@bob:example.com","origin_server_ts":7000,"content":{"redacts":"$old"}},
+		{"event_id":"$rstate","type":"m.room.redaction","sender":"@bob:example.com","content":{"redacts":"$topic"}}
+	]`
+
+	t.Run("hide", func(t *testing.T) {
+		svc := newMessageService(nil, nil, Config{}.withDefaults(), nil)
+		messages := svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", timelineEvents(t, raw))
+		assert.Equal(t, map[id.EventID]string{"$c": "kept"}, bodies(messages))
+	})
+
+	t.Run("placeholder", func(t *testing.T) {
+		client, _ := newFakeHomeserver(t, eventRoutes(map[string]string{
+			"$old":   `{"event_id":"$old","type":"m.room.message","sender":"@bob:example.com","content":{}}`,
+			"$topic": `{"event_id":"$topic","type":"m.room.topic","sender":"@bob:example.com","state_key":"","content":{}}`,
+		}))
+		svc := newMessageService(client, nil, Config{RedactionMode: RedactionPlaceholder, RedactionPlaceholder: "deleted"}.withDefaults(), nil)
+
+		messages := svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", timelineEvents(t, raw))
+
+		assert.Equal(t, map[id.EventID]string{"$a": "deleted", "$b": "deleted", "$c": "kept", "$rold": "deleted"}, bodies(messages))
+		// A redaction of an earlier message is attributed to the sender of that message
+		assert.Equal(t, timelineMessage{ID: "$rold", Sender: "@bob:example.com", Timestamp: 7000, ContentType: ContentTypeText, Body: "deleted"}, messages[3])
+	})
+}
+
+func TestCollapseTimeline_Encrypted(t *testing.T) {
+	raw := `[
+		{"event_id":"$e","type":"m.room.encrypted","sender":"@bob:example.com","origin_server_ts":1000,"content":{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgA","session_id":"s","device_id":"D","sender_key":"k"}},
+		{"event_id":"$gone","type":"m.room.encrypted","sender":"@bob:example.com","content":{},"unsigned":{"redacted_because":{"event_id":"$x","type":"m.room.redaction","sender":"@bob:example.com","content":{}}}},
+		{"event_id":"$rold","type":"m.room.redaction","sender":"@bob:example.com","origin_server_ts":3000,"content":{"redacts":"$old"}}
+	]`
+
+	svc := newMessageService(nil, nil, Config{UndecryptablePlaceholder: "locked"}.withDefaults(), nil)
+	messages := svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", timelineEvents(t, raw))
+	require.Len(t, messages, 1)
+	assert.Equal(t, timelineMessage{ID: "$e", Sender: "@bob:example.com", Timestamp: 1000, ContentType: ContentTypeText, Body: "locked"}, messages[0])
+
+	// Redacted encrypted messages follow the redaction mode
+	client, _ := newFakeHomeserver(t, eventRoutes(map[string]string{
+		"$old": `{"event_id":"$old","type":"m.room.encrypted","sender":"@bob:example.com","content":{}}`,
+	}))
+	svc = newMessageService(client, nil, Config{RedactionMode: RedactionPlaceholder}.withDefaults(), nil)
+	messages = svc.collapseTimeline(context.TODO(), "@alice:example.com", "!room:example.com", timelineEvents(t, raw))
+	assert.Equal(t, map[id.EventID]string{"$e": defaultUndecryptablePlaceholder, "$gone": defaultRedactionPlaceholder, "$rold": defaultRedactionPlaceholder}, bodies(messages))
+}
+
+func TestEditTarget(t *testing.T) {
+	client, _ := newFakeHomeserver(t, eventRoutes(map[string]string{
+		"$mine":   `{"event_id":"$mine","type":"m.room.message","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"hi"}}`,
+		"$edit":   `{"event_id":"$edit","type":"m.room.message","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"* hey","m.relates_to":{"rel_type":"m.replace","event_id":"$mine"}}}`,
+		"$theirs": `{"event_id":"$theirs","type":"m.room.message","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"hi"}}`,
+		"$topic":  `{"event_id":"$topic","type":"m.room.topic","sender":"@alice:example.com","state_key":"","content":{"topic":"t"}}`,
+	}))
+	svc := newMessageService(client, nil, Config{AllowEdits: true}.withDefaults(), nil)
+	ctx := context.TODO()
+
+	target, err := svc.editTarget(ctx, "@alice:example.com", "!room:example.com", "$mine")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$mine"), target)
+
+	// Editing an edit replaces the original message
+	target, err = svc.editTarget(ctx, "@alice:example.com", "!room:example.com", "$edit")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$mine"), target)
+
+	for _, eventID := range []string{"$theirs", "$topic", "$missing"} {
+		_, err = svc.editTarget(ctx, "@alice:example.com", "!room:example.com", eventID)
+		assert.ErrorIs(t, err, ErrInvalidEdit, eventID)
+	}
+
+	svc.allowEdits = false
+	_, err = svc.editTarget(ctx, "@alice:example.com", "!room:example.com", "$mine")
+	assert.ErrorIs(t, err, ErrInvalidEdit)
+}
+
+func TestConfigFromEnv_Messages(t *testing.T) {
+	t.Setenv("MESSAGE_REDACTION_MODE", "Placeholder")
+	t.Setenv("MESSAGE_REDACTION_PLACEHOLDER", "removed")
+	t.Setenv("MESSAGE_EDITS_ENABLED", "true")
+	t.Setenv("MESSAGE_MARKDOWN_ENABLED", "true")
+	t.Setenv("MESSAGE_NOTICE_PREFIX", "")
+	t.Setenv("MESSAGE_UNDECRYPTABLE_PLACEHOLDER", "encrypted")
+	t.Setenv("MESSAGE_BACKFILL_LIMIT", "0")
+	t.Setenv("MESSAGE_FETCH_PAGE_SIZE", "20")
+	cfg := ConfigFromEnv("").withDefaults()
+	assert.Equal(t, RedactionPlaceholder, cfg.RedactionMode)
+	assert.Equal(t, "removed", cfg.RedactionPlaceholder)
+	assert.True(t, cfg.AllowEdits)
+	assert.True(t, cfg.Markdown)
+	assert.Empty(t, cfg.NoticePrefix)
+	assert.Equal(t, "encrypted", cfg.UndecryptablePlaceholder)
+	assert.Zero(t, cfg.BackfillLimit)
+	assert.Equal(t, 20, cfg.FetchPageSize)
+
+	t.Setenv("MESSAGE_REDACTION_MODE", "bogus")
+	t.Setenv("MESSAGE_REDACTION_PLACEHOLDER", "")
+	t.Setenv("MESSAGE_EDITS_ENABLED", "")
+	t.Setenv("MESSAGE_MARKDOWN_ENABLED", "")
+	t.Setenv("MESSAGE_UNDECRYPTABLE_PLACEHOLDER", "")
+	t.Setenv("MESSAGE_BACKFILL_LIMIT", "-1")
+	t.Setenv("MESSAGE_FETCH_PAGE_SIZE", "0")
+	os.Unsetenv("MESSAGE_NOTICE_PREFIX")
+	cfg = ConfigFromEnv("").withDefaults()
+	assert.Equal(t, RedactionHide, cfg.RedactionMode)
+	assert.Equal(t, defaultRedactionPlaceholder, cfg.RedactionPlaceholder)
+	assert.False(t, cfg.AllowEdits)
+	assert.False(t, cfg.Markdown)
+	assert.Equal(t, defaultNoticePrefix, cfg.NoticePrefix)
+	assert.Equal(t, defaultUndecryptablePlaceholder, cfg.UndecryptablePlaceholder)
+	assert.Equal(t, defaultBackfillLimit, cfg.BackfillLimit)
+	assert.Equal(t, defaultFetchPageSize, cfg.FetchPageSize)
+}
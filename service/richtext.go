@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+const defaultNoticePrefix = "ℹ️ "
+
+// textParser renders Matrix HTML as plain text: links become "text (url)" unless the text is the URL,
+// mentions become the display name, inline formatting is dropped, and block quotes, lists and
+// line breaks are kept.
+var textParser = &format.HTMLParser{
+	TabsToSpaces:            4,
+	Newline:                 "\n",
+	HorizontalLine:          "\n---\n",
+	PillConverter:           format.DefaultPillConverter,
+	BoldConverter:           plainText,
+	ItalicConverter:         plainText,
+	StrikethroughConverter:  plainText,
+	MonospaceConverter:      plainText,
+	MonospaceBlockConverter: func(code, _ string, _ format.Context) string { return code },
+}
+
+func plainText(s string, _ format.Context) string {
+	return s
+}
+
+// messageText returns the plain text of a message: its HTML formatted_body converted to text when present,
+// its body otherwise, without the reply fallback and with emoji shortcodes replaced, see replaceShortcodes.
+func messageText(ctx context.Context, msg *event.MessageEventContent) string {
+	isReply := msg.RelatesTo.GetReplyTo() != ""
+	var text string
+	if msg.Format == event.FormatHTML && msg.FormattedBody != "" {
+		html := msg.FormattedBody
+		if isReply {
+			html = event.TrimReplyFallbackHTML(html)
+		}
+		text = strings.TrimSpace(textParser.Parse(html, format.NewContext(ctx)))
+	} else {
+		text = msg.Body
+		if isReply {
+			text = event.TrimReplyFallbackText(text)
+		}
+	}
+	return replaceShortcodes(text)
+}
+
+// renderText returns the text shown on the phone for a message of msgType from sender:
+// emotes read as "* sender text" and notices carry the notice prefix.
+func (s *MessageService) renderText(msgType event.MessageType, sender, text string) string {
+	switch msgType {
+	case event.MsgEmote:
+		return "* " + sender + " " + text
+	case event.MsgNotice:
+		return s.noticePrefix + text
+	default:
+		return text
+	}
+}
+
+// textContent builds the content of a text message sent from Acrobits. With Markdown enabled, a body
+// using Markdown syntax also gets an HTML formatted_body; the body is sent as typed.
+func (s *MessageService) textContent(body string) *event.MessageEventContent {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    body,
+	}
+	if s.markdown {
+		rendered := format.RenderMarkdown(body, true, false)
+		if rendered.Format == event.FormatHTML {
+			content.Format = event.FormatHTML
+			content.FormattedBody = rendered.FormattedBody
+		}
+	}
+	return content
+}
+
+var shortcodeRegex = regexp.MustCompile(`:([a-z0-9_+\-]+):`)
+
+// replaceShortcodes replaces the emoji shortcodes known to emojiShortcodes, e.g. ":thumbsup:",
+// with the emoji. Only shortcodes standing alone as words are replaced, so that text such as
+// "1:100:2" or "std::x::y" is kept; unknown shortcodes are left as they are.
+func replaceShortcodes(text string) string {
+	if !strings.Contains(text, ":") {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range shortcodeRegex.FindAllStringSubmatchIndex(text, -1) {
+		emoji, ok := emojiShortcodes[text[m[2]:m[3]]]
+		if !ok || !standsAlone(text[:m[0]], text[m[1]:]) {
+			continue
+		}
+		b.WriteString(text[last:m[0]])
+		b.WriteString(emoji)
+		last = m[1]
+	}
+	if last == 0 {
+		return text
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// standsAlone reports whether a shortcode between before and after is a word of its own,
+// not joined to a letter, a digit or another colon.
+func standsAlone(before, after string) bool {
+	prev, _ := utf8.DecodeLastRuneInString(before)
+	next, _ := utf8.DecodeRuneInString(after)
+	return (before == "" || !wordRune(prev)) && (after == "" || !wordRune(next))
+}
+
+func wordRune(r rune) bool {
+	return r == ':' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// emojiShortcodes holds the most used shortcodes, with the names used by Slack, GitHub and Element.
+var emojiShortcodes = map[string]string{
+	"smile":                        "😄",
+	"smiley":                       "😃",
+	"grinning":                     "😀",
+	"grin":                         "😁",
+	"laughing":                     "😆",
+	"sweat_smile":                  "😅",
+	"joy":                          "😂",
+	"rofl":                         "🤣",
+	"slightly_smiling_face":        "🙂",
+	"upside_down_face":             "🙃",
+	"wink":                         "😉",
+	"blush":                        "😊",
+	"innocent":                     "😇",
+	"heart_eyes":                   "😍",
+	"kissing_heart":                "😘",
+	"yum":                          "😋",
+	"stuck_out_tongue":             "😛",
+	"stuck_out_tongue_winking_eye": "😜",
+	"thinking":                     "🤔",
+	"neutral_face":                 "😐",
+	"expressionless":               "😑",
+	"unamused":                     "😒",
+	"roll_eyes":                    "🙄",
+	"grimacing":                    "😬",
+	"relieved":                     "😌",
+	"pensive":                      "😔",
+	"sleepy":                       "😪",
+	"sleeping":                     "😴",
+	"mask":                         "😷",
+	"sunglasses":                   "😎",
+	"confused":                     "😕",
+	"worried":                      "😟",
+	"open_mouth":                   "😮",
+	"astonished":                   "😲",
+	"flushed":                      "😳",
+	"cry":                          "😢",
+	"sob":                          "😭",
+	"scream":                       "😱",
+	"angry":                        "😠",
+	"rage":                         "😡",
+	"thumbsup":                     "👍",
+	"+1":                           "👍",
+	"thumbsdown":                   "👎",
+	"-1":                           "👎",
+	"ok_hand":                      "👌",
+	"wave":                         "👋",
+	"clap":                         "👏",
+	"pray":                         "🙏",
+	"raised_hands":                 "🙌",
+	"muscle":                       "💪",
+	"point_up":                     "☝️",
+	"v":                            "✌️",
+	"crossed_fingers":              "🤞",
+	"heart":                        "❤️",
+	"broken_heart":                 "💔",
+	"fire":                         "🔥",
+	"star":                         "⭐",
+	"sparkles":                     "✨",
+	"tada":                         "🎉",
+	"100":                          "💯",
+	"eyes":                         "👀",
+	"white_check_mark":             "✅",
+	"heavy_check_mark":             "✔️",
+	"x":                            "❌",
+	"warning":                      "⚠️",
+	"question":                     "❓",
+	"exclamation":                  "❗",
+	"phone":                        "☎️",
+	"telephone_receiver":           "📞",
+	"iphone":                       "📱",
+	"email":                        "📧",
+	"calendar":                     "📆",
+	"clock":                        "🕐",
+	"coffee":                       "☕",
+	"beer":                         "🍺",
+	"pizza":                        "🍕",
+	"cake":                         "🍰",
+	"gift":                         "🎁",
+	"rocket":                       "🚀",
+	"bulb":                         "💡",
+	"memo":                         "📝",
+	"lock":                         "🔒",
+	"sunny":                        "☀️",
+	"umbrella":                     "☔",
+	"zap":                          "⚡",
+	"see_no_evil":                  "🙈",
+	"shrug":                        "🤷",
+	"facepalm":                     "🤦",
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestMessageText(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  event.MessageEventContent
+		want string
+	}{
+		{
+			name: "plain body",
+			msg:  event.MessageEventContent{MsgType: event.MsgText, Body: "hello :wave:"},
+			want: "hello 👋",
+		},
+		{
+			name: "html with links",
+			msg: event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "see docs",
+				Format:        event.FormatHTML,
+				FormattedBody: `<p>see <a href="https://example.com/docs">the docs</a> or <a href="https://example.com">https://example.com</a></p>`,
+			},
+			want: "see the docs (https://example.com/docs) or https://example.com",
+		},
+		{
+			name: "html formatting and mentions",
+			msg: event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "Alice: **done**",
+				Format:        event.FormatHTML,
+				FormattedBody: `<a href="https://matrix.to/#/@alice:example.com">Alice</a>: <strong>done</strong><br><em>next</em><ul><li>one</li><li>two</li></ul>`,
+			},
+			want: "Alice: done\nnext\n* one\n* two",
+		},
+		{
+			name: "html reply fallback",
+			msg: event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "> <@alice:example.com> ping\n\npong",
+				Format:        event.FormatHTML,
+				FormattedBody: `<mx-reply><blockquote>In reply to <a href="https://matrix.to/#/@alice:example.com">Alice</a><br>ping</blockquote></mx-reply>pong`,
+				RelatesTo:     &event.RelatesTo{InReplyTo: &event.InReplyTo{EventID: "$q"}},
+			},
+			want: "pong",
+		},
+		{
+			name: "unknown shortcode",
+			msg:  event.MessageEventContent{MsgType: event.MsgText, Body: "meet at 10:30, :nope:"},
+			want: "meet at 10:30, :nope:",
+		},
+		{
+			name: "shortcodes standing alone",
+			msg:  event.MessageEventContent{MsgType: event.MsgText, Body: ":+1: (:smile:), great!:x:"},
+			want: "👍 (😄), great!❌",
+		},
+		{
+			name: "shortcodes within words",
+			msg:  event.MessageEventContent{MsgType: event.MsgText, Body: "use std::x::y, scale 1:100:2, a:smile:"},
+			want: "use std::x::y, scale 1:100:2, a:smile:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, messageText(context.TODO(), &tt.msg))
+		})
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	svc := newMessageService(nil, nil, Config{NoticePrefix: "[bot] "}.withDefaults(), nil)
+	assert.Equal(t, "* 202 waves", svc.renderText(event.MsgEmote, "202", "waves"))
+	assert.Equal(t, "[bot] build passed", svc.renderText(event.MsgNotice, "202", "build passed"))
+	assert.Equal(t, "hi", svc.renderText(event.MsgText, "202", "hi"))
+}
+
+func TestTextContent(t *testing.T) {
+	svc := newMessageService(nil, nil, Config{}.withDefaults(), nil)
+	content := svc.textContent("**see** you :smile:")
+	assert.Equal(t, event.MsgText, content.MsgType)
+	assert.Equal(t, "**see** you :smile:", content.Body, "the body is sent as typed")
+	assert.Empty(t, content.FormattedBody)
+
+	svc.markdown = true
+	content = svc.textContent("**see** you [there](https://example.com)")
+	assert.Equal(t, "**see** you [there](https://example.com)", content.Body)
+	assert.Equal(t, event.FormatHTML, content.Format)
+	assert.Equal(t, `<strong>see</strong> you <a href="https://example.com">there</a>`, content.FormattedBody)
+
+	// Plain text does not get a formatted body
+	content = svc.textContent("just text")
+	assert.Empty(t, content.Format)
+	assert.Empty(t, content.FormattedBody)
+}
@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// InviteSendersLocal allows invites from the users of the homeserver, see Config.InviteAllowedSenders.
+const InviteSendersLocal = "local"
+
+// parseInviteSenders splits the comma-separated list of allowed invite senders.
+func parseInviteSenders(list string) []string {
+	var senders []string
+	for _, sender := range strings.Split(list, ",") {
+		if sender = strings.ToLower(strings.TrimSpace(sender)); sender != "" {
+			senders = append(senders, sender)
+		}
+	}
+	return senders
+}
+
+// inviteAllowed reports whether invites sent by sender are accepted automatically.
+func (s *MessageService) inviteAllowed(sender id.UserID) bool {
+	user := strings.ToLower(string(sender))
+	_, server, _ := strings.Cut(user, ":")
+	for _, allowed := range s.inviteSenders {
+		switch {
+		case allowed == "*":
+			return true
+		case allowed == InviteSendersLocal:
+			if server != "" && server == strings.ToLower(s.homeserverHost) {
+				return true
+			}
+		case strings.HasPrefix(allowed, "@"):
+			if user == allowed {
+				return true
+			}
+		case server == allowed:
+			return true
+		}
+	}
+	return false
+}
+
+// acceptInvites joins userID to the rooms it was invited to by allowed senders, so their messages
+// are delivered by the next fetches. Other invites are left pending.
+func (s *MessageService) acceptInvites(ctx context.Context, userID id.UserID, invites map[id.RoomID]*mautrix.SyncInvitedRoom) {
+	for roomID, room := range invites {
+		inviter := inviterOf(userID, room)
+		if inviter == "" || !s.inviteAllowed(inviter) {
+			logger.Ctx(ctx).Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("inviter", string(inviter)).Msg("invite not accepted automatically")
+			continue
+		}
+		if _, err := s.matrixClient.JoinRoom(ctx, userID, roomID); err != nil {
+			logger.Ctx(ctx).Warn().Err(err).Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("inviter", string(inviter)).Msg("failed to accept invite")
+			continue
+		}
+		logger.Ctx(ctx).Info().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("inviter", string(inviter)).Msg("invite accepted")
+	}
+}
+
+// inviterOf returns the sender of the invite of userID, found in the stripped state of the room.
+func inviterOf(userID id.UserID, room *mautrix.SyncInvitedRoom) id.UserID {
+	for _, evt := range room.State.Events {
+		if evt.Type != event.StateMember || evt.GetStateKey() != string(userID) {
+			continue
+		}
+		if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+			continue
+		}
+		if evt.Content.AsMember().Membership == event.MembershipInvite {
+			return evt.Sender
+		}
+	}
+	return ""
+}
+
+// ErrRecipientBlocked is returned when one of the users of a direct room banned the other: the
+// proxy does not get around the ban by creating another room.
+var ErrRecipientBlocked = errors.New("direct room blocked by a ban")
+
+// directRoomCheckTTL is how long a checked direct room is trusted, so that sends make no extra
+// homeserver calls. A send refused by the room, or a membership change or an upgrade pushed by the
+// homeserver, has the room checked again sooner.
+const directRoomCheckTTL = 5 * time.Minute
+
+// checkDirectRoom returns the room to send to, repaired by repairDirectRoom when it was not checked
+// within directRoomCheckTTL.
+func (s *MessageService) checkDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID, key string, roomID id.RoomID) (id.RoomID, error) {
+	if s.directRoomChecked(key, roomID) {
+		return roomID, nil
+	}
+	roomID, err := s.repairDirectRoom(ctx, actingUserID, targetUserID, key, roomID)
+	if err == nil {
+		s.setDirectRoomChecked(key, roomID)
+	}
+	return roomID, err
+}
+
+// directRoomChecked reports whether roomID, the direct room of key, was checked recently.
+func (s *MessageService) directRoomChecked(key string, roomID id.RoomID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.checkedRooms[key]
+	return ok && entry.Value == roomID && !entry.isExpired(s.now())
+}
+
+func (s *MessageService) setDirectRoomChecked(key string, roomID id.RoomID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.checkedRooms == nil {
+		s.checkedRooms = make(map[string]cacheEntry[id.RoomID])
+	}
+	for k, entry := range s.checkedRooms {
+		if entry.isExpired(now) {
+			delete(s.checkedRooms, k)
+		}
+	}
+	s.checkedRooms[key] = cacheEntry[id.RoomID]{Value: roomID, ExpiresAt: now.Add(directRoomCheckTTL)}
+}
+
+// forgetDirectRoomChecks has roomID checked again at the next send.
+func (s *MessageService) forgetDirectRoomChecks(roomID id.RoomID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, entry := range s.checkedRooms {
+		if entry.Value == roomID {
+			delete(s.checkedRooms, k)
+		}
+	}
+}
+
+// repairDirectRoom follows the upgrades of the direct room and makes sure both users are still
+// members. A user who left is invited again; when the room cannot be used anymore, e.g. the sender
+// forgot it and its join rules refuse a rejoin, a new room replaces the old one. A ban is respected:
+// it fails with ErrRecipientBlocked.
+func (s *MessageService) repairDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID, key string, roomID id.RoomID) (id.RoomID, error) {
+	roomID = s.followUpgrades(ctx, actingUserID, targetUserID, key, roomID)
+
+	membership, err := s.matrixClient.Membership(ctx, actingUserID, roomID, actingUserID)
+	if err != nil && !errors.Is(err, mautrix.MForbidden) {
+		// The room is still the best guess: do not block the message on a failed check
+		logger.Ctx(ctx).Warn().Err(err).Str("room_id", string(roomID)).Msg("cannot check direct room membership")
+		return roomID, nil
+	}
+	if membership == event.MembershipBan {
+		logger.Ctx(ctx).Info().Str("acting_user", string(actingUserID)).Str("room_id", string(roomID)).Msg("sender banned from direct room")
+		return "", ErrRecipientBlocked
+	}
+	if membership != event.MembershipJoin {
+		// The sender left or forgot the room: it joins again when the room allows it
+		if _, err := s.matrixClient.JoinRoom(ctx, actingUserID, roomID); err != nil {
+			// A sender who forgot the room cannot see its ban, the counterpart can
+			if banned, _ := s.matrixClient.Membership(ctx, targetUserID, roomID, actingUserID); banned == event.MembershipBan {
+				logger.Ctx(ctx).Info().Str("acting_user", string(actingUserID)).Str("room_id", string(roomID)).Msg("sender banned from direct room")
+				return "", ErrRecipientBlocked
+			}
+			logger.Ctx(ctx).Info().Err(err).Str("acting_user", string(actingUserID)).Str("room_id", string(roomID)).Msg("sender cannot rejoin direct room")
+			return s.replaceDirectRoom(ctx, actingUserID, targetUserID, key, roomID)
+		}
+		logger.Ctx(ctx).Info().Str("acting_user", string(actingUserID)).Str("room_id", string(roomID)).Msg("sender rejoined direct room")
+	}
+
+	membership, err = s.matrixClient.Membership(ctx, actingUserID, roomID, targetUserID)
+	if err != nil {
+		logger.Ctx(ctx).Warn().Err(err).Str("room_id", string(roomID)).Msg("cannot check direct room membership")
+		return roomID, nil
+	}
+	switch membership {
+	case event.MembershipJoin, event.MembershipInvite:
+		return roomID, nil
+	case event.MembershipBan:
+		logger.Ctx(ctx).Info().Str("target_user", string(targetUserID)).Str("room_id", string(roomID)).Msg("counterpart banned from direct room")
+		return "", ErrRecipientBlocked
+	}
+
+	// The counterpart left: invite it again and, when it is one of our users, join it
+	if err := s.matrixClient.InviteUser(ctx, actingUserID, roomID, targetUserID); err != nil {
+		logger.Ctx(ctx).Info().Err(err).Str("target_user", string(targetUserID)).Str("room_id", string(roomID)).Msg("cannot invite counterpart back to direct room")
+		return s.replaceDirectRoom(ctx, actingUserID, targetUserID, key, roomID)
+	}
+	if _, err := s.matrixClient.JoinRoom(ctx, targetUserID, roomID); err != nil {
+		logger.Ctx(ctx).Debug().Err(err).Str("target_user", string(targetUserID)).Str("room_id", string(roomID)).Msg("counterpart invited back, waiting for it to join")
+	} else {
+		logger.Ctx(ctx).Info().Str("target_user", string(targetUserID)).Str("room_id", string(roomID)).Msg("counterpart rejoined direct room")
+	}
+	return roomID, nil
+}
+
+// replaceDirectRoom creates a new direct room for the two users and moves the alias to it.
+// The sender leaves the old room, which is not used anymore.
+func (s *MessageService) replaceDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID, key string, oldRoomID id.RoomID) (id.RoomID, error) {
+	logger.Ctx(ctx).Info().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Str("room_id", string(oldRoomID)).Msg("replacing direct room")
+
+	// The alias belongs to whoever created the room, which is one of the two users
+	err := s.matrixClient.DeleteRoomAlias(ctx, actingUserID, key)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		err = s.matrixClient.DeleteRoomAlias(ctx, targetUserID, key)
+	}
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		logger.Ctx(ctx).Error().Err(err).Str("alias", key).Str("room_id", string(oldRoomID)).Msg("cannot move direct room alias")
+		return "", fmt.Errorf("replace direct room: %w", err)
+	}
+
+	roomID, err := s.createDirectRoom(ctx, actingUserID, targetUserID, key)
+	if err != nil {
+		return "", err
+	}
+	if err := s.matrixClient.LeaveRoom(ctx, actingUserID, oldRoomID); err != nil {
+		logger.Ctx(ctx).Debug().Err(err).Str("room_id", string(oldRoomID)).Msg("cannot leave replaced direct room")
+	}
+	return roomID, nil
+}
+
+// maxRoomUpgrades bounds the tombstones followed from a room, in case they form a loop.
+const maxRoomUpgrades = 10
+
+// followUpgrades returns the latest version of a direct room. When the room was upgraded, the alias
+// moves to the replacement room, both users join it and the caches are updated.
+func (s *MessageService) followUpgrades(ctx context.Context, actingUserID, targetUserID id.UserID, key string, roomID id.RoomID) id.RoomID {
+	current := roomID
+	for range maxRoomUpgrades {
+		replacement, err := s.matrixClient.Tombstone(ctx, actingUserID, current)
+		if err != nil {
+			logger.Ctx(ctx).Debug().Err(err).Str("room_id", string(current)).Msg("cannot check room tombstone")
+			break
+		}
+		if replacement == "" || replacement == current {
+			break
+		}
+		current = replacement
+	}
+	if current != roomID {
+		s.moveDirectRoom(ctx, actingUserID, targetUserID, key, roomID, current)
+	}
+	return current
+}
+
+// moveDirectRoom makes roomID, which replaced oldRoomID, the direct room of the two users.
+func (s *MessageService) moveDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID, key string, oldRoomID, roomID id.RoomID) {
+	logger.Ctx(ctx).Info().Str("alias", key).Str("old_room_id", string(oldRoomID)).Str("room_id", string(roomID)).Msg("following direct room upgrade")
+
+	for _, userID := range []id.UserID{actingUserID, targetUserID} {
+		if _, err := s.matrixClient.JoinRoom(ctx, userID, roomID); err != nil {
+			logger.Ctx(ctx).Info().Err(err).Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("cannot join upgraded direct room")
+		}
+	}
+
+	// Synapse moves the local aliases on upgrade; other homeservers may leave them on the old room
+	if s.matrixClient.ResolveRoomAlias(ctx, key) != string(roomID) {
+		err := s.matrixClient.DeleteRoomAlias(ctx, actingUserID, key)
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			err = s.matrixClient.DeleteRoomAlias(ctx, targetUserID, key)
+		}
+		if err == nil || errors.Is(err, mautrix.MNotFound) {
+			err = s.matrixClient.CreateRoomAlias(ctx, actingUserID, key, roomID)
+		}
+		if err != nil {
+			logger.Ctx(ctx).Warn().Err(err).Str("alias", key).Str("room_id", string(roomID)).Msg("cannot move direct room alias to upgraded room")
+		}
+	}
+
+	s.roomAliasCache.Set(key, string(roomID))
+	s.roomAliasesCache.Delete(string(oldRoomID))
+	s.roomAliasesCache.Delete(string(roomID))
+	s.forgetDirectRoomChecks(oldRoomID)
+}
+
+// recentAppServiceTxns is how many application service transaction IDs are remembered. The
+// homeserver sends transactions in order and repeats one until it is acknowledged, so the last
+// IDs are enough to recognize a transaction sent again.
+const recentAppServiceTxns = 64
+
+// HandleAppServiceTransaction processes the events of the application service transaction txnID,
+// unless it was already processed.
+func (s *MessageService) HandleAppServiceTransaction(ctx context.Context, txnID string, events []*event.Event) {
+	if !s.firstAppServiceTxn(txnID) {
+		logger.Ctx(ctx).Debug().Str("txn_id", txnID).Msg("application service transaction already processed")
+		return
+	}
+	s.HandleAppServiceEvents(ctx, events)
+}
+
+// firstAppServiceTxn records txnID and reports whether it is not one of the recent transactions.
+func (s *MessageService) firstAppServiceTxn(txnID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.appServiceTxns, txnID) {
+		return false
+	}
+	if len(s.appServiceTxns) >= recentAppServiceTxns {
+		s.appServiceTxns = s.appServiceTxns[1:]
+	}
+	s.appServiceTxns = append(s.appServiceTxns, txnID)
+	return true
+}
+
+// HandleAppServiceEvents processes the events pushed by the homeserver in application service
+// transactions. Upgrades of direct rooms are followed right away, so messages are not sent
+// to the old room until the next send notices the tombstone, and rooms a member left are checked
+// again at the next send.
+func (s *MessageService) HandleAppServiceEvents(ctx context.Context, events []*event.Event) {
+	for _, evt := range events {
+		if evt.Type != event.StateTombstone && evt.Type != event.StateMember || evt.StateKey == nil {
+			continue
+		}
+		if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+			continue
+		}
+		if evt.Type == event.StateMember {
+			if membership := evt.Content.AsMember().Membership; membership != event.MembershipJoin && membership != event.MembershipInvite {
+				s.forgetDirectRoomChecks(evt.RoomID)
+			}
+			continue
+		}
+		if evt.GetStateKey() != "" {
+			continue
+		}
+		replacement := evt.Content.AsTombstone().ReplacementRoom
+		if replacement == "" {
+			continue
+		}
+		logger.Ctx(ctx).Info().Str("room_id", string(evt.RoomID)).Str("replacement_room", string(replacement)).Msg("room upgraded")
+		s.roomAliasesCache.Delete(string(evt.RoomID))
+
+		// The alias of a direct room names its users; it may already have moved to the replacement room.
+		// The tombstone is not trusted as is: followUpgrades reads it again from the homeserver.
+		for _, roomID := range []id.RoomID{evt.RoomID, replacement} {
+			for _, alias := range s.matrixClient.GetRoomAliases(ctx, roomID) {
+				key, userA, userB, ok := directRoomUsers(alias)
+				if !ok {
+					continue
+				}
+				s.followUpgrades(ctx, userA, userB, key, evt.RoomID)
+			}
+		}
+	}
+}
+
+// directRoomUsers returns the alias key and the users of a direct room alias, e.g. "#alice|bob:example.com".
+func directRoomUsers(alias string) (string, id.UserID, id.UserID, bool) {
+	localpart, server, ok := strings.Cut(strings.TrimPrefix(alias, "#"), ":")
+	if !ok {
+		return "", "", "", false
+	}
+	a, b, ok := strings.Cut(localpart, "|")
+	if !ok || a == "" || b == "" {
+		return "", "", "", false
+	}
+	userA, userB := id.UserID("@"+a+":"+server), id.UserID("@"+b+":"+server)
+	return generateRoomAliasKey(userA, userB), userA, userB, true
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// roomsHomeserver answers membership lookups from members, tombstone lookups from tombstones and
+// alias lookups from aliases. Invites are accepted, and messages from the members who joined the
+// room.
+type roomsHomeserver struct {
+	*fakeHomeserver
+	members    map[string]string // "<room>|<user>" -> membership
+	tombstones map[string]string // room -> replacement room
+	aliases    map[string]string // alias localpart, e.g. "#alice|bob" -> room
+}
+
+func newRoomsHomeserver(t *testing.T, members map[string]string) (*matrix.MatrixClient, *roomsHomeserver) {
+	t.Helper()
+	h := &roomsHomeserver{members: members}
+	client, fake := newFakeHomeserver(t, homeserverRoutes{
+		"GET /_matrix/client/v3/rooms/{room}/state/m.room.member/{user}": func(w http.ResponseWriter, r *http.Request) {
+			membership, ok := h.members[r.PathValue("room")+"|"+r.PathValue("user")]
+			if !ok {
+				writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+				return
+			}
+			fmt.Fprintf(w, `{"membership":%q}`, membership)
+		},
+		"GET /_matrix/client/v3/rooms/{room}/state/m.room.tombstone/{key...}": func(w http.ResponseWriter, r *http.Request) {
+			replacement, ok := h.tombstones[r.PathValue("room")]
+			if !ok {
+				writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+				return
+			}
+			fmt.Fprintf(w, `{"body":"upgraded","replacement_room":%q}`, replacement)
+		},
+		"GET /_matrix/client/v3/directory/room/{alias}": func(w http.ResponseWriter, r *http.Request) {
+			localpart, _, _ := strings.Cut(r.PathValue("alias"), ":")
+			room, ok := h.aliases[localpart]
+			if !ok {
+				writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+				return
+			}
+			fmt.Fprintf(w, `{"room_id":%q}`, room)
+		},
+		"GET /_matrix/client/v3/rooms/{room}/aliases": func(w http.ResponseWriter, r *http.Request) {
+			aliases := []string{}
+			for localpart, room := range h.aliases {
+				if room == r.PathValue("room") {
+					aliases = append(aliases, `"`+localpart+`:example.com"`)
+				}
+			}
+			w.Write([]byte(`{"aliases":[` + strings.Join(aliases, ",") + `]}`))
+		},
+		"POST /_matrix/client/v3/createRoom": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"room_id":"!new:example.com"}`))
+		},
+		"POST /_matrix/client/v3/join/{room}": func(w http.ResponseWriter, r *http.Request) {
+			room, user := r.PathValue("room"), r.URL.Query().Get("user_id")
+			if membership := h.members[room+"|"+user]; membership != "invite" && membership != "join" && !h.replacement(room) {
+				writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN")
+				return
+			}
+			if h.members != nil {
+				h.members[room+"|"+user] = "join"
+			}
+			fmt.Fprintf(w, `{"room_id":%q}`, room)
+		},
+		"PUT /_matrix/client/v3/rooms/{room}/send/{type}/{txn}": func(w http.ResponseWriter, r *http.Request) {
+			if h.members[r.PathValue("room")+"|"+r.URL.Query().Get("user_id")] != "join" {
+				writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN")
+				return
+			}
+			w.Write([]byte(`{"event_id":"$sent"}`))
+		},
+		"/": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{}`))
+		},
+	})
+	h.fakeHomeserver = fake
+	return client, h
+}
+
+// replacement reports whether room replaced an upgraded room, which its former members may join.
+func (h *roomsHomeserver) replacement(room string) bool {
+	for _, replacement := range h.tombstones {
+		if replacement == room {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInviteAllowed(t *testing.T) {
+	svc := newMessageService(nil, nil, Config{HomeserverURL: "https://example.com", InviteAllowedSenders: "local, @bot:other.org, partner.org"}.withDefaults(), nil)
+	assert.True(t, svc.inviteAllowed("@alice:example.com"))
+	assert.True(t, svc.inviteAllowed("@Bot:other.org"))
+	assert.True(t, svc.inviteAllowed("@anyone:partner.org"))
+	assert.False(t, svc.inviteAllowed("@spam:other.org"))
+
+	svc = newMessageService(nil, nil, Config{HomeserverURL: "https://example.com"}.withDefaults(), nil)
+	assert.False(t, svc.inviteAllowed("@alice:example.com"))
+
+	svc = newMessageService(nil, nil, Config{InviteAllowedSenders: "*"}.withDefaults(), nil)
+	assert.True(t, svc.inviteAllowed("@spam:other.org"))
+}
+
+func TestAcceptInvites(t *testing.T) {
+	client, h := newRoomsHomeserver(t, map[string]string{
+		"!dm:example.com|@alice:example.com": "invite",
+		"!spam:other.org|@alice:example.com": "invite",
+	})
+	svc := newMessageService(client, nil, Config{HomeserverURL: "https://example.com", InviteAllowedSenders: InviteSendersLocal}.withDefaults(), nil)
+
+	invites := map[id.RoomID]*mautrix.SyncInvitedRoom{
+		"!dm:example.com": {State: mautrix.SyncEventsList{Events: timelineEvents(t, `[{"type":"m.room.member","state_key":"@alice:example.com","sender":"@bob:example.com","content":{"membership":"invite","is_direct":true}}]`)}},
+		"!spam:other.org": {State: mautrix.SyncEventsList{Events: timelineEvents(t, `[{"type":"m.room.member","state_key":"@alice:example.com","sender":"@spam:other.org","content":{"membership":"invite"}}]`)}},
+	}
+	svc.acceptInvites(context.TODO(), "@alice:example.com", invites)
+
+	assert.Equal(t, []string{"POST /join/!dm:example.com as @alice:example.com"}, h.calls())
+}
+
+func TestCheckDirectRoom(t *testing.T) {
+	ctx := context.TODO()
+	const alice, bob = id.UserID("@alice:example.com"), id.UserID("@bob:example.com")
+
+	t.Run("both joined", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@alice:example.com": "join", "!dm:example.com|@bob:example.com": "join"})
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		roomID, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, id.RoomID("!dm:example.com"), roomID)
+		assert.Empty(t, h.calls())
+	})
+
+	t.Run("counterpart left", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@alice:example.com": "join", "!dm:example.com|@bob:example.com": "leave"})
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		roomID, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, id.RoomID("!dm:example.com"), roomID)
+		assert.Equal(t, []string{
+			"POST /rooms/!dm:example.com/invite as @alice:example.com",
+			// The test homeserver does not record the invite, so the join is refused: the invite stays pending
+			"POST /join/!dm:example.com as @bob:example.com",
+		}, h.calls())
+	})
+
+	t.Run("counterpart banned", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@alice:example.com": "join", "!dm:example.com|@bob:example.com": "ban"})
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		svc.roomAliasCache.Set("alice|bob", "!dm:example.com")
+		_, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		assert.ErrorIs(t, err, ErrRecipientBlocked)
+		assert.Empty(t, h.calls(), "no room replaces the one with the ban")
+		assert.Equal(t, "!dm:example.com", svc.roomAliasCache.Get("alice|bob"))
+	})
+
+	t.Run("sender banned", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@alice:example.com": "ban", "!dm:example.com|@bob:example.com": "join"})
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		_, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		assert.ErrorIs(t, err, ErrRecipientBlocked)
+		assert.Empty(t, h.calls())
+	})
+
+	t.Run("checked recently", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@alice:example.com": "join", "!dm:example.com|@bob:example.com": "join"})
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		_, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		require.NoError(t, err)
+		lookups := h.lookups()
+
+		roomID, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, id.RoomID("!dm:example.com"), roomID)
+		assert.Equal(t, lookups, h.lookups(), "no homeserver call within the TTL")
+
+		// A member leaving, pushed by the homeserver, has the room checked again
+		svc.HandleAppServiceEvents(ctx, timelineEvents(t, `[{"type":"m.room.member","state_key":"@bob:example.com","room_id":"!dm:example.com","sender":"@bob:example.com","content":{"membership":"leave"}}]`))
+		_, err = svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		require.NoError(t, err)
+		assert.Greater(t, h.lookups(), lookups)
+	})
+
+	t.Run("sender forgot the room", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@bob:example.com": "join", "!new:example.com|@bob:example.com": "invite"})
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		roomID, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!dm:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, id.RoomID("!new:example.com"), roomID)
+		assert.Equal(t, "POST /join/!dm:example.com as @alice:example.com", h.calls()[0])
+	})
+}
+
+func TestDeliverMessage_DirectRoomRefused(t *testing.T) {
+	const alice, bob = id.UserID("@alice:example.com"), id.UserID("@bob:example.com")
+	// Alice left the room after it was last checked
+	client, h := newRoomsHomeserver(t, map[string]string{"!dm:example.com|@alice:example.com": "invite", "!dm:example.com|@bob:example.com": "join"})
+	svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+	svc.roomAliasCache.Set("alice|bob", "!dm:example.com")
+	svc.setDirectRoomChecked("alice|bob", "!dm:example.com")
+
+	eventID, err := svc.deliverMessage(context.TODO(), alice, string(bob), &models.SendMessageRequest{Body: "hi"}, "txn1")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$sent"), eventID)
+	assert.Equal(t, []string{
+		"PUT /rooms/!dm:example.com/send/m.room.message/txn1 as @alice:example.com",
+		"POST /join/!dm:example.com as @alice:example.com",
+		"PUT /rooms/!dm:example.com/send/m.room.message/txn1 as @alice:example.com",
+	}, h.calls(), "the room is repaired before sending again")
+}
+
+func TestFollowUpgrades(t *testing.T) {
+	ctx := context.TODO()
+	const alice, bob = id.UserID("@alice:example.com"), id.UserID("@bob:example.com")
+
+	t.Run("alias left on the old room", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!v3:example.com|@alice:example.com": "join", "!v3:example.com|@bob:example.com": "join"})
+		h.tombstones = map[string]string{"!v1:example.com": "!v2:example.com", "!v2:example.com": "!v3:example.com"}
+		h.aliases = map[string]string{"#alice|bob": "!v1:example.com"}
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+		svc.roomAliasesCache.Set("!v1:example.com", []string{"#alice|bob:example.com"})
+
+		roomID, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!v1:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, id.RoomID("!v3:example.com"), roomID)
+		require.Len(t, h.calls(), 4)
+		assert.Equal(t, []string{
+			"POST /join/!v3:example.com as @alice:example.com",
+			"POST /join/!v3:example.com as @bob:example.com",
+		}, h.calls()[:2])
+		assert.True(t, strings.HasPrefix(h.calls()[2], "DELETE /directory/room/#alice|bob:"), h.calls()[2])
+		assert.True(t, strings.HasPrefix(h.calls()[3], "PUT /directory/room/#alice|bob:"), h.calls()[3])
+		assert.Equal(t, "!v3:example.com", svc.roomAliasCache.Get("alice|bob"))
+		assert.Nil(t, svc.roomAliasesCache.Get("!v1:example.com"))
+	})
+
+	t.Run("alias moved by the homeserver", func(t *testing.T) {
+		client, h := newRoomsHomeserver(t, map[string]string{"!v2:example.com|@alice:example.com": "join", "!v2:example.com|@bob:example.com": "join"})
+		h.tombstones = map[string]string{"!v1:example.com": "!v2:example.com"}
+		h.aliases = map[string]string{"#alice|bob": "!v2:example.com"}
+		svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+
+		roomID, err := svc.checkDirectRoom(ctx, alice, bob, "alice|bob", "!v1:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, id.RoomID("!v2:example.com"), roomID)
+		assert.Equal(t, []string{
+			"POST /join/!v2:example.com as @alice:example.com",
+			"POST /join/!v2:example.com as @bob:example.com",
+		}, h.calls())
+	})
+}
+
+func TestHandleAppServiceEvents(t *testing.T) {
+	client, h := newRoomsHomeserver(t, nil)
+	h.tombstones = map[string]string{"!v1:example.com": "!v2:example.com"}
+	h.aliases = map[string]string{"#alice|bob": "!v2:example.com"}
+	svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+	svc.roomAliasCache.Set("alice|bob", "!v1:example.com")
+
+	events := timelineEvents(t, `[
+		{"type":"m.room.message","room_id":"!other:example.com","sender":"@carol:example.com","content":{"msgtype":"m.text","body":"hi"}},
+		{"type":"m.room.tombstone","state_key":"","room_id":"!v1:example.com","sender":"@alice:example.com","content":{"body":"upgraded","replacement_room":"!v2:example.com"}}
+	]`)
+	svc.HandleAppServiceEvents(context.TODO(), events)
+
+	assert.Equal(t, []string{
+		"POST /join/!v2:example.com as @alice:example.com",
+		"POST /join/!v2:example.com as @bob:example.com",
+	}, h.calls())
+	assert.Equal(t, "!v2:example.com", svc.roomAliasCache.Get("alice|bob"))
+}
+
+func TestHandleAppServiceTransaction(t *testing.T) {
+	client, h := newRoomsHomeserver(t, nil)
+	h.tombstones = map[string]string{"!v1:example.com": "!v2:example.com"}
+	h.aliases = map[string]string{"#alice|bob": "!v2:example.com"}
+	svc := newMessageService(client, nil, Config{}.withDefaults(), nil)
+
+	events := timelineEvents(t, `[{"type":"m.room.tombstone","state_key":"","room_id":"!v1:example.com","sender":"@alice:example.com","content":{"body":"upgraded","replacement_room":"!v2:example.com"}}]`)
+	svc.HandleAppServiceTransaction(context.TODO(), "1", events)
+	calls := len(h.calls())
+	require.NotZero(t, calls)
+
+	// A transaction sent again by the homeserver is not processed twice
+	svc.HandleAppServiceTransaction(context.TODO(), "1", events)
+	assert.Len(t, h.calls(), calls)
+
+	for i := range recentAppServiceTxns {
+		svc.HandleAppServiceTransaction(context.TODO(), fmt.Sprintf("other-%d", i), nil)
+	}
+	assert.Len(t, svc.appServiceTxns, recentAppServiceTxns)
+	assert.True(t, svc.firstAppServiceTxn("1"), "old transactions are forgotten")
+}
+
+func TestDirectRoomUsers(t *testing.T) {
+	key, userA, userB, ok := directRoomUsers("#bob|alice:example.com")
+	require.True(t, ok)
+	assert.Equal(t, generateRoomAliasKey("@alice:example.com", "@bob:example.com"), key)
+	assert.Equal(t, id.UserID("@bob:example.com"), userA)
+	assert.Equal(t, id.UserID("@alice:example.com"), userB)
+
+	_, _, _, ok = directRoomUsers("#general:example.com")
+	assert.False(t, ok)
+}
+
+func TestConfigFromEnv_Invites(t *testing.T) {
+	t.Setenv("INVITE_ALLOWED_SENDERS", "")
+	assert.Empty(t, ConfigFromEnv("").InviteAllowedSenders)
+
+	t.Setenv("INVITE_ALLOWED_SENDERS", "*")
+	assert.Equal(t, "*", ConfigFromEnv("").InviteAllowedSenders)
+
+	os.Unsetenv("INVITE_ALLOWED_SENDERS")
+	assert.Empty(t, ConfigFromEnv("").InviteAllowedSenders)
+}
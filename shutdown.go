@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/tenant"
+)
+
+const (
+	defaultShutdownTimeout = 25 * time.Second
+	// stopServerTimeout bounds the stop of the other listeners, which starts once the wait for
+	// in-flight requests is over, possibly with its time used up.
+	stopServerTimeout = 5 * time.Second
+)
+
+// shutdownConfig controls how the server drains on SIGTERM/SIGINT.
+type shutdownConfig struct {
+	// drainDelay is how long readiness fails before the listener stops, so load balancers
+	// notice and stop routing new requests.
+	drainDelay time.Duration
+	// timeout bounds the wait for in-flight requests; connections still open are then closed.
+	timeout time.Duration
+}
+
+// shutdownConfigFromEnv reads SHUTDOWN_DRAIN_DELAY_SECONDS (default 0) and SHUTDOWN_TIMEOUT_SECONDS (default 25).
+func shutdownConfigFromEnv() shutdownConfig {
+	cfg := shutdownConfig{timeout: defaultShutdownTimeout}
+	if v := os.Getenv("SHUTDOWN_DRAIN_DELAY_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.drainDelay = time.Duration(parsed) * time.Second
+		}
+	}
+	if v := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.timeout = time.Duration(parsed) * time.Second
+		}
+	}
+	return cfg
+}
+
+// gracefulShutdown fails readiness, stops accepting connections, waits for in-flight requests
+// up to the configured timeout and then flushes and closes every tenant.
+// stopServer, if not nil, stops the listeners started by server.Configure.
+func gracefulShutdown(e *echo.Echo, stopServer func(context.Context) error, tenants []*tenant.Tenant, cfg shutdownConfig) {
+	for _, t := range tenants {
+		t.Drain()
+	}
+	if cfg.drainDelay > 0 {
+		logger.Info().Dur("delay", cfg.drainDelay).Msg("readiness failing, waiting before closing the listener")
+		time.Sleep(cfg.drainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		logger.Warn().Err(err).Dur("timeout", cfg.timeout).Msg("in-flight requests did not finish in time, closing connections")
+		if err := e.Close(); err != nil {
+			logger.Warn().Err(err).Msg("failed to close server")
+		}
+	}
+	if stopServer != nil {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), stopServerTimeout)
+		if err := stopServer(stopCtx); err != nil {
+			logger.Warn().Err(err).Msg("failed to stop acme challenge listener")
+		}
+		stopCancel()
+	}
+	logger.Info().Msg("server stopped, flushing tenants")
+
+	for _, t := range tenants {
+		if err := t.Close(); err != nil {
+			logger.Error().Err(err).Str("tenant", t.Name).Msg("failed to close tenant")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/health"
+	"github.com/nethesis/matrix2acrobits/service"
+	"github.com/nethesis/matrix2acrobits/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownConfigFromEnv(t *testing.T) {
+	t.Setenv("SHUTDOWN_DRAIN_DELAY_SECONDS", "")
+	t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "")
+	assert.Equal(t, shutdownConfig{timeout: defaultShutdownTimeout}, shutdownConfigFromEnv())
+
+	t.Setenv("SHUTDOWN_DRAIN_DELAY_SECONDS", "5")
+	t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "60")
+	assert.Equal(t, shutdownConfig{drainDelay: 5 * time.Second, timeout: time.Minute}, shutdownConfigFromEnv())
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(filepath.Join(t.TempDir(), "push_tokens.db"))
+	require.NoError(t, err)
+	checker := health.NewChecker(time.Minute, time.Second)
+	tn := &tenant.Tenant{
+		Name:           "default",
+		MessageService: service.NewMessageService(nil, pushTokenDB, ""),
+		PushTokenDB:    pushTokenDB,
+		Health:         checker,
+	}
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	started := make(chan struct{})
+	e.GET("/slow", func(c echo.Context) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return c.String(http.StatusOK, "done")
+	})
+	go e.Start("127.0.0.1:0")
+	require.Eventually(t, func() bool { return e.ListenerAddr() != nil }, 2*time.Second, 10*time.Millisecond)
+
+	type result struct {
+		status int
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + e.ListenerAddr().String() + "/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		done <- result{status: resp.StatusCode}
+	}()
+	<-started
+
+	gracefulShutdown(e, nil, []*tenant.Tenant{tn}, shutdownConfig{timeout: 5 * time.Second})
+
+	// The request in flight completed before the server stopped.
+	res := <-done
+	require.NoError(t, res.err)
+	assert.Equal(t, http.StatusOK, res.status)
+
+	assert.False(t, checker.Report(context.Background()).Ready())
+	assert.Error(t, pushTokenDB.Check(context.Background()), "database must be closed")
+}
+
+func TestGracefulShutdown_Timeout(t *testing.T) {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	e.GET("/stuck", func(c echo.Context) error {
+		close(started)
+		<-release
+		return c.NoContent(http.StatusOK)
+	})
+	go e.Start("127.0.0.1:0")
+	require.Eventually(t, func() bool { return e.ListenerAddr() != nil }, 2*time.Second, 10*time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + e.ListenerAddr().String() + "/stuck")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	// The other listeners are stopped with a context of their own, not the expired one.
+	var stopErr error
+	stopServer := func(ctx context.Context) error {
+		stopErr = ctx.Err()
+		return nil
+	}
+
+	start := time.Now()
+	gracefulShutdown(e, stopServer, nil, shutdownConfig{timeout: 100 * time.Millisecond})
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Error(t, <-done, "the stuck connection is closed after the timeout")
+	assert.NoError(t, stopErr)
+}
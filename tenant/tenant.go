@@ -0,0 +1,312 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/health"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/ratelimit"
+	"github.com/nethesis/matrix2acrobits/service"
+	"maunium.net/go/mautrix/id"
+)
+
+// Config describes a single tenant (one PBX and its homeserver) served by the proxy.
+// Requests are routed to a tenant by Host header (Hosts) or by URL prefix (PathPrefix).
+type Config struct {
+	Name          string   `json:"name"`
+	Hosts         []string `json:"hosts,omitempty"`
+	PathPrefix    string   `json:"path_prefix,omitempty"`
+	HomeserverURL string   `json:"homeserver_url"`
+	AsToken       string   `json:"as_token"`
+	AsUserID      string   `json:"as_user_id"`
+	// HsToken authenticates the application service transactions sent by the homeserver.
+	HsToken         string `json:"hs_token,omitempty"`
+	ProxyURL        string `json:"proxy_url,omitempty"`
+	ExtAuthURL      string `json:"ext_auth_url,omitempty"`
+	ExtAuthTimeoutS int    `json:"ext_auth_timeout_s,omitempty"`
+	CacheTTLSeconds int    `json:"cache_ttl_seconds,omitempty"`
+	PushTokenDBPath string `json:"push_token_db_path,omitempty"`
+	MappingFile     string `json:"mapping_file,omitempty"`
+	// CryptoDBPath stores the encryption keys when E2EE_ENABLED is set.
+	CryptoDBPath string `json:"crypto_db_path,omitempty"`
+	// PushGatewaySources are homeserver IPs or CIDRs allowed to call the push gateway without
+	// a pusher secret; when empty PUSH_GATEWAY_ALLOWED_SOURCES applies.
+	PushGatewaySources []string `json:"push_gateway_sources,omitempty"`
+	// Auth overrides the authentication backend; when nil the AUTH_* environment variables apply.
+	Auth *service.AuthConfig `json:"auth,omitempty"`
+}
+
+// Tenant bundles the services owned by a single tenant.
+// Nothing in a Tenant is shared with other tenants.
+type Tenant struct {
+	Name           string
+	Hosts          []string
+	PathPrefix     string
+	AdminToken     string
+	HsToken        string
+	MatrixClient   *matrix.MatrixClient
+	MessageService *service.MessageService
+	PushService    *service.PushService
+	PushTokenDB    *db.Database
+	// Guard rate limits the client endpoints and locks out brute-force attempts.
+	Guard *ratelimit.Guard
+	// Health checks the tenant's dependencies for the readiness endpoint.
+	Health *health.Checker
+}
+
+// validName matches the tenant names: they appear in the default database paths, in log fields
+// and in metric labels.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LoadConfigs reads a JSON array of tenant configurations from filePath and validates it.
+func LoadConfigs(filePath string) ([]Config, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+
+	if err := ValidateConfigs(configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// ValidateConfigs checks that every tenant is complete and that no two tenants
+// share a name, a host, a path prefix or a database file.
+func ValidateConfigs(configs []Config) error {
+	if len(configs) == 0 {
+		return errors.New("at least one tenant is required")
+	}
+
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	prefixes := make(map[string]string)
+	databases := make(map[string]string)
+	for i := range configs {
+		cfg := &configs[i]
+		cfg.Name = strings.TrimSpace(cfg.Name)
+		cfg.PathPrefix = normalizePrefix(cfg.PathPrefix)
+
+		if cfg.Name == "" {
+			return fmt.Errorf("tenant #%d: name is required", i)
+		}
+		if !validName.MatchString(cfg.Name) {
+			return fmt.Errorf("tenant %q: name may only contain letters, digits, '_' and '-'", cfg.Name)
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("tenant %q: duplicate name", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		if cfg.HomeserverURL == "" {
+			return fmt.Errorf("tenant %q: homeserver_url is required", cfg.Name)
+		}
+		if cfg.AsToken == "" {
+			return fmt.Errorf("tenant %q: as_token is required", cfg.Name)
+		}
+		if cfg.AsUserID == "" {
+			return fmt.Errorf("tenant %q: as_user_id is required", cfg.Name)
+		}
+		// A single tenant may be the catch-all; with several, each one needs a selector.
+		if len(configs) > 1 && len(cfg.Hosts) == 0 && cfg.PathPrefix == "" {
+			return fmt.Errorf("tenant %q: hosts or path_prefix is required when serving multiple tenants", cfg.Name)
+		}
+
+		for _, h := range cfg.Hosts {
+			h = strings.ToLower(strings.TrimSpace(h))
+			key := h + cfg.PathPrefix
+			if other, ok := hosts[key]; ok {
+				return fmt.Errorf("tenant %q: host %q already used by tenant %q", cfg.Name, h, other)
+			}
+			hosts[key] = cfg.Name
+		}
+		if cfg.PathPrefix != "" && len(cfg.Hosts) == 0 {
+			if other, ok := prefixes[cfg.PathPrefix]; ok {
+				return fmt.Errorf("tenant %q: path_prefix %q already used by tenant %q", cfg.Name, cfg.PathPrefix, other)
+			}
+			prefixes[cfg.PathPrefix] = cfg.Name
+		}
+
+		for _, path := range []string{pushTokenDBPath(*cfg), cryptoDBPath(*cfg)} {
+			path = filepath.Clean(path)
+			if other, ok := databases[path]; ok {
+				return fmt.Errorf("tenant %q: database %q already used by tenant %q", cfg.Name, path, other)
+			}
+			databases[path] = cfg.Name
+		}
+	}
+	return nil
+}
+
+// pushTokenDBPath returns the push token database of the tenant, by default in /tmp after its name.
+func pushTokenDBPath(cfg Config) string {
+	if cfg.PushTokenDBPath != "" {
+		return cfg.PushTokenDBPath
+	}
+	return fmt.Sprintf("/tmp/push_tokens_%s.db", cfg.Name)
+}
+
+// cryptoDBPath returns the encryption key database of the tenant, by default in /tmp after its name.
+func cryptoDBPath(cfg Config) string {
+	if cfg.CryptoDBPath != "" {
+		return cfg.CryptoDBPath
+	}
+	return fmt.Sprintf("/tmp/crypto_%s.db", cfg.Name)
+}
+
+// New builds all services for a tenant. Values missing from cfg fall back to
+// the process-wide environment defaults (see service.ConfigFromEnv).
+func New(cfg Config) (*Tenant, error) {
+	matrixClient, err := matrix.NewClient(matrix.Config{
+		HomeserverURL: cfg.HomeserverURL,
+		AsToken:       cfg.AsToken,
+		AsUserID:      id.UserID(cfg.AsUserID),
+		Retry:         matrix.RetryConfigFromEnv(),
+		Tenant:        cfg.Name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tenant %q: failed to initialize matrix client: %w", cfg.Name, err)
+	}
+	if cryptoCfg := matrix.CryptoConfigFromEnv(); cryptoCfg.Enabled {
+		cryptoCfg.DBPath = cryptoDBPath(cfg)
+		if err := matrixClient.EnableCrypto(context.Background(), cryptoCfg); err != nil {
+			return nil, fmt.Errorf("tenant %q: failed to enable encryption: %w", cfg.Name, err)
+		}
+	}
+
+	sourceList := strings.Join(cfg.PushGatewaySources, ",")
+	if sourceList == "" {
+		sourceList = os.Getenv("PUSH_GATEWAY_ALLOWED_SOURCES")
+	}
+	pushSources, err := service.ParseSources(sourceList)
+	if err != nil {
+		matrixClient.Close()
+		return nil, fmt.Errorf("tenant %q: %w", cfg.Name, err)
+	}
+
+	pushTokenDB, err := db.NewDatabase(pushTokenDBPath(cfg))
+	if err != nil {
+		matrixClient.Close()
+		return nil, fmt.Errorf("tenant %q: failed to initialize push token database: %w", cfg.Name, err)
+	}
+
+	proxyURL := cfg.ProxyURL
+	if proxyURL == "" {
+		proxyURL = cfg.HomeserverURL
+	}
+
+	svcCfg := service.ConfigFromEnv(proxyURL)
+	svcCfg.Tenant = cfg.Name
+	svcCfg.HomeserverURL = cfg.HomeserverURL
+	if cfg.ExtAuthURL != "" {
+		svcCfg.ExtAuthURL = cfg.ExtAuthURL
+	}
+	if cfg.ExtAuthTimeoutS > 0 {
+		svcCfg.ExtAuthTimeout = time.Duration(cfg.ExtAuthTimeoutS) * time.Second
+	}
+	if cfg.CacheTTLSeconds > 0 {
+		svcCfg.CacheTTL = time.Duration(cfg.CacheTTLSeconds) * time.Second
+	}
+
+	if cfg.Auth != nil {
+		svcCfg.Auth = *cfg.Auth
+	}
+
+	svc, err := service.NewMessageServiceWithConfig(matrixClient, pushTokenDB, svcCfg)
+	if err != nil {
+		pushTokenDB.Close()
+		matrixClient.Close()
+		return nil, fmt.Errorf("tenant %q: %w", cfg.Name, err)
+	}
+	if cfg.MappingFile != "" {
+		if err := svc.LoadMappingsFromFile(cfg.MappingFile); err != nil {
+			logger.Error().Err(err).Str("tenant", cfg.Name).Str("file", cfg.MappingFile).Msg("failed to load mappings from file")
+		}
+	}
+
+	pushSvc := service.NewPushService(pushTokenDB)
+	pushSvc.SetAllowedSources(pushSources)
+	pushSvc.SetTenant(cfg.Name)
+
+	logger.Info().Str("tenant", cfg.Name).Strs("hosts", cfg.Hosts).Str("path_prefix", cfg.PathPrefix).Str("homeserver", cfg.HomeserverURL).Msg("tenant initialized")
+
+	return &Tenant{
+		Name:           cfg.Name,
+		Hosts:          cfg.Hosts,
+		PathPrefix:     cfg.PathPrefix,
+		AdminToken:     cfg.AsToken,
+		HsToken:        cfg.HsToken,
+		MatrixClient:   matrixClient,
+		MessageService: svc,
+		PushService:    pushSvc,
+		PushTokenDB:    pushTokenDB,
+		Guard:          ratelimit.NewGuardFromEnv(),
+		Health: health.NewCheckerFromEnv(
+			health.Check{Name: "matrix", Critical: true, Run: matrixClient.Whoami},
+			health.Check{Name: "database", Critical: true, Run: pushTokenDB.Check},
+			health.Check{Name: "auth", Critical: true, Run: svc.CheckAuth},
+			// Without PNM pushes are lost, but clients still send and fetch messages.
+			health.Check{Name: "pnm", Critical: false, Run: pushSvc.CheckPNM},
+		),
+	}, nil
+}
+
+// Drain marks the tenant as not ready, ahead of a shutdown.
+func (t *Tenant) Drain() {
+	if t.Health != nil {
+		t.Health.Drain()
+	}
+}
+
+// Close flushes the state kept in memory and releases the resources held by the tenant.
+// The database is closed last, once the services no longer need it.
+func (t *Tenant) Close() error {
+	var errs []error
+	if t.MessageService != nil {
+		if err := t.MessageService.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if t.PushService != nil {
+		t.PushService.Close()
+	}
+	if t.MatrixClient != nil {
+		if err := t.MatrixClient.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if t.PushTokenDB != nil {
+		if err := t.PushTokenDB.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// normalizePrefix ensures a prefix starts with "/" and has no trailing slash.
+func normalizePrefix(prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
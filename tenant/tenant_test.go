@@ -0,0 +1,229 @@
+package tenant
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(name string) Config {
+	return Config{
+		Name:          name,
+		Hosts:         []string{name + ".example.com"},
+		HomeserverURL: "https://matrix." + name + ".example.com",
+		AsToken:       "as-token-" + name,
+		AsUserID:      "@_acrobits_proxy:matrix." + name + ".example.com",
+	}
+}
+
+func TestValidateConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs func() []Config
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			configs: func() []Config { return nil },
+			wantErr: "at least one tenant is required",
+		},
+		{
+			name:    "valid",
+			configs: func() []Config { return []Config{testConfig("a"), testConfig("b")} },
+		},
+		{
+			name: "single tenant without selector",
+			configs: func() []Config {
+				c := testConfig("a")
+				c.Hosts = nil
+				return []Config{c}
+			},
+		},
+		{
+			name: "missing name",
+			configs: func() []Config {
+				c := testConfig("a")
+				c.Name = " "
+				return []Config{c}
+			},
+			wantErr: "name is required",
+		},
+		{
+			name: "invalid name",
+			configs: func() []Config {
+				c := testConfig("a")
+				c.Name = "../acme"
+				return []Config{c}
+			},
+			wantErr: "name may only contain",
+		},
+		{
+			name:    "duplicate name",
+			configs: func() []Config { return []Config{testConfig("a"), testConfig("a")} },
+			wantErr: "duplicate name",
+		},
+		{
+			name: "missing as_token",
+			configs: func() []Config {
+				c := testConfig("a")
+				c.AsToken = ""
+				return []Config{c}
+			},
+			wantErr: "as_token is required",
+		},
+		{
+			name: "duplicate host",
+			configs: func() []Config {
+				b := testConfig("b")
+				b.Hosts = []string{"A.example.com"}
+				return []Config{testConfig("a"), b}
+			},
+			wantErr: "already used by tenant",
+		},
+		{
+			name: "same host with different prefixes",
+			configs: func() []Config {
+				a := testConfig("a")
+				a.Hosts = []string{"shared.example.com"}
+				a.PathPrefix = "/a"
+				b := testConfig("b")
+				b.Hosts = []string{"shared.example.com"}
+				b.PathPrefix = "/b"
+				return []Config{a, b}
+			},
+		},
+		{
+			name: "duplicate prefix",
+			configs: func() []Config {
+				a := testConfig("a")
+				a.Hosts = nil
+				a.PathPrefix = "/t/acme/"
+				b := testConfig("b")
+				b.Hosts = nil
+				b.PathPrefix = "t/acme"
+				return []Config{a, b}
+			},
+			wantErr: "path_prefix",
+		},
+		{
+			name: "duplicate database",
+			configs: func() []Config {
+				a := testConfig("a")
+				a.PushTokenDBPath = "/data/push_tokens.db"
+				b := testConfig("b")
+				b.PushTokenDBPath = "/data//push_tokens.db"
+				return []Config{a, b}
+			},
+			wantErr: "already used by tenant",
+		},
+		{
+			name: "database of another tenant by default",
+			configs: func() []Config {
+				a := testConfig("a")
+				a.CryptoDBPath = "/tmp/push_tokens_b.db"
+				return []Config{a, testConfig("b")}
+			},
+			wantErr: "database",
+		},
+		{
+			name: "push token and crypto database shared",
+			configs: func() []Config {
+				a := testConfig("a")
+				a.PushTokenDBPath = "/data/acme.db"
+				a.CryptoDBPath = "/data/acme.db"
+				return []Config{a}
+			},
+			wantErr: "database",
+		},
+		{
+			name: "multiple tenants without selector",
+			configs: func() []Config {
+				b := testConfig("b")
+				b.Hosts = nil
+				return []Config{testConfig("a"), b}
+			},
+			wantErr: "hosts or path_prefix is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateConfigs(tt.configs())
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tenants.json")
+	content := `[
+		{"name":"acme","path_prefix":"acme/","homeserver_url":"https://matrix.acme.example","as_token":"t1","as_user_id":"@bot:acme.example"},
+		{"name":"globex","hosts":["globex.example"],"homeserver_url":"https://matrix.globex.example","as_token":"t2","as_user_id":"@bot:globex.example","ext_auth_timeout_s":2}
+	]`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	configs, err := LoadConfigs(path)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	assert.Equal(t, "/acme", configs[0].PathPrefix)
+	assert.Equal(t, []string{"globex.example"}, configs[1].Hosts)
+	assert.Equal(t, 2, configs[1].ExtAuthTimeoutS)
+
+	_, err = LoadConfigs(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err = LoadConfigs(path)
+	assert.Error(t, err)
+}
+
+func TestNew_TenantIsolation(t *testing.T) {
+	dir := t.TempDir()
+
+	cfgA := testConfig("a")
+	cfgA.PushTokenDBPath = filepath.Join(dir, "a.db")
+	cfgB := testConfig("b")
+	cfgB.PushTokenDBPath = filepath.Join(dir, "b.db")
+
+	a, err := New(cfgA)
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := New(cfgB)
+	require.NoError(t, err)
+	defer b.Close()
+
+	assert.Equal(t, "as-token-a", a.AdminToken)
+	assert.NotSame(t, a.MatrixClient, b.MatrixClient)
+	assert.NotSame(t, a.MessageService, b.MessageService)
+
+	// Mappings saved in one tenant are not visible from the other.
+	_, err = a.MessageService.SaveMapping(&models.MappingRequest{Number: 201, MatrixID: "@alice:matrix.a.example.com"})
+	require.NoError(t, err)
+
+	resp, err := a.MessageService.LookupMapping("201")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:matrix.a.example.com", resp.MatrixID)
+
+	_, err = b.MessageService.LookupMapping("201")
+	assert.ErrorIs(t, err, service.ErrMappingNotFound)
+
+	// Push tokens are stored in separate partitions.
+	require.NoError(t, a.PushTokenDB.SavePushToken("sel-a", "tok-a", "app", "", ""))
+	tokensB, err := b.PushTokenDB.ListPushTokens()
+	require.NoError(t, err)
+	assert.Empty(t, tokensB)
+	tokensA, err := a.PushTokenDB.ListPushTokens()
+	require.NoError(t, err)
+	assert.Len(t, tokensA, 1)
+}
@@ -0,0 +1,59 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for every request, continuing the trace of the caller
+// when it sends a traceparent header. It must run after the RequestID middleware.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			route := c.Path()
+			if route == "" {
+				route = req.URL.Path
+			}
+			ctx, span := otel.Tracer(instrumentationName).Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(req.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(req.URL.Path),
+					semconv.ClientAddress(c.RealIP()),
+					attribute.String("http.request_id", c.Response().Header().Get(echo.HeaderXRequestID)),
+				),
+			)
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				var he *echo.HTTPError
+				if errors.As(err, &he) {
+					status = he.Code
+				}
+				span.RecordError(err)
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Package tracing configures OpenTelemetry and provides the helpers used to create spans.
+// Unless an OTLP endpoint is configured the global no-op provider is kept, so spans cost
+// next to nothing in tests and in deployments without a collector.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/nethesis/matrix2acrobits"
+	defaultServiceName  = "matrix2acrobits"
+)
+
+// Attribute keys shared by all spans.
+const (
+	AttrUsername    = attribute.Key("acrobits.username")
+	AttrUserID      = attribute.Key("matrix.user_id")
+	AttrRoomID      = attribute.Key("matrix.room_id")
+	AttrEventID     = attribute.Key("matrix.event_id")
+	AttrSelector    = attribute.Key("acrobits.selector")
+	AttrAuthBackend = attribute.Key("auth.backend")
+)
+
+// Enabled reports whether the environment asks for trace export: OTEL_TRACES_EXPORTER=otlp,
+// or an OTLP endpoint set while OTEL_TRACES_EXPORTER is not "none".
+func Enabled() bool {
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "otlp":
+		return true
+	case "none":
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init installs the W3C trace context propagator and, when Enabled, a tracer provider
+// exporting over OTLP/HTTP. The exporter honours the standard OTEL_EXPORTER_OTLP_* variables,
+// the sampler OTEL_TRACES_SAMPLER and the resource OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES.
+// The returned function flushes and stops the provider.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(defaultServiceName)),
+		resource.NewSchemaless(resource.Environment().Attributes()...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetAttributes adds attributes to the span in ctx.
+func SetAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// Transport wraps base (http.DefaultTransport when nil) so outgoing requests get a client span
+// and carry the trace context.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useRecorder installs a tracer provider recording spans in memory for the duration of the test.
+func useRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider := otel.GetTracerProvider()
+	prevPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return recorder
+}
+
+func TestEnabled(t *testing.T) {
+	cases := []struct {
+		name     string
+		exporter string
+		endpoint string
+		want     bool
+	}{
+		{name: "nothing set", want: false},
+		{name: "endpoint set", endpoint: "http://collector:4318", want: true},
+		{name: "exporter otlp", exporter: "otlp", want: true},
+		{name: "exporter none wins over endpoint", exporter: "none", endpoint: "http://collector:4318", want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("OTEL_TRACES_EXPORTER", tc.exporter)
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tc.endpoint)
+			t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+			assert.Equal(t, tc.want, Enabled())
+		})
+	}
+}
+
+func TestInit_DisabledIsNoop(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	shutdown, err := Init(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, shutdown(t.Context()))
+
+	_, span := Start(t.Context(), "noop")
+	assert.False(t, span.SpanContext().IsValid())
+	span.End()
+}
+
+func TestStartEnd(t *testing.T) {
+	recorder := useRecorder(t)
+
+	ctx, parent := Start(t.Context(), "parent", AttrUsername.String("201"))
+	_, child := Start(ctx, "child")
+	SetAttributes(ctx, AttrRoomID.String("!room:example.com"))
+	End(child, errors.New("boom"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+	assert.Contains(t, spans[1].Attributes(), AttrUsername.String("201"))
+	assert.Contains(t, spans[1].Attributes(), AttrRoomID.String("!room:example.com"))
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := useRecorder(t)
+
+	e := echo.New()
+	e.Use(Middleware())
+	var handlerSpan trace.SpanContext
+	e.GET("/api/client/:name", func(c echo.Context) error {
+		handlerSpan = trace.SpanContextFromContext(c.Request().Context())
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return errors.New("boom")
+	})
+
+	t.Run("continues the caller trace", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/client/fetch_messages", nil)
+		req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		spans := recorder.Ended()
+		require.NotEmpty(t, spans)
+		span := spans[len(spans)-1]
+		assert.Equal(t, "GET /api/client/:name", span.Name())
+		assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext().TraceID().String())
+		assert.Equal(t, "b7ad6b7169203331", span.Parent().SpanID().String())
+		assert.Equal(t, span.SpanContext(), handlerSpan)
+	})
+
+	t.Run("marks server errors", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/fail", nil)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := recorder.Ended()
+		span := spans[len(spans)-1]
+		assert.Equal(t, "GET /fail", span.Name())
+		assert.Equal(t, codes.Error, span.Status().Code)
+		assert.Len(t, span.Events(), 1)
+	})
+}